@@ -0,0 +1,382 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/auth"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	// annotation on account key secret recording when the key in it was rotated by driver
+	keyRotationTimeAnnotation = "file.csi.azure.com/key-rotation-time"
+
+	// reason of event emitted on account key secret when the key in it is updated
+	accountKeyUpdatedReason = "AccountKeyUpdated"
+	accountKeyRotatedReason = "AccountKeyRotated"
+)
+
+// storageAccountRef identifies a storage account
+type storageAccountRef struct {
+	subsID        string
+	resourceGroup string
+	accountName   string
+}
+
+// accountKeySecretRef identifies a k8s secret storing account key which is read and written by driver
+type accountKeySecretRef struct {
+	name      string
+	namespace string
+}
+
+// accountKey is an access key of storage account
+type accountKey struct {
+	name  string
+	value string
+}
+
+// accountKeyRegenerator regenerates access key of storage account by key name, e.g. key1, key2
+type accountKeyRegenerator interface {
+	RegenerateKey(ctx context.Context, subsID, resourceGroup, accountName, keyName string) error
+}
+
+// armAccountKeyRegenerator regenerates account key with management API using cluster identity
+type armAccountKeyRegenerator struct {
+	baseURI    string
+	authorizer autorest.Authorizer
+	userAgent  string
+}
+
+func newAccountKeyRegenerator(cloud *azure.Cloud, userAgent string) (accountKeyRegenerator, error) {
+	token, err := auth.GetServicePrincipalToken(&cloud.AzureAuthConfig, &cloud.Environment, cloud.Environment.ServiceManagementEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service principal token: %v", err)
+	}
+	return &armAccountKeyRegenerator{
+		baseURI:    cloud.Environment.ResourceManagerEndpoint,
+		authorizer: autorest.NewBearerAuthorizer(token),
+		userAgent:  userAgent,
+	}, nil
+}
+
+func (r *armAccountKeyRegenerator) RegenerateKey(ctx context.Context, subsID, resourceGroup, accountName, keyName string) error {
+	client := storage.NewAccountsClientWithBaseURI(r.baseURI, subsID)
+	client.Authorizer = r.authorizer
+	if err := client.AddToUserAgent(r.userAgent); err != nil {
+		klog.Warningf("failed to add user agent(%s): %v", r.userAgent, err)
+	}
+	_, err := client.RegenerateKey(ctx, resourceGroup, accountName, storage.AccountRegenerateKeyParameters{KeyName: &keyName})
+	return err
+}
+
+// getAccountKeySecretRef returns storage account and account key secret of pv, false is returned
+// if the account key is not read from a secret written by driver, e.g. nfs volume, nodeStageSecretRef is set
+// or the account key is not stored by CreateVolume
+func (d *Driver) getAccountKeySecretRef(pv *v1.PersistentVolume) (storageAccountRef, accountKeySecretRef, bool) {
+	account, secretRef, writtenByDriver, ok := d.parseAccountKeySecretRef(pv)
+	if !ok || !writtenByDriver {
+		return storageAccountRef{}, accountKeySecretRef{}, false
+	}
+	return account, secretRef, true
+}
+
+// parseAccountKeySecretRef returns storage account and the secret which account key of pv is read from,
+// and whether the secret is written by driver, false is returned if pv does not read account key from secret
+func (d *Driver) parseAccountKeySecretRef(pv *v1.PersistentVolume) (storageAccountRef, accountKeySecretRef, bool, bool) {
+	source := pv.Spec.CSI
+	if source == nil || source.Driver != d.Name {
+		return storageAccountRef{}, accountKeySecretRef{}, false, false
+	}
+	h, err := ParseVolumeHandle(source.VolumeHandle)
+	if err != nil {
+		h = &VolumeHandle{}
+	}
+	writtenByDriver, readFromSecret := true, true
+	var secretName, pvcNamespace string
+	for k, v := range source.VolumeAttributes {
+		switch strings.ToLower(k) {
+		case subscriptionIDField:
+			h.SubscriptionID = v
+		case resourceGroupField:
+			h.ResourceGroup = v
+		case storageAccountField:
+			h.AccountName = v
+		case protocolField:
+			h.Protocol = v
+		case secretNameField:
+			secretName = v
+		case secretNamespaceField:
+			h.SecretNamespace = v
+		case pvcNamespaceKey:
+			pvcNamespace = v
+		case getAccountKeyFromSecretField:
+			if strings.EqualFold(v, trueValue) {
+				// secret is managed by user
+				writtenByDriver = false
+			}
+		case storeAccountKeyField:
+			if strings.EqualFold(v, falseValue) {
+				writtenByDriver = false
+			}
+		case credentialProvidersField:
+			if providers, err := d.parseCredentialProviders(v); err != nil || !containsCredentialProvider(providers, credentialProviderSecret) {
+				readFromSecret = false
+			}
+		}
+	}
+	if h.ResourceGroup == "" {
+		h.ResourceGroup = d.cloud.ResourceGroup
+	}
+	if h.SubscriptionID == "" {
+		h.SubscriptionID = d.cloud.SubscriptionID
+	}
+	account := storageAccountRef{subsID: h.SubscriptionID, resourceGroup: h.ResourceGroup, accountName: h.AccountName}
+	if ref := source.NodeStageSecretRef; ref != nil {
+		return account, accountKeySecretRef{name: ref.Name, namespace: ref.Namespace}, false, true
+	}
+	if !readFromSecret || h.AccountName == "" || h.Protocol == nfs {
+		return storageAccountRef{}, accountKeySecretRef{}, false, false
+	}
+	if secretName == "" {
+		secretName = fmt.Sprintf(secretNameTemplate, h.AccountName)
+	}
+	if h.SecretNamespace == "" {
+		h.SecretNamespace = pvcNamespace
+	}
+	if h.SecretNamespace == "" {
+		h.SecretNamespace = defaultNamespace
+	}
+	return account, accountKeySecretRef{name: secretName, namespace: h.SecretNamespace}, writtenByDriver, true
+}
+
+// listStorageAccountKeys returns valid access keys of storage account with cluster identity
+func (d *Driver) listStorageAccountKeys(ctx context.Context, account storageAccountRef) ([]accountKey, error) {
+	key := d.getSubscriptionThrottleKey(account.subsID)
+	if err := d.subscriptionLimiter.wait(ctx, key); err != nil {
+		return nil, err
+	}
+	result, rerr := d.cloud.StorageAccountClient.ListKeys(ctx, account.subsID, account.resourceGroup, account.accountName)
+	if rerr != nil {
+		return nil, d.subscriptionLimiter.throttledError(key, rerr.Error(), accountOpThrottlingRetryAfter)
+	}
+	var keys []accountKey
+	if result.Keys != nil {
+		for _, k := range *result.Keys {
+			if k.KeyName == nil || k.Value == nil || *k.Value == "" {
+				continue
+			}
+			v := *k.Value
+			// same as the key returned by cloud provider
+			if ind := strings.LastIndex(v, " "); ind >= 0 {
+				v = v[(ind + 1):]
+			}
+			keys = append(keys, accountKey{name: *k.KeyName, value: v})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no valid keys of account(%s)", account.accountName)
+	}
+	return keys, nil
+}
+
+// reconcileAccountKeys updates account key secrets written by driver(labeled with managedByLabel) if the key in secret is not valid any more,
+// the unused key of storage account is regenerated and switched to if rotation is due
+func (d *Driver) reconcileAccountKeys(ctx context.Context, recorder record.EventRecorder, regenerator accountKeyRegenerator, now time.Time) error {
+	kubeClient := d.cloud.KubeClient
+	pvList, err := kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	accountSecrets := map[storageAccountRef][]accountKeySecretRef{}
+	for i := range pvList.Items {
+		account, secretRef, ok := d.getAccountKeySecretRef(&pvList.Items[i])
+		if !ok {
+			continue
+		}
+		found := false
+		for _, ref := range accountSecrets[account] {
+			if ref == secretRef {
+				found = true
+				break
+			}
+		}
+		if !found {
+			accountSecrets[account] = append(accountSecrets[account], secretRef)
+		}
+	}
+	for account, secretRefs := range accountSecrets {
+		if err := d.reconcileAccountKey(ctx, recorder, regenerator, account, secretRefs, now); err != nil {
+			klog.Errorf("failed to reconcile key of account(%s): %v", account.accountName, err)
+		}
+	}
+	return nil
+}
+
+// reconcileAccountKey syncs key of storage account into secrets, regenerator is nil if key rotation is disabled
+func (d *Driver) reconcileAccountKey(ctx context.Context, recorder record.EventRecorder, regenerator accountKeyRegenerator, account storageAccountRef, secretRefs []accountKeySecretRef, now time.Time) error {
+	kubeClient := d.cloud.KubeClient
+	var secrets []*v1.Secret
+	for _, ref := range secretRefs {
+		secret, err := kubeClient.CoreV1().Secrets(ref.namespace).Get(ctx, ref.name, metav1.GetOptions{})
+		if err != nil {
+			// secret is not created, e.g. static pv whose account key is read with cluster identity
+			klog.V(4).Infof("skip syncing key of account(%s) into secret(%s/%s): %v", account.accountName, ref.namespace, ref.name, err)
+			continue
+		}
+		if secret.Labels[managedByLabel] != d.Name {
+			// secret is not created by driver, e.g. created by user with the same name, or created before labels were introduced
+			klog.V(4).Infof("skip syncing key of account(%s) into secret(%s/%s) not managed by %s", account.accountName, ref.namespace, ref.name, d.Name)
+			continue
+		}
+		if name := strings.TrimSpace(string(secret.Data[defaultSecretAccountName])); !strings.EqualFold(name, account.accountName) {
+			klog.Warningf("skip syncing key of account(%s) into secret(%s/%s) storing key of account(%s)", account.accountName, ref.namespace, ref.name, name)
+			continue
+		}
+		secrets = append(secrets, secret)
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	keys, err := d.listStorageAccountKeys(ctx, account)
+	if err != nil {
+		return err
+	}
+	// the key stored in secrets is kept if it's still valid, otherwise the first valid key is used
+	target := keys[0]
+	inUse := map[string]bool{}
+	for _, secret := range secrets {
+		value := strings.TrimSpace(string(secret.Data[defaultSecretAccountKey]))
+		for _, k := range keys {
+			if k.value == value {
+				inUse[k.name] = true
+				target = k
+			}
+		}
+	}
+
+	rotated := false
+	if regenerator != nil && d.accountKeyRotationInterval > 0 && isAccountKeyRotationDue(secrets, d.accountKeyRotationInterval, now) {
+		// regenerate the key not used by secrets, so that existing mounts keep working until next rotation
+		standby := keys[len(keys)-1]
+		for _, k := range keys {
+			if !inUse[k.name] {
+				standby = k
+				break
+			}
+		}
+		klog.V(2).Infof("rotating key of account(%s), regenerate %s", account.accountName, standby.name)
+		if err := regenerator.RegenerateKey(ctx, account.subsID, account.resourceGroup, account.accountName, standby.name); err != nil {
+			return fmt.Errorf("failed to regenerate %s of account(%s): %v", standby.name, account.accountName, err)
+		}
+		if keys, err = d.listStorageAccountKeys(ctx, account); err != nil {
+			return err
+		}
+		target = keys[0]
+		for _, k := range keys {
+			if k.name == standby.name {
+				target = k
+			}
+		}
+		rotated = true
+	}
+
+	for _, secret := range secrets {
+		if !rotated && strings.TrimSpace(string(secret.Data[defaultSecretAccountKey])) == target.value {
+			continue
+		}
+		secret = secret.DeepCopy()
+		secret.Data[defaultSecretAccountKey] = []byte(target.value)
+		reason, message := accountKeyUpdatedReason, fmt.Sprintf("key of account(%s) is updated to %s since the stored key is not valid", account.accountName, target.name)
+		if rotated {
+			if secret.Annotations == nil {
+				secret.Annotations = map[string]string{}
+			}
+			secret.Annotations[keyRotationTimeAnnotation] = now.UTC().Format(time.RFC3339)
+			reason, message = accountKeyRotatedReason, fmt.Sprintf("key of account(%s) is rotated to %s", account.accountName, target.name)
+		}
+		if _, err := kubeClient.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update secret(%s/%s): %v", secret.Namespace, secret.Name, err)
+		}
+		klog.V(2).Infof("secret(%s/%s): %s", secret.Namespace, secret.Name, message)
+		recorder.Event(secret, v1.EventTypeNormal, reason, message)
+	}
+	d.accountCacheMap.Set(account.accountName, target.value)
+	return nil
+}
+
+// isAccountKeyRotationDue returns true if the key in any secret was rotated or created before interval
+func isAccountKeyRotationDue(secrets []*v1.Secret, interval time.Duration, now time.Time) bool {
+	for _, secret := range secrets {
+		rotationTime := secret.CreationTimestamp.Time
+		if v, ok := secret.Annotations[keyRotationTimeAnnotation]; ok {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				klog.Warningf("invalid %s(%s) of secret(%s/%s): %v", keyRotationTimeAnnotation, v, secret.Namespace, secret.Name, err)
+			} else {
+				rotationTime = t
+			}
+		}
+		if !now.Before(rotationTime.Add(interval)) {
+			return true
+		}
+	}
+	return false
+}
+
+// runAccountKeyReconciler syncs account key secrets written by driver periodically until stopCh is closed
+func (d *Driver) runAccountKeyReconciler(interval time.Duration, stopCh <-chan struct{}) {
+	kubeClient := d.cloud.KubeClient
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	defer broadcaster.Shutdown()
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: d.Name})
+
+	var regenerator accountKeyRegenerator
+	if d.accountKeyRotationInterval > 0 {
+		var err error
+		if regenerator, err = newAccountKeyRegenerator(d.cloud, GetUserAgent(d.Name, d.customUserAgent, d.userAgentSuffix)); err != nil {
+			klog.Errorf("account key rotation is disabled: %v", err)
+		}
+	}
+
+	klog.V(2).Infof("starting account key reconciler with interval(%v), rotation interval(%v)", interval, d.accountKeyRotationInterval)
+	wait.Until(func() {
+		if d.cloud.StorageAccountClient == nil {
+			klog.Warningf("skip reconciling account keys since StorageAccountClient is nil")
+			return
+		}
+		if err := d.reconcileAccountKeys(context.Background(), recorder, regenerator, time.Now()); err != nil {
+			klog.Errorf("failed to reconcile account keys: %v", err)
+		}
+	}, interval, stopCh)
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+)
+
+type fakeAccountKeyRegenerator struct {
+	regenerated []string
+	keys        *[]storage.AccountKey
+}
+
+func (r *fakeAccountKeyRegenerator) RegenerateKey(ctx context.Context, subsID, resourceGroup, accountName, keyName string) error {
+	r.regenerated = append(r.regenerated, keyName)
+	for i, k := range *r.keys {
+		if *k.KeyName == keyName {
+			value := *k.Value + "-new"
+			(*r.keys)[i].Value = &value
+		}
+	}
+	return nil
+}
+
+func newAccountKeys(values ...string) *[]storage.AccountKey {
+	names := []string{"key1", "key2"}
+	keys := []storage.AccountKey{}
+	for i := range values {
+		keys = append(keys, storage.AccountKey{KeyName: &names[i], Value: &values[i]})
+	}
+	return &keys
+}
+
+func TestGetAccountKeySecretRef(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud.SubscriptionID = "subs"
+	d.cloud.ResourceGroup = "rg"
+	newPV := func(driver, volumeHandle string, attributes map[string]string, secretRef *v1.SecretReference) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeHandle, VolumeAttributes: attributes, NodeStageSecretRef: secretRef},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		desc            string
+		pv              *v1.PersistentVolume
+		expectedAccount storageAccountRef
+		expectedSecret  accountKeySecretRef
+		expectedOK      bool
+	}{
+		{
+			desc: "pv of other driver",
+			pv:   newPV("other", "rg#account#share", nil, nil),
+		},
+		{
+			desc: "pv with nodeStageSecretRef",
+			pv:   newPV(d.Name, "rg#account#share", nil, &v1.SecretReference{Name: "secret", Namespace: "ns"}),
+		},
+		{
+			desc: "account key from secret managed by user",
+			pv:   newPV(d.Name, "rg#account#share", map[string]string{getAccountKeyFromSecretField: trueValue}, nil),
+		},
+		{
+			desc: "account key not stored",
+			pv:   newPV(d.Name, "rg#account#share", map[string]string{storeAccountKeyField: falseValue}, nil),
+		},
+		{
+			desc: "nfs volume",
+			pv:   newPV(d.Name, "rg#account#share", map[string]string{protocolField: nfs}, nil),
+		},
+		{
+			desc: "no account",
+			pv:   newPV(d.Name, "unique-volume-id", nil, nil),
+		},
+		{
+			desc:            "default secret in pvc namespace",
+			pv:              newPV(d.Name, "rg#account#share", map[string]string{pvcNamespaceKey: "ns"}, nil),
+			expectedAccount: storageAccountRef{subsID: "subs", resourceGroup: "rg", accountName: "account"},
+			expectedSecret:  accountKeySecretRef{name: "azure-storage-account-account-secret", namespace: "ns"},
+			expectedOK:      true,
+		},
+		{
+			desc: "secret in volume attributes",
+			pv: newPV(d.Name, "unique-volume-id", map[string]string{
+				subscriptionIDField:  "subs2",
+				resourceGroupField:   "rg2",
+				storageAccountField:  "account2",
+				secretNameField:      "secret",
+				secretNamespaceField: "ns2",
+			}, nil),
+			expectedAccount: storageAccountRef{subsID: "subs2", resourceGroup: "rg2", accountName: "account2"},
+			expectedSecret:  accountKeySecretRef{name: "secret", namespace: "ns2"},
+			expectedOK:      true,
+		},
+		{
+			desc:            "default namespace",
+			pv:              newPV(d.Name, "rg#account#share", nil, nil),
+			expectedAccount: storageAccountRef{subsID: "subs", resourceGroup: "rg", accountName: "account"},
+			expectedSecret:  accountKeySecretRef{name: "azure-storage-account-account-secret", namespace: defaultNamespace},
+			expectedOK:      true,
+		},
+	}
+
+	for _, test := range tests {
+		account, secret, ok := d.getAccountKeySecretRef(test.pv)
+		assert.Equal(t, test.expectedOK, ok, test.desc)
+		assert.Equal(t, test.expectedAccount, account, test.desc)
+		assert.Equal(t, test.expectedSecret, secret, test.desc)
+	}
+}
+
+func TestIsAccountKeyRotationDue(t *testing.T) {
+	now := time.Now()
+	newSecret := func(created time.Time, annotations map[string]string) *v1.Secret {
+		return &v1.Secret{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created), Annotations: annotations}}
+	}
+	tests := []struct {
+		desc     string
+		secrets  []*v1.Secret
+		expected bool
+	}{
+		{
+			desc:    "secret created recently",
+			secrets: []*v1.Secret{newSecret(now.Add(-time.Hour), nil)},
+		},
+		{
+			desc:     "secret created before interval",
+			secrets:  []*v1.Secret{newSecret(now.Add(-48*time.Hour), nil)},
+			expected: true,
+		},
+		{
+			desc:    "key rotated recently",
+			secrets: []*v1.Secret{newSecret(now.Add(-48*time.Hour), map[string]string{keyRotationTimeAnnotation: now.Add(-time.Hour).Format(time.RFC3339)})},
+		},
+		{
+			desc:     "invalid rotation time",
+			secrets:  []*v1.Secret{newSecret(now.Add(-48*time.Hour), map[string]string{keyRotationTimeAnnotation: "invalid"})},
+			expected: true,
+		},
+		{
+			desc:     "one of secrets is due",
+			secrets:  []*v1.Secret{newSecret(now.Add(-time.Hour), nil), newSecret(now.Add(-48*time.Hour), nil)},
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isAccountKeyRotationDue(test.secrets, 24*time.Hour, now), test.desc)
+	}
+}
+
+func TestReconcileAccountKeys(t *testing.T) {
+	now := time.Now()
+	driverName := NewFakeDriver().Name
+	newSecret := func(name, accountName, accountKey string) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "default",
+				CreationTimestamp: metav1.NewTime(now.Add(-time.Hour)),
+				Labels:            map[string]string{managedByLabel: driverName},
+			},
+			Data: map[string][]byte{
+				defaultSecretAccountName: []byte(accountName),
+				defaultSecretAccountKey:  []byte(accountKey),
+			},
+		}
+	}
+	newUserSecret := func(name, accountName, accountKey string) *v1.Secret {
+		secret := newSecret(name, accountName, accountKey)
+		secret.Labels = nil
+		return secret
+	}
+	tests := []struct {
+		desc                string
+		secrets             []*v1.Secret
+		keys                *[]storage.AccountKey
+		rotationInterval    time.Duration
+		expectedKeys        map[string]string
+		expectedRegenerated []string
+		expectedEvents      int
+		expectedRotated     bool
+	}{
+		{
+			desc:         "key in secret is valid",
+			secrets:      []*v1.Secret{newSecret("azure-storage-account-account-secret", "account", "key2")},
+			keys:         newAccountKeys("key1", "key2"),
+			expectedKeys: map[string]string{"azure-storage-account-account-secret": "key2"},
+		},
+		{
+			desc:           "key in secret is regenerated outside of driver",
+			secrets:        []*v1.Secret{newSecret("azure-storage-account-account-secret", "account", "stale")},
+			keys:           newAccountKeys("key1", "key2"),
+			expectedKeys:   map[string]string{"azure-storage-account-account-secret": "key1"},
+			expectedEvents: 1,
+		},
+		{
+			desc:         "secret of other account is skipped",
+			secrets:      []*v1.Secret{newSecret("azure-storage-account-account-secret", "other", "stale")},
+			keys:         newAccountKeys("key1", "key2"),
+			expectedKeys: map[string]string{"azure-storage-account-account-secret": "stale"},
+		},
+		{
+			desc:         "secret not managed by driver is skipped",
+			secrets:      []*v1.Secret{newUserSecret("azure-storage-account-account-secret", "account", "stale")},
+			keys:         newAccountKeys("key1", "key2"),
+			expectedKeys: map[string]string{"azure-storage-account-account-secret": "stale"},
+		},
+		{
+			desc:             "secret not managed by driver is not rotated",
+			secrets:          []*v1.Secret{newUserSecret("azure-storage-account-account-secret", "account", "key1")},
+			keys:             newAccountKeys("key1", "key2"),
+			rotationInterval: time.Minute,
+			expectedKeys:     map[string]string{"azure-storage-account-account-secret": "key1"},
+		},
+		{
+			desc:             "rotation is not due",
+			secrets:          []*v1.Secret{newSecret("azure-storage-account-account-secret", "account", "key1")},
+			keys:             newAccountKeys("key1", "key2"),
+			rotationInterval: 24 * time.Hour,
+			expectedKeys:     map[string]string{"azure-storage-account-account-secret": "key1"},
+		},
+		{
+			desc:                "unused key is regenerated and switched to",
+			secrets:             []*v1.Secret{newSecret("azure-storage-account-account-secret", "account", "key1")},
+			keys:                newAccountKeys("key1", "key2"),
+			rotationInterval:    time.Minute,
+			expectedKeys:        map[string]string{"azure-storage-account-account-secret": "key2-new"},
+			expectedRegenerated: []string{"key2"},
+			expectedEvents:      1,
+			expectedRotated:     true,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud.SubscriptionID = "subs"
+		d.cloud.ResourceGroup = "rg"
+		d.accountKeyRotationInterval = test.rotationInterval
+		ctrl := gomock.NewController(t)
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), "subs", "rg", "account").DoAndReturn(
+			func(ctx context.Context, subsID, resourceGroup, accountName string) (storage.AccountListKeysResult, error) {
+				keys := append([]storage.AccountKey{}, *test.keys...)
+				return storage.AccountListKeysResult{Keys: &keys}, nil
+			}).AnyTimes()
+		clientSet := fake.NewSimpleClientset()
+		d.cloud.KubeClient = clientSet
+		pv := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: d.Name, VolumeHandle: "rg#account#share"},
+				},
+			},
+		}
+		_, err := clientSet.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		for _, secret := range test.secrets {
+			_, err := clientSet.CoreV1().Secrets(secret.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+			assert.NoError(t, err)
+		}
+		recorder := record.NewFakeRecorder(10)
+		regenerator := &fakeAccountKeyRegenerator{keys: test.keys}
+
+		err = d.reconcileAccountKeys(context.TODO(), recorder, regenerator, now)
+		assert.NoError(t, err, test.desc)
+		for name, expected := range test.expectedKeys {
+			secret, err := clientSet.CoreV1().Secrets("default").Get(context.TODO(), name, metav1.GetOptions{})
+			assert.NoError(t, err, test.desc)
+			assert.Equal(t, expected, string(secret.Data[defaultSecretAccountKey]), test.desc)
+			_, rotated := secret.Annotations[keyRotationTimeAnnotation]
+			assert.Equal(t, test.expectedRotated, rotated, test.desc)
+		}
+		assert.Equal(t, test.expectedRegenerated, regenerator.regenerated, test.desc)
+		assert.Equal(t, test.expectedEvents, len(recorder.Events), test.desc)
+		ctrl.Finish()
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// labels on account key secrets created by driver
+	managedByLabel      = "app.kubernetes.io/managed-by"
+	storageAccountLabel = "file.csi.azure.com/storage-account"
+
+	// annotation on account key secrets created by driver, which is refreshed whenever the secret is set by CreateVolume
+	lastUsedTimeAnnotation = "file.csi.azure.com/last-used-time"
+
+	// account key secret is deleted only if it's not referenced by any pv and not used for this period, so that
+	// the secret set by CreateVolume is not deleted before the pv is created
+	accountKeySecretGCGracePeriod = 10 * time.Minute
+)
+
+// namespacedAccount is a storage account referenced by pvs in a namespace
+type namespacedAccount struct {
+	namespace   string
+	accountName string
+}
+
+// getAccountKeySecretLabels returns the labels set on account key secret created by driver
+func (d *Driver) getAccountKeySecretLabels(accountName string) map[string]string {
+	return map[string]string{
+		managedByLabel:      d.Name,
+		storageAccountLabel: accountName,
+	}
+}
+
+// garbageCollectAccountKeySecrets deletes account key secrets created by driver once no pv in the namespace references
+// the storage account or the secret, and the secret is not used for accountKeySecretGCGracePeriod
+func (d *Driver) garbageCollectAccountKeySecrets(ctx context.Context, now time.Time) error {
+	kubeClient := d.cloud.KubeClient
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: d.Name}).String()
+	secretList, err := kubeClient.CoreV1().Secrets("").List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf("failed to list account key secrets: %v", err)
+	}
+	pvList, err := kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	referencedAccounts := map[namespacedAccount]bool{}
+	referencedSecrets := map[accountKeySecretRef]bool{}
+	for i := range pvList.Items {
+		account, secretRef, _, ok := d.parseAccountKeySecretRef(&pvList.Items[i])
+		if !ok {
+			continue
+		}
+		referencedSecrets[secretRef] = true
+		if account.accountName != "" {
+			referencedAccounts[namespacedAccount{namespace: secretRef.namespace, accountName: account.accountName}] = true
+		}
+	}
+
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		accountName := secret.Labels[storageAccountLabel]
+		if referencedSecrets[accountKeySecretRef{name: secret.Name, namespace: secret.Namespace}] ||
+			(accountName != "" && referencedAccounts[namespacedAccount{namespace: secret.Namespace, accountName: accountName}]) {
+			continue
+		}
+		if now.Sub(getLastUsedTime(secret)) < accountKeySecretGCGracePeriod {
+			continue
+		}
+		if err := d.deleteAccountKeySecret(ctx, secret); err != nil {
+			klog.Errorf("failed to delete account key secret(%s/%s): %v", secret.Namespace, secret.Name, err)
+			continue
+		}
+		klog.V(2).Infof("account key secret(%s/%s) of account(%s) is deleted since it's not referenced by any pv", secret.Namespace, secret.Name, accountName)
+	}
+	return nil
+}
+
+// getLastUsedTime returns the time when secret is last set by CreateVolume, creation time is returned if the
+// annotation is not found or invalid
+func getLastUsedTime(secret *v1.Secret) time.Time {
+	if v, ok := secret.Annotations[lastUsedTimeAnnotation]; ok {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t
+		}
+		klog.Warningf("invalid annotation %s(%s) on secret(%s/%s)", lastUsedTimeAnnotation, v, secret.Namespace, secret.Name)
+	}
+	return secret.CreationTimestamp.Time
+}
+
+// refreshLastUsedTime updates last used time annotation on existing account key secret created by driver
+func (d *Driver) refreshLastUsedTime(ctx context.Context, secretName, secretNamespace string, now time.Time) error {
+	secrets := d.cloud.KubeClient.CoreV1().Secrets(secretNamespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if secret.Labels[managedByLabel] != d.Name {
+			// secret is not created by driver
+			return nil
+		}
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[lastUsedTimeAnnotation] = now.UTC().Format(time.RFC3339)
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// deleteAccountKeySecret deletes the secret only if it's not replaced by another one with the same name
+func (d *Driver) deleteAccountKeySecret(ctx context.Context, secret *v1.Secret) error {
+	uid := secret.UID
+	err := d.cloud.KubeClient.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid},
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// runAccountKeySecretGC garbage collects account key secrets created by driver periodically until stopCh is closed
+func (d *Driver) runAccountKeySecretGC(interval time.Duration, stopCh <-chan struct{}) {
+	klog.V(2).Infof("starting account key secret garbage collector with interval(%v)", interval)
+	wait.Until(func() {
+		if err := d.garbageCollectAccountKeySecrets(context.Background(), time.Now()); err != nil {
+			klog.Errorf("failed to garbage collect account key secrets: %v", err)
+		}
+	}, interval, stopCh)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetAzureCredentialsLabels(t *testing.T) {
+	d := NewFakeDriver()
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+
+	name, err := d.SetAzureCredentials(context.TODO(), "account", "key", "", "ns")
+	assert.NoError(t, err)
+	secret, err := clientSet.CoreV1().Secrets("ns").Get(context.TODO(), name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{managedByLabel: d.Name, storageAccountLabel: "account"}, secret.Labels)
+	lastUsedTime := getLastUsedTime(secret)
+	assert.WithinDuration(t, time.Now(), lastUsedTime, time.Minute)
+
+	// last used time is refreshed if secret already exists
+	secret.Annotations[lastUsedTimeAnnotation] = lastUsedTime.Add(-time.Hour).Format(time.RFC3339)
+	_, err = clientSet.CoreV1().Secrets("ns").Update(context.TODO(), secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	_, err = d.SetAzureCredentials(context.TODO(), "account", "key", "", "ns")
+	assert.NoError(t, err)
+	secret, err = clientSet.CoreV1().Secrets("ns").Get(context.TODO(), name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, getLastUsedTime(secret).Before(lastUsedTime))
+
+	// secret not created by driver is not annotated
+	_, err = clientSet.CoreV1().Secrets("ns").Create(context.TODO(), &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "custom-secret", Namespace: "ns"}}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = d.SetAzureCredentials(context.TODO(), "account", "key", "custom-secret", "ns")
+	assert.NoError(t, err)
+	secret, err = clientSet.CoreV1().Secrets("ns").Get(context.TODO(), "custom-secret", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, secret.Annotations)
+}
+
+func TestGetLastUsedTime(t *testing.T) {
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		expected    time.Time
+	}{
+		{
+			desc:     "no annotation",
+			expected: created,
+		},
+		{
+			desc:        "invalid annotation",
+			annotations: map[string]string{lastUsedTimeAnnotation: "invalid"},
+			expected:    created,
+		},
+		{
+			desc:        "valid annotation",
+			annotations: map[string]string{lastUsedTimeAnnotation: "2022-01-02T00:00:00Z"},
+			expected:    created.Add(24 * time.Hour),
+		},
+	}
+
+	for _, test := range tests {
+		secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created), Annotations: test.annotations}}
+		assert.True(t, test.expected.Equal(getLastUsedTime(secret)), test.desc)
+	}
+}
+
+func TestGarbageCollectAccountKeySecrets(t *testing.T) {
+	d := NewFakeDriver()
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+
+	now := time.Now()
+	newSecret := func(name, namespace, accountName string, managed bool) *v1.Secret {
+		secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			UID:         types.UID(namespace + "/" + name),
+			Annotations: map[string]string{lastUsedTimeAnnotation: now.UTC().Format(time.RFC3339)},
+		}}
+		if managed {
+			secret.Labels = d.getAccountKeySecretLabels(accountName)
+		}
+		return secret
+	}
+	newPV := func(name, volumeHandle string, attributes map[string]string, secretRef *v1.SecretReference) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: d.Name, VolumeHandle: volumeHandle, VolumeAttributes: attributes, NodeStageSecretRef: secretRef},
+				},
+			},
+		}
+	}
+	secrets := []*v1.Secret{
+		// referenced by pv in the same namespace
+		newSecret("azure-storage-account-account1-secret", "ns1", "account1", true),
+		// account is referenced by pv in another namespace only
+		newSecret("azure-storage-account-account1-secret", "ns2", "account1", true),
+		// referenced by secretName of pv
+		newSecret("custom-secret", "ns3", "account3", true),
+		// referenced by nodeStageSecretRef of pv
+		newSecret("stage-secret", "ns4", "account4", true),
+		// not referenced, but not created by driver
+		newSecret("azure-storage-account-account5-secret", "ns5", "account5", false),
+		// account is referenced by pv with storeAccountKey=false
+		newSecret("azure-storage-account-account6-secret", "ns6", "account6", true),
+	}
+	for _, secret := range secrets {
+		_, err := clientSet.CoreV1().Secrets(secret.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+	pvs := []*v1.PersistentVolume{
+		newPV("pv1", "rg#account1#share1", map[string]string{pvcNamespaceKey: "ns1"}, nil),
+		newPV("pv3", "rg#account#share3", map[string]string{pvcNamespaceKey: "ns3", secretNameField: "custom-secret"}, nil),
+		newPV("pv4", "rg#account#share4", nil, &v1.SecretReference{Name: "stage-secret", Namespace: "ns4"}),
+		newPV("pv6", "rg#account6#share6", map[string]string{secretNamespaceField: "ns6", storeAccountKeyField: falseValue}, nil),
+	}
+	for _, pv := range pvs {
+		_, err := clientSet.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+	listSecrets := func() []string {
+		secretList, err := clientSet.CoreV1().Secrets("").List(context.TODO(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		names := []string{}
+		for _, secret := range secretList.Items {
+			names = append(names, secret.Namespace+"/"+secret.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	all := listSecrets()
+
+	// unreferenced secret is not deleted in grace period
+	assert.NoError(t, d.garbageCollectAccountKeySecrets(context.TODO(), now))
+	assert.Equal(t, all, listSecrets())
+	assert.NoError(t, d.garbageCollectAccountKeySecrets(context.TODO(), now.Add(time.Minute)))
+	assert.Equal(t, all, listSecrets())
+
+	// unreferenced secret is deleted after grace period
+	assert.NoError(t, d.garbageCollectAccountKeySecrets(context.TODO(), now.Add(accountKeySecretGCGracePeriod)))
+	assert.Equal(t, []string{
+		"ns1/azure-storage-account-account1-secret",
+		"ns3/custom-secret",
+		"ns4/stage-secret",
+		"ns5/azure-storage-account-account5-secret",
+		"ns6/azure-storage-account-account6-secret",
+	}, listSecrets())
+
+	// secret used again in grace period is not deleted after its pv is deleted
+	assert.NoError(t, clientSet.CoreV1().PersistentVolumes().Delete(context.TODO(), "pv1", metav1.DeleteOptions{}))
+	later := now.Add(time.Hour)
+	assert.NoError(t, d.refreshLastUsedTime(context.TODO(), "azure-storage-account-account1-secret", "ns1", later))
+	assert.NoError(t, d.garbageCollectAccountKeySecrets(context.TODO(), later.Add(time.Minute)))
+	assert.Contains(t, listSecrets(), "ns1/azure-storage-account-account1-secret")
+
+	// secret is deleted once grace period passes after last use
+	assert.NoError(t, d.garbageCollectAccountKeySecrets(context.TODO(), later.Add(accountKeySecretGCGracePeriod)))
+	assert.NotContains(t, listSecrets(), "ns1/azure-storage-account-account1-secret")
+}
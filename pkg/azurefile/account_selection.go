@@ -0,0 +1,271 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+
+	"k8s.io/klog/v2"
+
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	// storage account selection policies, account matching is left to cloud provider if policy is not specified
+	leastSharesPolicy      = "leastshares"
+	mostFreeCapacityPolicy = "mostfreecapacity"
+	roundRobinPolicy       = "roundrobin"
+	perNamespacePolicy     = "pernamespace"
+
+	// tag of storage account dedicated to the pvc namespace in perNamespace selection policy
+	pvcNamespaceTag = "k8s-azure-pvc-namespace"
+)
+
+var supportedAccountSelectionPolicyList = []string{leastSharesPolicy, mostFreeCapacityPolicy, roundRobinPolicy, perNamespacePolicy}
+
+// accountUsage is the usage of a storage account which matches account settings of CreateVolume
+type accountUsage struct {
+	Name           string
+	Tags           map[string]*string
+	ShareCount     int
+	ProvisionedGiB int64
+	LimitGiB       int64
+}
+
+// freeGiB returns the capacity which could still be provisioned on the storage account
+func (u *accountUsage) freeGiB() int64 {
+	return u.LimitGiB - u.ProvisionedGiB
+}
+
+// accountSelectionRequest describes the volume which a storage account is selected for
+type accountSelectionRequest struct {
+	// PoolKey identifies the candidate accounts with the same account settings
+	PoolKey    string
+	Namespace  string
+	RequestGiB int64
+	// EncryptionIdentity is the user-assigned identity used to access customer-managed key
+	EncryptionIdentity string
+}
+
+// accountSelector selects a storage account for a new file share among candidate accounts,
+// all candidates have enough free capacity for the request
+type accountSelector interface {
+	// Select returns the name of selected account, empty string means that a new account should be created
+	Select(req *accountSelectionRequest, candidates []accountUsage) string
+}
+
+// newAccountSelectors returns all supported account selectors keyed by policy name
+func newAccountSelectors() map[string]accountSelector {
+	return map[string]accountSelector{
+		leastSharesPolicy:      &leastSharesSelector{},
+		mostFreeCapacityPolicy: &mostFreeCapacitySelector{},
+		roundRobinPolicy:       &roundRobinSelector{next: map[string]int{}},
+		perNamespacePolicy:     &perNamespaceSelector{},
+	}
+}
+
+// leastSharesSelector selects the account with the least file shares
+type leastSharesSelector struct{}
+
+func (s *leastSharesSelector) Select(req *accountSelectionRequest, candidates []accountUsage) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].ShareCount != candidates[j].ShareCount {
+			return candidates[i].ShareCount < candidates[j].ShareCount
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0].Name
+}
+
+// mostFreeCapacitySelector selects the account with the most free capacity
+type mostFreeCapacitySelector struct{}
+
+func (s *mostFreeCapacitySelector) Select(req *accountSelectionRequest, candidates []accountUsage) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].freeGiB() != candidates[j].freeGiB() {
+			return candidates[i].freeGiB() > candidates[j].freeGiB()
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0].Name
+}
+
+// roundRobinSelector selects candidate accounts in turn per account pool
+type roundRobinSelector struct {
+	sync.Mutex
+	next map[string]int
+}
+
+func (s *roundRobinSelector) Select(req *accountSelectionRequest, candidates []accountUsage) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	s.Lock()
+	defer s.Unlock()
+	i := s.next[req.PoolKey] % len(candidates)
+	s.next[req.PoolKey] = i + 1
+	return candidates[i].Name
+}
+
+// perNamespaceSelector selects the account dedicated to the pvc namespace with the most free capacity,
+// a new account tagged with the pvc namespace should be created if there is no such account
+type perNamespaceSelector struct {
+	mostFreeCapacitySelector
+}
+
+func (s *perNamespaceSelector) Select(req *accountSelectionRequest, candidates []accountUsage) string {
+	dedicated := []accountUsage{}
+	for _, c := range candidates {
+		if v, ok := c.Tags[pvcNamespaceTag]; ok && to.String(v) == req.Namespace {
+			dedicated = append(dedicated, c)
+		}
+	}
+	return s.mostFreeCapacitySelector.Select(req, dedicated)
+}
+
+func isSupportedAccountSelectionPolicy(policy string) bool {
+	if policy == "" {
+		return true
+	}
+	for _, v := range supportedAccountSelectionPolicyList {
+		if strings.EqualFold(policy, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAccountMatched returns true if the storage account in the account pool matches the remaining account settings
+// which are also checked by cloud provider in EnsureStorageAccount
+func isAccountMatched(account storage.Account, accountOptions *azure.AccountOptions) bool {
+	if !azure.AreVNetRulesEqual(account, accountOptions) {
+		return false
+	}
+	if accountOptions.EnableLargeFileShare && account.Sku.Tier != storage.SkuTierPremium &&
+		(account.AccountProperties == nil || account.LargeFileSharesState != storage.LargeFileSharesStateEnabled) {
+		return false
+	}
+	hasPrivateEndpoint := account.AccountProperties != nil && account.PrivateEndpointConnections != nil && len(*account.PrivateEndpointConnections) > 0
+	if hasPrivateEndpoint != accountOptions.CreatePrivateEndpoint {
+		return false
+	}
+	if accountOptions.MatchTags {
+		for k, v := range account.Tags {
+			if accountOptions.Tags[k] != to.String(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isEncryptionMatched returns true if the encryption of storage account matches the customer-managed key settings,
+// accounts encrypted with customer-managed key are not matched without customer-managed key settings and vice versa
+func isEncryptionMatched(account storage.Account, accountOptions *azure.AccountOptions, identity string) bool {
+	var encryption *storage.Encryption
+	if account.AccountProperties != nil {
+		encryption = account.Encryption
+	}
+	hasCMK := encryption != nil && encryption.KeySource == storage.KeySourceMicrosoftKeyvault && encryption.KeyVaultProperties != nil
+	if !hasCMK || accountOptions.KeyVaultURI == nil {
+		return hasCMK == (accountOptions.KeyVaultURI != nil)
+	}
+	normalizeURI := func(uri *string) string {
+		return strings.TrimSuffix(strings.ToLower(to.String(uri)), "/")
+	}
+	var accountIdentity string
+	if encryption.EncryptionIdentity != nil {
+		accountIdentity = to.String(encryption.EncryptionIdentity.EncryptionUserAssignedIdentity)
+	}
+	return normalizeURI(encryption.KeyVaultProperties.KeyVaultURI) == normalizeURI(accountOptions.KeyVaultURI) &&
+		strings.EqualFold(to.String(encryption.KeyVaultProperties.KeyName), to.String(accountOptions.KeyName)) &&
+		strings.EqualFold(to.String(encryption.KeyVaultProperties.KeyVersion), to.String(accountOptions.KeyVersion)) &&
+		strings.EqualFold(accountIdentity, identity)
+}
+
+// selectStorageAccount selects a storage account matching accountOptions by policy, the accounts are ranked by
+// their usage, empty string is returned if there is no matching account with enough free capacity for the request.
+// The first matching account is returned if policy is empty.
+func (d *Driver) selectStorageAccount(ctx context.Context, policy string, accountOptions *azure.AccountOptions, req *accountSelectionRequest) (string, error) {
+	selector, ok := d.accountSelectors[strings.ToLower(policy)]
+	if !ok && policy != "" {
+		return "", fmt.Errorf("account selection policy(%s) is not supported", policy)
+	}
+	subsID := accountOptions.SubscriptionID
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	accounts, err := d.getStorageAccountPool(ctx, subsID, accountOptions.ResourceGroup, accountOptions.Location, accountOptions.Type, accountOptions.Kind, "")
+	if err != nil {
+		return "", err
+	}
+
+	limitGiB := int64(standardAccountCapacityLimit)
+	if strings.HasPrefix(strings.ToLower(accountOptions.Type), premium) {
+		limitGiB = premiumAccountCapacityLimit
+	}
+	candidates := []accountUsage{}
+	for _, account := range accounts {
+		if !isAccountMatched(account, accountOptions) || !isEncryptionMatched(account, accountOptions, req.EncryptionIdentity) {
+			continue
+		}
+		if selector == nil {
+			klog.V(2).Infof("account(%s) is the first matching account in pool(%s)", *account.Name, req.PoolKey)
+			return *account.Name, nil
+		}
+		shareCount, provisionedGiB, err := d.getAccountUsage(ctx, subsID, accountOptions.ResourceGroup, *account.Name)
+		if err != nil {
+			return "", fmt.Errorf("failed to get usage of account(%s): %v", *account.Name, err)
+		}
+		usage := accountUsage{
+			Name:           *account.Name,
+			Tags:           account.Tags,
+			ShareCount:     shareCount,
+			ProvisionedGiB: provisionedGiB,
+			LimitGiB:       limitGiB,
+		}
+		if usage.freeGiB() < req.RequestGiB {
+			klog.V(4).Infof("skip account(%s) with free capacity(%d GiB) less than requested size(%d GiB)", usage.Name, usage.freeGiB(), req.RequestGiB)
+			continue
+		}
+		candidates = append(candidates, usage)
+	}
+	if selector == nil {
+		klog.V(2).Infof("no matching account in pool(%s)", req.PoolKey)
+		return "", nil
+	}
+
+	accountName := selector.Select(req, candidates)
+	klog.V(2).Infof("account(%s) is selected by policy(%s) among %d candidate accounts in pool(%s)", accountName, policy, len(candidates), req.PoolKey)
+	return accountName, nil
+}
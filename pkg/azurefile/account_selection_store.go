@@ -0,0 +1,142 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// account selection of volume is persisted in ConfigMap data as {volName}: {accountName}/{fileShareName},
+// so that a retried CreateVolume after controller restart lands on the same storage account
+const accountSelectionSeparator = "/"
+
+// isAccountSelectionPersisted returns true if account selection is persisted in ConfigMap
+func (d *Driver) isAccountSelectionPersisted() bool {
+	return d.accountSelectionConfigMapName != "" && d.cloud != nil && d.cloud.KubeClient != nil
+}
+
+// getPersistedAccountSelection returns the storage account persisted for volName, empty string is returned if not found
+// or the ConfigMap could not be read, since account selection is persisted on a best effort basis
+func (d *Driver) getPersistedAccountSelection(ctx context.Context, volName string) string {
+	if !d.isAccountSelectionPersisted() {
+		return ""
+	}
+	cm, err := d.cloud.KubeClient.CoreV1().ConfigMaps(d.accountSelectionConfigMapNamespace).Get(ctx, d.accountSelectionConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.Warningf("failed to get persisted account selection of volume(%s): %v", volName, err)
+		}
+		return ""
+	}
+	accountName, _, _ := strings.Cut(cm.Data[volName], accountSelectionSeparator)
+	return accountName
+}
+
+// persistAccountSelection persists the storage account and file share selected for volName
+func (d *Driver) persistAccountSelection(ctx context.Context, volName, accountName, fileShareName string) error {
+	if !d.isAccountSelectionPersisted() {
+		return nil
+	}
+	value := accountName + accountSelectionSeparator + fileShareName
+	return d.updateAccountSelectionConfigMap(ctx, func(data map[string]string) bool {
+		if data[volName] == value {
+			return false
+		}
+		data[volName] = value
+		return true
+	})
+}
+
+// deletePersistedAccountSelection removes the persisted account selection of volName, e.g. the account could not hold more file shares
+func (d *Driver) deletePersistedAccountSelection(ctx context.Context, volName string) error {
+	if !d.isAccountSelectionPersisted() {
+		return nil
+	}
+	return d.updateAccountSelectionConfigMap(ctx, func(data map[string]string) bool {
+		if _, ok := data[volName]; !ok {
+			return false
+		}
+		delete(data, volName)
+		return true
+	})
+}
+
+// forgetAccountSelection removes the persisted account selection of deleted volume, which is left if removing it
+// failed after the volume was created, the volume is matched by volume name in volume handle if file share is
+// shared or specified, otherwise by storage account and file share
+func (d *Driver) forgetAccountSelection(ctx context.Context, h *VolumeHandle) {
+	if !d.isAccountSelectionPersisted() {
+		return
+	}
+	value := h.AccountName + accountSelectionSeparator + h.FileShareName
+	err := d.updateAccountSelectionConfigMap(ctx, func(data map[string]string) bool {
+		updated := false
+		for volName, v := range data {
+			if v == value && (h.UUID == "" || h.UUID == volName) {
+				delete(data, volName)
+				updated = true
+			}
+		}
+		return updated
+	})
+	if err != nil {
+		klog.Warningf("failed to remove persisted account selection of file share(%s) on account(%s): %v", h.FileShareName, h.AccountName, err)
+	}
+}
+
+// updateAccountSelectionConfigMap applies update on data of account selection ConfigMap, the ConfigMap is created
+// if not found, update returns false if data is not changed
+func (d *Driver) updateAccountSelectionConfigMap(ctx context.Context, update func(data map[string]string) bool) error {
+	configMaps := d.cloud.KubeClient.CoreV1().ConfigMaps(d.accountSelectionConfigMapNamespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, d.accountSelectionConfigMapName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			data := map[string]string{}
+			if !update(data) {
+				return nil
+			}
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: d.accountSelectionConfigMapName, Namespace: d.accountSelectionConfigMapNamespace},
+				Data:       data,
+			}
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// created by another request, retry with update
+				return apierrors.NewConflict(v1.Resource("configmaps"), d.accountSelectionConfigMapName, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		if !update(cm.Data) {
+			return nil
+		}
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
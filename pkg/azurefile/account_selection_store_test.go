@@ -0,0 +1,55 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPersistAccountSelection(t *testing.T) {
+	ctx := context.Background()
+	d := NewFakeDriver()
+	d.accountSelectionConfigMapName = "account-selection"
+	d.accountSelectionConfigMapNamespace = "kube-system"
+
+	// persistence is disabled without kube client
+	assert.NoError(t, d.persistAccountSelection(ctx, "pvc-1", "account1", "pvc-1"))
+	assert.Equal(t, "", d.getPersistedAccountSelection(ctx, "pvc-1"))
+
+	d.cloud.KubeClient = fake.NewSimpleClientset()
+	assert.Equal(t, "", d.getPersistedAccountSelection(ctx, "pvc-1"))
+
+	assert.NoError(t, d.persistAccountSelection(ctx, "pvc-1", "account1", "pvc-1"))
+	assert.NoError(t, d.persistAccountSelection(ctx, "pvc-2", "account1", "pvc-2"))
+	assert.NoError(t, d.persistAccountSelection(ctx, "pvc-3", "account2", "pvc-subdir-pool"))
+	assert.NoError(t, d.persistAccountSelection(ctx, "pvc-4", "account2", "pvc-subdir-pool"))
+	assert.Equal(t, "account1", d.getPersistedAccountSelection(ctx, "pvc-1"))
+
+	assert.NoError(t, d.deletePersistedAccountSelection(ctx, "pvc-2"))
+	assert.NoError(t, d.deletePersistedAccountSelection(ctx, "pvc-2"))
+	d.forgetAccountSelection(ctx, &VolumeHandle{AccountName: "account1", FileShareName: "pvc-1"})
+	d.forgetAccountSelection(ctx, &VolumeHandle{AccountName: "account2", FileShareName: "pvc-subdir-pool", UUID: "pvc-3"})
+
+	cm, err := d.cloud.KubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, "account-selection", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pvc-4": "account2/pvc-subdir-pool"}, cm.Data)
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+func TestAccountSelectors(t *testing.T) {
+	candidates := []accountUsage{
+		{Name: "account1", ShareCount: 5, ProvisionedGiB: 100, LimitGiB: 1000},
+		{Name: "account2", ShareCount: 2, ProvisionedGiB: 800, LimitGiB: 1000, Tags: map[string]*string{pvcNamespaceTag: to.StringPtr("ns2")}},
+		{Name: "account3", ShareCount: 2, ProvisionedGiB: 500, LimitGiB: 1000, Tags: map[string]*string{pvcNamespaceTag: to.StringPtr("ns1")}},
+		{Name: "account4", ShareCount: 9, ProvisionedGiB: 50, LimitGiB: 1000, Tags: map[string]*string{pvcNamespaceTag: to.StringPtr("ns1")}},
+	}
+
+	tests := []struct {
+		policy     string
+		req        *accountSelectionRequest
+		candidates []accountUsage
+		expected   []string
+	}{
+		{
+			policy:     leastSharesPolicy,
+			req:        &accountSelectionRequest{PoolKey: "pool"},
+			candidates: candidates,
+			expected:   []string{"account2"},
+		},
+		{
+			policy:     mostFreeCapacityPolicy,
+			req:        &accountSelectionRequest{PoolKey: "pool"},
+			candidates: candidates,
+			expected:   []string{"account4"},
+		},
+		{
+			policy:     roundRobinPolicy,
+			req:        &accountSelectionRequest{PoolKey: "pool"},
+			candidates: candidates,
+			expected:   []string{"account1", "account2", "account3", "account4", "account1"},
+		},
+		{
+			policy:     perNamespacePolicy,
+			req:        &accountSelectionRequest{PoolKey: "pool", Namespace: "ns1"},
+			candidates: candidates,
+			expected:   []string{"account4"},
+		},
+		{
+			policy:     perNamespacePolicy,
+			req:        &accountSelectionRequest{PoolKey: "pool", Namespace: "ns3"},
+			candidates: candidates,
+			expected:   []string{""},
+		},
+		{
+			policy:   leastSharesPolicy,
+			req:      &accountSelectionRequest{PoolKey: "pool"},
+			expected: []string{""},
+		},
+		{
+			policy:   roundRobinPolicy,
+			req:      &accountSelectionRequest{PoolKey: "pool"},
+			expected: []string{""},
+		},
+	}
+
+	for _, test := range tests {
+		selector := newAccountSelectors()[test.policy]
+		for i, expected := range test.expected {
+			c := make([]accountUsage, len(test.candidates))
+			copy(c, test.candidates)
+			result := selector.Select(test.req, c)
+			if result != expected {
+				t.Errorf("policy(%s) selection(%d) returned with: %q, expected: %q", test.policy, i, result, expected)
+			}
+		}
+	}
+}
+
+func TestIsSupportedAccountSelectionPolicy(t *testing.T) {
+	assert.True(t, isSupportedAccountSelectionPolicy(""))
+	assert.True(t, isSupportedAccountSelectionPolicy("leastShares"))
+	assert.True(t, isSupportedAccountSelectionPolicy("perNamespace"))
+	assert.False(t, isSupportedAccountSelectionPolicy("random"))
+}
+
+func TestIsAccountMatched(t *testing.T) {
+	subnetID := "subnetID"
+	tests := []struct {
+		desc           string
+		account        storage.Account
+		accountOptions *azure.AccountOptions
+		expected       bool
+	}{
+		{
+			desc:           "no extra account settings",
+			account:        storage.Account{Sku: &storage.Sku{Tier: storage.SkuTierStandard}},
+			accountOptions: &azure.AccountOptions{},
+			expected:       true,
+		},
+		{
+			desc:           "vnet rule not found",
+			account:        storage.Account{Sku: &storage.Sku{Tier: storage.SkuTierStandard}, AccountProperties: &storage.AccountProperties{}},
+			accountOptions: &azure.AccountOptions{VirtualNetworkResourceIDs: []string{subnetID}},
+			expected:       false,
+		},
+		{
+			desc: "vnet rule found",
+			account: storage.Account{Sku: &storage.Sku{Tier: storage.SkuTierStandard}, AccountProperties: &storage.AccountProperties{
+				NetworkRuleSet: &storage.NetworkRuleSet{VirtualNetworkRules: &[]storage.VirtualNetworkRule{{VirtualNetworkResourceID: &subnetID, Action: storage.ActionAllow}}},
+			}},
+			accountOptions: &azure.AccountOptions{VirtualNetworkResourceIDs: []string{subnetID}},
+			expected:       true,
+		},
+		{
+			desc:           "large file shares disabled",
+			account:        storage.Account{Sku: &storage.Sku{Tier: storage.SkuTierStandard}, AccountProperties: &storage.AccountProperties{}},
+			accountOptions: &azure.AccountOptions{EnableLargeFileShare: true},
+			expected:       false,
+		},
+		{
+			desc:           "large file shares on premium account",
+			account:        storage.Account{Sku: &storage.Sku{Tier: storage.SkuTierPremium}},
+			accountOptions: &azure.AccountOptions{EnableLargeFileShare: true},
+			expected:       true,
+		},
+		{
+			desc:           "private endpoint not found",
+			account:        storage.Account{Sku: &storage.Sku{Tier: storage.SkuTierStandard}},
+			accountOptions: &azure.AccountOptions{CreatePrivateEndpoint: true},
+			expected:       false,
+		},
+		{
+			desc:           "tags not matched",
+			account:        storage.Account{Sku: &storage.Sku{Tier: storage.SkuTierStandard}, Tags: map[string]*string{"key": to.StringPtr("value")}},
+			accountOptions: &azure.AccountOptions{MatchTags: true, Tags: map[string]string{"key": "value2"}},
+			expected:       false,
+		},
+		{
+			desc:           "tags matched",
+			account:        storage.Account{Sku: &storage.Sku{Tier: storage.SkuTierStandard}, Tags: map[string]*string{"key": to.StringPtr("value")}},
+			accountOptions: &azure.AccountOptions{MatchTags: true, Tags: map[string]string{"key": "value"}},
+			expected:       true,
+		},
+	}
+
+	for _, test := range tests {
+		result := isAccountMatched(test.account, test.accountOptions)
+		if result != test.expected {
+			t.Errorf("test[%s]: isAccountMatched returned with: %v, expected: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestIsEncryptionMatched(t *testing.T) {
+	identity := "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/identity"
+	cmkAccount := storage.Account{AccountProperties: &storage.AccountProperties{
+		Encryption: &storage.Encryption{
+			KeySource:          storage.KeySourceMicrosoftKeyvault,
+			KeyVaultProperties: &storage.KeyVaultProperties{KeyVaultURI: to.StringPtr("https://vault.vault.azure.net/"), KeyName: to.StringPtr("key")},
+			EncryptionIdentity: &storage.EncryptionIdentity{EncryptionUserAssignedIdentity: to.StringPtr(identity)},
+		},
+	}}
+	tests := []struct {
+		desc           string
+		account        storage.Account
+		accountOptions *azure.AccountOptions
+		identity       string
+		expected       bool
+	}{
+		{
+			desc:           "no customer-managed key",
+			account:        storage.Account{AccountProperties: &storage.AccountProperties{Encryption: &storage.Encryption{KeySource: storage.KeySourceMicrosoftStorage}}},
+			accountOptions: &azure.AccountOptions{},
+			expected:       true,
+		},
+		{
+			desc:           "customer-managed key account without customer-managed key settings",
+			account:        cmkAccount,
+			accountOptions: &azure.AccountOptions{},
+			expected:       false,
+		},
+		{
+			desc:           "customer-managed key settings on microsoft-managed key account",
+			account:        storage.Account{},
+			accountOptions: &azure.AccountOptions{KeyVaultURI: to.StringPtr("https://vault.vault.azure.net/"), KeyName: to.StringPtr("key")},
+			identity:       identity,
+			expected:       false,
+		},
+		{
+			desc:           "customer-managed key matched",
+			account:        cmkAccount,
+			accountOptions: &azure.AccountOptions{KeyVaultURI: to.StringPtr("https://Vault.vault.azure.net"), KeyName: to.StringPtr("key")},
+			identity:       identity,
+			expected:       true,
+		},
+		{
+			desc:           "key version not matched",
+			account:        cmkAccount,
+			accountOptions: &azure.AccountOptions{KeyVaultURI: to.StringPtr("https://vault.vault.azure.net/"), KeyName: to.StringPtr("key"), KeyVersion: to.StringPtr("version")},
+			identity:       identity,
+			expected:       false,
+		},
+		{
+			desc:           "identity not matched",
+			account:        cmkAccount,
+			accountOptions: &azure.AccountOptions{KeyVaultURI: to.StringPtr("https://vault.vault.azure.net/"), KeyName: to.StringPtr("key")},
+			identity:       identity + "2",
+			expected:       false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isEncryptionMatched(test.account, test.accountOptions, test.identity)
+		if result != test.expected {
+			t.Errorf("test[%s]: isEncryptionMatched returned with: %v, expected: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestSelectStorageAccount(t *testing.T) {
+	name, location := "account1", "westus"
+	accounts := []storage.Account{
+		{Name: &name, Sku: &storage.Sku{Name: storage.SkuNameStandardLRS, Tier: storage.SkuTierStandard}, Kind: storage.KindStorageV2, Location: &location},
+	}
+
+	d := NewFakeDriver()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+
+	// no account in the pool matches premium sku
+	accountOptions := &azure.AccountOptions{Type: string(storage.SkuNamePremiumLRS), Kind: string(storage.KindFileStorage), ResourceGroup: "rg", Location: location}
+	result, err := d.selectStorageAccount(context.Background(), leastSharesPolicy, accountOptions, &accountSelectionRequest{PoolKey: "pool", RequestGiB: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, "", result)
+
+	// matching account is skipped with private endpoint setting
+	accountOptions = &azure.AccountOptions{Type: string(storage.SkuNameStandardLRS), Kind: string(storage.KindStorageV2), ResourceGroup: "rg", Location: location, CreatePrivateEndpoint: true}
+	result, err = d.selectStorageAccount(context.Background(), roundRobinPolicy, accountOptions, &accountSelectionRequest{PoolKey: "pool", RequestGiB: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, "", result)
+
+	// no matching account without policy
+	accountOptions = &azure.AccountOptions{Type: string(storage.SkuNamePremiumLRS), Kind: string(storage.KindFileStorage), ResourceGroup: "rg", Location: location}
+	result, err = d.selectStorageAccount(context.Background(), "", accountOptions, &accountSelectionRequest{PoolKey: "pool"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", result)
+
+	// first matching account is selected without policy
+	accountOptions = &azure.AccountOptions{Type: string(storage.SkuNameStandardLRS), Kind: string(storage.KindStorageV2), ResourceGroup: "rg", Location: location}
+	result, err = d.selectStorageAccount(context.Background(), "", accountOptions, &accountSelectionRequest{PoolKey: "pool"})
+	assert.NoError(t, err)
+	assert.Equal(t, name, result)
+
+	_, err = d.selectStorageAccount(context.Background(), "random", accountOptions, &accountSelectionRequest{PoolKey: "pool"})
+	assert.Equal(t, fmt.Errorf("account selection policy(random) is not supported"), err)
+}
+
+func TestDiscardStorageAccount(t *testing.T) {
+	d := NewFakeDriver()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+	mockStorageAccountsClient.EXPECT().Delete(gomock.Any(), "subscriptionID", "rg", "account1").Return(nil)
+	d.discardStorageAccount(context.Background(), "", "rg", "account1")
+
+	// account is tagged to skip matching if it could not be deleted
+	mockStorageAccountsClient.EXPECT().Delete(gomock.Any(), "subs", "rg", "account2").Return(&retry.Error{RawError: fmt.Errorf("test error")})
+	mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), "subs", "rg", "account2").Return(storage.Account{}, nil)
+	mockStorageAccountsClient.EXPECT().Update(gomock.Any(), "subs", "rg", "account2", gomock.Any()).DoAndReturn(
+		func(ctx context.Context, subsID, resourceGroup, accountName string, parameters storage.AccountUpdateParameters) *retry.Error {
+			_, ok := parameters.Tags[azure.SkipMatchingTag]
+			assert.True(t, ok)
+			return nil
+		})
+	d.discardStorageAccount(context.Background(), "subs", "rg", "account2")
+}
@@ -20,6 +20,7 @@ limitations under the License.
 package azurefile
 
 import (
+	"fmt"
 	"os"
 
 	mount "k8s.io/mount-utils"
@@ -29,6 +30,14 @@ func SMBMount(m *mount.SafeFormatAndMount, source, target, fsType string, option
 	return nil
 }
 
+func SMBRemount(m *mount.SafeFormatAndMount, source, target string, options, sensitiveMountOptions []string) error {
+	return fmt.Errorf("remount is not supported on darwin")
+}
+
+func isSMBAuthError(err error) bool {
+	return false
+}
+
 func SMBUnmount(m *mount.SafeFormatAndMount, target string) error {
 	return nil
 }
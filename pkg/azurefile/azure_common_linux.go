@@ -20,7 +20,9 @@ limitations under the License.
 package azurefile
 
 import (
+	"errors"
 	"os"
+	"syscall"
 
 	mount "k8s.io/mount-utils"
 )
@@ -29,6 +31,16 @@ func SMBMount(m *mount.SafeFormatAndMount, source, target, fsType string, option
 	return m.MountSensitive(source, target, fsType, options, sensitiveMountOptions)
 }
 
+// SMBRemount remounts cifs mount in place with credentials in sensitiveMountOptions
+func SMBRemount(m *mount.SafeFormatAndMount, source, target string, options, sensitiveMountOptions []string) error {
+	return m.MountSensitive(source, target, cifs, append([]string{"remount"}, options...), sensitiveMountOptions)
+}
+
+// isSMBAuthError returns true if the error of accessing cifs mount could be caused by authentication failure on reconnect
+func isSMBAuthError(err error) bool {
+	return errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EKEYEXPIRED) || errors.Is(err, syscall.EKEYREJECTED)
+}
+
 func SMBUnmount(m *mount.SafeFormatAndMount, target string) error {
 	return m.Unmount(target)
 }
@@ -34,6 +34,14 @@ func SMBMount(m *mount.SafeFormatAndMount, source, target, fsType string, mountO
 	return fmt.Errorf("could not cast to csi proxy class")
 }
 
+func SMBRemount(m *mount.SafeFormatAndMount, source, target string, options, sensitiveMountOptions []string) error {
+	return fmt.Errorf("remount is not supported on windows")
+}
+
+func isSMBAuthError(err error) bool {
+	return false
+}
+
 func SMBUnmount(m *mount.SafeFormatAndMount, target string) error {
 	if proxy, ok := m.Interface.(mounter.CSIProxyMounter); ok {
 		return proxy.SMBUnmount(target)
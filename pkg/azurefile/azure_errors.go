@@ -0,0 +1,260 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorCategory is the category of error returned by Azure management or data plane API
+type errorCategory string
+
+const (
+	errorCategoryUnknown       errorCategory = "Unknown"
+	errorCategoryNotFound      errorCategory = "NotFound"
+	errorCategoryThrottled     errorCategory = "Throttled"
+	errorCategoryQuotaExceeded errorCategory = "QuotaExceeded"
+	errorCategoryAuthFailed    errorCategory = "AuthFailed"
+	errorCategoryBeingDeleted  errorCategory = "BeingDeleted"
+	// storage account is being provisioned
+	errorCategoryNotReady errorCategory = "NotReady"
+	// deadline of gRPC request is exceeded or the request is cancelled
+	errorCategoryDeadlineExceeded errorCategory = "DeadlineExceeded"
+	errorCategoryCanceled         errorCategory = "Canceled"
+
+	shareNotFound = "ShareNotFound"
+)
+
+var (
+	// service error codes of management and data plane API
+	errorCodeCategories = map[string]errorCategory{
+		"ShareNotFound":                          errorCategoryNotFound,
+		"ShareSnapshotNotFound":                  errorCategoryNotFound,
+		"ResourceNotFound":                       errorCategoryNotFound,
+		"ParentNotFound":                         errorCategoryNotFound,
+		"StorageAccountNotFound":                 errorCategoryNotFound,
+		"ResourceGroupNotFound":                  errorCategoryNotFound,
+		tooManyRequests:                          errorCategoryThrottled,
+		serverBusy:                               errorCategoryThrottled,
+		"SubscriptionRequestsThrottled":          errorCategoryThrottled,
+		accountLimitExceedManagementAPI:          errorCategoryQuotaExceeded,
+		"TotalSharesCountExceedsAccountLimit":    errorCategoryQuotaExceeded,
+		"TotalSharesCapacityExceedsAccountLimit": errorCategoryQuotaExceeded,
+		"AuthenticationFailed":                   errorCategoryAuthFailed,
+		"AuthorizationFailed":                    errorCategoryAuthFailed,
+		"AuthorizationFailure":                   errorCategoryAuthFailed,
+		"AuthorizationPermissionMismatch":        errorCategoryAuthFailed,
+		"InvalidAuthenticationInfo":              errorCategoryAuthFailed,
+		"ShareBeingDeleted":                      errorCategoryBeingDeleted,
+		accountNotProvisioned:                    errorCategoryNotReady,
+	}
+
+	// error codes returned if the storage account could not hold more file shares
+	accountLimitExceededCodes = map[string]bool{
+		accountLimitExceedManagementAPI:          true,
+		"TotalSharesCountExceedsAccountLimit":    true,
+		"TotalSharesCapacityExceedsAccountLimit": true,
+	}
+
+	// errors returned without any response of Azure API, e.g. client side throttling of cloud provider,
+	// they are matched by message only if neither error type nor error code is found
+	errorMessageCategories = map[string]errorCategory{
+		clientThrottled:   errorCategoryThrottled,
+		shareBeingDeleted: errorCategoryBeingDeleted,
+	}
+
+	// errors whose type is lost are classified by the fields formatted in error message, e.g.
+	// retry.Error: "Retriable: true, RetryAfter: 16s, HTTPStatusCode: 429, RawError: ..."
+	// autorest.DetailedError: "StatusCode=409 -- Original Error: autorest/azure: Service returned an error. Status=<nil> Code=\"ShareBeingDeleted\""
+	httpStatusCodeRegex = regexp.MustCompile(`(?:HTTPStatusCode: |StatusCode=)(\d{3})\b`)
+	errorCodeRegex      = regexp.MustCompile(`(?:Code=\\?"|ErrorCode=|"code":\s*")(\w+)`)
+)
+
+// azureErrorDetail is extracted from error returned by Azure SDKs
+type azureErrorDetail struct {
+	StatusCode int
+	Code       string
+	RetryAfter time.Duration
+}
+
+// getAzureErrorDetail returns http status code, service error code and Retry-After of err, error types of
+// azfile and autorest are inspected first, then the fields formatted in error message
+func getAzureErrorDetail(err error) azureErrorDetail {
+	var detail azureErrorDetail
+	if err == nil {
+		return detail
+	}
+	var stgErr azfile.StorageError
+	var requestErr *azure.RequestError
+	var detailedErr autorest.DetailedError
+	switch {
+	case errors.As(err, &stgErr):
+		if resp := stgErr.Response(); resp != nil {
+			detail.StatusCode = resp.StatusCode
+			detail.RetryAfter = getRetryAfterFromHeader(resp.Header, 0)
+		}
+		detail.Code = string(stgErr.ServiceCode())
+	case errors.As(err, &requestErr):
+		detail.StatusCode, _ = requestErr.StatusCode.(int)
+		if requestErr.ServiceError != nil {
+			detail.Code = requestErr.ServiceError.Code
+		}
+	case errors.As(err, &detailedErr):
+		detail.StatusCode, _ = detailedErr.StatusCode.(int)
+	}
+
+	msg := err.Error()
+	if detail.StatusCode == 0 {
+		if m := httpStatusCodeRegex.FindStringSubmatch(msg); len(m) == 2 {
+			detail.StatusCode, _ = strconv.Atoi(m[1])
+		}
+	}
+	if detail.RetryAfter == 0 {
+		if m := retryAfterRegex.FindStringSubmatch(msg); len(m) == 2 {
+			if sec, err := strconv.Atoi(m[1]); err == nil {
+				detail.RetryAfter = time.Duration(sec) * time.Second
+			}
+		}
+	}
+	if detail.Code == "" {
+		if m := errorCodeRegex.FindStringSubmatch(msg); len(m) == 2 {
+			detail.Code = m[1]
+		}
+	}
+	return detail
+}
+
+// classifyError returns the category of error returned by Azure API
+func classifyError(err error) errorCategory {
+	if err == nil {
+		return errorCategoryUnknown
+	}
+	if s, ok := getStatus(err); ok {
+		// error returned by driver, e.g. throttle limiter
+		switch s.Code() {
+		case codes.NotFound:
+			return errorCategoryNotFound
+		case codes.ResourceExhausted:
+			return errorCategoryThrottled
+		case codes.PermissionDenied:
+			return errorCategoryAuthFailed
+		case codes.DeadlineExceeded:
+			return errorCategoryDeadlineExceeded
+		case codes.Canceled:
+			return errorCategoryCanceled
+		}
+		return errorCategoryUnknown
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorCategoryDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return errorCategoryCanceled
+	}
+	detail := getAzureErrorDetail(err)
+	if c, ok := errorCodeCategories[detail.Code]; ok {
+		return c
+	}
+	if detail.Code == "" && !isAzureSDKError(err) {
+		msg := strings.ToLower(err.Error())
+		for m, c := range errorMessageCategories {
+			if strings.Contains(msg, strings.ToLower(m)) {
+				return c
+			}
+		}
+	}
+	switch {
+	case detail.StatusCode == http.StatusTooManyRequests || detail.RetryAfter > 0:
+		return errorCategoryThrottled
+	case detail.StatusCode == http.StatusNotFound:
+		return errorCategoryNotFound
+	case detail.StatusCode == http.StatusUnauthorized || detail.StatusCode == http.StatusForbidden:
+		return errorCategoryAuthFailed
+	}
+	return errorCategoryUnknown
+}
+
+// isAzureSDKError returns true if err is returned along with the response of Azure API
+func isAzureSDKError(err error) bool {
+	var stgErr azfile.StorageError
+	var requestErr *azure.RequestError
+	var detailedErr autorest.DetailedError
+	return errors.As(err, &stgErr) || errors.As(err, &requestErr) || errors.As(err, &detailedErr)
+}
+
+// isAccountLimitExceededError returns true if the file share could not be created since the storage account
+// reaches its limit, data plane API returns ShareNotFound in this case
+func isAccountLimitExceededError(err error, useDataPlaneAPI bool) bool {
+	code := getAzureErrorDetail(err).Code
+	return accountLimitExceededCodes[code] || (useDataPlaneAPI && code == shareNotFound)
+}
+
+// getStatus returns gRPC status of err returned by driver, the status wrapped in err is also returned,
+// e.g. the error of throttle limiter returned by data plane pipeline
+func getStatus(err error) (*status.Status, bool) {
+	var statusErr interface{ GRPCStatus() *status.Status }
+	if err == nil || !errors.As(err, &statusErr) {
+		return nil, false
+	}
+	return statusErr.GRPCStatus(), true
+}
+
+// isNotFoundError returns true if the resource of Azure API is not found
+func isNotFoundError(err error) bool {
+	return classifyError(err) == errorCategoryNotFound
+}
+
+// getGRPCCode returns the gRPC status code of error category
+func (c errorCategory) getGRPCCode() codes.Code {
+	switch c {
+	case errorCategoryNotFound:
+		return codes.NotFound
+	case errorCategoryThrottled, errorCategoryQuotaExceeded:
+		return codes.ResourceExhausted
+	case errorCategoryAuthFailed:
+		return codes.PermissionDenied
+	case errorCategoryBeingDeleted, errorCategoryNotReady:
+		return codes.Unavailable
+	case errorCategoryDeadlineExceeded:
+		return codes.DeadlineExceeded
+	case errorCategoryCanceled:
+		return codes.Canceled
+	}
+	return codes.Internal
+}
+
+// azureStatusErrorf returns gRPC status error with message and the code of err category,
+// the code of gRPC status error returned by driver is kept as is
+func azureStatusErrorf(err error, format string, a ...interface{}) error {
+	code := classifyError(err).getGRPCCode()
+	if s, ok := getStatus(err); ok {
+		code = s.Code()
+	}
+	return status.Errorf(code, format, a...)
+}
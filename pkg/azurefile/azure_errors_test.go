@@ -0,0 +1,226 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		desc     string
+		err      error
+		expected errorCategory
+	}{
+		{
+			desc:     "nil error",
+			expected: errorCategoryUnknown,
+		},
+		{
+			desc:     "unknown error",
+			err:      fmt.Errorf("test error"),
+			expected: errorCategoryUnknown,
+		},
+		{
+			desc:     "autorest request error",
+			err:      autorest.DetailedError{StatusCode: http.StatusNotFound, Original: &azure.RequestError{ServiceError: &azure.ServiceError{Code: "ShareNotFound"}}},
+			expected: errorCategoryNotFound,
+		},
+		{
+			desc:     "autorest detailed error without service error",
+			err:      autorest.DetailedError{StatusCode: http.StatusForbidden, Original: errors.New("forbidden")},
+			expected: errorCategoryAuthFailed,
+		},
+		{
+			desc:     "data plane storage error",
+			err:      fmt.Errorf("failed to create file share, err: %w", newFakeStorageError(http.StatusConflict, "ShareBeingDeleted")),
+			expected: errorCategoryBeingDeleted,
+		},
+		{
+			desc:     "cloud provider retry error",
+			err:      errors.New("Retriable: true, RetryAfter: 0s, HTTPStatusCode: 400, RawError: storage.FileSharesClient#Create: Failure responding to request: StatusCode=400 -- Original Error: autorest/azure: Service returned an error. Status=400 Code=\"TotalSharesProvisionedCapacityExceedsAccountLimit\""),
+			expected: errorCategoryQuotaExceeded,
+		},
+		{
+			desc:     "account not provisioned",
+			err:      errors.New("Retriable: true, RetryAfter: 0001-01-01 00:00:00 +0000 UTC, HTTPStatusCode: 409, RawError: Code=\"StorageAccountIsNotProvisioned\""),
+			expected: errorCategoryNotReady,
+		},
+		{
+			desc:     "http status without error code",
+			err:      errors.New("Retriable: false, RetryAfter: 0s, HTTPStatusCode: 404, RawError: not found"),
+			expected: errorCategoryNotFound,
+		},
+		{
+			desc:     "data plane error code",
+			err:      errors.New("storage: service returned error: StatusCode=403, ErrorCode=AuthenticationFailed"),
+			expected: errorCategoryAuthFailed,
+		},
+		{
+			desc:     "error code without format is not matched",
+			err:      errors.New("ShareNotFound"),
+			expected: errorCategoryUnknown,
+		},
+		{
+			desc:     "client throttled",
+			err:      errors.New("azure cloud provider rate limited(write) for operation CreateFileShare, client throttled"),
+			expected: errorCategoryThrottled,
+		},
+		{
+			desc:     "share being deleted without error code",
+			err:      errors.New("The specified share is being deleted. Try operation later."),
+			expected: errorCategoryBeingDeleted,
+		},
+		{
+			desc:     "message is not matched if error code is found",
+			err:      errors.New("Code=\"ShareNotFound\" Message=\"client throttled\""),
+			expected: errorCategoryNotFound,
+		},
+		{
+			desc:     "message is not matched for autorest request error",
+			err:      &azure.RequestError{DetailedError: autorest.DetailedError{StatusCode: http.StatusBadRequest}, ServiceError: &azure.ServiceError{Code: "InvalidHeaderValue", Message: "client throttled"}},
+			expected: errorCategoryUnknown,
+		},
+		{
+			desc:     "message is not matched for autorest detailed error",
+			err:      autorest.DetailedError{StatusCode: http.StatusConflict, Original: errors.New("The specified share is being deleted")},
+			expected: errorCategoryUnknown,
+		},
+		{
+			desc:     "context deadline exceeded",
+			err:      fmt.Errorf("failed to create file share, err: %w", context.DeadlineExceeded),
+			expected: errorCategoryDeadlineExceeded,
+		},
+		{
+			desc:     "context canceled",
+			err:      context.Canceled,
+			expected: errorCategoryCanceled,
+		},
+		{
+			desc:     "throttled by driver",
+			err:      status.Error(codes.ResourceExhausted, "throttled"),
+			expected: errorCategoryThrottled,
+		},
+		{
+			desc:     "internal error of driver",
+			err:      status.Error(codes.Internal, "ShareNotFound"),
+			expected: errorCategoryUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, classifyError(test.err), test.desc)
+	}
+}
+
+func TestGetAzureErrorDetail(t *testing.T) {
+	detail := getAzureErrorDetail(errors.New("Retriable: true, RetryAfter: 16s, HTTPStatusCode: 429, RawError: Code=\"TooManyRequests\""))
+	assert.Equal(t, azureErrorDetail{StatusCode: http.StatusTooManyRequests, Code: tooManyRequests, RetryAfter: 16 * time.Second}, detail)
+
+	detail = getAzureErrorDetail(newFakeStorageError(http.StatusServiceUnavailable, serverBusy))
+	assert.Equal(t, azureErrorDetail{StatusCode: http.StatusServiceUnavailable, Code: serverBusy, RetryAfter: 30 * time.Second}, detail)
+
+	assert.Equal(t, azureErrorDetail{}, getAzureErrorDetail(nil))
+}
+
+func TestIsAccountLimitExceededError(t *testing.T) {
+	tests := []struct {
+		desc            string
+		err             error
+		useDataPlaneAPI bool
+		expected        bool
+	}{
+		{
+			desc: "nil error",
+		},
+		{
+			desc:     "provisioned capacity exceeds account limit",
+			err:      fmt.Errorf("Code=\"%s\"", accountLimitExceedManagementAPI),
+			expected: true,
+		},
+		{
+			desc:     "share count exceeds account limit",
+			err:      autorest.DetailedError{StatusCode: http.StatusBadRequest, Original: &azure.RequestError{ServiceError: &azure.ServiceError{Code: "TotalSharesCountExceedsAccountLimit"}}},
+			expected: true,
+		},
+		{
+			desc:            "share not found returned by data plane API",
+			err:             newFakeStorageError(http.StatusNotFound, shareNotFound),
+			useDataPlaneAPI: true,
+			expected:        true,
+		},
+		{
+			desc: "share not found returned by management API",
+			err:  fmt.Errorf("Code=\"%s\"", shareNotFound),
+		},
+		{
+			desc:            "other not found error",
+			err:             fmt.Errorf("Code=\"StorageAccountNotFound\""),
+			useDataPlaneAPI: true,
+		},
+		{
+			desc:            "error code in message without format",
+			err:             fmt.Errorf("TotalSharesCountExceedsAccountLimit"),
+			useDataPlaneAPI: true,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isAccountLimitExceededError(test.err, test.useDataPlaneAPI), test.desc)
+	}
+}
+
+func TestAzureStatusErrorf(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected codes.Code
+	}{
+		{err: fmt.Errorf("test error"), expected: codes.Internal},
+		{err: fmt.Errorf("Code=\"ShareNotFound\""), expected: codes.NotFound},
+		{err: fmt.Errorf("Code=\"ShareBeingDeleted\""), expected: codes.Unavailable},
+		{err: fmt.Errorf("Code=\"%s\"", accountLimitExceedManagementAPI), expected: codes.ResourceExhausted},
+		{err: fmt.Errorf("ErrorCode=AuthorizationFailure"), expected: codes.PermissionDenied},
+		{err: status.Error(codes.ResourceExhausted, "throttled"), expected: codes.ResourceExhausted},
+		{err: status.Error(codes.InvalidArgument, "invalid"), expected: codes.InvalidArgument},
+		{err: context.DeadlineExceeded, expected: codes.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		err := azureStatusErrorf(test.err, "failed: %v", test.err)
+		assert.Equal(t, test.expected, status.Code(err), test.err.Error())
+		assert.Equal(t, fmt.Sprintf("failed: %v", test.err), status.Convert(err).Message())
+	}
+}
+
+// newFakeStorageError returns azfile.StorageError of response with statusCode and error code
+func newFakeStorageError(statusCode int, code string) error {
+	f := newFakeFileClient(func(req *http.Request) *http.Response {
+		return &http.Response{StatusCode: statusCode, Header: http.Header{errorCodeHeader: {code}, "Retry-After": {"30"}}}
+	})
+	return f.deleteFileShare(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "share")
+}
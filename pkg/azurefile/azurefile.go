@@ -21,17 +21,25 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net/url"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
 	"github.com/Azure/azure-storage-file-go/azfile"
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pborman/uuid"
 	"github.com/rubiojr/go-vhd/vhd"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -45,14 +53,13 @@ import (
 	"sigs.k8s.io/azurefile-csi-driver/pkg/mounter"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
 	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	"sigs.k8s.io/cloud-provider-azure/pkg/consts"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
-	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 )
 
 const (
 	DefaultDriverName  = "file.csi.azure.com"
 	separator          = "#"
-	volumeIDTemplate   = "%s#%s#%s#%s#%s#%s"
 	secretNameTemplate = "azure-storage-account-%s-secret"
 	serviceURLTemplate = "https://%s.file.%s"
 	fileURLTemplate    = "https://%s.file.%s/%s/%s"
@@ -65,6 +72,9 @@ const (
 	defaultDirMode     = "0777"
 	defaultActimeo     = "30"
 
+	// version of file service REST API used by operations not supported by azfile
+	fileServiceAPIVersion = "2020-02-10"
+
 	// See https://docs.microsoft.com/en-us/rest/api/storageservices/naming-and-referencing-shares--directories--files--and-metadata#share-names
 	fileShareNameMinLength = 3
 	fileShareNameMaxLength = 63
@@ -74,9 +84,30 @@ const (
 	// See https://docs.microsoft.com/en-us/azure/storage/files/storage-files-planning#provisioned-shares
 	defaultAzureFileQuota = 100
 
+	// See https://docs.microsoft.com/en-us/azure/storage/files/storage-files-scale-targets#storage-account-scale-targets
+	premiumAccountCapacityLimit  = 100 * 1024      // 100 TiB
+	standardAccountCapacityLimit = 5 * 1024 * 1024 // 5 PiB
+	maximumLargeFileShareSize    = 100 * 1024      // 100 TiB
+	maximumFileShareSize         = 5 * 1024        // 5 TiB
+
 	// key of snapshot name in metadata
 	snapshotNameKey = "initiator"
 
+	// keys of ownership metadata on file share created by driver
+	createdByMetadataKey    = "createdby"
+	clusterNameMetadataKey  = "clustername"
+	pvNameMetadataKey       = "pvname"
+	pvcNameMetadataKey      = "pvcname"
+	pvcNamespaceMetadataKey = "pvcnamespace"
+	// key of volume ID in metadata of file share which is provisioned as one volume
+	volumeIDMetadataKey = "volumeid"
+	// key of requested capacity in metadata of subdirectory volume, since quota is not enforced per subdirectory
+	requestedCapacityMetadataKey = "requestedcapacity"
+	// keys of actions taken when volume is deleted in metadata of file share or subdirectory
+	shareOnDeleteMetadataKey    = "shareondelete"
+	snapshotOnDeleteMetadataKey = "snapshotondelete"
+	subDirOnDeleteMetadataKey   = "subdirondelete"
+
 	shareNameField                    = "sharename"
 	accessTierField                   = "accesstier"
 	rootSquashTypeField               = "rootsquashtype"
@@ -129,24 +160,47 @@ const (
 	subnetNameField                   = "subnetname"
 	shareNamePrefixField              = "sharenameprefix"
 	requireInfraEncryptionField       = "requireinfraencryption"
+	provisioningModeField             = "provisioningmode"
+	subDirOnDeleteField               = "subdirondelete"
+	accountSelectionPolicyField       = "accountselectionpolicy"
+	shareOnDeleteField                = "shareondelete"
+	snapshotOnDeleteField             = "snapshotondelete"
+	softDeletedShareActionField       = "softdeletedshareaction"
+	restoreSoftDeletedShareField      = "restoresoftdeletedshare"
+	unquarantineField                 = "unquarantine"
+	keyVaultURIField                  = "keyvaulturi"
+	keyNameField                      = "keyname"
+	keyVersionField                   = "keyversion"
+	userAssignedIdentityField         = "userassignedidentity"
+	credentialProvidersField          = "credentialproviders"
 	premium                           = "premium"
 
+	// in subdirectory provisioning mode, a directory inside a shared file share is provisioned as volume
+	subDirProvisioningMode = "subdirectory"
+	// default name of the shared file share in subdirectory provisioning mode if shareName is not specified
+	defaultSubDirShareName = "pvc-subdir-pool"
+	// actions taken on subdirectory when volume is deleted
+	subDirOnDeleteDelete  = "delete"
+	subDirOnDeleteArchive = "archive"
+	subDirOnDeleteRetain  = "retain"
+	// prefix of the directory name which subdirectory is archived into
+	archivedSubDirPrefix = "archived-"
+
+	// topology keys reported by NodeGetInfo and returned in AccessibleTopology of CreateVolume
+	topologyRegionKey = "topology.file.csi.azure.com/region"
+	topologyZoneKey   = "topology.file.csi.azure.com/zone"
+
 	accountNotProvisioned = "StorageAccountIsNotProvisioned"
 	// this is a workaround fix for 429 throttling issue, will update cloud provider for better fix later
 	tooManyRequests   = "TooManyRequests"
 	shareBeingDeleted = "The specified share is being deleted"
 	clientThrottled   = "client throttled"
-	// accountLimitExceed returned by different API
+	// accountLimitExceed returned by management API
 	accountLimitExceedManagementAPI = "TotalSharesProvisionedCapacityExceedsAccountLimit"
-	accountLimitExceedDataPlaneAPI  = "specified share does not exist"
 
-	fileShareNotFound  = "ErrorCode=ShareNotFound"
-	statusCodeNotFound = "StatusCode=404"
-	httpCodeNotFound   = "HTTPStatusCode: 404"
-
-	// define different sleep time when hit throttling
-	accountOpThrottlingSleepSec = 16
-	fileOpThrottlingSleepSec    = 180
+	// define different Retry-After when hit throttling without Retry-After
+	accountOpThrottlingRetryAfter = 16 * time.Second
+	fileOpThrottlingRetryAfter    = 180 * time.Second
 
 	defaultAccountNamePrefix = "f"
 
@@ -174,8 +228,11 @@ var (
 	supportedProtocolList            = []string{smb, nfs}
 	supportedDiskFsTypeList          = []string{ext4, ext3, ext2, xfs}
 	supportedFSGroupChangePolicyList = []string{FSGroupChangeNone, string(v1.FSGroupChangeAlways), string(v1.FSGroupChangeOnRootMismatch)}
+	supportedProvisioningModeList    = []string{subDirProvisioningMode}
+	supportedSubDirOnDeleteList      = []string{subDirOnDeleteDelete, subDirOnDeleteArchive, subDirOnDeleteRetain}
 
-	retriableErrors = []string{accountNotProvisioned, tooManyRequests, shareBeingDeleted, clientThrottled}
+	// resource ID of user-assigned managed identity
+	userAssignedIdentityRegex = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourcegroups/[^/]+/providers/microsoft\.managedidentity/userassignedidentities/[^/]+$`)
 )
 
 // DriverOptions defines driver parameters specified in driver deployment
@@ -192,6 +249,31 @@ type DriverOptions struct {
 	EnableGetVolumeStats                   bool
 	MountPermissions                       uint64
 	FSGroupChangePolicy                    string
+	ClusterName                            string
+	EnableShareOwnershipCheck              bool
+	QuarantineDeletedShares                bool
+	QuarantineGracePeriod                  time.Duration
+	EnableQuarantinedShareMountCheck       bool
+	StaleVHDAttachmentReconcileInterval    time.Duration
+	AccountSelectionConfigMapName          string
+	AccountSelectionConfigMapNamespace     string
+	SubscriptionAPIQPS                     float64
+	SubscriptionAPIBurst                   int
+	AccountAPIQPS                          float64
+	AccountAPIBurst                        int
+	ThrottleMaxWait                        time.Duration
+	DataPlaneMaxTries                      int
+	DataPlaneTryTimeout                    time.Duration
+	DataPlaneRetryDelay                    time.Duration
+	DataPlaneMaxRetryDelay                 time.Duration
+	DataPlaneProxyURL                      string
+	DataPlaneCACertFile                    string
+	AccountKeySyncInterval                 time.Duration
+	AccountKeyRotationInterval             time.Duration
+	StagedMountCheckInterval               time.Duration
+	CredentialFilePathTemplate             string
+	AccountKeySecretGCInterval             time.Duration
+	LeaderElectionNamespace                string
 }
 
 // Driver implements all interfaces of CSI drivers
@@ -203,13 +285,28 @@ type Driver struct {
 	customUserAgent                        string
 	userAgentSuffix                        string
 	fsGroupChangePolicy                    string
+	clusterName                            string
 	allowEmptyCloudConfig                  bool
 	allowInlineVolumeKeyAccessWithIdentity bool
 	enableVHDDiskFeature                   bool
 	enableGetVolumeStats                   bool
-	mountPermissions                       uint64
-	fileClient                             *azureFileClient
-	mounter                                *mount.SafeFormatAndMount
+	enableShareOwnershipCheck              bool
+	quarantineDeletedShares                bool
+	enableQuarantinedShareMountCheck       bool
+	quarantineGracePeriod                  time.Duration
+	staleVHDAttachmentReconcileInterval    time.Duration
+	accountKeySyncInterval                 time.Duration
+	accountKeyRotationInterval             time.Duration
+	stagedMountCheckInterval               time.Duration
+	accountKeySecretGCInterval             time.Duration
+	leaderElectionNamespace                string
+	// identity of this controller replica in controller lease
+	leaderIdentity                     string
+	accountSelectionConfigMapName      string
+	accountSelectionConfigMapNamespace string
+	mountPermissions                   uint64
+	fileClient                         *azureFileClient
+	mounter                            *mount.SafeFormatAndMount
 	// lock per volume attach (only for vhd disk feature)
 	volLockMap *lockMap
 	// only for nfs feature
@@ -219,6 +316,12 @@ type Driver struct {
 	volumeLocks *volumeLocks
 	// a map storing all volumes created by this driver <volumeName, accountName>
 	volMap sync.Map
+	// a map storing cifs mounts staged on this node <volumeID, *stagedMount>
+	stagedMounts sync.Map
+	// a map storing mount paths of staged mounts whose stat is not returned yet <mountPath, struct{}>
+	pendingStagedMountStats sync.Map
+	// credential providers of account key by name
+	credentialProviders map[string]credentialProvider
 	// a timed cache storing all account name and keys retrieved by this driver <accountName, accountkey>
 	accountCacheMap *azcache.TimedCache
 	// a map storing all secret names created by this driver <secretCacheKey, "">
@@ -227,8 +330,15 @@ type Driver struct {
 	dataPlaneAPIVolCache *azcache.TimedCache
 	// a timed cache storing account search history (solve account list throttling issue)
 	accountSearchCache *azcache.TimedCache
+	// a timed cache storing provisioned capacity of storage accounts reported by GetCapacity <subsID/rg/account, GiB>
+	accountUsageCache *azcache.TimedCache
 	// a timed cache storing tag removing history (solve account update throttling issue)
 	removeTagCache *azcache.TimedCache
+	// storage account selectors keyed by selection policy
+	accountSelectors map[string]accountSelector
+	// driver-wide throttle limiters of management API per subscription and data plane API per storage account
+	subscriptionLimiter *throttleLimiter
+	accountLimiter      *throttleLimiter
 }
 
 // NewDriver Creates a NewCSIDriver object. Assumes vendor version is equal to driver version &
@@ -248,11 +358,40 @@ func NewDriver(options *DriverOptions) *Driver {
 	driver.enableGetVolumeStats = options.EnableGetVolumeStats
 	driver.mountPermissions = options.MountPermissions
 	driver.fsGroupChangePolicy = options.FSGroupChangePolicy
+	driver.clusterName = options.ClusterName
+	driver.enableShareOwnershipCheck = options.EnableShareOwnershipCheck
+	driver.quarantineDeletedShares = options.QuarantineDeletedShares
+	driver.quarantineGracePeriod = options.QuarantineGracePeriod
+	driver.enableQuarantinedShareMountCheck = options.EnableQuarantinedShareMountCheck
+	driver.staleVHDAttachmentReconcileInterval = options.StaleVHDAttachmentReconcileInterval
+	driver.accountKeySyncInterval = options.AccountKeySyncInterval
+	driver.accountKeyRotationInterval = options.AccountKeyRotationInterval
+	driver.stagedMountCheckInterval = options.StagedMountCheckInterval
+	driver.accountKeySecretGCInterval = options.AccountKeySecretGCInterval
+	driver.leaderElectionNamespace = options.LeaderElectionNamespace
+	driver.accountSelectionConfigMapName = options.AccountSelectionConfigMapName
+	driver.accountSelectionConfigMapNamespace = options.AccountSelectionConfigMapNamespace
 	driver.volLockMap = newLockMap()
 	driver.subnetLockMap = newLockMap()
 	driver.volumeLocks = newVolumeLocks()
+	driver.accountSelectors = newAccountSelectors()
+	driver.subscriptionLimiter = newThrottleLimiter(throttleScopeSubscription, options.SubscriptionAPIQPS, options.SubscriptionAPIBurst, options.ThrottleMaxWait)
+	driver.accountLimiter = newThrottleLimiter(throttleScopeAccount, options.AccountAPIQPS, options.AccountAPIBurst, options.ThrottleMaxWait)
+	driver.credentialProviders = newCredentialProviders(&driver, options.CredentialFilePathTemplate)
 
 	var err error
+	driver.fileClient, err = newAzureFileClient(nil, &dataPlaneClientOptions{
+		MaxTries:      int32(options.DataPlaneMaxTries),
+		TryTimeout:    options.DataPlaneTryTimeout,
+		RetryDelay:    options.DataPlaneRetryDelay,
+		MaxRetryDelay: options.DataPlaneMaxRetryDelay,
+		ProxyURL:      options.DataPlaneProxyURL,
+		CACertFile:    options.DataPlaneCACertFile,
+		UserAgent:     GetUserAgent(driver.Name, driver.customUserAgent, driver.userAgentSuffix),
+	}, driver.accountLimiter)
+	if err != nil {
+		klog.Fatalf("failed to create data plane client: %v", err)
+	}
 	getter := func(key string) (interface{}, error) { return nil, nil }
 
 	if driver.secretCacheMap, err = azcache.NewTimedcache(time.Minute, getter); err != nil {
@@ -263,6 +402,10 @@ func NewDriver(options *DriverOptions) *Driver {
 		klog.Fatalf("%v", err)
 	}
 
+	if driver.accountUsageCache, err = azcache.NewTimedcache(time.Minute, getter); err != nil {
+		klog.Fatalf("%v", err)
+	}
+
 	if driver.removeTagCache, err = azcache.NewTimedcache(3*time.Minute, getter); err != nil {
 		klog.Fatalf("%v", err)
 	}
@@ -294,8 +437,7 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 	}
 	klog.V(2).Infof("cloud: %s, location: %s, rg: %s, VnetName: %s, VnetResourceGroup: %s, SubnetName: %s", d.cloud.Cloud, d.cloud.Location, d.cloud.ResourceGroup, d.cloud.VnetName, d.cloud.VnetResourceGroup, d.cloud.SubnetName)
 
-	// todo: set backoff from cloud provider config
-	d.fileClient = newAzureFileClient(&d.cloud.Environment, &retry.Backoff{Steps: 1})
+	d.fileClient.env = &d.cloud.Environment
 
 	d.mounter, err = mounter.NewSafeMounter()
 	if err != nil {
@@ -308,9 +450,14 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-			//csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 			csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 		})
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -326,46 +473,71 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 	}
 	if d.enableGetVolumeStats {
 		nodeCap = append(nodeCap, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS)
 	}
 	d.AddNodeServiceCapabilities(nodeCap)
 
+	if d.NodeID == "" {
+		if d.cloud != nil && d.cloud.KubeClient != nil {
+			// background tasks of controller are only run by the replica holding controller lease
+			go d.runWithControllerLease(d.runControllerTasks, wait.NeverStop)
+		} else {
+			d.runControllerTasks(wait.NeverStop)
+		}
+	}
+	if d.NodeID != "" && d.stagedMountCheckInterval > 0 && runtime.GOOS == "linux" {
+		go d.runStagedMountChecker(d.stagedMountCheckInterval, wait.NeverStop)
+	}
+
 	s := csicommon.NewNonBlockingGRPCServer()
 	// Driver d act as IdentityServer, ControllerServer and NodeServer
 	s.Start(endpoint, d, d, d, testBool)
 	s.Wait()
 }
 
+// runControllerTasks starts background tasks of controller until stopCh is closed
+func (d *Driver) runControllerTasks(stopCh <-chan struct{}) {
+	if d.quarantineGracePeriod > 0 {
+		go d.runQuarantineReaper(stopCh)
+	}
+	if d.cloud == nil || d.cloud.KubeClient == nil {
+		return
+	}
+	if d.enableVHDDiskFeature && d.staleVHDAttachmentReconcileInterval > 0 {
+		go d.runStaleVHDAttachmentReconciler(d.staleVHDAttachmentReconcileInterval, stopCh)
+	}
+	if d.accountKeySyncInterval > 0 {
+		go d.runAccountKeyReconciler(d.accountKeySyncInterval, stopCh)
+	}
+	if d.accountKeySecretGCInterval > 0 {
+		go d.runAccountKeySecretGC(d.accountKeySecretGCInterval, stopCh)
+	}
+}
+
 // getFileShareQuota return (-1, nil) means file share does not exist
-func (d *Driver) getFileShareQuota(subsID, resourceGroupName, accountName, fileShareName string, secrets map[string]string) (int, error) {
+func (d *Driver) getFileShareQuota(ctx context.Context, subsID, resourceGroupName, accountName, storageEndpointSuffix, fileShareName string, secrets map[string]string) (int, error) {
 	if len(secrets) > 0 {
 		accountName, accountKey, err := getStorageAccount(secrets)
 		if err != nil {
 			return -1, err
 		}
-		fileClient, err := d.fileClient.getFileSvcClient(accountName, accountKey)
-		if err != nil {
-			return -1, err
-		}
-		share := fileClient.GetShareReference(fileShareName)
-		exists, err := share.Exists()
-		if err != nil {
-			return -1, err
-		}
-		if !exists {
-			return -1, nil
-		}
-		return share.Properties.Quota, nil
+		quota, err := d.fileClient.getFileShareQuota(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName)
+		return quota, d.accountLimiter.throttledError(accountName, err, fileOpThrottlingRetryAfter)
 	}
 
+	key := d.getSubscriptionThrottleKey(subsID)
+	if err := d.subscriptionLimiter.wait(ctx, key); err != nil {
+		return -1, err
+	}
 	fileShare, err := d.cloud.GetFileShare(subsID, resourceGroupName, accountName, fileShareName)
 	if err != nil {
-		if strings.Contains(err.Error(), "ShareNotFound") {
+		if isNotFoundError(err) {
 			return -1, nil
 		}
-		return -1, err
+		return -1, d.subscriptionLimiter.throttledError(key, err, fileOpThrottlingRetryAfter)
 	}
 
 	if fileShare.FileShareProperties == nil || fileShare.FileShareProperties.ShareQuota == nil {
@@ -374,34 +546,84 @@ func (d *Driver) getFileShareQuota(subsID, resourceGroupName, accountName, fileS
 	return int(*fileShare.FileShareProperties.ShareQuota), nil
 }
 
-// get file share info according to volume id, e.g.
-// input: "rg#f5713de20cde511e8ba4900#fileShareName#diskname.vhd#uuid#namespace#subsID"
-// output: rg, f5713de20cde511e8ba4900, fileShareName, diskname.vhd, namespace, subsID
-func GetFileShareInfo(id string) (string, string, string, string, string, string, error) {
-	segments := strings.Split(id, separator)
-	if len(segments) < 3 {
-		return "", "", "", "", "", "", fmt.Errorf("error parsing volume id: %q, should at least contain two #", id)
+// getFileShareMetadata return (nil, nil) means file share does not exist
+func (d *Driver) getFileShareMetadata(ctx context.Context, subsID, resourceGroupName, accountName, storageEndpointSuffix, fileShareName string, secrets map[string]string) (map[string]string, error) {
+	if len(secrets) > 0 {
+		accountName, accountKey, err := getStorageAccount(secrets)
+		if err != nil {
+			return nil, err
+		}
+		metadata, err := d.fileClient.getFileShareMetadata(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName)
+		return metadata, d.accountLimiter.throttledError(accountName, err, fileOpThrottlingRetryAfter)
 	}
-	rg := segments[0]
-	var diskName, namespace, subsID string
-	if len(segments) > 3 {
-		diskName = segments[3]
+
+	key := d.getSubscriptionThrottleKey(subsID)
+	if err := d.subscriptionLimiter.wait(ctx, key); err != nil {
+		return nil, err
 	}
-	if rg == "" {
-		// in csi migration, rg could be empty, then the 5th element is namespace
-		// https://github.com/kubernetes/kubernetes/blob/v1.23.5/staging/src/k8s.io/csi-translation-lib/plugins/azure_file.go#L137
-		if len(segments) > 4 {
-			namespace = segments[4]
+	fileShare, err := d.cloud.GetFileShare(subsID, resourceGroupName, accountName, fileShareName)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, nil
 		}
-	} else {
-		if len(segments) > 5 {
-			namespace = segments[5]
+		return nil, d.subscriptionLimiter.throttledError(key, err, fileOpThrottlingRetryAfter)
+	}
+	metadata := map[string]string{}
+	if fileShare.FileShareProperties != nil {
+		for k, v := range fileShare.FileShareProperties.Metadata {
+			// metadata keys are case-insensitive
+			metadata[strings.ToLower(k)] = to.String(v)
 		}
-		if len(segments) > 6 {
-			subsID = segments[6]
+	}
+	return metadata, nil
+}
+
+// updateFileShareMetadata merges metadata into existing metadata of file share
+func (d *Driver) updateFileShareMetadata(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName string, metadata map[string]*string) error {
+	shareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return err
+	}
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		return err
+	}
+	existing := properties.NewMetadata()
+	for k, v := range metadata {
+		if v != nil {
+			existing[k] = *v
+		}
+	}
+	_, err = shareURL.SetMetadata(ctx, existing)
+	return err
+}
+
+// getShareOwnershipMetadata returns the metadata set on file share created by driver, empty values are skipped
+func (d *Driver) getShareOwnershipMetadata(pvName, pvcName, pvcNamespace string) map[string]*string {
+	metadata := map[string]*string{}
+	for k, v := range map[string]string{
+		createdByMetadataKey:    d.Name,
+		clusterNameMetadataKey:  d.clusterName,
+		pvNameMetadataKey:       pvName,
+		pvcNameMetadataKey:      pvcName,
+		pvcNamespaceMetadataKey: pvcNamespace,
+	} {
+		if v != "" {
+			metadata[k] = to.StringPtr(v)
 		}
 	}
-	return rg, segments[1], segments[2], diskName, namespace, subsID, nil
+	return metadata
+}
+
+// checkShareOwnership returns error if file share was not created by driver in this cluster according to its metadata
+func (d *Driver) checkShareOwnership(shareName string, metadata map[string]string) error {
+	if metadata[createdByMetadataKey] != d.Name {
+		return fmt.Errorf("file share(%s) was not created by driver(%s), metadata: %v", shareName, d.Name, metadata)
+	}
+	if metadata[clusterNameMetadataKey] != d.clusterName {
+		return fmt.Errorf("file share(%s) belongs to cluster(%s) instead of cluster(%s)", shareName, metadata[clusterNameMetadataKey], d.clusterName)
+	}
+	return nil
 }
 
 // check whether mountOptions contains file_mode, dir_mode, vers, if not, append default mode
@@ -509,54 +731,56 @@ func checkShareNameBeginAndEnd(fileShareName string) bool {
 	return false
 }
 
-// get snapshot name according to snapshot id, e.g.
-// input: "rg#f5713de20cde511e8ba4900#csivolumename#diskname#2019-08-22T07:17:53.0000000Z"
-// output: 2019-08-22T07:17:53.0000000Z (last element)
-func getSnapshot(id string) (string, error) {
-	segments := strings.Split(id, separator)
-	if len(segments) < 5 {
-		return "", fmt.Errorf("error parsing volume id: %q, should at least contain four #", id)
+// get snapshot creation time according to snapshot name, e.g.
+// input: 2019-08-22T07:17:53.0000000Z
+// output: timestamp of 2019-08-22T07:17:53Z
+func getSnapshotCreationTime(snapshot string) (*timestamppb.Timestamp, error) {
+	t, err := time.Parse(time.RFC3339, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing snapshot creation time: %q, %v", snapshot, err)
 	}
-	return segments[len(segments)-1], nil
+	return timestamppb.New(t), nil
 }
 
-func getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string) (*azfile.FileURL, error) {
+// get account name and list marker according to list token, e.g.
+// input: "f5713de20cde511e8ba4900#/f5713de20cde511e8ba4900/pvc-123"
+// output: f5713de20cde511e8ba4900, /f5713de20cde511e8ba4900/pvc-123
+func parseListToken(token string) (string, string, error) {
+	segments := strings.SplitN(token, separator, 2)
+	if len(segments) < 2 || segments[0] == "" {
+		return "", "", fmt.Errorf("error parsing list token: %q, should be in format of account#marker", token)
+	}
+	return segments[0], segments[1], nil
+}
+
+// generateShareSASToken generates a read-only SAS token of the file share, which is used as
+// authorization of the copy source since the copy source could be in another storage account
+func generateShareSASToken(accountName, accountKey, fileShareName string, expiry time.Duration) (string, error) {
 	credential, err := azfile.NewSharedKeyCredential(accountName, accountKey)
 	if err != nil {
-		return nil, fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
-	}
-	u, err := url.Parse(fmt.Sprintf(fileURLTemplate, accountName, storageEndpointSuffix, fileShareName, diskName))
+		return "", fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
+	}
+	sasQueryParams, err := azfile.FileSASSignatureValues{
+		Protocol:    azfile.SASProtocolHTTPS,
+		ExpiryTime:  time.Now().UTC().Add(expiry),
+		Permissions: azfile.ShareSASPermissions{Read: true, List: true}.String(),
+		ShareName:   fileShareName,
+	}.NewSASQueryParameters(credential)
 	if err != nil {
-		return nil, fmt.Errorf("parse fileURLTemplate error: %v", err)
-	}
-	if u == nil {
-		return nil, fmt.Errorf("parse fileURLTemplate error: url is nil")
-	}
-	po := azfile.PipelineOptions{
-		// Set RetryOptions to control how HTTP request are retried when retryable failures occur
-		Retry: azfile.RetryOptions{
-			Policy:        azfile.RetryPolicyExponential, // Use exponential backoff as opposed to linear
-			MaxTries:      3,                             // Try at most 3 times to perform the operation (set to 1 to disable retries)
-			TryTimeout:    time.Second * 3,               // Maximum time allowed for any single try
-			RetryDelay:    time.Second * 1,               // Backoff amount for each retry (exponential or linear)
-			MaxRetryDelay: time.Second * 3,               // Max delay between retries
-		},
+		return "", fmt.Errorf("generate SAS token of share(%s) failed with error: %v", fileShareName, err)
 	}
-	fileURL := azfile.NewFileURL(*u, azfile.NewPipeline(credential, po))
-	return &fileURL, nil
+	return sasQueryParams.Encode(), nil
 }
 
-func createDisk(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, diskSizeBytes int64) error {
-	vhdHeader := vhd.CreateFixedHeader(uint64(diskSizeBytes), &vhd.VHDOptions{})
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.BigEndian, vhdHeader); nil != err {
-		return fmt.Errorf("failed to write VHDHeader(%+v): %v", vhdHeader, err)
+func (d *Driver) createDisk(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, diskSizeBytes int64) error {
+	headerBytes, err := getVHDHeader(diskSizeBytes)
+	if err != nil {
+		return err
 	}
-	headerBytes := buf.Bytes()
 	start := diskSizeBytes - int64(len(headerBytes))
 	end := diskSizeBytes - 1
 
-	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
+	fileURL, err := d.fileClient.getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
 	if err != nil {
 		return err
 	}
@@ -572,106 +796,165 @@ func createDisk(ctx context.Context, accountName, accountKey, storageEndpointSuf
 	return nil
 }
 
+// resizeDisk grows the fixed vhd disk file to diskSizeBytes and rewrites the vhd footer at the end of the new file,
+// shrinking is not supported and it's a no-op if the disk file is already larger than or equal to diskSizeBytes
+func (d *Driver) resizeDisk(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, diskSizeBytes int64) error {
+	fileURL, err := d.fileClient.getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
+	if err != nil {
+		return err
+	}
+	if fileURL == nil {
+		return fmt.Errorf("getFileURL(%s,%s,%s,%s) return empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName)
+	}
+	properties, err := fileURL.GetProperties(ctx)
+	if err != nil {
+		return err
+	}
+	currentSizeBytes := properties.ContentLength()
+	if currentSizeBytes >= diskSizeBytes {
+		// file system on the node may have been expanded over the tail of the disk, don't touch it again
+		klog.V(2).Infof("size(%d) of disk(%s) on share(%s) is not smaller than requested size(%d), skip resizing", currentSizeBytes, diskName, fileShareName, diskSizeBytes)
+		return nil
+	}
+
+	headerBytes, err := getVHDHeader(diskSizeBytes)
+	if err != nil {
+		return err
+	}
+	if _, err = fileURL.Resize(ctx, diskSizeBytes); err != nil {
+		return err
+	}
+	if _, err = fileURL.UploadRange(ctx, diskSizeBytes-vhd.VHD_HEADER_SIZE, bytes.NewReader(headerBytes[:vhd.VHD_HEADER_SIZE]), nil); err != nil {
+		return err
+	}
+	klog.V(2).Infof("resize disk(%s) on share(%s) from %d to %d bytes successfully", diskName, fileShareName, currentSizeBytes, diskSizeBytes)
+	return nil
+}
+
+// getVHDHeader returns the footer of a fixed vhd disk with diskSizeBytes
+func getVHDHeader(diskSizeBytes int64) ([]byte, error) {
+	vhdHeader := vhd.CreateFixedHeader(uint64(diskSizeBytes), &vhd.VHDOptions{})
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, vhdHeader); nil != err {
+		return nil, fmt.Errorf("failed to write VHDHeader(%+v): %v", vhdHeader, err)
+	}
+	return buf.Bytes(), nil
+}
+
 func IsCorruptedDir(dir string) bool {
 	_, pathErr := mount.PathExists(dir)
 	return pathErr != nil && mount.IsCorruptedMnt(pathErr)
 }
 
 // GetAccountInfo get account info
-// return <rgName, accountName, accountKey, fileShareName, diskName, subsID, err>
-func (d *Driver) GetAccountInfo(ctx context.Context, volumeID string, secrets, reqContext map[string]string) (string, string, string, string, string, string, error) {
-	rgName, accountName, fileShareName, diskName, secretNamespace, subsID, err := GetFileShareInfo(volumeID)
+// return <volume handle overridden by request context, accountKey, err>
+func (d *Driver) GetAccountInfo(ctx context.Context, volumeID string, secrets, reqContext map[string]string) (*VolumeHandle, string, error) {
+	h, err := ParseVolumeHandle(volumeID)
 	if err != nil {
 		// ignore volumeID parsing error
 		klog.Warningf("parsing volumeID(%s) return with error: %v", volumeID, err)
-		err = nil
+		h, err = &VolumeHandle{}, nil
 	}
 
-	var protocol, accountKey, secretName, pvcNamespace string
+	var accountKey, secretName, pvcNamespace, credentialProviders string
 	// indicates whether get account key only from k8s secret
 	getAccountKeyFromSecret := false
 
 	for k, v := range reqContext {
 		switch strings.ToLower(k) {
 		case subscriptionIDField:
-			subsID = v
+			h.SubscriptionID = v
 		case resourceGroupField:
-			rgName = v
+			h.ResourceGroup = v
 		case storageAccountField:
-			accountName = v
+			h.AccountName = v
 		case getAccountKeyFromSecretField:
 			if strings.EqualFold(v, trueValue) {
 				getAccountKeyFromSecret = true
 			}
 		case shareNameField:
-			fileShareName = v
+			h.FileShareName = v
 		case diskNameField:
-			diskName = v
+			h.DiskName = v
 		case protocolField:
-			protocol = v
+			h.Protocol = v
 		case secretNameField:
 			secretName = v
 		case secretNamespaceField:
-			secretNamespace = v
+			h.SecretNamespace = v
 		case pvcNamespaceKey:
 			pvcNamespace = v
+		case credentialProvidersField:
+			credentialProviders = v
 		}
 	}
 
-	if rgName == "" {
-		rgName = d.cloud.ResourceGroup
+	if h.ResourceGroup == "" {
+		h.ResourceGroup = d.cloud.ResourceGroup
 	}
-	if subsID == "" {
-		subsID = d.cloud.SubscriptionID
+	if h.SubscriptionID == "" {
+		h.SubscriptionID = d.cloud.SubscriptionID
 	}
-	if protocol == nfs && fileShareName != "" {
+	if h.Protocol == nfs && h.FileShareName != "" {
 		// nfs protocol does not need account key, return directly
-		return rgName, accountName, accountKey, fileShareName, diskName, subsID, err
+		return h, accountKey, err
 	}
 
-	if secretNamespace == "" {
+	if h.SecretNamespace == "" {
 		if pvcNamespace == "" {
-			secretNamespace = defaultNamespace
+			h.SecretNamespace = defaultNamespace
 		} else {
-			secretNamespace = pvcNamespace
+			h.SecretNamespace = pvcNamespace
 		}
 	}
 
 	if len(secrets) == 0 {
 		// read account key from cache first
-		cache, errCache := d.accountCacheMap.Get(accountName, azcache.CacheReadTypeDefault)
+		cache, errCache := d.accountCacheMap.Get(h.AccountName, azcache.CacheReadTypeDefault)
 		if errCache != nil {
-			return rgName, accountName, accountKey, fileShareName, diskName, subsID, errCache
+			return h, accountKey, errCache
 		}
 		if cache != nil {
 			accountKey = cache.(string)
 		} else {
-			if secretName == "" && accountName != "" {
-				secretName = fmt.Sprintf(secretNameTemplate, accountName)
+			var providers []string
+			if providers, err = d.parseCredentialProviders(credentialProviders); err != nil {
+				return h, accountKey, err
 			}
-			if secretName != "" {
-				var name string
-				name, accountKey, err = d.GetStorageAccountFromSecret(ctx, secretName, secretNamespace)
-				if name != "" {
-					accountName = name
-				}
-				if err != nil {
-					klog.Warningf("GetStorageAccountFromSecret(%s, %s) failed with error: %v", secretName, secretNamespace, err)
-					if !getAccountKeyFromSecret && d.cloud.StorageAccountClient != nil && accountName != "" {
-						klog.V(2).Infof("use cluster identity to get account key from (%s, %s, %s)", subsID, rgName, accountName)
-						accountKey, err = d.cloud.GetStorageAccesskey(ctx, subsID, accountName, rgName)
-						if err != nil {
-							klog.Errorf("GetStorageAccesskey(%s, %s, %s) failed with error: %v", subsID, rgName, accountName, err)
-						}
+			if getAccountKeyFromSecret || d.cloud.StorageAccountClient == nil {
+				// account key could not be read with cluster identity
+				var filtered []string
+				for _, p := range providers {
+					if p != credentialProviderIdentity {
+						filtered = append(filtered, p)
 					}
 				}
+				providers = filtered
+			}
+			if secretName == "" && h.AccountName != "" {
+				secretName = fmt.Sprintf(secretNameTemplate, h.AccountName)
+			}
+			var name string
+			name, accountKey, err = d.getAccountKeyFromProviders(ctx, providers, &credentialRequest{
+				subsID:          h.SubscriptionID,
+				resourceGroup:   h.ResourceGroup,
+				accountName:     h.AccountName,
+				secretName:      secretName,
+				secretNamespace: h.SecretNamespace,
+			})
+			if name != "" {
+				h.AccountName = name
+			}
+			if err != nil {
+				klog.Errorf("could not get key of account(%s) in rg(%s) subsID(%s): %v", h.AccountName, h.ResourceGroup, h.SubscriptionID, err)
+				return h, accountKey, err
 			}
 		}
 	} else {
 		var account string
 		account, accountKey, err = getStorageAccount(secrets)
 		if account != "" {
-			accountName = account
+			h.AccountName = account
 		}
 		if err != nil {
 			klog.Errorf("getStorageAccount failed with error: %v", err)
@@ -679,9 +962,9 @@ func (d *Driver) GetAccountInfo(ctx context.Context, volumeID string, secrets, r
 	}
 
 	if err == nil && accountKey != "" {
-		d.accountCacheMap.Set(accountName, accountKey)
+		d.accountCacheMap.Set(h.AccountName, accountKey)
 	}
-	return rgName, accountName, accountKey, fileShareName, diskName, subsID, err
+	return h, accountKey, err
 }
 
 func isSupportedProtocol(protocol string) bool {
@@ -732,22 +1015,193 @@ func isSupportedFSGroupChangePolicy(policy string) bool {
 	return false
 }
 
+func isSupportedProvisioningMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+	for _, v := range supportedProvisioningModeList {
+		if strings.EqualFold(mode, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSupportedSubDirOnDelete(onDelete string) bool {
+	if onDelete == "" {
+		return true
+	}
+	for _, v := range supportedSubDirOnDeleteList {
+		if strings.EqualFold(onDelete, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEncryptionParameters validates customer-managed key settings of storage account created by driver,
+// user-assigned identity is required since it's the only identity which could access key vault when account is created
+func validateEncryptionParameters(keyVaultURI, keyName, keyVersion, identity string) error {
+	if keyVaultURI == "" {
+		if keyName != "" || keyVersion != "" || identity != "" {
+			return fmt.Errorf("keyName, keyVersion and userAssignedIdentity could only be used with keyVaultURI")
+		}
+		return nil
+	}
+	if u, err := url.Parse(keyVaultURI); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("keyVaultURI(%s) is not a valid https URL", keyVaultURI)
+	}
+	if keyName == "" {
+		return fmt.Errorf("keyName must be provided with keyVaultURI(%s)", keyVaultURI)
+	}
+	if identity == "" {
+		return fmt.Errorf("userAssignedIdentity must be provided with keyVaultURI(%s)", keyVaultURI)
+	}
+	if !userAssignedIdentityRegex.MatchString(identity) {
+		return fmt.Errorf("userAssignedIdentity(%s) is not a valid resource ID of user-assigned managed identity", identity)
+	}
+	return nil
+}
+
+// getValidSubDirName returns the cleaned relative path of subdirectory inside file share,
+// empty string is returned if subDir is not a valid directory path
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/naming-and-referencing-shares--directories--files--and-metadata#directory-and-file-names
+func getValidSubDirName(subDir string) string {
+	subDir = strings.Trim(path.Clean("/"+subDir), "/")
+	if subDir == "" || len(subDir) > 255 || strings.ContainsAny(subDir, "\\:|<>*?\"#") {
+		return ""
+	}
+	for _, name := range strings.Split(subDir, "/") {
+		if strings.HasSuffix(name, ".") {
+			return ""
+		}
+	}
+	return subDir
+}
+
+// getTopologyFromRequirement returns the region and the distinct availability zones of the accessibility requirement,
+// preferred topologies are evaluated before requisite ones and only zones within the first found region are returned
+func getTopologyFromRequirement(requirement *csi.TopologyRequirement) (string, []string) {
+	if requirement == nil {
+		return "", nil
+	}
+	var region string
+	var zones []string
+	for _, topology := range append(requirement.GetPreferred(), requirement.GetRequisite()...) {
+		segments := topology.GetSegments()
+		zone := getSegmentValue(segments, topologyZoneKey, v1.LabelTopologyZone)
+		topologyRegion := getSegmentValue(segments, topologyRegionKey, v1.LabelTopologyRegion)
+		if topologyRegion == "" && strings.Contains(zone, "-") {
+			// availability zone is in format of <region>-<zone-id>
+			topologyRegion = zone[:strings.LastIndex(zone, "-")]
+		}
+		if topologyRegion == "" {
+			continue
+		}
+		if region == "" {
+			region = topologyRegion
+		}
+		if !strings.EqualFold(region, topologyRegion) || !isAvailabilityZone(zone, region) {
+			continue
+		}
+		found := false
+		for _, z := range zones {
+			if strings.EqualFold(z, zone) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			zones = append(zones, zone)
+		}
+	}
+	return region, zones
+}
+
+// getAccessibleTopology returns the topology where the file share on account with sku in region is accessible,
+// only a NFS file share on account with LRS sku specified by user in a single availability zone is restricted to that zone
+func getAccessibleTopology(region, sku, protocol string, zones []string) []*csi.Topology {
+	segments := map[string]string{topologyRegionKey: region}
+	if len(zones) == 1 && protocol == nfs && isLocallyRedundantSku(sku) {
+		segments[topologyZoneKey] = zones[0]
+	}
+	return []*csi.Topology{{Segments: segments}}
+}
+
+// getSegmentValue returns the value of the first found key in topology segments
+func getSegmentValue(segments map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if v, ok := segments[key]; ok && v != "" {
+			return strings.ToLower(v)
+		}
+	}
+	return ""
+}
+
+// isAvailabilityZone returns true if the zone is in format of <region>-<zone-id>
+func isAvailabilityZone(zone, region string) bool {
+	return region != "" && strings.HasPrefix(strings.ToLower(zone), strings.ToLower(region)+"-")
+}
+
+// isZoneRedundantSku returns true if the storage account sku replicates data across availability zones
+func isZoneRedundantSku(sku string) bool {
+	return strings.HasSuffix(strings.ToLower(sku), "zrs")
+}
+
+// isLocallyRedundantSku returns true if the storage account sku is Standard_LRS or Premium_LRS
+func isLocallyRedundantSku(sku string) bool {
+	return strings.EqualFold(sku, string(storage.SkuNameStandardLRS)) || strings.EqualFold(sku, string(storage.SkuNamePremiumLRS))
+}
+
+// getNodeTopology returns the region and availability zone of current node from node labels,
+// zone is empty if the node is not in an availability zone
+func (d *Driver) getNodeTopology(ctx context.Context) (string, string) {
+	var region, zone string
+	if d.cloud == nil {
+		return region, zone
+	}
+	region = strings.ToLower(d.cloud.Location)
+	if d.cloud.KubeClient != nil {
+		node, err := d.cloud.KubeClient.CoreV1().Nodes().Get(ctx, d.NodeID, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("failed to get node(%s), error: %v", d.NodeID, err)
+		} else {
+			if v := getSegmentValue(node.Labels, v1.LabelTopologyRegion, v1.LabelFailureDomainBetaRegion); v != "" {
+				region = v
+			}
+			zone = getSegmentValue(node.Labels, v1.LabelTopologyZone, v1.LabelFailureDomainBetaZone)
+		}
+	}
+	if !isAvailabilityZone(zone, region) {
+		// fault domain is not an availability zone
+		zone = ""
+	}
+	return region, zone
+}
+
 // CreateFileShare creates a file share
-func (d *Driver) CreateFileShare(accountOptions *azure.AccountOptions, shareOptions *fileclient.ShareOptions, secrets map[string]string) error {
-	return wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+func (d *Driver) CreateFileShare(ctx context.Context, accountOptions *azure.AccountOptions, storageEndpointSuffix string, shareOptions *fileclient.ShareOptions, secrets map[string]string) error {
+	return wait.ExponentialBackoffWithContext(ctx, d.cloud.RequestBackoff(), func() (bool, error) {
 		var err error
+		limiter, key := d.subscriptionLimiter, d.getSubscriptionThrottleKey(accountOptions.SubscriptionID)
 		if len(secrets) > 0 {
 			accountName, accountKey, rerr := getStorageAccount(secrets)
 			if rerr != nil {
 				return true, rerr
 			}
-			err = d.fileClient.CreateFileShare(accountName, accountKey, shareOptions)
+			limiter, key = d.accountLimiter, accountName
+			err = d.fileClient.CreateFileShare(ctx, accountName, accountKey, storageEndpointSuffix, shareOptions)
 		} else {
+			if err := limiter.wait(ctx, key); err != nil {
+				return true, err
+			}
 			err = d.cloud.FileClient.WithSubscriptionID(accountOptions.SubscriptionID).CreateFileShare(accountOptions.ResourceGroup, accountOptions.Name, shareOptions)
 		}
+		if limiter.throttled(key, err, fileOpThrottlingRetryAfter) {
+			return true, status.Errorf(codes.ResourceExhausted, "CreateFileShare(%s) on account(%s) is throttled: %v", shareOptions.Name, accountOptions.Name, err)
+		}
 		if isRetriableError(err) {
 			klog.Warningf("CreateFileShare(%s) on account(%s) failed with error(%v), waiting for retrying", shareOptions.Name, accountOptions.Name, err)
-			sleepIfThrottled(err, fileOpThrottlingSleepSec)
 			return false, nil
 		}
 		return true, err
@@ -755,35 +1209,38 @@ func (d *Driver) CreateFileShare(accountOptions *azure.AccountOptions, shareOpti
 }
 
 // DeleteFileShare deletes a file share using storage account name and key
-func (d *Driver) DeleteFileShare(ctx context.Context, subsID, resourceGroup, accountName, shareName string, secrets map[string]string) error {
-	return wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+func (d *Driver) DeleteFileShare(ctx context.Context, subsID, resourceGroup, accountName, storageEndpointSuffix, shareName string, secrets map[string]string) error {
+	return wait.ExponentialBackoffWithContext(ctx, d.cloud.RequestBackoff(), func() (bool, error) {
 		var err error
+		limiter, key := d.subscriptionLimiter, d.getSubscriptionThrottleKey(subsID)
 		if len(secrets) > 0 {
 			accountName, accountKey, rerr := getStorageAccount(secrets)
 			if rerr != nil {
 				return true, rerr
 			}
-			err = d.fileClient.deleteFileShare(ctx, accountName, accountKey, shareName)
+			limiter, key = d.accountLimiter, accountName
+			err = d.fileClient.deleteFileShare(ctx, accountName, accountKey, storageEndpointSuffix, shareName)
 		} else {
+			if err := limiter.wait(ctx, key); err != nil {
+				return true, err
+			}
 			err = d.cloud.DeleteFileShare(subsID, resourceGroup, accountName, shareName)
 		}
 
-		if err != nil {
-			if strings.Contains(err.Error(), statusCodeNotFound) ||
-				strings.Contains(err.Error(), httpCodeNotFound) ||
-				strings.Contains(err.Error(), fileShareNotFound) {
-				klog.Warningf("DeleteFileShare(%s) on account(%s) failed with error(%v), return as success", shareName, accountName, err)
-				return true, nil
-			}
+		if isNotFoundError(err) {
+			klog.Warningf("DeleteFileShare(%s) on account(%s) failed with error(%v), return as success", shareName, accountName, err)
+			return true, nil
 		}
 
-		if isRetriableError(err) {
-			klog.Warningf("DeleteFileShare(%s) on account(%s) failed with error(%v), waiting for retrying", shareName, accountName, err)
-			if strings.Contains(strings.ToLower(err.Error()), strings.ToLower(tooManyRequests)) {
+		if limiter.throttled(key, err, fileOpThrottlingRetryAfter) {
+			if len(secrets) == 0 {
 				klog.Warningf("switch to use data plane API instead for account %s since it's throttled", accountName)
 				d.dataPlaneAPIVolCache.Set(accountName, "")
-				return true, err
 			}
+			return true, status.Errorf(codes.ResourceExhausted, "DeleteFileShare(%s) on account(%s) is throttled: %v", shareName, accountName, err)
+		}
+		if isRetriableError(err) {
+			klog.Warningf("DeleteFileShare(%s) on account(%s) failed with error(%v), waiting for retrying", shareName, accountName, err)
 			return false, nil
 		}
 
@@ -792,21 +1249,28 @@ func (d *Driver) DeleteFileShare(ctx context.Context, subsID, resourceGroup, acc
 }
 
 // ResizeFileShare resizes a file share
-func (d *Driver) ResizeFileShare(subsID, resourceGroup, accountName, shareName string, sizeGiB int, secrets map[string]string) error {
-	return wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+func (d *Driver) ResizeFileShare(ctx context.Context, subsID, resourceGroup, accountName, storageEndpointSuffix, shareName string, sizeGiB int, secrets map[string]string) error {
+	return wait.ExponentialBackoffWithContext(ctx, d.cloud.RequestBackoff(), func() (bool, error) {
 		var err error
+		limiter, key := d.subscriptionLimiter, d.getSubscriptionThrottleKey(subsID)
 		if len(secrets) > 0 {
 			accountName, accountKey, rerr := getStorageAccount(secrets)
 			if rerr != nil {
 				return true, rerr
 			}
-			err = d.fileClient.resizeFileShare(accountName, accountKey, shareName, sizeGiB)
+			limiter, key = d.accountLimiter, accountName
+			err = d.fileClient.resizeFileShare(ctx, accountName, accountKey, storageEndpointSuffix, shareName, sizeGiB)
 		} else {
+			if err := limiter.wait(ctx, key); err != nil {
+				return true, err
+			}
 			err = d.cloud.ResizeFileShare(subsID, resourceGroup, accountName, shareName, sizeGiB)
 		}
+		if limiter.throttled(key, err, fileOpThrottlingRetryAfter) {
+			return true, status.Errorf(codes.ResourceExhausted, "ResizeFileShare(%s) on account(%s) is throttled: %v", shareName, accountName, err)
+		}
 		if isRetriableError(err) {
 			klog.Warningf("ResizeFileShare(%s) on account(%s) with new size(%d) failed with error(%v), waiting for retrying", shareName, accountName, sizeGiB, err)
-			sleepIfThrottled(err, fileOpThrottlingSleepSec)
 			return false, nil
 		}
 		return true, err
@@ -826,18 +1290,89 @@ func (d *Driver) RemoveStorageAccountTag(ctx context.Context, subsID, resourceGr
 	}
 
 	klog.V(2).Infof("remove tag(%s) on account(%s) subsID(%s), resourceGroup(%s)", key, account, subsID, resourceGroup)
+	throttleKey := d.getSubscriptionThrottleKey(subsID)
+	if err := d.subscriptionLimiter.wait(ctx, throttleKey); err != nil {
+		return err
+	}
 	defer d.removeTagCache.Set(account, key)
 	if rerr := d.cloud.RemoveStorageAccountTag(ctx, subsID, resourceGroup, account, key); rerr != nil {
-		return rerr.Error()
+		return d.subscriptionLimiter.throttledError(throttleKey, rerr.Error(), accountOpThrottlingRetryAfter)
 	}
 	return nil
 }
 
+// SetStorageAccountEncryption configures customer-managed key with user-assigned identity on the storage account
+func (d *Driver) SetStorageAccountEncryption(ctx context.Context, accountOptions *azure.AccountOptions, identity string) error {
+	if d.cloud.StorageAccountClient == nil {
+		return fmt.Errorf("StorageAccountClient is nil")
+	}
+	subsID := accountOptions.SubscriptionID
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	parameters := storage.AccountUpdateParameters{
+		Identity: &storage.Identity{
+			Type:                   storage.IdentityTypeUserAssigned,
+			UserAssignedIdentities: map[string]*storage.UserAssignedIdentity{identity: {}},
+		},
+		AccountPropertiesUpdateParameters: &storage.AccountPropertiesUpdateParameters{
+			Encryption: &storage.Encryption{
+				KeySource: storage.KeySourceMicrosoftKeyvault,
+				KeyVaultProperties: &storage.KeyVaultProperties{
+					KeyName:     accountOptions.KeyName,
+					KeyVersion:  accountOptions.KeyVersion,
+					KeyVaultURI: accountOptions.KeyVaultURI,
+				},
+				EncryptionIdentity: &storage.EncryptionIdentity{EncryptionUserAssignedIdentity: &identity},
+				Services: &storage.EncryptionServices{
+					File: &storage.EncryptionService{Enabled: to.BoolPtr(true)},
+					Blob: &storage.EncryptionService{Enabled: to.BoolPtr(true)},
+				},
+			},
+		},
+	}
+	throttleKey := d.getSubscriptionThrottleKey(subsID)
+	return wait.ExponentialBackoffWithContext(ctx, d.cloud.RequestBackoff(), func() (bool, error) {
+		if err := d.subscriptionLimiter.wait(ctx, throttleKey); err != nil {
+			return true, err
+		}
+		var err error
+		if rerr := d.cloud.StorageAccountClient.Update(ctx, subsID, accountOptions.ResourceGroup, accountOptions.Name, parameters); rerr != nil {
+			err = rerr.Error()
+		}
+		if err = d.subscriptionLimiter.throttledError(throttleKey, err, accountOpThrottlingRetryAfter); status.Code(err) == codes.ResourceExhausted {
+			return true, err
+		}
+		if isRetriableError(err) {
+			klog.Warningf("SetStorageAccountEncryption on account(%s) failed with error(%v), waiting for retrying", accountOptions.Name, err)
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+// discardStorageAccount deletes the storage account which is created by driver but could not be used, e.g. customer-managed
+// key could not be set on it, the account is tagged to skip matching if it could not be deleted
+func (d *Driver) discardStorageAccount(ctx context.Context, subsID, resourceGroup, accountName string) {
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	rerr := d.cloud.StorageAccountClient.Delete(ctx, subsID, resourceGroup, accountName)
+	if rerr == nil {
+		klog.V(2).Infof("storage account(%s) in rg(%s) is deleted", accountName, resourceGroup)
+		return
+	}
+	klog.Warningf("failed to delete storage account(%s) in rg(%s): %v, skip matching it instead", accountName, resourceGroup, rerr.Error())
+	tags := map[string]*string{azure.SkipMatchingTag: to.StringPtr("")}
+	if rerr := d.cloud.AddStorageAccountTags(ctx, subsID, resourceGroup, accountName, tags); rerr != nil {
+		klog.Errorf("AddStorageAccountTags(%v) on account(%s) subsID(%s) rg(%s) failed with error: %v", tags, accountName, subsID, resourceGroup, rerr.Error())
+	}
+}
+
 // GetStorageAccesskey get Azure storage account key from
 //  1. secrets (if not empty)
-//  2. use k8s client identity to read from k8s secret
-//  3. use cluster identity to get from storage account directly
-func (d *Driver) GetStorageAccesskey(ctx context.Context, accountOptions *azure.AccountOptions, secrets map[string]string, secretName, secretNamespace string) (string, error) {
+//  2. credential providers in order, which are k8s secret and cluster identity by default
+func (d *Driver) GetStorageAccesskey(ctx context.Context, accountOptions *azure.AccountOptions, secrets map[string]string, secretName, secretNamespace string, credentialProviders []string) (string, error) {
 	if len(secrets) > 0 {
 		_, accountKey, err := getStorageAccount(secrets)
 		return accountKey, err
@@ -853,15 +1388,19 @@ func (d *Driver) GetStorageAccesskey(ctx context.Context, accountOptions *azure.
 		return cache.(string), nil
 	}
 
-	// read from k8s secret first
+	if len(credentialProviders) == 0 {
+		credentialProviders = defaultCredentialProviders
+	}
 	if secretName == "" {
 		secretName = fmt.Sprintf(secretNameTemplate, accountName)
 	}
-	_, accountKey, err := d.GetStorageAccountFromSecret(ctx, secretName, secretNamespace)
-	if err != nil {
-		klog.V(2).Infof("could not get account(%s) key from secret(%s), error: %v, use cluster identity to get account key instead", accountOptions.Name, secretName, err)
-		accountKey, err = d.cloud.GetStorageAccesskey(ctx, accountOptions.SubscriptionID, accountName, accountOptions.ResourceGroup)
-	}
+	_, accountKey, err := d.getAccountKeyFromProviders(ctx, credentialProviders, &credentialRequest{
+		subsID:          accountOptions.SubscriptionID,
+		resourceGroup:   accountOptions.ResourceGroup,
+		accountName:     accountName,
+		secretName:      secretName,
+		secretNamespace: secretNamespace,
+	})
 
 	if err == nil && accountKey != "" {
 		d.accountCacheMap.Set(accountName, accountKey)
@@ -886,6 +1425,83 @@ func (d *Driver) GetStorageAccountFromSecret(ctx context.Context, secretName, se
 	return accountName, accountKey, nil
 }
 
+// getStorageAccountsCreatedByDriver returns storage accounts created by this driver sorted by name, accounts are
+// listed in the resource group of current cluster and the resource groups recorded in volume IDs of this driver
+func (d *Driver) getStorageAccountsCreatedByDriver(ctx context.Context) ([]storageAccountRef, error) {
+	if d.cloud.StorageAccountClient == nil {
+		return nil, fmt.Errorf("StorageAccountClient is nil")
+	}
+	// accountName is empty in resource group refs
+	resourceGroups := []storageAccountRef{{subsID: d.cloud.SubscriptionID, resourceGroup: d.cloud.ResourceGroup}}
+	for _, ref := range d.getVolumeResourceGroups(ctx) {
+		found := false
+		for _, rg := range resourceGroups {
+			if strings.EqualFold(rg.subsID, ref.subsID) && strings.EqualFold(rg.resourceGroup, ref.resourceGroup) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			resourceGroups = append(resourceGroups, ref)
+		}
+	}
+
+	var accountRefs []storageAccountRef
+	listed := map[string]bool{}
+	for i, rg := range resourceGroups {
+		accounts, rerr := d.cloud.StorageAccountClient.ListByResourceGroup(ctx, rg.subsID, rg.resourceGroup)
+		if rerr != nil {
+			if i == 0 {
+				return nil, rerr.Error()
+			}
+			klog.Warningf("skip listing storage accounts in subsID(%s) rg(%s): %v", rg.subsID, rg.resourceGroup, rerr.Error())
+			continue
+		}
+		for _, account := range accounts {
+			if account.Name == nil || account.Tags == nil || listed[strings.ToLower(*account.Name)] {
+				continue
+			}
+			if v, ok := account.Tags[consts.CreatedByTag]; ok && v != nil && *v == "azure" {
+				listed[strings.ToLower(*account.Name)] = true
+				accountRefs = append(accountRefs, storageAccountRef{subsID: rg.subsID, resourceGroup: rg.resourceGroup, accountName: *account.Name})
+			}
+		}
+	}
+	sort.Slice(accountRefs, func(i, j int) bool {
+		return accountRefs[i].accountName < accountRefs[j].accountName
+	})
+	return accountRefs, nil
+}
+
+// getVolumeResourceGroups returns subscriptions and resource groups recorded in volume IDs of persistent volumes
+// provisioned by this driver, storage accounts could be created in other resource groups by storage class parameters
+func (d *Driver) getVolumeResourceGroups(ctx context.Context) []storageAccountRef {
+	if d.cloud.KubeClient == nil {
+		return nil
+	}
+	pvList, err := d.cloud.KubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("failed to list persistent volumes: %v", err)
+		return nil
+	}
+	var refs []storageAccountRef
+	for _, pv := range pvList.Items {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != d.Name {
+			continue
+		}
+		h, err := ParseVolumeHandle(pv.Spec.CSI.VolumeHandle)
+		if err != nil || h.ResourceGroup == "" {
+			continue
+		}
+		subsID := h.SubscriptionID
+		if subsID == "" {
+			subsID = d.cloud.SubscriptionID
+		}
+		refs = append(refs, storageAccountRef{subsID: subsID, resourceGroup: h.ResourceGroup})
+	}
+	return refs
+}
+
 // getSubnetResourceID get default subnet resource ID from cloud provider config
 func (d *Driver) getSubnetResourceID() string {
 	subsID := d.cloud.SubscriptionID
@@ -919,6 +1535,15 @@ func (d *Driver) useDataPlaneAPI(volumeID, accountName string) bool {
 	return false
 }
 
+// getStorageEndpointSuffix returns the storage endpoint suffix carried in volume handle,
+// or the one of current cloud environment if it's not set
+func (d *Driver) getStorageEndpointSuffix(h *VolumeHandle) string {
+	if h != nil && h.StorageEndpointSuffix != "" {
+		return h.StorageEndpointSuffix
+	}
+	return d.cloud.Environment.StorageEndpointSuffix
+}
+
 func (d *Driver) SetAzureCredentials(ctx context.Context, accountName, accountKey, secretName, secretNamespace string) (string, error) {
 	if d.cloud.KubeClient == nil {
 		klog.Warningf("could not create secret: kubeClient is nil")
@@ -930,10 +1555,13 @@ func (d *Driver) SetAzureCredentials(ctx context.Context, accountName, accountKe
 	if secretName == "" {
 		secretName = fmt.Sprintf(secretNameTemplate, accountName)
 	}
+	now := time.Now()
 	secret := &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: secretNamespace,
-			Name:      secretName,
+			Namespace:   secretNamespace,
+			Name:        secretName,
+			Labels:      d.getAccountKeySecretLabels(accountName),
+			Annotations: map[string]string{lastUsedTimeAnnotation: now.UTC().Format(time.RFC3339)},
 		},
 		Data: map[string][]byte{
 			defaultSecretAccountName: []byte(accountName),
@@ -943,6 +1571,10 @@ func (d *Driver) SetAzureCredentials(ctx context.Context, accountName, accountKe
 	}
 	_, err := d.cloud.KubeClient.CoreV1().Secrets(secretNamespace).Create(ctx, secret, metav1.CreateOptions{})
 	if errors.IsAlreadyExists(err) {
+		// existing secret is in use again, which should not be garbage collected
+		if rerr := d.refreshLastUsedTime(ctx, secretName, secretNamespace, now); rerr != nil {
+			klog.Warningf("failed to refresh annotation %s on secret(%s/%s): %v", lastUsedTimeAnnotation, secretNamespace, secretName, rerr)
+		}
 		err = nil
 	}
 	if err != nil {
@@ -18,120 +18,369 @@ package azurefile
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
 
-	azs "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-file-go/azfile"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"k8s.io/klog/v2"
 
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
-	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 )
 
 const (
-	useHTTPS = true
-)
+	// header of service error code in data plane API response
+	errorCodeHeader    = "x-ms-error-code"
+	shareAlreadyExists = "ShareAlreadyExists"
 
-var (
-	// refer https://github.com/Azure/azure-sdk-for-go/blob/master/storage/client.go#L88.
-	defaultValidStatusCodes = []int{
-		http.StatusRequestTimeout,      // 408
-		http.StatusInternalServerError, // 500
-		http.StatusBadGateway,          // 502
-		http.StatusServiceUnavailable,  // 503
-		http.StatusGatewayTimeout,      // 504
-	}
+	// pipeline of storage account is evicted from cache if it's not used for this period
+	pipelineCacheTTL = time.Hour
 )
 
+// dataPlaneClientOptions configures requests of storage data plane API
+type dataPlaneClientOptions struct {
+	// maximum number of tries of a request, 1 means no retry
+	MaxTries      int32
+	TryTimeout    time.Duration
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// proxy of requests, proxy in environment variables is used if empty
+	ProxyURL string
+	// PEM file of CA certificates trusted in addition to system CA certificates
+	CACertFile string
+	UserAgent  string
+}
+
+// azureFileClient is the client of storage data plane API, the pipeline of each storage account is cached
+// and all pipelines share one HTTP transport, so that connections are reused across requests
 type azureFileClient struct {
-	env     *azure.Environment
-	backoff *retry.Backoff
+	env *azure.Environment
 	// if storageEndpointSuffix is empty, will default to cloud.env.StorageEndpointSuffix
 	StorageEndpointSuffix string
+
+	retryOptions azfile.RetryOptions
+	userAgent    string
+	httpClient   *http.Client
+	// requests are throttled per storage account
+	limiter *throttleLimiter
+
+	mu sync.Mutex
+	// pipelines keyed by storage account name, pipelines not used for pipelineCacheTTL are evicted
+	pipelines map[string]*accountPipeline
+	// for unit test
+	now func() time.Time
 }
 
-func newAzureFileClient(env *azure.Environment, backoff *retry.Backoff) *azureFileClient {
+type accountPipeline struct {
+	accountKey string
+	pipeline   pipeline.Pipeline
+	lastUsed   time.Time
+}
+
+func newAzureFileClient(env *azure.Environment, options *dataPlaneClientOptions, limiter *throttleLimiter) (*azureFileClient, error) {
+	httpClient, err := newDataPlaneHTTPClient(options.ProxyURL, options.CACertFile)
+	if err != nil {
+		return nil, err
+	}
 	return &azureFileClient{
-		env:     env,
-		backoff: backoff,
+		env: env,
+		retryOptions: azfile.RetryOptions{
+			Policy:        azfile.RetryPolicyExponential,
+			MaxTries:      options.MaxTries,
+			TryTimeout:    options.TryTimeout,
+			RetryDelay:    options.RetryDelay,
+			MaxRetryDelay: options.MaxRetryDelay,
+		},
+		userAgent:  options.UserAgent,
+		httpClient: httpClient,
+		limiter:    limiter,
+		pipelines:  map[string]*accountPipeline{},
+		now:        time.Now,
+	}, nil
+}
+
+// newDataPlaneHTTPClient returns HTTP client with proxy and additional CA certificates
+func newDataPlaneHTTPClient(proxyURL, caCertFile string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url(%s): %v", proxyURL, err)
+		}
+		transport.Proxy = http.ProxyURL(u)
 	}
+	if caCertFile != "" {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate file(%s): %v", caCertFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			klog.Warningf("failed to load system CA certificates: %v", err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate found in %s", caCertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &http.Client{Transport: transport}, nil
 }
 
-func (f *azureFileClient) CreateFileShare(accountName, accountKey string, shareOptions *fileclient.ShareOptions) error {
-	if shareOptions == nil {
-		return fmt.Errorf("shareOptions of account(%s) is nil", accountName)
+func (f *azureFileClient) getStorageEndpointSuffix() string {
+	if f.StorageEndpointSuffix != "" {
+		return f.StorageEndpointSuffix
 	}
-	return f.createFileShare(accountName, accountKey, shareOptions.Name, shareOptions.RequestGiB)
+	if f.env != nil && f.env.StorageEndpointSuffix != "" {
+		return f.env.StorageEndpointSuffix
+	}
+	return defaultStorageEndPointSuffix
 }
 
-func (f *azureFileClient) createFileShare(accountName, accountKey, name string, sizeGiB int) error {
-	fileClient, err := f.getFileSvcClient(accountName, accountKey)
+// getPipeline returns the cached pipeline of storage account, the pipeline is rebuilt if account key is changed
+func (f *azureFileClient) getPipeline(accountName, accountKey string) (*accountPipeline, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.now != nil {
+		now = f.now()
+	}
+	if p, ok := f.pipelines[accountName]; ok && p.accountKey == accountKey {
+		p.lastUsed = now
+		return p, nil
+	}
+	credential, err := azfile.NewSharedKeyCredential(accountName, accountKey)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
+	}
+	// same policies as azfile.NewPipeline except the HTTP sender
+	factories := []pipeline.Factory{
+		azfile.NewTelemetryPolicyFactory(azfile.TelemetryOptions{Value: f.userAgent}),
+		azfile.NewUniqueRequestIDPolicyFactory(),
+		azfile.NewRetryPolicyFactory(f.retryOptions),
+		credential,
+		azfile.NewRequestLogPolicyFactory(azfile.RequestLogOptions{}),
+		pipeline.MethodFactoryMarker(),
+	}
+	p := &accountPipeline{
+		accountKey: accountKey,
+		pipeline:   pipeline.NewPipeline(factories, pipeline.Options{HTTPSender: f.newSender(accountName)}),
+		lastUsed:   now,
 	}
-	share := fileClient.GetShareReference(name)
-	share.Properties.Quota = sizeGiB
-	newlyCreated, err := share.CreateIfNotExists(nil)
+	if f.pipelines == nil {
+		f.pipelines = map[string]*accountPipeline{}
+	}
+	// pipelines of deleted or no longer used accounts are evicted whenever a new pipeline is built
+	for name, cached := range f.pipelines {
+		if now.Sub(cached.lastUsed) > pipelineCacheTTL {
+			delete(f.pipelines, name)
+		}
+	}
+	f.pipelines[accountName] = p
+	return p, nil
+}
+
+// newSender returns HTTP sender of storage account, every try of a request waits on throttle limiter of the account,
+// and the account is blocked until Retry-After is over if it's throttled
+func (f *azureFileClient) newSender(accountName string) pipeline.Factory {
+	httpClient := f.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			// policies of azfile expect a non-nil response even if the request fails
+			if err := f.limiter.wait(ctx, accountName); err != nil {
+				return pipeline.NewHTTPResponse(nil), err
+			}
+			resp, err := httpClient.Do(request.WithContext(ctx))
+			if err != nil {
+				if ctx.Err() != nil {
+					return pipeline.NewHTTPResponse(nil), ctx.Err()
+				}
+				return pipeline.NewHTTPResponse(nil), pipeline.NewError(err, "HTTP request failed")
+			}
+			if resp.StatusCode == http.StatusTooManyRequests || resp.Header.Get(errorCodeHeader) == serverBusy {
+				f.limiter.block(accountName, getRetryAfterFromHeader(resp.Header, fileOpThrottlingRetryAfter))
+			}
+			return pipeline.NewHTTPResponse(resp), nil
+		}
+	})
+}
+
+// getServiceURL returns service URL of storage account, default endpoint suffix is used if storageEndpointSuffix is empty
+func (f *azureFileClient) getServiceURL(accountName, accountKey, storageEndpointSuffix string) (*azfile.ServiceURL, error) {
+	p, err := f.getPipeline(accountName, accountKey)
 	if err != nil {
-		return fmt.Errorf("failed to create file share, err: %v", err)
+		return nil, err
 	}
-	if !newlyCreated {
-		klog.V(2).Infof("file share(%s) under account(%s) already exists", name, accountName)
+	u, err := f.parseServiceURL(accountName, storageEndpointSuffix)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	serviceURL := azfile.NewServiceURL(*u, p.pipeline)
+	return &serviceURL, nil
 }
 
-// delete a file share
-func (f *azureFileClient) deleteFileShare(ctx context.Context, accountName, accountKey, name string) error {
-	fileClient, err := f.getFileSvcClient(accountName, accountKey)
+func (f *azureFileClient) parseServiceURL(accountName, storageEndpointSuffix string) (*url.URL, error) {
+	if storageEndpointSuffix == "" {
+		storageEndpointSuffix = f.getStorageEndpointSuffix()
+	}
+	u, err := url.Parse(fmt.Sprintf(serviceURLTemplate, accountName, storageEndpointSuffix))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("parse serviceURLTemplate error: %v", err)
 	}
-	return fileClient.GetShareReference(name).Delete(nil)
+	return u, nil
 }
 
-func (f *azureFileClient) resizeFileShare(accountName, accountKey, name string, sizeGiB int) error {
-	fileClient, err := f.getFileSvcClient(accountName, accountKey)
+func (f *azureFileClient) getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName string) (*azfile.ShareURL, error) {
+	serviceURL, err := f.getServiceURL(accountName, accountKey, storageEndpointSuffix)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	share := fileClient.GetShareReference(name)
-	if share.Properties.Quota >= sizeGiB {
-		klog.Warningf("file share size(%dGi) is already greater or equal than requested size(%dGi), accountName: %s, shareName: %s",
-			share.Properties.Quota, sizeGiB, accountName, name)
-		return nil
+	shareURL := serviceURL.NewShareURL(fileShareName)
+	return &shareURL, nil
+}
+
+func (f *azureFileClient) getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, fileName string) (*azfile.FileURL, error) {
+	p, err := f.getPipeline(accountName, accountKey)
+	if err != nil {
+		return nil, err
 	}
-	share.Properties.Quota = sizeGiB
-	if err = share.SetProperties(nil); err != nil {
-		return fmt.Errorf("failed to set quota on file share %s, err: %v", name, err)
+	if storageEndpointSuffix == "" {
+		storageEndpointSuffix = f.getStorageEndpointSuffix()
 	}
-	klog.V(4).Infof("resize file share completed, accountName: %s, shareName: %s, sizeGiB: %d", accountName, name, sizeGiB)
-	return nil
+	u, err := url.Parse(fmt.Sprintf(fileURLTemplate, accountName, storageEndpointSuffix, fileShareName, fileName))
+	if err != nil {
+		return nil, fmt.Errorf("parse fileURLTemplate error: %v", err)
+	}
+	fileURL := azfile.NewFileURL(*u, p.pipeline)
+	return &fileURL, nil
 }
 
-func (f *azureFileClient) getFileSvcClient(accountName, accountKey string) (*azs.FileServiceClient, error) {
-	storageEndpointSuffix := f.env.StorageEndpointSuffix
-	if f.StorageEndpointSuffix != "" {
-		storageEndpointSuffix = f.StorageEndpointSuffix
+// sendFileServiceRequest sends request of file service REST API on resource(empty for file service, share name for file share),
+// it's used for operations not supported by the API version of azfile, the response body should be closed by caller
+func (f *azureFileClient) sendFileServiceRequest(ctx context.Context, accountName, accountKey, storageEndpointSuffix, method, resource string, query url.Values, headers map[string]string) (*http.Response, error) {
+	p, err := f.getPipeline(accountName, accountKey)
+	if err != nil {
+		return nil, err
 	}
-	if storageEndpointSuffix == "" {
-		storageEndpointSuffix = defaultStorageEndPointSuffix
+	u, err := f.parseServiceURL(accountName, storageEndpointSuffix)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + resource
+	u.RawQuery = query.Encode()
+	req, err := pipeline.NewRequest(method, *u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", fileServiceAPIVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.pipeline.Do(ctx, nil, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Response(), nil
+}
+
+func (f *azureFileClient) CreateFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix string, shareOptions *fileclient.ShareOptions) error {
+	if shareOptions == nil {
+		return fmt.Errorf("shareOptions of account(%s) is nil", accountName)
+	}
+	metadata := map[string]string{}
+	for k, v := range shareOptions.Metadata {
+		if v != nil {
+			metadata[k] = *v
+		}
 	}
+	return f.createFileShare(ctx, accountName, accountKey, storageEndpointSuffix, shareOptions.Name, shareOptions.RequestGiB, metadata)
+}
 
-	fileClient, err := azs.NewClient(accountName, accountKey, storageEndpointSuffix, azs.DefaultAPIVersion, useHTTPS)
+func (f *azureFileClient) createFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix, name string, sizeGiB int, metadata map[string]string) error {
+	shareURL, err := f.getShareURL(accountName, accountKey, storageEndpointSuffix, name)
 	if err != nil {
-		return nil, fmt.Errorf("error creating azure client: %v", err)
+		return err
 	}
+	if _, err := shareURL.Create(ctx, metadata, int32(sizeGiB)); err != nil {
+		if isStorageErrorWithServiceCode(err, azfile.ServiceCodeShareAlreadyExists) {
+			klog.V(2).Infof("file share(%s) under account(%s) already exists", name, accountName)
+			return nil
+		}
+		return fmt.Errorf("failed to create file share, err: %w", err)
+	}
+	return nil
+}
 
-	if f.backoff != nil {
-		fileClient.Sender = &azs.DefaultSender{
-			RetryAttempts:    f.backoff.Steps,
-			ValidStatusCodes: defaultValidStatusCodes,
-			RetryDuration:    f.backoff.Duration,
+// getFileShareMetadata returns (nil, nil) if file share does not exist
+func (f *azureFileClient) getFileShareMetadata(ctx context.Context, accountName, accountKey, storageEndpointSuffix, name string) (map[string]string, error) {
+	shareURL, err := f.getShareURL(accountName, accountKey, storageEndpointSuffix, name)
+	if err != nil {
+		return nil, err
+	}
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		if isStorageErrorWithServiceCode(err, azfile.ServiceCodeShareNotFound) {
+			return nil, nil
 		}
+		return nil, err
 	}
+	return properties.NewMetadata(), nil
+}
 
-	fc := fileClient.GetFileService()
-	return &fc, nil
+// getFileShareQuota returns (-1, nil) if file share does not exist
+func (f *azureFileClient) getFileShareQuota(ctx context.Context, accountName, accountKey, storageEndpointSuffix, name string) (int, error) {
+	shareURL, err := f.getShareURL(accountName, accountKey, storageEndpointSuffix, name)
+	if err != nil {
+		return -1, err
+	}
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		if isStorageErrorWithServiceCode(err, azfile.ServiceCodeShareNotFound) {
+			return -1, nil
+		}
+		return -1, err
+	}
+	return int(properties.Quota()), nil
+}
+
+// delete a file share
+func (f *azureFileClient) deleteFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix, name string) error {
+	shareURL, err := f.getShareURL(accountName, accountKey, storageEndpointSuffix, name)
+	if err != nil {
+		return err
+	}
+	_, err = shareURL.Delete(ctx, azfile.DeleteSnapshotsOptionNone)
+	return err
+}
+
+func (f *azureFileClient) resizeFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix, name string, sizeGiB int) error {
+	shareURL, err := f.getShareURL(accountName, accountKey, storageEndpointSuffix, name)
+	if err != nil {
+		return err
+	}
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get properties of file share %s, err: %w", name, err)
+	}
+	if int(properties.Quota()) >= sizeGiB {
+		klog.Warningf("file share size(%dGi) is already greater or equal than requested size(%dGi), accountName: %s, shareName: %s",
+			properties.Quota(), sizeGiB, accountName, name)
+		return nil
+	}
+	if _, err = shareURL.SetQuota(ctx, int32(sizeGiB)); err != nil {
+		return fmt.Errorf("failed to set quota on file share %s, err: %w", name, err)
+	}
+	klog.V(4).Infof("resize file share completed, accountName: %s, shareName: %s, sizeGiB: %d", accountName, name, sizeGiB)
+	return nil
 }
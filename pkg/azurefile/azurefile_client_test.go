@@ -19,57 +19,157 @@ package azurefile
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-storage-file-go/azfile"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/stretchr/testify/assert"
 
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
-	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 )
 
-func TestGetFileSvcClient(t *testing.T) {
-	accountName := "ut"
-	accountKey := "ut"
-	f := azureFileClient{
-		env: &azure.Environment{
-			StorageEndpointSuffix: "ut",
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newFakeFileClient returns azureFileClient whose requests are served by handler without retry
+func newFakeFileClient(handler func(req *http.Request) *http.Response) *azureFileClient {
+	return &azureFileClient{
+		env:          &azure.Environment{},
+		retryOptions: azfile.RetryOptions{MaxTries: 1},
+		httpClient: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := req.Context().Err(); err != nil {
+				return nil, err
+			}
+			resp := handler(req)
+			resp.Request = req
+			header := http.Header{}
+			for k, v := range resp.Header {
+				header[http.CanonicalHeaderKey(k)] = v
+			}
+			resp.Header = header
+			resp.Body = io.NopCloser(strings.NewReader(""))
+			return resp, nil
+		})},
+	}
+}
+
+func TestNewDataPlaneHTTPClient(t *testing.T) {
+	invalidCAFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(invalidCAFile, []byte("invalid"), 0600))
+
+	tests := []struct {
+		desc        string
+		proxyURL    string
+		caCertFile  string
+		expectedErr string
+	}{
+		{
+			desc: "default",
+		},
+		{
+			desc:     "valid proxy",
+			proxyURL: "http://proxy:3128",
+		},
+		{
+			desc:        "invalid proxy",
+			proxyURL:    "http://proxy:port",
+			expectedErr: "invalid proxy url(http://proxy:port)",
 		},
-		backoff: &retry.Backoff{
-			Steps:    1,
-			Duration: time.Second,
+		{
+			desc:        "CA certificate file not found",
+			caCertFile:  "/non-existing/ca.pem",
+			expectedErr: "failed to read CA certificate file(/non-existing/ca.pem)",
+		},
+		{
+			desc:        "no CA certificate in file",
+			caCertFile:  invalidCAFile,
+			expectedErr: fmt.Sprintf("no CA certificate found in %s", invalidCAFile),
 		},
 	}
-	_, actualErr := f.getFileSvcClient(accountName, accountKey)
-	expectedErr := fmt.Errorf("error creating azure client: azure: account name is not valid: it must be between 3 and 24 characters, and only may contain numbers and lowercase letters: ut")
-	if !reflect.DeepEqual(actualErr, expectedErr) {
-		t.Errorf("actualErr: (%v), expectedErr: (%v)", actualErr, expectedErr)
+
+	for _, test := range tests {
+		client, err := newDataPlaneHTTPClient(test.proxyURL, test.caCertFile)
+		if test.expectedErr == "" {
+			assert.NoError(t, err, test.desc)
+			assert.NotNil(t, client, test.desc)
+		} else {
+			assert.ErrorContains(t, err, test.expectedErr, test.desc)
+		}
 	}
-	accountName = "unittest"
-	accountKey = "dW5pdHRlc3Q="
-	fileserviceClient, err := f.getFileSvcClient(accountName, accountKey)
-	assert.NotNil(t, fileserviceClient)
+}
+
+func TestGetStorageEndpointSuffix(t *testing.T) {
+	f := azureFileClient{}
+	assert.Equal(t, defaultStorageEndPointSuffix, f.getStorageEndpointSuffix())
+	f.env = &azure.Environment{}
+	assert.Equal(t, defaultStorageEndPointSuffix, f.getStorageEndpointSuffix())
+	f.env = &azure.Environment{StorageEndpointSuffix: "core.chinacloudapi.cn"}
+	assert.Equal(t, "core.chinacloudapi.cn", f.getStorageEndpointSuffix())
+	f.StorageEndpointSuffix = "ut"
+	assert.Equal(t, "ut", f.getStorageEndpointSuffix())
+}
+
+func TestGetPipeline(t *testing.T) {
+	f, err := newAzureFileClient(nil, &dataPlaneClientOptions{MaxTries: 1}, nil)
 	assert.NoError(t, err)
 
-	//Test that the client uses defaultStorageEndpointSuffix
-	f = azureFileClient{
-		env: &azure.Environment{},
-		backoff: &retry.Backoff{
-			Steps:    1,
-			Duration: time.Second,
-		},
-	}
-	accountName = "unittest"
-	accountKey = "dW5pdHRlc3Q="
-	fileserviceClient, err = f.getFileSvcClient(accountName, accountKey)
-	assert.NotNil(t, fileserviceClient)
+	_, err = f.getPipeline("unittest", "invalid key")
+	assert.ErrorContains(t, err, "NewSharedKeyCredential(unittest) failed with error")
+
+	p1, err := f.getPipeline("unittest", "dW5pdHRlc3Q=")
+	assert.NoError(t, err)
+	p2, err := f.getPipeline("unittest", "dW5pdHRlc3Q=")
 	assert.NoError(t, err)
+	assert.Same(t, p1, p2, "pipeline should be cached")
+
+	p3, err := f.getPipeline("unittest", "dW5pdHRlc3QtbmV3")
+	assert.NoError(t, err)
+	assert.NotSame(t, p1, p3, "pipeline should be rebuilt after account key is changed")
+	assert.Equal(t, "dW5pdHRlc3QtbmV3", p3.accountKey)
+	assert.Len(t, f.pipelines, 1)
+
+	// pipeline not used for pipelineCacheTTL is evicted when another pipeline is built
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	_, err = f.getPipeline("unittest2", "dW5pdHRlc3Q=")
+	assert.NoError(t, err)
+	now = now.Add(pipelineCacheTTL / 2)
+	_, err = f.getPipeline("unittest2", "dW5pdHRlc3Q=")
+	assert.NoError(t, err)
+	now = now.Add(pipelineCacheTTL)
+	_, err = f.getPipeline("unittest3", "dW5pdHRlc3Q=")
+	assert.NoError(t, err)
+	assert.Len(t, f.pipelines, 2)
+	assert.Contains(t, f.pipelines, "unittest2")
+	assert.NotContains(t, f.pipelines, "unittest")
+}
+
+func TestGetShareURLWithKey(t *testing.T) {
+	f := azureFileClient{}
+	fileURL, err := f.getFileURL("unittest", "dW5pdHRlc3Q=", "", "share", "disk.vhd")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://unittest.file.core.windows.net/share/disk.vhd", fileURL.String())
+
+	shareURL, err := f.getShareURL("unittest", "dW5pdHRlc3Q=", "core.chinacloudapi.cn", "share")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://unittest.file.core.chinacloudapi.cn/share", shareURL.String())
 }
 
 func TestCreateFileShare(t *testing.T) {
+	options := &fileclient.ShareOptions{
+		Name:       "share",
+		RequestGiB: 10,
+	}
 
 	testCases := []struct {
 		name     string
@@ -81,7 +181,7 @@ func TestCreateFileShare(t *testing.T) {
 				accountName := "unittest"
 				accountKey := "dW5pdHRlc3Q="
 				f := azureFileClient{}
-				actualErr := f.CreateFileShare(accountName, accountKey, nil)
+				actualErr := f.CreateFileShare(context.Background(), accountName, accountKey, "", nil)
 				expectedErr := fmt.Errorf("shareOptions of account(%s) is nil", accountName)
 				if !reflect.DeepEqual(actualErr, expectedErr) {
 					t.Errorf("actualErr: (%v), expectedErr: (%v)", actualErr, expectedErr)
@@ -89,46 +189,58 @@ func TestCreateFileShare(t *testing.T) {
 			},
 		},
 		{
-			name: "AccountName invalid",
+			name: "AccountKey invalid",
 			testFunc: func(t *testing.T) {
-				accountName := "ut"
-				accountKey := "dW5pdHRlc3Q="
-				options := &fileclient.ShareOptions{
-					RequestGiB: 10,
-				}
-				f := azureFileClient{
-					env: &azure.Environment{
-						StorageEndpointSuffix: "ut",
-					},
-				}
-				actualErr := f.CreateFileShare(accountName, accountKey, options)
-				expectedErr := fmt.Errorf("error creating azure client: azure: account name is not valid: it must be between 3 and 24 characters, and only may contain numbers and lowercase letters: ut")
-				if !reflect.DeepEqual(actualErr, expectedErr) {
-					t.Errorf("actualErr: (%v), expectedErr: (%v)", actualErr, expectedErr)
-				}
-				actualErr = f.createFileShare(accountName, accountKey, "unit-test", 10)
-				if !reflect.DeepEqual(actualErr, expectedErr) {
-					t.Errorf("actualErr: (%v), expectedErr: (%v)", actualErr, expectedErr)
-				}
+				f := azureFileClient{}
+				actualErr := f.CreateFileShare(context.Background(), "unittest", "ut", "", options)
+				assert.ErrorContains(t, actualErr, "NewSharedKeyCredential(unittest) failed with error")
 			},
 		},
 		{
-			name: "",
+			name: "file share created",
 			testFunc: func(t *testing.T) {
-				accountName := "test"
-				accountKey := "dW5pdHRlc3Q="
-				options := &fileclient.ShareOptions{
-					Name:       "devstoreaccount1",
-					RequestGiB: 10,
-				}
-				f := azureFileClient{
-					env: &azure.Environment{},
-				}
-				actualErr := f.CreateFileShare(accountName, accountKey, options)
-				expectedErr := fmt.Errorf("failed to create file share, err: ")
-				if !strings.HasPrefix(actualErr.Error(), expectedErr.Error()) {
-					t.Errorf("actualErr: (%v), expectedErr: (%v)", actualErr, expectedErr)
-				}
+				f := newFakeFileClient(func(req *http.Request) *http.Response {
+					assert.Equal(t, http.MethodPut, req.Method)
+					assert.Equal(t, "10", req.Header.Get("x-ms-share-quota"))
+					assert.NotEmpty(t, req.Header.Get("Authorization"))
+					// storage endpoint suffix of the request is used instead of the one of cloud environment
+					assert.Equal(t, "unittest.file.core.chinacloudapi.cn", req.URL.Host)
+					return &http.Response{StatusCode: http.StatusCreated}
+				})
+				assert.NoError(t, f.CreateFileShare(context.Background(), "unittest", "dW5pdHRlc3Q=", "core.chinacloudapi.cn", options))
+			},
+		},
+		{
+			name: "file share already exists",
+			testFunc: func(t *testing.T) {
+				f := newFakeFileClient(func(req *http.Request) *http.Response {
+					return &http.Response{StatusCode: http.StatusConflict, Header: http.Header{errorCodeHeader: {shareAlreadyExists}}}
+				})
+				assert.NoError(t, f.CreateFileShare(context.Background(), "unittest", "dW5pdHRlc3Q=", "", options))
+			},
+		},
+		{
+			name: "file share being deleted",
+			testFunc: func(t *testing.T) {
+				f := newFakeFileClient(func(req *http.Request) *http.Response {
+					return &http.Response{StatusCode: http.StatusConflict, Header: http.Header{errorCodeHeader: {"ShareBeingDeleted"}}}
+				})
+				actualErr := f.CreateFileShare(context.Background(), "unittest", "dW5pdHRlc3Q=", "", options)
+				assert.ErrorContains(t, actualErr, "failed to create file share, err: ")
+				assert.Equal(t, errorCategoryBeingDeleted, classifyError(actualErr))
+			},
+		},
+		{
+			name: "Context deadline exceeded",
+			testFunc: func(t *testing.T) {
+				f := newFakeFileClient(func(req *http.Request) *http.Response {
+					return &http.Response{StatusCode: http.StatusCreated}
+				})
+				ctx, cancel := context.WithTimeout(context.Background(), 0)
+				defer cancel()
+				actualErr := f.CreateFileShare(ctx, "unittest", "dW5pdHRlc3Q=", "", options)
+				assert.ErrorIs(t, actualErr, context.DeadlineExceeded)
+				assert.Equal(t, errorCategoryDeadlineExceeded, classifyError(actualErr))
 			},
 		},
 	}
@@ -137,19 +249,38 @@ func TestCreateFileShare(t *testing.T) {
 	}
 }
 
+func TestGetFileShareProperties(t *testing.T) {
+	f := newFakeFileClient(func(req *http.Request) *http.Response {
+		if strings.HasSuffix(req.URL.Path, "/notfound") {
+			return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{errorCodeHeader: {shareNotFound}}}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Ms-Share-Quota": {"100"}, "X-Ms-Meta-Createdby": {"azurefile"}}}
+	})
+
+	quota, err := f.getFileShareQuota(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "share")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, quota)
+
+	quota, err = f.getFileShareQuota(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "notfound")
+	assert.NoError(t, err)
+	assert.Equal(t, -1, quota)
+
+	metadata, err := f.getFileShareMetadata(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "share")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"createdby": "azurefile"}, metadata)
+
+	metadata, err = f.getFileShareMetadata(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "notfound")
+	assert.NoError(t, err)
+	assert.Nil(t, metadata)
+}
+
 func TestDeleteFileShare(t *testing.T) {
-	accountName := "ut"
-	accountKey := "ut"
-	f := azureFileClient{
-		env: &azure.Environment{
-			StorageEndpointSuffix: "ut",
-		},
-	}
-	actualErr := f.deleteFileShare(context.TODO(), accountName, accountKey, "")
-	expectedErr := fmt.Errorf("error creating azure client: azure: account name is not valid: it must be between 3 and 24 characters, and only may contain numbers and lowercase letters: ut")
-	if !reflect.DeepEqual(actualErr, expectedErr) {
-		t.Errorf("actualErr: (%v), expectedErr: (%v)", actualErr, expectedErr)
-	}
+	f := newFakeFileClient(func(req *http.Request) *http.Response {
+		assert.Equal(t, http.MethodDelete, req.Method)
+		return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{errorCodeHeader: {shareNotFound}}}
+	})
+	actualErr := f.deleteFileShare(context.TODO(), "unittest", "dW5pdHRlc3Q=", "", "share")
+	assert.True(t, isNotFoundError(actualErr))
 }
 
 func TestResizeFileShare(t *testing.T) {
@@ -158,53 +289,49 @@ func TestResizeFileShare(t *testing.T) {
 		testFunc func(t *testing.T)
 	}{
 		{
-			name: "invalid account name",
+			name: "invalid account key",
 			testFunc: func(t *testing.T) {
-				accountName := "ut"
-				accountKey := "dW5pdHRlc3Q="
-				f := azureFileClient{
-					env: &azure.Environment{
-						StorageEndpointSuffix: "ut",
-					},
-				}
-				actualErr := f.resizeFileShare(accountName, accountKey, "", 10)
-				expectedErr := fmt.Errorf("error creating azure client: azure: account name is not valid: it must be between 3 and 24 characters, and only may contain numbers and lowercase letters: ut")
-				if !reflect.DeepEqual(actualErr, expectedErr) {
-					t.Errorf("actualErr: (%v), expectedErr: (%v)", actualErr, expectedErr)
-				}
+				f := azureFileClient{}
+				actualErr := f.resizeFileShare(context.Background(), "unittest", "ut", "", "", 10)
+				assert.ErrorContains(t, actualErr, "NewSharedKeyCredential(unittest) failed with error")
 			},
 		},
 		{
 			name: "file share size is already greater or equal than requested size",
 			testFunc: func(t *testing.T) {
-				//file share size is already greater or equal than requested size
-				accountName := "unittest"
-				accountKey := "dW5pdHRlc3Q="
-				f := azureFileClient{
-					env: &azure.Environment{
-						StorageEndpointSuffix: "ut",
-					},
-				}
-				actualErr := f.resizeFileShare(accountName, accountKey, "", -2)
-				assert.NoError(t, actualErr)
+				f := newFakeFileClient(func(req *http.Request) *http.Response {
+					assert.Equal(t, http.MethodGet, req.Method, "quota should not be set")
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Ms-Share-Quota": {"100"}}}
+				})
+				assert.NoError(t, f.resizeFileShare(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "share", 100))
+			},
+		},
+		{
+			name: "file share is resized",
+			testFunc: func(t *testing.T) {
+				var quota string
+				f := newFakeFileClient(func(req *http.Request) *http.Response {
+					if req.Method == http.MethodPut {
+						quota = req.Header.Get("x-ms-share-quota")
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Ms-Share-Quota": {"100"}}}
+				})
+				assert.NoError(t, f.resizeFileShare(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "share", 200))
+				assert.Equal(t, "200", quota)
 			},
 		},
 		{
 			name: "Request quota size is invalid",
 			testFunc: func(t *testing.T) {
-				//Request quota size is invalid
-				accountName := "unittest"
-				accountKey := "dW5pdHRlc3Q="
-				f := azureFileClient{
-					env: &azure.Environment{
-						StorageEndpointSuffix: "ut",
-					},
-				}
-				actualErr := f.resizeFileShare(accountName, accountKey, "", 6000)
-				expectedErr := fmt.Errorf("failed to set quota on file share , err: invalid value 6000 for quota, valid values are [1, 5120]")
-				if !reflect.DeepEqual(actualErr, expectedErr) {
-					t.Errorf("actualErr: (%v), expectedErr: (%v)", actualErr, expectedErr)
-				}
+				f := newFakeFileClient(func(req *http.Request) *http.Response {
+					if req.Method == http.MethodPut {
+						return &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{errorCodeHeader: {"InvalidHeaderValue"}}}
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Ms-Share-Quota": {"100"}}}
+				})
+				actualErr := f.resizeFileShare(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "share", 6000)
+				assert.ErrorContains(t, actualErr, "failed to set quota on file share share, err: ")
+				assert.Equal(t, "InvalidHeaderValue", getAzureErrorDetail(actualErr).Code)
 			},
 		},
 	}
@@ -212,3 +339,28 @@ func TestResizeFileShare(t *testing.T) {
 		t.Run(tc.name, tc.testFunc)
 	}
 }
+
+func TestDataPlaneThrottling(t *testing.T) {
+	limiter := newThrottleLimiter(throttleScopeAccount, 0, 0, time.Second)
+	requests := 0
+	f := newFakeFileClient(func(req *http.Request) *http.Response {
+		requests++
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{errorCodeHeader: {serverBusy}, "Retry-After": {"30"}}}
+	})
+	f.limiter = limiter
+
+	_, err := f.getFileShareQuota(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "share")
+	assert.Equal(t, errorCategoryThrottled, classifyError(err))
+	assert.Equal(t, 1, requests)
+
+	// the account is blocked until Retry-After is over
+	_, err = f.getFileShareQuota(context.Background(), "unittest", "dW5pdHRlc3Q=", "", "share")
+	assert.Equal(t, errorCategoryThrottled, classifyError(err))
+	assert.False(t, isRetriableError(err))
+	assert.Equal(t, 1, requests)
+
+	// other accounts are not blocked
+	_, err = f.getFileShareQuota(context.Background(), "unittest2", "dW5pdHRlc3Q=", "", "share")
+	assert.Error(t, err)
+	assert.Equal(t, 2, requests)
+}
@@ -21,23 +21,34 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
 	azure2 "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 
 	"sigs.k8s.io/cloud-provider-azure/pkg/auth"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/consts"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 )
 
 const (
@@ -51,8 +62,9 @@ var (
 
 func NewFakeDriver() *Driver {
 	driverOptions := DriverOptions{
-		NodeID:     fakeNodeID,
-		DriverName: DefaultDriverName,
+		NodeID:            fakeNodeID,
+		DriverName:        DefaultDriverName,
+		DataPlaneMaxTries: 1,
 	}
 	driver := NewDriver(&driverOptions)
 	driver.Name = fakeDriverName
@@ -178,140 +190,6 @@ func TestAppendDefaultMountOptions(t *testing.T) {
 	}
 }
 
-func TestGetFileShareInfo(t *testing.T) {
-	tests := []struct {
-		id                string
-		resourceGroupName string
-		accountName       string
-		fileShareName     string
-		diskName          string
-		namespace         string
-		subsID            string
-		expectedError     error
-	}{
-		{
-			id:                "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname1.vhd#1620118846",
-			resourceGroupName: "rg",
-			accountName:       "f5713de20cde511e8ba4900",
-			fileShareName:     "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			diskName:          "diskname1.vhd",
-			namespace:         "",
-			expectedError:     nil,
-		},
-		{
-			id:                "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname1.vhd#1620118846#namespace",
-			resourceGroupName: "rg",
-			accountName:       "f5713de20cde511e8ba4900",
-			fileShareName:     "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			diskName:          "diskname1.vhd",
-			namespace:         "namespace",
-			expectedError:     nil,
-		},
-		{
-			id:                "#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname1.vhd#namespace",
-			resourceGroupName: "",
-			accountName:       "f5713de20cde511e8ba4900",
-			fileShareName:     "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			diskName:          "diskname1.vhd",
-			namespace:         "namespace",
-			expectedError:     nil,
-		},
-		{
-			id:                "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname2.vhd#",
-			resourceGroupName: "rg",
-			accountName:       "f5713de20cde511e8ba4900",
-			fileShareName:     "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			diskName:          "diskname2.vhd",
-			expectedError:     nil,
-		},
-		{
-			id:                "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname3.vhd",
-			resourceGroupName: "rg",
-			accountName:       "f5713de20cde511e8ba4900",
-			fileShareName:     "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			diskName:          "diskname3.vhd",
-			expectedError:     nil,
-		},
-		{
-			id:                "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			resourceGroupName: "rg",
-			accountName:       "f5713de20cde511e8ba4900",
-			fileShareName:     "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			diskName:          "",
-			expectedError:     nil,
-		},
-		{
-			id:                "rg#f5713de20cde511e8ba4900",
-			resourceGroupName: "",
-			accountName:       "",
-			fileShareName:     "",
-			diskName:          "",
-			expectedError:     fmt.Errorf("error parsing volume id: \"rg#f5713de20cde511e8ba4900\", should at least contain two #"),
-		},
-		{
-			id:                "rg",
-			resourceGroupName: "",
-			accountName:       "",
-			fileShareName:     "",
-			diskName:          "",
-			expectedError:     fmt.Errorf("error parsing volume id: \"rg\", should at least contain two #"),
-		},
-		{
-			id:                "",
-			resourceGroupName: "",
-			accountName:       "",
-			fileShareName:     "",
-			diskName:          "",
-			expectedError:     fmt.Errorf("error parsing volume id: \"\", should at least contain two #"),
-		},
-		{
-			id:                "rg#f5713de20cde511e8ba4900#fileShareName#diskname.vhd#uuid#namespace#subsID",
-			resourceGroupName: "rg",
-			accountName:       "f5713de20cde511e8ba4900",
-			fileShareName:     "fileShareName",
-			diskName:          "diskname.vhd",
-			namespace:         "namespace",
-			subsID:            "subsID",
-			expectedError:     nil,
-		},
-		{
-			id:                "rg#f5713de20cde511e8ba4900#fileShareName#diskname.vhd#uuid#namespace",
-			resourceGroupName: "rg",
-			accountName:       "f5713de20cde511e8ba4900",
-			fileShareName:     "fileShareName",
-			diskName:          "diskname.vhd",
-			namespace:         "namespace",
-			subsID:            "",
-			expectedError:     nil,
-		},
-	}
-
-	for _, test := range tests {
-		resourceGroupName, accountName, fileShareName, diskName, namespace, subsID, expectedError := GetFileShareInfo(test.id)
-		if resourceGroupName != test.resourceGroupName {
-			t.Errorf("GetFileShareInfo(%q) returned with: %q, expected: %q", test.id, resourceGroupName, test.resourceGroupName)
-		}
-		if accountName != test.accountName {
-			t.Errorf("GetFileShareInfo(%q) returned with: %q, expected: %q", test.id, accountName, test.accountName)
-		}
-		if fileShareName != test.fileShareName {
-			t.Errorf("GetFileShareInfo(%q) returned with: %q, expected: %q", test.id, fileShareName, test.fileShareName)
-		}
-		if diskName != test.diskName {
-			t.Errorf("GetFileShareInfo(%q) returned with: %q, expected: %q", test.id, diskName, test.diskName)
-		}
-		if namespace != test.namespace {
-			t.Errorf("GetFileShareInfo(%q) returned with: %q, expected: %q", test.id, namespace, test.namespace)
-		}
-		if subsID != test.subsID {
-			t.Errorf("GetFileShareInfo(%q) returned with: %q, expected: %q", test.id, subsID, test.subsID)
-		}
-		if !reflect.DeepEqual(expectedError, test.expectedError) {
-			t.Errorf("GetFileShareInfo(%q) returned with: %v, expected: %v", test.id, expectedError, test.expectedError)
-		}
-	}
-}
-
 func TestGetStorageAccount(t *testing.T) {
 	emptyAccountKeyMap := map[string]string{
 		"accountname": "testaccount",
@@ -491,53 +369,71 @@ func TestCheckShareNameBeginAndEnd(t *testing.T) {
 	}
 }
 
-func TestGetSnapshot(t *testing.T) {
+func TestGetSnapshotCreationTime(t *testing.T) {
 	tests := []struct {
-		options   string
-		expected1 string
-		expected2 error
+		snapshot    string
+		expected    int64
+		expectedErr bool
 	}{
 		{
-			options:   "rg#f123#csivolumename#diskname#2019-08-22T07:17:53.0000000Z",
-			expected1: "2019-08-22T07:17:53.0000000Z",
-			expected2: nil,
+			snapshot: "2019-08-22T07:17:53.0000000Z",
+			expected: time.Date(2019, 8, 22, 7, 17, 53, 0, time.UTC).Unix(),
 		},
 		{
-			options:   "rg#f123#csivolumename#diskname#uuid#2020-08-22T07:17:53.0000000Z",
-			expected1: "2020-08-22T07:17:53.0000000Z",
-			expected2: nil,
+			snapshot:    "invalid",
+			expectedErr: true,
 		},
+	}
+
+	for _, test := range tests {
+		result, err := getSnapshotCreationTime(test.snapshot)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("input: %q, expected error", test.snapshot)
+			}
+			continue
+		}
+		if err != nil || result.GetSeconds() != test.expected {
+			t.Errorf("input: %q, getSnapshotCreationTime result: %v, expected: %v, err: %v", test.snapshot, result, test.expected, err)
+		}
+	}
+}
+
+func TestParseListToken(t *testing.T) {
+	tests := []struct {
+		token           string
+		expectedAccount string
+		expectedMarker  string
+		expectedErr     error
+	}{
 		{
-			options:   "rg#f123#csivolumename#diskname#uuid#default#2021-08-22T07:17:53.0000000Z",
-			expected1: "2021-08-22T07:17:53.0000000Z",
-			expected2: nil,
+			token:           "account#marker",
+			expectedAccount: "account",
+			expectedMarker:  "marker",
 		},
 		{
-			options:   "rg#f123#csivolumename",
-			expected1: "",
-			expected2: fmt.Errorf("error parsing volume id: \"rg#f123#csivolumename\", should at least contain four #"),
+			token:           "account#",
+			expectedAccount: "account",
 		},
 		{
-			options:   "rg#f123",
-			expected1: "",
-			expected2: fmt.Errorf("error parsing volume id: \"rg#f123\", should at least contain four #"),
+			token:           "account#marker#with#separator",
+			expectedAccount: "account",
+			expectedMarker:  "marker#with#separator",
 		},
 		{
-			options:   "rg",
-			expected1: "",
-			expected2: fmt.Errorf("error parsing volume id: \"rg\", should at least contain four #"),
+			token:       "account",
+			expectedErr: fmt.Errorf("error parsing list token: %q, should be in format of account#marker", "account"),
 		},
 		{
-			options:   "",
-			expected1: "",
-			expected2: fmt.Errorf("error parsing volume id: \"\", should at least contain four #"),
+			token:       "#marker",
+			expectedErr: fmt.Errorf("error parsing list token: %q, should be in format of account#marker", "#marker"),
 		},
 	}
 
 	for _, test := range tests {
-		result1, result2 := getSnapshot(test.options)
-		if !reflect.DeepEqual(result1, test.expected1) || !reflect.DeepEqual(result2, test.expected2) {
-			t.Errorf("input: %q, getSnapshot result1: %q, expected1: %q, result2: %q, expected2: %q, ", test.options, result1, test.expected1, result2, test.expected2)
+		account, marker, err := parseListToken(test.token)
+		if account != test.expectedAccount || marker != test.expectedMarker || !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("input: %q, parseListToken result: (%q, %q, %v), expected: (%q, %q, %v)", test.token, account, marker, err, test.expectedAccount, test.expectedMarker, test.expectedErr)
 		}
 	}
 }
@@ -602,6 +498,7 @@ func TestNewDriver(t *testing.T) {
 }
 
 func TestGetFileURL(t *testing.T) {
+	d := NewFakeDriver()
 	tests := []struct {
 		accountName           string
 		accountKey            string
@@ -652,7 +549,7 @@ func TestGetFileURL(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		_, err := getFileURL(test.accountName, test.accountKey, test.storageEndpointSuffix, test.fileShareName, test.diskName)
+		_, err := d.fileClient.getFileURL(test.accountName, test.accountKey, test.storageEndpointSuffix, test.fileShareName, test.diskName)
 		if !reflect.DeepEqual(err, test.expectedError) {
 			t.Errorf("accountName: %v accountKey: %v storageEndpointSuffix: %v fileShareName: %v diskName: %v Error: %v",
 				test.accountName, test.accountKey, test.storageEndpointSuffix, test.fileShareName, test.diskName, err)
@@ -758,7 +655,7 @@ func TestGetAccountInfo(t *testing.T) {
 		d.cloud.KubeClient = clientSet
 		d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
 		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), test.rgName, gomock.Any()).Return(key, nil).AnyTimes()
-		rgName, accountName, _, fileShareName, diskName, _, err := d.GetAccountInfo(context.Background(), test.volumeID, test.secrets, test.reqContext)
+		h, _, err := d.GetAccountInfo(context.Background(), test.volumeID, test.secrets, test.reqContext)
 		if test.expectErr && err == nil {
 			t.Errorf("Unexpected non-error")
 			continue
@@ -769,10 +666,10 @@ func TestGetAccountInfo(t *testing.T) {
 		}
 
 		if err == nil {
-			assert.Equal(t, test.rgName, rgName, test.volumeID)
-			assert.Equal(t, test.expectAccountName, accountName, test.volumeID)
-			assert.Equal(t, test.expectFileShareName, fileShareName, test.volumeID)
-			assert.Equal(t, test.expectDiskName, diskName, test.volumeID)
+			assert.Equal(t, test.rgName, h.ResourceGroup, test.volumeID)
+			assert.Equal(t, test.expectAccountName, h.AccountName, test.volumeID)
+			assert.Equal(t, test.expectFileShareName, h.FileShareName, test.volumeID)
+			assert.Equal(t, test.expectDiskName, h.DiskName, test.volumeID)
 		}
 	}
 }
@@ -808,7 +705,7 @@ func TestCreateDisk(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		_ = createDisk(context.Background(), test.accountName, test.accountKey, test.storageEndpointSuffix,
+		_ = d.createDisk(context.Background(), test.accountName, test.accountKey, test.storageEndpointSuffix,
 			test.fileShareName, test.diskName, 20)
 	}
 }
@@ -844,7 +741,7 @@ func TestGetFileShareQuota(t *testing.T) {
 			desc:                "Share not found",
 			secrets:             map[string]string{},
 			mockedFileShareResp: storage.FileShare{},
-			mockedFileShareErr:  fmt.Errorf("ShareNotFound"),
+			mockedFileShareErr:  fmt.Errorf("Code=\"ShareNotFound\""),
 			expectedQuota:       -1,
 			expectedError:       nil,
 		},
@@ -867,7 +764,7 @@ func TestGetFileShareQuota(t *testing.T) {
 			expectedError:       fmt.Errorf("could not find accountname or azurestorageaccountname field secrets(map[secrets:secrets])"),
 		},
 		{
-			desc: "Error creating azure client",
+			desc: "Invalid account key",
 			secrets: map[string]string{
 				"accountname": "ut",
 				"accountkey":  "testkey",
@@ -875,7 +772,7 @@ func TestGetFileShareQuota(t *testing.T) {
 			mockedFileShareResp: storage.FileShare{},
 			mockedFileShareErr:  nil,
 			expectedQuota:       -1,
-			expectedError:       fmt.Errorf("error creating azure client: azure: account name is not valid: it must be between 3 and 24 characters, and only may contain numbers and lowercase letters: ut"),
+			expectedError:       fmt.Errorf("NewSharedKeyCredential(ut) failed with error: illegal base64 data at input byte 4"),
 		},
 	}
 
@@ -884,7 +781,7 @@ func TestGetFileShareQuota(t *testing.T) {
 		d.cloud.FileClient = mockFileClient
 		mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(test.mockedFileShareResp, test.mockedFileShareErr).AnyTimes()
 		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
-		quota, err := d.getFileShareQuota("", resourceGroupName, accountName, fileShareName, test.secrets)
+		quota, err := d.getFileShareQuota(context.Background(), "", resourceGroupName, accountName, "", fileShareName, test.secrets)
 		if !reflect.DeepEqual(err, test.expectedError) {
 			t.Errorf("test name: %s, Unexpected error: %v, expected error: %v", test.desc, err, test.expectedError)
 		}
@@ -1080,3 +977,378 @@ func TestIsSupportedRootSquashType(t *testing.T) {
 		}
 	}
 }
+
+func TestGetTopologyFromRequirement(t *testing.T) {
+	tests := []struct {
+		desc           string
+		requirement    *csi.TopologyRequirement
+		expectedRegion string
+		expectedZones  []string
+	}{
+		{
+			desc: "nil requirement",
+		},
+		{
+			desc: "region only",
+			requirement: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{Segments: map[string]string{topologyRegionKey: "eastus", topologyZoneKey: ""}}},
+			},
+			expectedRegion: "eastus",
+		},
+		{
+			desc: "preferred zone is evaluated first",
+			requirement: &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{{Segments: map[string]string{topologyRegionKey: "eastus", topologyZoneKey: "eastus-2"}}},
+				Requisite: []*csi.Topology{
+					{Segments: map[string]string{topologyRegionKey: "eastus", topologyZoneKey: "eastus-1"}},
+					{Segments: map[string]string{topologyRegionKey: "eastus", topologyZoneKey: "eastus-2"}},
+				},
+			},
+			expectedRegion: "eastus",
+			expectedZones:  []string{"eastus-2", "eastus-1"},
+		},
+		{
+			desc: "well-known zone key without region",
+			requirement: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{Segments: map[string]string{v1.LabelTopologyZone: "EastUS-3"}}},
+			},
+			expectedRegion: "eastus",
+			expectedZones:  []string{"eastus-3"},
+		},
+		{
+			desc: "zones in other regions and fault domains are ignored",
+			requirement: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{Segments: map[string]string{topologyRegionKey: "westus", topologyZoneKey: "westus-1"}},
+					{Segments: map[string]string{topologyRegionKey: "eastus", topologyZoneKey: "eastus-1"}},
+					{Segments: map[string]string{topologyRegionKey: "westus", topologyZoneKey: "0"}},
+				},
+			},
+			expectedRegion: "westus",
+			expectedZones:  []string{"westus-1"},
+		},
+	}
+
+	for _, test := range tests {
+		region, zones := getTopologyFromRequirement(test.requirement)
+		assert.Equal(t, test.expectedRegion, region, test.desc)
+		assert.Equal(t, test.expectedZones, zones, test.desc)
+	}
+}
+
+func TestGetAccessibleTopology(t *testing.T) {
+	tests := []struct {
+		desc     string
+		sku      string
+		protocol string
+		zones    []string
+		expected map[string]string
+	}{
+		{
+			desc:     "LRS account without zone",
+			sku:      "Standard_LRS",
+			protocol: nfs,
+			expected: map[string]string{topologyRegionKey: "eastus"},
+		},
+		{
+			desc:     "NFS share on LRS account in a single zone",
+			sku:      "Premium_LRS",
+			protocol: nfs,
+			zones:    []string{"eastus-1"},
+			expected: map[string]string{topologyRegionKey: "eastus", topologyZoneKey: "eastus-1"},
+		},
+		{
+			desc:     "SMB share on LRS account in a single zone",
+			sku:      "Premium_LRS",
+			protocol: smb,
+			zones:    []string{"eastus-1"},
+			expected: map[string]string{topologyRegionKey: "eastus"},
+		},
+		{
+			desc:     "NFS share without sku in a single zone",
+			protocol: nfs,
+			zones:    []string{"eastus-1"},
+			expected: map[string]string{topologyRegionKey: "eastus"},
+		},
+		{
+			desc:     "NFS share on ZRS account in a single zone",
+			sku:      "Premium_ZRS",
+			protocol: nfs,
+			zones:    []string{"eastus-1"},
+			expected: map[string]string{topologyRegionKey: "eastus"},
+		},
+		{
+			desc:     "NFS share on LRS account in multiple zones",
+			sku:      "premium_lrs",
+			protocol: nfs,
+			zones:    []string{"eastus-1", "eastus-2"},
+			expected: map[string]string{topologyRegionKey: "eastus"},
+		},
+	}
+
+	for _, test := range tests {
+		topology := getAccessibleTopology("eastus", test.sku, test.protocol, test.zones)
+		assert.Equal(t, []*csi.Topology{{Segments: test.expected}}, topology, test.desc)
+	}
+}
+
+func TestGetValidSubDirName(t *testing.T) {
+	tests := []struct {
+		subDir   string
+		expected string
+	}{
+		{subDir: "pvc-subdir", expected: "pvc-subdir"},
+		{subDir: "/ns/pvc-subdir/", expected: "ns/pvc-subdir"},
+		{subDir: "ns//./pvc-subdir", expected: "ns/pvc-subdir"},
+		{subDir: "../pvc-subdir", expected: "pvc-subdir"},
+		{subDir: "/", expected: ""},
+		{subDir: "", expected: ""},
+		{subDir: "pvc?subdir", expected: ""},
+		{subDir: "pvc#subdir", expected: ""},
+		{subDir: "pvc-subdir.", expected: ""},
+		{subDir: strings.Repeat("a", 256), expected: ""},
+	}
+
+	for _, test := range tests {
+		result := getValidSubDirName(test.subDir)
+		if result != test.expected {
+			t.Errorf("getValidSubDirName(%q) returned with: %q, expected: %q", test.subDir, result, test.expected)
+		}
+	}
+}
+
+func TestValidateEncryptionParameters(t *testing.T) {
+	identity := "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/identity"
+	tests := []struct {
+		desc        string
+		keyVaultURI string
+		keyName     string
+		keyVersion  string
+		identity    string
+		expectedErr error
+	}{
+		{
+			desc: "no customer-managed key",
+		},
+		{
+			desc:        "valid customer-managed key",
+			keyVaultURI: "https://vault.vault.azure.net/",
+			keyName:     "key",
+			keyVersion:  "version",
+			identity:    identity,
+		},
+		{
+			desc:        "keyVersion without keyVaultURI",
+			keyVersion:  "version",
+			expectedErr: fmt.Errorf("keyName, keyVersion and userAssignedIdentity could only be used with keyVaultURI"),
+		},
+		{
+			desc:        "keyVaultURI is not https",
+			keyVaultURI: "http://vault.vault.azure.net/",
+			keyName:     "key",
+			identity:    identity,
+			expectedErr: fmt.Errorf("keyVaultURI(http://vault.vault.azure.net/) is not a valid https URL"),
+		},
+		{
+			desc:        "keyName not provided",
+			keyVaultURI: "https://vault.vault.azure.net/",
+			identity:    identity,
+			expectedErr: fmt.Errorf("keyName must be provided with keyVaultURI(https://vault.vault.azure.net/)"),
+		},
+		{
+			desc:        "identity not provided",
+			keyVaultURI: "https://vault.vault.azure.net/",
+			keyName:     "key",
+			expectedErr: fmt.Errorf("userAssignedIdentity must be provided with keyVaultURI(https://vault.vault.azure.net/)"),
+		},
+		{
+			desc:        "invalid identity",
+			keyVaultURI: "https://vault.vault.azure.net/",
+			keyName:     "key",
+			identity:    "identity",
+			expectedErr: fmt.Errorf("userAssignedIdentity(identity) is not a valid resource ID of user-assigned managed identity"),
+		},
+	}
+
+	for _, test := range tests {
+		err := validateEncryptionParameters(test.keyVaultURI, test.keyName, test.keyVersion, test.identity)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGetShareOwnershipMetadata(t *testing.T) {
+	d := NewFakeDriver()
+	d.clusterName = "cluster"
+	expected := map[string]*string{
+		createdByMetadataKey:    to.StringPtr(d.Name),
+		clusterNameMetadataKey:  to.StringPtr("cluster"),
+		pvNameMetadataKey:       to.StringPtr("pv"),
+		pvcNamespaceMetadataKey: to.StringPtr("ns"),
+	}
+	result := d.getShareOwnershipMetadata("pv", "", "ns")
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("getShareOwnershipMetadata returned with: %v, expected: %v", result, expected)
+	}
+}
+
+func TestCheckShareOwnership(t *testing.T) {
+	d := NewFakeDriver()
+	d.clusterName = "cluster"
+	tests := []struct {
+		desc        string
+		metadata    map[string]string
+		expectedErr error
+	}{
+		{
+			desc:     "created by driver in this cluster",
+			metadata: map[string]string{createdByMetadataKey: d.Name, clusterNameMetadataKey: "cluster", pvNameMetadataKey: "pv"},
+		},
+		{
+			desc:        "not created by driver",
+			metadata:    map[string]string{},
+			expectedErr: fmt.Errorf("file share(share) was not created by driver(%s), metadata: map[]", d.Name),
+		},
+		{
+			desc:        "created by driver in another cluster",
+			metadata:    map[string]string{createdByMetadataKey: d.Name, clusterNameMetadataKey: "cluster2"},
+			expectedErr: fmt.Errorf("file share(share) belongs to cluster(cluster2) instead of cluster(cluster)"),
+		},
+	}
+
+	for _, test := range tests {
+		err := d.checkShareOwnership("share", test.metadata)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGetFileShareMetadata(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		desc                string
+		mockedFileShareResp storage.FileShare
+		mockedFileShareErr  error
+		expectedMetadata    map[string]string
+		expectedError       error
+	}{
+		{
+			desc:               "Get file share return error",
+			mockedFileShareErr: fmt.Errorf("test error"),
+			expectedError:      fmt.Errorf("test error"),
+		},
+		{
+			desc:               "Share not found",
+			mockedFileShareErr: fmt.Errorf("Code=\"ShareNotFound\""),
+		},
+		{
+			desc:                "Share without metadata",
+			mockedFileShareResp: storage.FileShare{FileShareProperties: &storage.FileShareProperties{}},
+			expectedMetadata:    map[string]string{},
+		},
+		{
+			desc: "Share with metadata",
+			mockedFileShareResp: storage.FileShare{FileShareProperties: &storage.FileShareProperties{
+				Metadata: map[string]*string{"CreatedBy": to.StringPtr("driver")},
+			}},
+			expectedMetadata: map[string]string{createdByMetadataKey: "driver"},
+		},
+	}
+
+	for _, test := range tests {
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(test.mockedFileShareResp, test.mockedFileShareErr).AnyTimes()
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		metadata, err := d.getFileShareMetadata(context.Background(), "", "rg", "accountname", "", "filesharename", nil)
+		if !reflect.DeepEqual(err, test.expectedError) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedError)
+		}
+		if !reflect.DeepEqual(metadata, test.expectedMetadata) {
+			t.Errorf("test[%s]: unexpected metadata: %v, expected: %v", test.desc, metadata, test.expectedMetadata)
+		}
+	}
+}
+
+func TestGetStorageAccountsCreatedByDriver(t *testing.T) {
+	createdByTags := map[string]*string{consts.CreatedByTag: to.StringPtr("azure")}
+	newAccount := func(name string, tags map[string]*string) storage.Account {
+		return storage.Account{Name: to.StringPtr(name), Tags: tags}
+	}
+	newPV := func(name, driver, volumeHandle string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeHandle},
+				},
+			},
+		}
+	}
+
+	d := NewFakeDriver()
+	d.cloud.SubscriptionID = "subs"
+	d.cloud.ResourceGroup = "rg"
+	d.cloud.KubeClient = fake.NewSimpleClientset(
+		newPV("pv1", d.Name, "rg#accountb#share"),
+		newPV("pv2", d.Name, "rg2#accountc#share"),
+		newPV("pv3", d.Name, "rg3#accountd#share####subs2"),
+		newPV("pv4", d.Name, "rg4#accounte#share"),
+		newPV("pv5", "other.csi.azure.com", "rg5#accountf#share"),
+	)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), "subs", "rg").Return([]storage.Account{
+		newAccount("accountb", createdByTags),
+		newAccount("accounta", createdByTags),
+		newAccount("notcreatedbydriver", nil),
+	}, nil).Times(1)
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), "subs", "rg2").Return([]storage.Account{
+		newAccount("accountc", createdByTags),
+	}, nil).Times(1)
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), "subs2", "rg3").Return([]storage.Account{
+		newAccount("accountd", createdByTags),
+	}, nil).Times(1)
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), "subs", "rg4").Return(nil, &retry.Error{RawError: fmt.Errorf("test error")}).Times(1)
+
+	accounts, err := d.getStorageAccountsCreatedByDriver(context.Background())
+	assert.NoError(t, err)
+	expected := []storageAccountRef{
+		{subsID: "subs", resourceGroup: "rg", accountName: "accounta"},
+		{subsID: "subs", resourceGroup: "rg", accountName: "accountb"},
+		{subsID: "subs", resourceGroup: "rg2", accountName: "accountc"},
+		{subsID: "subs2", resourceGroup: "rg3", accountName: "accountd"},
+	}
+	assert.Equal(t, expected, accounts)
+
+	// failure of listing storage accounts in resource group of cluster is returned
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), "subs", "rg").Return(nil, &retry.Error{RawError: fmt.Errorf("test error")}).Times(1)
+	d.cloud.KubeClient = nil
+	_, err = d.getStorageAccountsCreatedByDriver(context.Background())
+	assert.Error(t, err)
+}
+
+func TestSetStorageAccountEncryptionThrottled(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud.SubscriptionID = "subs"
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	mockStorageAccountsClient.EXPECT().Update(gomock.Any(), "subs", "rg", "account", gomock.Any()).
+		Return(&retry.Error{HTTPStatusCode: http.StatusTooManyRequests, RetryAfter: time.Now().Add(time.Minute), RawError: fmt.Errorf("TooManyRequests")}).Times(1)
+
+	accountOptions := &azure.AccountOptions{Name: "account", ResourceGroup: "rg", KeyVaultURI: to.StringPtr("https://vault"), KeyName: to.StringPtr("key")}
+	err := d.SetStorageAccountEncryption(context.Background(), accountOptions, "identity")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	// management API calls in default subscription are blocked until Retry-After
+	assert.Equal(t, codes.ResourceExhausted, status.Code(d.subscriptionLimiter.wait(context.Background(), d.getSubscriptionThrottleKey(""))))
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// controller lease expires if not renewed within controllerLeaseDuration
+	controllerLeaseDuration      = 30 * time.Second
+	controllerLeaseRenewInterval = 10 * time.Second
+	defaultLeaderElectionNS      = "kube-system"
+)
+
+// getControllerLeaseName returns name of the lease held by the controller replica running background tasks
+func (d *Driver) getControllerLeaseName() string {
+	return strings.ReplaceAll(d.Name, ".", "-") + "-controller"
+}
+
+// getControllerLeaseNamespace returns namespace of the controller lease
+func (d *Driver) getControllerLeaseNamespace() string {
+	if d.leaderElectionNamespace == "" {
+		return defaultLeaderElectionNS
+	}
+	return d.leaderElectionNamespace
+}
+
+// getLeaderIdentity returns identity of this controller replica in controller lease
+func (d *Driver) getLeaderIdentity() string {
+	if d.leaderIdentity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			klog.Warningf("failed to get hostname: %v", err)
+		}
+		d.leaderIdentity = hostname + "_" + uuid.NewUUID().String()
+	}
+	return d.leaderIdentity
+}
+
+// runWithControllerLease runs run while this replica holds controller lease, the stop channel passed to run is
+// closed once the lease is lost, so that only one controller replica runs background tasks at a time
+func (d *Driver) runWithControllerLease(run func(stopCh <-chan struct{}), stopCh <-chan struct{}) {
+	identity := d.getLeaderIdentity()
+	klog.V(2).Infof("trying to acquire controller lease %s/%s as %s", d.getControllerLeaseNamespace(), d.getControllerLeaseName(), identity)
+
+	var leaderStopCh chan struct{}
+	stopLeading := func() {
+		if leaderStopCh != nil {
+			close(leaderStopCh)
+			leaderStopCh = nil
+		}
+	}
+	defer stopLeading()
+
+	wait.Until(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), controllerLeaseRenewInterval)
+		defer cancel()
+		isLeader, err := d.tryAcquireOrRenewControllerLease(ctx, time.Now())
+		if err != nil {
+			klog.Errorf("failed to acquire or renew controller lease: %v", err)
+		}
+		switch {
+		case isLeader && leaderStopCh == nil:
+			klog.V(2).Infof("acquired controller lease as %s, starting controller background tasks", identity)
+			leaderStopCh = make(chan struct{})
+			run(leaderStopCh)
+		case !isLeader && leaderStopCh != nil:
+			klog.Warningf("lost controller lease, stopping controller background tasks")
+			stopLeading()
+		}
+	}, controllerLeaseRenewInterval, stopCh)
+}
+
+// tryAcquireOrRenewControllerLease returns true if this replica holds controller lease after the call
+func (d *Driver) tryAcquireOrRenewControllerLease(ctx context.Context, now time.Time) (bool, error) {
+	leaseClient := d.cloud.KubeClient.CoordinationV1().Leases(d.getControllerLeaseNamespace())
+	identity := d.getLeaderIdentity()
+	leaseDurationSeconds := int32(controllerLeaseDuration.Seconds())
+	renewTime := metav1.NewMicroTime(now)
+
+	lease, err := leaseClient.Get(ctx, d.getControllerLeaseName(), metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to get lease %s: %w", d.getControllerLeaseName(), err)
+		}
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      d.getControllerLeaseName(),
+				Namespace: d.getControllerLeaseNamespace(),
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		if _, err := leaseClient.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to create lease %s: %w", d.getControllerLeaseName(), err)
+		}
+		return true, nil
+	}
+
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	if holder != "" && holder != identity && !isLeaseExpired(lease, now) {
+		return false, nil
+	}
+
+	lease = lease.DeepCopy()
+	if holder != identity {
+		lease.Spec.HolderIdentity = &identity
+		lease.Spec.AcquireTime = &renewTime
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.RenewTime = &renewTime
+	lease.Spec.LeaseDurationSeconds = &leaseDurationSeconds
+	if _, err := leaseClient.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		if apierrors.IsConflict(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to update lease %s: %w", d.getControllerLeaseName(), err)
+	}
+	return true, nil
+}
+
+// isLeaseExpired returns true if lease is not renewed within its duration
+func isLeaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetControllerLeaseName(t *testing.T) {
+	d := NewFakeDriver()
+	d.Name = DefaultDriverName
+	assert.Equal(t, "file-csi-azure-com-controller", d.getControllerLeaseName())
+	assert.Equal(t, defaultLeaderElectionNS, d.getControllerLeaseNamespace())
+	d.leaderElectionNamespace = "ns"
+	assert.Equal(t, "ns", d.getControllerLeaseNamespace())
+}
+
+func TestTryAcquireOrRenewControllerLease(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	newDriver := func(identity string) *Driver {
+		d := NewFakeDriver()
+		d.cloud.KubeClient = clientSet
+		d.leaderIdentity = identity
+		return d
+	}
+	d1, d2 := newDriver("replica1"), newDriver("replica2")
+	now := time.Now()
+	ctx := context.TODO()
+
+	// replica1 creates the lease
+	isLeader, err := d1.tryAcquireOrRenewControllerLease(ctx, now)
+	assert.NoError(t, err)
+	assert.True(t, isLeader)
+
+	// replica2 could not acquire the lease held by replica1
+	isLeader, err = d2.tryAcquireOrRenewControllerLease(ctx, now.Add(controllerLeaseRenewInterval))
+	assert.NoError(t, err)
+	assert.False(t, isLeader)
+
+	// replica1 renews the lease
+	now = now.Add(controllerLeaseRenewInterval)
+	isLeader, err = d1.tryAcquireOrRenewControllerLease(ctx, now)
+	assert.NoError(t, err)
+	assert.True(t, isLeader)
+
+	// replica2 takes over the lease once it's expired
+	now = now.Add(controllerLeaseDuration + time.Second)
+	isLeader, err = d2.tryAcquireOrRenewControllerLease(ctx, now)
+	assert.NoError(t, err)
+	assert.True(t, isLeader)
+
+	// replica1 lost the lease
+	isLeader, err = d1.tryAcquireOrRenewControllerLease(ctx, now)
+	assert.NoError(t, err)
+	assert.False(t, isLeader)
+
+	lease, err := clientSet.CoordinationV1().Leases(defaultLeaderElectionNS).Get(ctx, d1.getControllerLeaseName(), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "replica2", *lease.Spec.HolderIdentity)
+	assert.Equal(t, int32(1), *lease.Spec.LeaseTransitions)
+}
+
+func TestRunWithControllerLease(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud.KubeClient = fake.NewSimpleClientset()
+	started := make(chan struct{})
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.runWithControllerLease(func(leaderStopCh <-chan struct{}) {
+			close(started)
+			go func() {
+				<-leaderStopCh
+				close(done)
+			}()
+		}, stopCh)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("controller tasks are not started after acquiring lease")
+	}
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("controller tasks are not stopped")
+	}
+}
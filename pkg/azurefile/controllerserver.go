@@ -19,9 +19,12 @@ package azurefile
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"net/http"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	volumehelper "sigs.k8s.io/azurefile-csi-driver/pkg/util"
 
@@ -29,15 +32,14 @@ import (
 	"github.com/Azure/azure-storage-file-go/azfile"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/pborman/uuid"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
-	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
 	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
 	"sigs.k8s.io/cloud-provider-azure/pkg/metrics"
@@ -47,6 +49,13 @@ import (
 const (
 	azureFileCSIDriverName = "azurefile_csi_driver"
 	privateEndpoint        = "privateendpoint"
+
+	waitForCopyInterval = 5 * time.Second
+	waitForCopyTimeout  = 3 * time.Minute
+	// SAS token of copy source should be valid until all pending server side copies are completed
+	copySASTokenExpiry = 24 * time.Hour
+
+	volumeHealthyMessage = "volume is healthy"
 )
 
 var (
@@ -111,6 +120,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	var secretNamespace, pvcNamespace, protocol, customTags, storageEndpointSuffix, networkEndpointType, accessTier, rootSquashType string
 	var createAccount, useDataPlaneAPI, useSeretCache, disableDeleteRetentionPolicy, enableLFS, matchTags bool
 	var vnetResourceGroup, vnetName, subnetName, shareNamePrefix, fsGroupChangePolicy string
+	var provisioningMode, folderName, subDirOnDelete, accountSelectionPolicy, shareOnDelete string
+	var snapshotOnDelete, softDeletedShareAction string
+	var keyVaultURI, keyName, keyVersion, userAssignedIdentity, pvName, pvcName string
+	var credentialProviders []string
 	var requireInfraEncryption *bool
 	// set allowBlobPublicAccess as false by default
 	allowBlobPublicAccess := to.BoolPtr(false)
@@ -181,13 +194,36 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 				allowBlobPublicAccess = to.BoolPtr(true)
 			}
 		case pvcNameKey:
+			pvcName = v
 			fileShareNameReplaceMap[pvcNameMetadata] = v
 		case pvNameKey:
+			pvName = v
 			fileShareNameReplaceMap[pvNameMetadata] = v
 		case serverNameField:
 			// no op, only used in NodeStageVolume
 		case folderNameField:
-			// no op, only used in NodeStageVolume
+			// used as subdirectory name in subdirectory provisioning mode, otherwise only used in NodeStageVolume
+			folderName = v
+		case provisioningModeField:
+			provisioningMode = v
+		case subDirOnDeleteField:
+			subDirOnDelete = v
+		case shareOnDeleteField:
+			shareOnDelete = v
+		case snapshotOnDeleteField:
+			snapshotOnDelete = v
+		case softDeletedShareActionField:
+			softDeletedShareAction = v
+		case accountSelectionPolicyField:
+			accountSelectionPolicy = strings.ToLower(v)
+		case keyVaultURIField:
+			keyVaultURI = v
+		case keyNameField:
+			keyName = v
+		case keyVersionField:
+			keyVersion = v
+		case userAssignedIdentityField:
+			userAssignedIdentity = v
 		case fsGroupChangePolicyField:
 			fsGroupChangePolicy = v
 		case mountPermissionsField:
@@ -209,6 +245,11 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			if strings.EqualFold(v, trueValue) {
 				requireInfraEncryption = to.BoolPtr(true)
 			}
+		case credentialProvidersField:
+			var err error
+			if credentialProviders, err = d.parseCredentialProviders(v); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid credentialProviders(%s) in storage class: %v", v, err)
+			}
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid parameter %q in storage class", k))
 		}
@@ -218,6 +259,26 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("matchTags must set as false when storageAccount(%s) is provided", account))
 	}
 
+	if !isSupportedAccountSelectionPolicy(accountSelectionPolicy) {
+		return nil, status.Errorf(codes.InvalidArgument, "accountSelectionPolicy(%s) is not supported, supported accountSelectionPolicy list: %v", accountSelectionPolicy, supportedAccountSelectionPolicyList)
+	}
+
+	if accountSelectionPolicy != "" {
+		if account != "" || createAccount {
+			return nil, status.Errorf(codes.InvalidArgument, "accountSelectionPolicy(%s) could not be used with storageAccount or createAccount", accountSelectionPolicy)
+		}
+		if accountSelectionPolicy == perNamespacePolicy && pvcNamespace == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "accountSelectionPolicy(%s) requires pvc namespace in parameters, enable --extra-create-metadata on csi-provisioner", accountSelectionPolicy)
+		}
+	}
+
+	if err := validateEncryptionParameters(keyVaultURI, keyName, keyVersion, userAssignedIdentity); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	if keyVaultURI != "" && account != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "keyVaultURI could not be used with storageAccount(%s), customer-managed key is only configured on storage account created by driver", account)
+	}
+
 	if subsID != "" && subsID != d.cloud.SubscriptionID {
 		if resourceGroup == "" {
 			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("resourceGroup must be provided in cross subscription(%s)", subsID))
@@ -264,6 +325,68 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Errorf(codes.InvalidArgument, "fsType(%s) is not supported with protocol(%s)", fsType, protocol)
 	}
 
+	if !isSupportedProvisioningMode(provisioningMode) {
+		return nil, status.Errorf(codes.InvalidArgument, "provisioningMode(%s) is not supported, supported provisioningMode list: %v", provisioningMode, supportedProvisioningModeList)
+	}
+
+	if !isSupportedSubDirOnDelete(subDirOnDelete) {
+		return nil, status.Errorf(codes.InvalidArgument, "subDirOnDelete(%s) is not supported, supported subDirOnDelete list: %v", subDirOnDelete, supportedSubDirOnDeleteList)
+	}
+
+	if !isSupportedShareOnDelete(shareOnDelete) {
+		return nil, status.Errorf(codes.InvalidArgument, "shareOnDelete(%s) is not supported, supported shareOnDelete list: %v", shareOnDelete, supportedShareOnDeleteList)
+	}
+
+	if !isSupportedSnapshotOnDelete(snapshotOnDelete) {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshotOnDelete(%s) is not supported, supported snapshotOnDelete list: %v", snapshotOnDelete, supportedSnapshotOnDeleteList)
+	}
+
+	if snapshotOnDelete != "" && (d.quarantineDeletedShares || strings.EqualFold(shareOnDelete, shareOnDeleteQuarantine)) {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshotOnDelete could not be used with %s shareOnDelete", shareOnDeleteQuarantine)
+	}
+
+	if !isSupportedSoftDeletedShareAction(softDeletedShareAction) {
+		return nil, status.Errorf(codes.InvalidArgument, "softDeletedShareAction(%s) is not supported, supported softDeletedShareAction list: %v", softDeletedShareAction, supportedSoftDeletedShareActionList)
+	}
+
+	isSubDirMode := strings.EqualFold(provisioningMode, subDirProvisioningMode)
+	if isSubDirMode {
+		if shareOnDelete != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "shareOnDelete is not supported in %s provisioning mode, use subDirOnDelete instead", subDirProvisioningMode)
+		}
+		if snapshotOnDelete != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshotOnDelete is not supported in %s provisioning mode", subDirProvisioningMode)
+		}
+		if softDeletedShareAction != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "softDeletedShareAction is not supported in %s provisioning mode", subDirProvisioningMode)
+		}
+		if protocol == nfs || fsType == nfs {
+			return nil, status.Errorf(codes.InvalidArgument, "protocol(%s) is not supported in %s provisioning mode", nfs, subDirProvisioningMode)
+		}
+		if isDiskFsType(fsType) {
+			return nil, status.Errorf(codes.InvalidArgument, "fsType(%s) is not supported in %s provisioning mode", fsType, subDirProvisioningMode)
+		}
+		if req.GetVolumeContentSource() != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume cloning and snapshot restore are not supported in %s provisioning mode", subDirProvisioningMode)
+		}
+	} else if subDirOnDelete != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "subDirOnDelete is only supported in %s provisioning mode", subDirProvisioningMode)
+	}
+
+	requirement := req.GetAccessibilityRequirements()
+	topologyRegion, topologyZones := getTopologyFromRequirement(requirement)
+	if topologyRegion != "" {
+		if location == "" {
+			location = topologyRegion
+		} else if !strings.EqualFold(location, topologyRegion) {
+			return nil, status.Errorf(codes.InvalidArgument, "location(%s) in storage class does not match region(%s) of requested topology", location, topologyRegion)
+		}
+	}
+	if sku == "" && len(topologyZones) > 1 {
+		// requested topology spans multiple availability zones, use zone redundant storage
+		sku = string(storage.SkuNameStandardZRS)
+	}
+
 	if disableDeleteRetentionPolicy && !strings.HasPrefix(strings.ToLower(sku), premium) {
 		return nil, status.Errorf(codes.InvalidArgument, "disableDeleteRetentionPolicy is not supported with Standard account type(%s)", sku)
 	}
@@ -275,12 +398,18 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		createPrivateEndpoint = true
 	}
 	var vnetResourceIDs []string
+	// sku may be defaulted below, while topology is only restricted by sku specified by user
+	requestedSku := sku
 	if fsType == nfs || protocol == nfs {
 		protocol = nfs
 		enableHTTPSTrafficOnly = false
 		if !strings.HasPrefix(strings.ToLower(sku), premium) {
 			// NFS protocol only supports Premium storage
-			sku = string(storage.SkuNamePremiumLRS)
+			if isZoneRedundantSku(sku) {
+				sku = string(storage.SkuNamePremiumZRS)
+			} else {
+				sku = string(storage.SkuNamePremiumLRS)
+			}
 		}
 		shareProtocol = storage.EnabledProtocolsNFS
 		// NFS protocol does not need account key
@@ -313,6 +442,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 
 	// replace pv/pvc name namespace metadata in fileShareName
 	validFileShareName := replaceWithMap(fileShareName, fileShareNameReplaceMap)
+	if validFileShareName == "" && isSubDirMode {
+		// all volumes are provisioned on the same file share in subdirectory provisioning mode
+		validFileShareName = defaultSubDirShareName
+	}
 	if validFileShareName == "" {
 		name := volName
 		if shareNamePrefix != "" {
@@ -329,6 +462,18 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		validFileShareName = getValidFileShareName(name)
 	}
 
+	var subDir string
+	if isSubDirMode {
+		// replace pv/pvc name namespace metadata in folderName
+		name := replaceWithMap(folderName, fileShareNameReplaceMap)
+		if name == "" {
+			name = volName
+		}
+		if subDir = getValidSubDirName(name); subDir == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "folderName(%s) is not a valid directory name", name)
+		}
+	}
+
 	if resourceGroup == "" {
 		resourceGroup = d.cloud.ResourceGroup
 	}
@@ -359,38 +504,89 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		SubnetName:                              subnetName,
 		RequireInfrastructureEncryption:         requireInfraEncryption,
 	}
+	if keyVaultURI != "" {
+		accountOptions.KeyVaultURI = &keyVaultURI
+		accountOptions.KeyName = &keyName
+		if keyVersion != "" {
+			accountOptions.KeyVersion = &keyVersion
+		}
+	}
 
 	var accountKey, lockKey string
 	accountName := account
 	if len(req.GetSecrets()) == 0 && accountName == "" {
 		if v, ok := d.volMap.Load(volName); ok {
 			accountName = v.(string)
+		} else if accountName = d.getPersistedAccountSelection(ctx, volName); accountName != "" {
+			// account was selected before controller restart
+			klog.V(2).Infof("use storage account(%s) persisted for volume(%s)", accountName, volName)
+			d.volMap.Store(volName, accountName)
 		} else {
 			lockKey = fmt.Sprintf("%s%s%s%s%s%v", sku, accountKind, resourceGroup, location, protocol, createPrivateEndpoint)
-			// search in cache first
-			cache, err := d.accountSearchCache.Get(lockKey, azcache.CacheReadTypeDefault)
-			if err != nil {
-				return nil, status.Errorf(codes.Internal, err.Error())
+			if keyVaultURI != "" {
+				// accounts encrypted with different customer-managed keys are never shared
+				lockKey = fmt.Sprintf("%s%s%s%s%s", lockKey, strings.ToLower(strings.TrimSuffix(keyVaultURI, "/")), strings.ToLower(keyName), strings.ToLower(keyVersion), strings.ToLower(userAssignedIdentity))
+			}
+			var cache interface{}
+			if accountSelectionPolicy == "" {
+				// search in cache first, accounts are ranked on every request if selection policy is specified
+				if cache, err = d.accountSearchCache.Get(lockKey, azcache.CacheReadTypeDefault); err != nil {
+					return nil, status.Errorf(codes.Internal, err.Error())
+				}
 			}
 			if cache != nil {
 				accountName = cache.(string)
 			} else {
 				d.volLockMap.LockEntry(lockKey)
-				err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+				if (accountSelectionPolicy != "" || keyVaultURI != "") && !createAccount {
+					// cloud provider does not check encryption of existing accounts, so accounts are selected by driver
+					// if customer-managed key is specified, the first matching account is selected without policy
+					if accountSelectionPolicy == perNamespacePolicy {
+						// a new account created for the namespace is tagged with the namespace
+						accountOptions.Tags[pvcNamespaceTag] = pvcNamespace
+					}
+					selectionReq := &accountSelectionRequest{PoolKey: lockKey, Namespace: pvcNamespace, RequestGiB: int64(fileShareSize), EncryptionIdentity: userAssignedIdentity}
+					if accountOptions.Name, err = d.selectStorageAccount(ctx, accountSelectionPolicy, accountOptions, selectionReq); err != nil {
+						d.volLockMap.UnlockEntry(lockKey)
+						return nil, status.Errorf(codes.Internal, "failed to select storage account by policy(%s): %v", accountSelectionPolicy, err)
+					}
+					// create a new account if there is no suitable account
+					accountOptions.CreateAccount = accountOptions.Name == ""
+				}
+				// customer-managed key could only be set by driver with user-assigned identity after account is created
+				ensureAccountOptions := *accountOptions
+				ensureAccountOptions.KeyVaultURI, ensureAccountOptions.KeyName, ensureAccountOptions.KeyVersion = nil, nil, nil
+				throttleKey := d.getSubscriptionThrottleKey(subsID)
+				err = wait.ExponentialBackoffWithContext(ctx, d.cloud.RequestBackoff(), func() (bool, error) {
+					if err := d.subscriptionLimiter.wait(ctx, throttleKey); err != nil {
+						return true, err
+					}
 					var retErr error
-					accountName, accountKey, retErr = d.cloud.EnsureStorageAccount(ctx, accountOptions, defaultAccountNamePrefix)
+					accountName, accountKey, retErr = d.cloud.EnsureStorageAccount(ctx, &ensureAccountOptions, defaultAccountNamePrefix)
+					if d.subscriptionLimiter.throttled(throttleKey, retErr, accountOpThrottlingRetryAfter) {
+						return true, status.Errorf(codes.ResourceExhausted, "EnsureStorageAccount(%s) is throttled: %v", account, retErr)
+					}
 					if isRetriableError(retErr) {
 						klog.Warningf("EnsureStorageAccount(%s) failed with error(%v), waiting for retrying", account, retErr)
-						sleepIfThrottled(retErr, accountOpThrottlingSleepSec)
 						return false, nil
 					}
 					return true, retErr
 				})
+				if err == nil && keyVaultURI != "" && accountOptions.CreateAccount {
+					accountOptions.Name = accountName
+					if err = d.SetStorageAccountEncryption(ctx, accountOptions, userAssignedIdentity); err != nil {
+						err = fmt.Errorf("failed to set customer-managed key on storage account(%s): %v", accountName, err)
+						// never match the account encrypted with Microsoft-managed keys in retries
+						d.discardStorageAccount(ctx, subsID, accountOptions.ResourceGroup, accountName)
+					}
+				}
 				d.volLockMap.UnlockEntry(lockKey)
 				if err != nil {
-					return nil, status.Errorf(codes.Internal, "failed to ensure storage account: %v", err)
+					return nil, azureStatusErrorf(err, "failed to ensure storage account: %v", err)
+				}
+				if accountSelectionPolicy == "" {
+					d.accountSearchCache.Set(lockKey, accountName)
 				}
-				d.accountSearchCache.Set(lockKey, accountName)
 				d.volMap.Store(volName, accountName)
 				if accountKey != "" {
 					d.accountCacheMap.Set(accountName, accountKey)
@@ -406,31 +602,92 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			storageEndpointSuffix = defaultStorageEndPointSuffix
 		}
 	}
-	if d.fileClient != nil {
-		d.fileClient.StorageEndpointSuffix = storageEndpointSuffix
-	}
 	if createPrivateEndpoint {
 		setKeyValueInMap(parameters, serverNameField, fmt.Sprintf("%s.privatelink.file.%s", accountName, storageEndpointSuffix))
 	}
 
 	accountOptions.Name = accountName
+	shareRestored := false
+	if softDeletedShareAction != "" && !strings.EqualFold(softDeletedShareAction, softDeletedShareWait) {
+		// soft-deleted file share with the same name blocks creating file share until it's purged
+		if accountKey == "" {
+			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, credentialProviders); err != nil {
+				return nil, azureStatusErrorf(err, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
+			}
+		}
+		shareName, restored, err := d.handleSoftDeletedFileShare(ctx, softDeletedShareAction, accountName, accountKey, storageEndpointSuffix, validFileShareName)
+		if err != nil {
+			return nil, azureStatusErrorf(err, "failed to %s soft-deleted file share(%s) on account(%s): %v", strings.ToLower(softDeletedShareAction), validFileShareName, accountName, err)
+		}
+		validFileShareName, shareRestored = shareName, restored
+	}
+	if len(req.GetSecrets()) == 0 && account == "" {
+		// persist account selection before creating file share, so that retried CreateVolume after controller restart
+		// does not create file share on another account, it's best effort and removed once the volume is created
+		if err := d.persistAccountSelection(ctx, volName, accountName, validFileShareName); err != nil {
+			klog.Warningf("failed to persist account selection of volume(%s): %v", volName, err)
+		}
+	}
+
 	secret := req.GetSecrets()
 	if len(secret) == 0 && useDataPlaneAPI {
 		if accountKey == "" {
-			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, secret, secretName, secretNamespace); err != nil {
-				return nil, status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
+			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, secret, secretName, secretNamespace, credentialProviders); err != nil {
+				return nil, azureStatusErrorf(err, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
 			}
 		}
 		secret = createStorageAccountSecret(accountName, accountKey)
 		// skip validating file share quota if useDataPlaneAPI
-	} else {
-		if quota, err := d.getFileShareQuota(subsID, resourceGroup, accountName, validFileShareName, secret); err != nil {
-			return nil, status.Errorf(codes.Internal, err.Error())
-		} else if quota != -1 && quota < fileShareSize {
+	} else if !isSubDirMode {
+		if quota, err := d.getFileShareQuota(ctx, subsID, resourceGroup, accountName, storageEndpointSuffix, validFileShareName, secret); err != nil {
+			return nil, azureStatusErrorf(err, err.Error())
+		} else if quota != -1 && quota < fileShareSize && !shareRestored {
 			return nil, status.Errorf(codes.AlreadyExists, "request file share(%s) already exists, but its capacity %d is smaller than %d", validFileShareName, quota, fileShareSize)
 		}
 	}
 
+	shareExists := false
+	if isSubDirMode {
+		// quota of the shared file share is not managed per volume, never update it on existing file share
+		quota, err := d.getFileShareQuota(ctx, subsID, resourceGroup, accountName, storageEndpointSuffix, validFileShareName, secret)
+		if err != nil {
+			return nil, azureStatusErrorf(err, err.Error())
+		}
+		shareExists = quota != -1
+	}
+
+	createVHD := isDiskFsType(fsType) && !strings.HasSuffix(diskName, vhdSuffix)
+	if createVHD {
+		diskName = getVHDDiskName(fileShareName, validFileShareName, volName)
+	}
+
+	var uuid string
+	if fileShareName != "" || isSubDirMode {
+		// add volume name as suffix to differentiate volumeID since "shareName" is specified or file share is shared
+		// not necessary for dynamic file share name creation since volumeID already contains volume name
+		uuid = volName
+	}
+	volumeHandle := &VolumeHandle{
+		ResourceGroup:   resourceGroup,
+		AccountName:     accountName,
+		FileShareName:   validFileShareName,
+		DiskName:        diskName,
+		UUID:            uuid,
+		SecretNamespace: secretNamespace,
+		SubDir:          subDir,
+	}
+	if subsID != "" && subsID != d.cloud.SubscriptionID {
+		volumeHandle.SubscriptionID = subsID
+	}
+	if protocol == nfs {
+		volumeHandle.Protocol = nfs
+	}
+	if storageEndpointSuffix != d.cloud.Environment.StorageEndpointSuffix && storageEndpointSuffix != defaultStorageEndPointSuffix {
+		// only carry storage endpoint suffix different from the one of current cloud environment
+		volumeHandle.StorageEndpointSuffix = storageEndpointSuffix
+	}
+	volumeID := volumeHandle.String()
+
 	shareOptions := &fileclient.ShareOptions{
 		Name:       validFileShareName,
 		Protocol:   shareProtocol,
@@ -438,62 +695,156 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		AccessTier: accessTier,
 		RootSquash: rootSquashType,
 	}
+	if isSubDirMode {
+		// shared file share does not belong to any pv
+		shareOptions.Metadata = d.getShareOwnershipMetadata("", "", "")
+	} else {
+		if pvName == "" {
+			pvName = volName
+		}
+		shareOptions.Metadata = d.getShareOwnershipMetadata(pvName, pvcName, pvcNamespace)
+		if fileShareName == "" {
+			// file share is only provisioned as this volume if its name is generated, so that it could be listed by ListVolumes
+			shareOptions.Metadata[volumeIDMetadataKey] = to.StringPtr(volumeID)
+		}
+	}
+	// actions taken when volume is deleted are kept in file share metadata
+	deletePolicyMetadata := map[string]*string{}
+	if strings.EqualFold(shareOnDelete, shareOnDeleteQuarantine) {
+		deletePolicyMetadata[shareOnDeleteMetadataKey] = to.StringPtr(shareOnDeleteQuarantine)
+	}
+	if snapshotOnDelete != "" {
+		deletePolicyMetadata[snapshotOnDeleteMetadataKey] = to.StringPtr(strings.ToLower(snapshotOnDelete))
+	}
+	for k, v := range deletePolicyMetadata {
+		shareOptions.Metadata[k] = v
+	}
 
-	var volumeID string
 	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_create_volume", d.cloud.ResourceGroup, subsID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
 	}()
 
-	klog.V(2).Infof("begin to create file share(%s) on account(%s) type(%s) subID(%s) rg(%s) location(%s) size(%d) protocol(%s)", validFileShareName, accountName, sku, subsID, resourceGroup, location, fileShareSize, shareProtocol)
-	if err := d.CreateFileShare(accountOptions, shareOptions, secret); err != nil {
-		if strings.Contains(err.Error(), accountLimitExceedManagementAPI) || strings.Contains(err.Error(), accountLimitExceedDataPlaneAPI) {
-			klog.Warningf("create file share(%s) on account(%s) type(%s) subID(%s) rg(%s) location(%s) size(%d), error: %v, skip matching current account", validFileShareName, account, sku, subsID, resourceGroup, location, fileShareSize, err)
-			tags := map[string]*string{
-				azure.SkipMatchingTag: to.StringPtr(""),
+	if shareExists {
+		klog.V(2).Infof("file share(%s) on account(%s) already exists, provision subdirectory(%s) on it", validFileShareName, accountName, subDir)
+	} else if shareRestored {
+		// restored file share is only expanded if it's smaller than requested
+		quota, err := d.getFileShareQuota(ctx, subsID, resourceGroup, accountName, storageEndpointSuffix, validFileShareName, secret)
+		if err != nil {
+			return nil, azureStatusErrorf(err, err.Error())
+		}
+		if quota != -1 && quota < fileShareSize {
+			if err := d.ResizeFileShare(ctx, subsID, resourceGroup, accountName, storageEndpointSuffix, validFileShareName, fileShareSize, secret); err != nil {
+				return nil, azureStatusErrorf(err, "failed to expand restored file share(%s) on account(%s) to %d GiB: %v", validFileShareName, accountName, fileShareSize, err)
 			}
-			if rerr := d.cloud.AddStorageAccountTags(ctx, subsID, resourceGroup, accountName, tags); rerr != nil {
-				klog.Warningf("AddStorageAccountTags(%v) on account(%s) subsID(%s) rg(%s) failed with error: %v", tags, accountName, subsID, resourceGroup, rerr.Error())
+		}
+		// restored file share still carries metadata of the deleted volume
+		if err := d.updateFileShareMetadata(ctx, accountName, accountKey, storageEndpointSuffix, validFileShareName, shareOptions.Metadata); err != nil {
+			return nil, azureStatusErrorf(err, "failed to update metadata of restored file share(%s) on account(%s): %v", validFileShareName, accountName, err)
+		}
+		klog.V(2).Infof("restored file share(%s) on account(%s) is used for volume(%s)", validFileShareName, accountName, volName)
+	} else {
+		klog.V(2).Infof("begin to create file share(%s) on account(%s) type(%s) subID(%s) rg(%s) location(%s) size(%d) protocol(%s)", validFileShareName, accountName, sku, subsID, resourceGroup, location, fileShareSize, shareProtocol)
+		if err := d.CreateFileShare(ctx, accountOptions, storageEndpointSuffix, shareOptions, secret); err != nil {
+			// search another account only if the account is not specified by user
+			if account == "" && isAccountLimitExceededError(err, len(secret) > 0) {
+				klog.Warningf("create file share(%s) on account(%s) type(%s) subID(%s) rg(%s) location(%s) size(%d), error: %v, skip matching current account", validFileShareName, account, sku, subsID, resourceGroup, location, fileShareSize, err)
+				tags := map[string]*string{
+					azure.SkipMatchingTag: to.StringPtr(""),
+				}
+				if rerr := d.cloud.AddStorageAccountTags(ctx, subsID, resourceGroup, accountName, tags); rerr != nil {
+					klog.Warningf("AddStorageAccountTags(%v) on account(%s) subsID(%s) rg(%s) failed with error: %v", tags, accountName, subsID, resourceGroup, rerr.Error())
+				}
+				// release volume lock first to prevent deadlock
+				d.volumeLocks.Release(volName)
+				// clean search cache
+				if err := d.accountSearchCache.Delete(lockKey); err != nil {
+					return nil, status.Errorf(codes.Internal, err.Error())
+				}
+				// remove the volName from the volMap to stop it matching the same storage account
+				d.volMap.Delete(volName)
+				if err := d.deletePersistedAccountSelection(ctx, volName); err != nil {
+					klog.Warningf("failed to delete persisted account selection of volume(%s): %v", volName, err)
+				}
+				return d.CreateVolume(ctx, req)
+			}
+			return nil, azureStatusErrorf(err, "failed to create file share(%s) on account(%s) type(%s) subsID(%s) rg(%s) location(%s) size(%d), error: %v", validFileShareName, account, sku, subsID, resourceGroup, location, fileShareSize, err)
+		}
+		klog.V(2).Infof("create file share %s on storage account %s successfully", validFileShareName, accountName)
+		if fileShareName != "" && len(deletePolicyMetadata) > 0 {
+			// file share specified by user may already exist, whose metadata is not set by creation
+			if accountKey == "" {
+				if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, credentialProviders); err != nil {
+					return nil, azureStatusErrorf(err, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
+				}
 			}
-			// release volume lock first to prevent deadlock
-			d.volumeLocks.Release(volName)
-			// clean search cache
-			if err := d.accountSearchCache.Delete(lockKey); err != nil {
-				return nil, status.Errorf(codes.Internal, err.Error())
+			if err := d.updateFileShareMetadata(ctx, accountName, accountKey, storageEndpointSuffix, validFileShareName, deletePolicyMetadata); err != nil {
+				return nil, azureStatusErrorf(err, "failed to update metadata of file share(%s) on account(%s): %v", validFileShareName, accountName, err)
 			}
-			// remove the volName from the volMap to stop it matching the same storage account
-			d.volMap.Delete(volName)
-			return d.CreateVolume(ctx, req)
 		}
-		return nil, status.Errorf(codes.Internal, "failed to create file share(%s) on account(%s) type(%s) subsID(%s) rg(%s) location(%s) size(%d), error: %v", validFileShareName, account, sku, subsID, resourceGroup, location, fileShareSize, err)
 	}
-	klog.V(2).Infof("create file share %s on storage account %s successfully", validFileShareName, accountName)
 
-	if isDiskFsType(fsType) && !strings.HasSuffix(diskName, vhdSuffix) {
+	if createVHD {
 		if accountKey == "" {
-			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace); err != nil {
-				return nil, status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
+			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, credentialProviders); err != nil {
+				return nil, azureStatusErrorf(err, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
 			}
 		}
-		if fileShareName == "" {
-			// use pvc name as vhd disk name if file share not specified
-			diskName = validFileShareName + vhdSuffix
-		} else {
-			// use uuid as vhd disk name if file share specified
-			diskName = uuid.NewUUID().String() + vhdSuffix
-		}
-		diskSizeBytes := volumehelper.GiBToBytes(requestGiB)
-		klog.V(2).Infof("begin to create vhd file(%s) size(%d) on share(%s) on account(%s) type(%s) rg(%s) location(%s)",
-			diskName, diskSizeBytes, validFileShareName, account, sku, resourceGroup, location)
-		if err := createDisk(ctx, accountName, accountKey, d.cloud.Environment.StorageEndpointSuffix, validFileShareName, diskName, diskSizeBytes); err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to create VHD disk: %v", err)
+		if req.GetVolumeContentSource() == nil {
+			diskSizeBytes := volumehelper.GiBToBytes(requestGiB)
+			klog.V(2).Infof("begin to create vhd file(%s) size(%d) on share(%s) on account(%s) type(%s) rg(%s) location(%s)",
+				diskName, diskSizeBytes, validFileShareName, account, sku, resourceGroup, location)
+			if err := d.createDisk(ctx, accountName, accountKey, storageEndpointSuffix, validFileShareName, diskName, diskSizeBytes); err != nil {
+				return nil, azureStatusErrorf(err, "failed to create VHD disk: %v", err)
+			}
+			klog.V(2).Infof("create vhd file(%s) size(%d) on share(%s) on account(%s) type(%s) rg(%s) location(%s) successfully",
+				diskName, diskSizeBytes, validFileShareName, account, sku, resourceGroup, location)
 		}
-		klog.V(2).Infof("create vhd file(%s) size(%d) on share(%s) on account(%s) type(%s) rg(%s) location(%s) successfully",
-			diskName, diskSizeBytes, validFileShareName, account, sku, resourceGroup, location)
 		setKeyValueInMap(parameters, diskNameField, diskName)
 	}
 
+	if isSubDirMode {
+		if accountKey == "" {
+			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, credentialProviders); err != nil {
+				return nil, azureStatusErrorf(err, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
+			}
+		}
+		shareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, validFileShareName)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get share url of file share(%s) on account(%s): %v", validFileShareName, accountName, err)
+		}
+		if err := createSubDir(ctx, *shareURL, subDir); err != nil {
+			return nil, azureStatusErrorf(err, "failed to create subdirectory(%s) on share(%s) account(%s), error: %v", subDir, validFileShareName, accountName, err)
+		}
+		// action taken when volume is deleted is kept in subdirectory metadata
+		subDirMetadata := map[string]string{
+			requestedCapacityMetadataKey: strconv.FormatInt(capacityBytes, 10),
+			subDirOnDeleteMetadataKey:    strings.ToLower(subDirOnDelete),
+		}
+		if err := setSubDirMetadata(ctx, *shareURL, subDir, subDirMetadata); err != nil {
+			return nil, azureStatusErrorf(err, "failed to set metadata of subdirectory(%s) on share(%s) account(%s), error: %v", subDir, validFileShareName, accountName, err)
+		}
+		klog.V(2).Infof("create subdirectory(%s) on share(%s) account(%s) successfully", subDir, validFileShareName, accountName)
+		// subdirectory is mounted by NodeStageVolume
+		setKeyValueInMap(parameters, folderNameField, subDir)
+	}
+
+	if req.GetVolumeContentSource() != nil {
+		if accountKey == "" {
+			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, credentialProviders); err != nil {
+				return nil, azureStatusErrorf(err, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
+			}
+		}
+		if err := d.copyVolume(ctx, req, accountName, accountKey, storageEndpointSuffix, validFileShareName, diskName, protocol); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(credentialProviders) > 0 && !containsCredentialProvider(credentialProviders, credentialProviderSecret) {
+		// account key in k8s secret would never be read
+		storeAccountKey = false
+	}
 	if storeAccountKey && len(req.GetSecrets()) == 0 {
 		secretCacheKey := accountName + secretName + secretNamespace
 		if useSeretCache {
@@ -505,8 +856,8 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 		if !useSeretCache {
 			if accountKey == "" {
-				if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace); err != nil {
-					return nil, status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
+				if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, credentialProviders); err != nil {
+					return nil, azureStatusErrorf(err, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
 				}
 			}
 			storeSecretName, err := d.SetAzureCredentials(ctx, accountName, accountKey, secretName, secretNamespace)
@@ -520,31 +871,38 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
-	var uuid string
-	if fileShareName != "" {
-		// add volume name as suffix to differentiate volumeID since "shareName" is specified
-		// not necessary for dynamic file share name creation since volumeID already contains volume name
-		uuid = volName
-	}
-	volumeID = fmt.Sprintf(volumeIDTemplate, resourceGroup, accountName, validFileShareName, diskName, uuid, secretNamespace)
-	if subsID != "" && subsID != d.cloud.SubscriptionID {
-		volumeID = volumeID + "#" + subsID
-	}
-
 	if useDataPlaneAPI {
 		d.dataPlaneAPIVolCache.Set(volumeID, "")
 		d.dataPlaneAPIVolCache.Set(accountName, "")
 	}
 
 	isOperationSucceeded = true
+	if len(req.GetSecrets()) == 0 && account == "" {
+		// account selection is only needed until the volume is created
+		if err := d.deletePersistedAccountSelection(ctx, volName); err != nil {
+			klog.Warningf("failed to delete persisted account selection of volume(%s): %v", volName, err)
+		}
+	}
+
+	var accessibleTopology []*csi.Topology
+	if requirement != nil {
+		if location == "" {
+			location = d.cloud.Location
+		}
+		if location != "" {
+			accessibleTopology = getAccessibleTopology(strings.ToLower(location), requestedSku, protocol, topologyZones)
+		}
+	}
 
 	// reset secretNamespace field in VolumeContext
 	setKeyValueInMap(parameters, secretNamespaceField, secretNamespace)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volumeID,
-			CapacityBytes: capacityBytes,
-			VolumeContext: parameters,
+			VolumeId:           volumeID,
+			CapacityBytes:      capacityBytes,
+			VolumeContext:      parameters,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: accessibleTopology,
 		},
 	}, nil
 }
@@ -565,47 +923,112 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 	}
 	defer d.volumeLocks.Release(volumeID)
 
-	resourceGroupName, accountName, fileShareName, _, secretNamespace, subsID, err := GetFileShareInfo(volumeID)
+	h, err := ParseVolumeHandle(volumeID)
 	if err != nil {
 		// According to CSI Driver Sanity Tester, should succeed when an invalid volume id is used
-		klog.Errorf("GetFileShareInfo(%s) in DeleteVolume failed with error: %v", volumeID, err)
+		klog.Errorf("ParseVolumeHandle(%s) in DeleteVolume failed with error: %v", volumeID, err)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	if resourceGroupName == "" {
-		resourceGroupName = d.cloud.ResourceGroup
+	if h.ResourceGroup == "" {
+		h.ResourceGroup = d.cloud.ResourceGroup
 	}
-	if subsID == "" {
-		subsID = d.cloud.SubscriptionID
+	if h.SubscriptionID == "" {
+		h.SubscriptionID = d.cloud.SubscriptionID
 	}
 
 	secret := req.GetSecrets()
-	if len(secret) == 0 && d.useDataPlaneAPI(volumeID, accountName) {
+	if len(secret) == 0 && d.useDataPlaneAPI(volumeID, h.AccountName) {
 		reqContext := map[string]string{}
-		if secretNamespace != "" {
-			setKeyValueInMap(reqContext, secretNamespaceField, secretNamespace)
+		if h.SecretNamespace != "" {
+			setKeyValueInMap(reqContext, secretNamespaceField, h.SecretNamespace)
 		}
 
 		// use data plane api, get account key first
-		_, _, accountKey, _, _, _, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), reqContext)
+		_, accountKey, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), reqContext)
 		if err != nil {
 			return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
 		}
-		secret = createStorageAccountSecret(accountName, accountKey)
+		secret = createStorageAccountSecret(h.AccountName, accountKey)
 	}
 
-	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_delete_volume", resourceGroupName, subsID, d.Name)
+	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_delete_volume", h.ResourceGroup, h.SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
+		if isOperationSucceeded {
+			d.forgetAccountSelection(ctx, h)
+		}
 	}()
 
-	if err := d.DeleteFileShare(ctx, subsID, resourceGroupName, accountName, fileShareName, secret); err != nil {
-		return nil, status.Errorf(codes.Internal, "DeleteFileShare %s under account(%s) rg(%s) failed with error: %v", fileShareName, accountName, resourceGroupName, err)
+	if h.SubDir != "" {
+		// only the subdirectory is deleted in subdirectory provisioning mode, the shared file share is kept
+		reqContext := map[string]string{}
+		if h.SecretNamespace != "" {
+			setKeyValueInMap(reqContext, secretNamespaceField, h.SecretNamespace)
+		}
+		_, accountKey, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), reqContext)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
+		}
+		if err := d.deleteSubDir(ctx, h.AccountName, accountKey, d.getStorageEndpointSuffix(h), h.FileShareName, h.SubDir); err != nil {
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			return nil, azureStatusErrorf(err, "delete subdirectory(%s) on share(%s) account(%s) failed with error: %v", h.SubDir, h.FileShareName, h.AccountName, err)
+		}
+		klog.V(2).Infof("subdirectory(%s) on share(%s) account(%s) volume(%s) is deleted successfully", h.SubDir, h.FileShareName, h.AccountName, volumeID)
+		isOperationSucceeded = true
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	// actions taken when volume is deleted are kept in file share metadata
+	metadata, err := d.getFileShareMetadata(ctx, h.SubscriptionID, h.ResourceGroup, h.AccountName, d.getStorageEndpointSuffix(h), h.FileShareName, secret)
+	if err != nil {
+		return nil, azureStatusErrorf(err, "failed to get metadata of file share(%s) under account(%s) rg(%s): %v", h.FileShareName, h.AccountName, h.ResourceGroup, err)
+	}
+	if d.enableShareOwnershipCheck && metadata != nil {
+		if err := d.checkShareOwnership(h.FileShareName, metadata); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "refuse to delete volume(%s): %v", volumeID, err)
+		}
+	}
+
+	if d.isQuarantineOnDelete(metadata) {
+		// file share is kept and deleted by controller after grace period
+		reqContext := map[string]string{}
+		if h.SecretNamespace != "" {
+			setKeyValueInMap(reqContext, secretNamespaceField, h.SecretNamespace)
+		}
+		_, accountKey, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), reqContext)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
+		}
+		if err := d.quarantineFileShare(ctx, h.AccountName, accountKey, d.getStorageEndpointSuffix(h), h.FileShareName, time.Now()); err != nil {
+			return nil, azureStatusErrorf(err, "quarantine file share(%s) under account(%s) rg(%s) failed with error: %v", h.FileShareName, h.AccountName, h.ResourceGroup, err)
+		}
+		klog.V(2).Infof("azure file(%s) under subsID(%s) rg(%s) account(%s) volume(%s) is quarantined successfully", h.FileShareName, h.SubscriptionID, h.ResourceGroup, h.AccountName, volumeID)
+		isOperationSucceeded = true
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	if onDelete := metadata[snapshotOnDeleteMetadataKey]; onDelete != "" {
+		// file share with snapshots could not be deleted as usual
+		done, err := d.applySnapshotOnDelete(ctx, volumeID, h, onDelete, req.GetSecrets())
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			isOperationSucceeded = true
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+	}
+
+	if err := d.DeleteFileShare(ctx, h.SubscriptionID, h.ResourceGroup, h.AccountName, d.getStorageEndpointSuffix(h), h.FileShareName, secret); err != nil {
+		return nil, azureStatusErrorf(err, "DeleteFileShare %s under account(%s) rg(%s) failed with error: %v", h.FileShareName, h.AccountName, h.ResourceGroup, err)
 	}
-	klog.V(2).Infof("azure file(%s) under subsID(%s) rg(%s) account(%s) volume(%s) is deleted successfully", fileShareName, subsID, resourceGroupName, accountName, volumeID)
-	if err := d.RemoveStorageAccountTag(ctx, subsID, resourceGroupName, accountName, azure.SkipMatchingTag); err != nil {
-		klog.Warningf("RemoveStorageAccountTag(%s) under rg(%s) account(%s) failed with %v", azure.SkipMatchingTag, resourceGroupName, accountName, err)
+	klog.V(2).Infof("azure file(%s) under subsID(%s) rg(%s) account(%s) volume(%s) is deleted successfully", h.FileShareName, h.SubscriptionID, h.ResourceGroup, h.AccountName, volumeID)
+	if err := d.RemoveStorageAccountTag(ctx, h.SubscriptionID, h.ResourceGroup, h.AccountName, azure.SkipMatchingTag); err != nil {
+		klog.Warningf("RemoveStorageAccountTag(%s) under rg(%s) account(%s) failed with %v", azure.SkipMatchingTag, h.ResourceGroup, h.AccountName, err)
 	}
 
 	isOperationSucceeded = true
@@ -613,8 +1036,135 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 }
 
 // ControllerGetVolume get volume
-func (d *Driver) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid get volume request: %v", req)
+	}
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	h, err := ParseVolumeHandle(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "error parsing volume id: %q: %v", volumeID, err)
+	}
+	if h.ResourceGroup == "" {
+		h.ResourceGroup = d.cloud.ResourceGroup
+	}
+	if h.SubscriptionID == "" {
+		h.SubscriptionID = d.cloud.SubscriptionID
+	}
+
+	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_get_volume", h.ResourceGroup, h.SubscriptionID, d.Name)
+	isOperationSucceeded := false
+	defer func() {
+		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
+	}()
+
+	capacityBytes, condition := d.getVolumeStatus(ctx, volumeID, h, "")
+	isOperationSucceeded = true
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: capacityBytes,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: condition,
+		},
+	}, nil
+}
+
+// getVolumeStatus returns the capacity of the volume and whether it is still healthy, capacity of vhd disk or
+// subdirectory volume is read by data plane api since it's not the quota of file share,
+// account key is looked up by volume ID if it's empty
+func (d *Driver) getVolumeStatus(ctx context.Context, volumeID string, h *VolumeHandle, accountKey string) (int64, *csi.VolumeCondition) {
+	capacityBytes, condition := d.getVolumeCondition(h.SubscriptionID, h.ResourceGroup, h.AccountName, h.FileShareName)
+	if condition.Abnormal {
+		return capacityBytes, condition
+	}
+	return d.getSubVolumeStatus(ctx, volumeID, h, accountKey, capacityBytes)
+}
+
+// getSubVolumeStatus returns the capacity of the volume and whether it is still healthy on an existing file share,
+// capacity of vhd disk or subdirectory volume is got with data plane API, shareCapacityBytes is returned otherwise
+func (d *Driver) getSubVolumeStatus(ctx context.Context, volumeID string, h *VolumeHandle, accountKey string, shareCapacityBytes int64) (int64, *csi.VolumeCondition) {
+	capacityBytes, condition := shareCapacityBytes, &csi.VolumeCondition{Abnormal: false, Message: volumeHealthyMessage}
+	if h.SubDir == "" && !strings.HasSuffix(h.DiskName, vhdSuffix) {
+		return capacityBytes, condition
+	}
+	if accountKey == "" {
+		reqContext := map[string]string{}
+		if h.SecretNamespace != "" {
+			setKeyValueInMap(reqContext, secretNamespaceField, h.SecretNamespace)
+		}
+		var err error
+		if _, accountKey, err = d.GetAccountInfo(ctx, volumeID, nil, reqContext); err != nil {
+			message := fmt.Sprintf("failed to get account key of account(%s): %v", h.AccountName, err)
+			klog.V(2).Infof("volume condition is abnormal: %s", message)
+			return 0, &csi.VolumeCondition{Abnormal: true, Message: message}
+		}
+	}
+	shareURL, err := d.fileClient.getShareURL(h.AccountName, accountKey, d.getStorageEndpointSuffix(h), h.FileShareName)
+	if err != nil {
+		return 0, &csi.VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+
+	if h.SubDir != "" {
+		properties, err := shareURL.NewRootDirectoryURL().NewDirectoryURL(h.SubDir).GetProperties(ctx)
+		if err != nil {
+			message := fmt.Sprintf("failed to get subdirectory(%s) on share(%s): %v", h.SubDir, h.FileShareName, err)
+			if isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+				message = fmt.Sprintf("subdirectory(%s) not found on share(%s)", h.SubDir, h.FileShareName)
+			}
+			klog.V(2).Infof("volume condition is abnormal: %s", message)
+			return 0, &csi.VolumeCondition{Abnormal: true, Message: message}
+		}
+		// capacity is unknown if subdirectory is provisioned by previous driver version
+		capacityBytes, _ = strconv.ParseInt(properties.NewMetadata()[requestedCapacityMetadataKey], 10, 64)
+		return capacityBytes, condition
+	}
+
+	properties, err := shareURL.NewRootDirectoryURL().NewFileURL(h.DiskName).GetProperties(ctx)
+	if err != nil {
+		message := fmt.Sprintf("failed to get vhd disk(%s) on share(%s): %v", h.DiskName, h.FileShareName, err)
+		if isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+			message = fmt.Sprintf("vhd disk(%s) not found on share(%s)", h.DiskName, h.FileShareName)
+		}
+		klog.V(2).Infof("volume condition is abnormal: %s", message)
+		return 0, &csi.VolumeCondition{Abnormal: true, Message: message}
+	}
+	return properties.ContentLength(), condition
+}
+
+// getVolumeCondition returns the capacity of the file share and whether it is still healthy,
+// the volume is abnormal if the share is missing, being deleted or its account is unreachable
+func (d *Driver) getVolumeCondition(subsID, resourceGroupName, accountName, fileShareName string) (int64, *csi.VolumeCondition) {
+	fileShare, err := d.cloud.GetFileShare(subsID, resourceGroupName, accountName, fileShareName)
+	if err != nil {
+		var message string
+		switch {
+		case getAzureErrorDetail(err).Code == shareNotFound:
+			message = fmt.Sprintf("file share(%s) not found on account(%s)", fileShareName, accountName)
+		case classifyError(err) == errorCategoryBeingDeleted:
+			message = fmt.Sprintf("file share(%s) on account(%s) is being deleted", fileShareName, accountName)
+		default:
+			message = fmt.Sprintf("failed to get file share(%s) on account(%s): %v", fileShareName, accountName, err)
+		}
+		klog.V(2).Infof("volume condition is abnormal: %s", message)
+		return 0, &csi.VolumeCondition{Abnormal: true, Message: message}
+	}
+
+	if fileShare.FileShareProperties == nil {
+		return 0, &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("FileShareProperties of file share(%s) is nil", fileShareName)}
+	}
+	if fileShare.FileShareProperties.Deleted != nil && *fileShare.FileShareProperties.Deleted {
+		return 0, &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("file share(%s) on account(%s) is being deleted", fileShareName, accountName)}
+	}
+	var capacityBytes int64
+	if fileShare.FileShareProperties.ShareQuota != nil {
+		capacityBytes = volumehelper.GiBToBytes(int64(*fileShare.FileShareProperties.ShareQuota))
+	}
+	return capacityBytes, &csi.VolumeCondition{Abnormal: false, Message: volumeHealthyMessage}
 }
 
 // ValidateVolumeCapabilities return the capabilities of the volume
@@ -628,25 +1178,19 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not provided")
 	}
 
-	resourceGroupName, accountName, _, fileShareName, diskName, subsID, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), req.GetVolumeContext())
-	if err != nil || accountName == "" || fileShareName == "" {
+	h, _, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), req.GetVolumeContext())
+	if err != nil || h.AccountName == "" || h.FileShareName == "" {
 		return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
 	}
-	if resourceGroupName == "" {
-		resourceGroupName = d.cloud.ResourceGroup
-	}
-	if subsID == "" {
-		subsID = d.cloud.SubscriptionID
-	}
 
-	if quota, err := d.getFileShareQuota(subsID, resourceGroupName, accountName, fileShareName, req.GetSecrets()); err != nil {
-		return nil, status.Errorf(codes.Internal, "error checking if volume(%s) exists: %v", volumeID, err)
+	if quota, err := d.getFileShareQuota(ctx, h.SubscriptionID, h.ResourceGroup, h.AccountName, d.getStorageEndpointSuffix(h), h.FileShareName, req.GetSecrets()); err != nil {
+		return nil, azureStatusErrorf(err, "error checking if volume(%s) exists: %v", volumeID, err)
 	} else if quota == -1 {
 		return nil, status.Errorf(codes.NotFound, "the requested volume(%s) does not exist.", volumeID)
 	}
 
 	confirmed := &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps}
-	if !strings.HasSuffix(diskName, vhdSuffix) {
+	if !strings.HasSuffix(h.DiskName, vhdSuffix) {
 		return &csi.ValidateVolumeCapabilitiesResponse{Confirmed: confirmed}, nil
 	}
 	for _, c := range volCaps {
@@ -664,41 +1208,288 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	}, nil
 }
 
-// GetCapacity returns the capacity of the total available storage pool
+// GetCapacity returns the remaining provisioned capacity of the storage account pool
+// which matches the sku, resource group and location in storage class parameters
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
-
-// ListVolumes return all available volumes
-func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
-
-// ControllerPublishVolume make a volume available on some required node
-func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	volumeID := req.GetVolumeId()
-	if len(volumeID) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
-	}
-
-	volCap := req.GetVolumeCapability()
-	if volCap == nil {
-		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
-	}
-
-	nodeID := req.GetNodeId()
-	if len(nodeID) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Node ID not provided")
+	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid get capacity request: %v", req)
 	}
 
-	volContext := req.GetVolumeContext()
-	_, accountName, accountKey, fileShareName, diskName, _, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), volContext)
+	var sku, subsID, resourceGroup, location, account, protocol, fsType, networkEndpointType string
+	var enableLFS bool
+	// other parameters are validated in CreateVolume
+	for k, v := range req.GetParameters() {
+		switch strings.ToLower(k) {
+		case skuNameField:
+			sku = v
+		case storageAccountTypeField:
+			sku = v
+		case locationField:
+			location = v
+		case storageAccountField:
+			account = v
+		case subscriptionIDField:
+			subsID = v
+		case resourceGroupField:
+			resourceGroup = v
+		case protocolField:
+			protocol = v
+		case fsTypeField:
+			fsType = v
+		case enableLargeFileSharesField:
+			enableLFS = strings.EqualFold(v, trueValue)
+		case networkEndpointTypeField:
+			networkEndpointType = v
+		}
+	}
+
+	// accounts are partitioned by protocol and network endpoint type in the same way as CreateVolume
+	accountOptions := &azure.AccountOptions{
+		EnableLargeFileShare:  enableLFS,
+		CreatePrivateEndpoint: strings.EqualFold(networkEndpointType, privateEndpoint),
+	}
+	if fsType == nfs || protocol == nfs {
+		if !strings.HasPrefix(strings.ToLower(sku), premium) {
+			// NFS protocol only supports Premium storage
+			sku = string(storage.SkuNamePremiumLRS)
+		}
+		if !accountOptions.CreatePrivateEndpoint {
+			accountOptions.VirtualNetworkResourceIDs = []string{d.getSubnetResourceID()}
+		}
+	}
+	if sku == "" {
+		sku = string(storage.SkuNameStandardLRS)
+	}
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	if resourceGroup == "" {
+		resourceGroup = d.cloud.ResourceGroup
+	}
+	if location == "" {
+		location = getSegmentValue(req.GetAccessibleTopology().GetSegments(), topologyRegionKey)
+	}
+	if location == "" {
+		location = d.cloud.Location
+	}
+
+	accountKind := string(storage.KindStorageV2)
+	var accountLimitGiB, maximumShareGiB int64 = standardAccountCapacityLimit, maximumFileShareSize
+	if enableLFS {
+		maximumShareGiB = maximumLargeFileShareSize
+	}
+	if strings.HasPrefix(strings.ToLower(sku), premium) {
+		accountKind = string(storage.KindFileStorage)
+		accountLimitGiB, maximumShareGiB = premiumAccountCapacityLimit, maximumLargeFileShareSize
+	}
+
+	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_get_capacity", resourceGroup, subsID, d.Name)
+	isOperationSucceeded := false
+	defer func() {
+		mc.ObserveOperationWithResult(isOperationSucceeded)
+	}()
+
+	accounts, err := d.getStorageAccountPool(ctx, subsID, resourceGroup, location, sku, accountKind, account)
+	if err != nil {
+		return nil, azureStatusErrorf(err, "failed to list storage accounts in subsID(%s) rg(%s): %v", subsID, resourceGroup, err)
+	}
+
+	var availableGiB, largestAvailableGiB int64
+	if len(accounts) == 0 && account == "" {
+		// a new storage account would be created for the first volume
+		availableGiB, largestAvailableGiB = accountLimitGiB, accountLimitGiB
+	}
+	for _, acct := range accounts {
+		accountName := *acct.Name
+		if account == "" && !isAccountMatched(acct, accountOptions) {
+			continue
+		}
+		provisionedGiB, err := d.getCachedAccountProvisionedGiB(ctx, subsID, resourceGroup, accountName)
+		if err != nil {
+			// capacity of other accounts is still reported
+			klog.Warningf("skip account(%s) in rg(%s) since failed to get its provisioned capacity: %v", accountName, resourceGroup, err)
+			continue
+		}
+		klog.V(4).Infof("account(%s) type(%s) rg(%s) location(%s) provisioned capacity: %d GiB, limit: %d GiB", accountName, sku, resourceGroup, location, provisionedGiB, accountLimitGiB)
+		if remainingGiB := accountLimitGiB - provisionedGiB; remainingGiB > 0 {
+			availableGiB += remainingGiB
+			if remainingGiB > largestAvailableGiB {
+				largestAvailableGiB = remainingGiB
+			}
+		}
+	}
+	if largestAvailableGiB > maximumShareGiB {
+		largestAvailableGiB = maximumShareGiB
+	}
+
+	isOperationSucceeded = true
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: volumehelper.GiBToBytes(availableGiB),
+		MaximumVolumeSize: wrapperspb.Int64(volumehelper.GiBToBytes(largestAvailableGiB)),
+	}, nil
+}
+
+// getStorageAccountPool returns storage accounts which could be matched in CreateVolume
+func (d *Driver) getStorageAccountPool(ctx context.Context, subsID, resourceGroup, location, sku, accountKind, account string) ([]storage.Account, error) {
+	if d.cloud.StorageAccountClient == nil {
+		return nil, fmt.Errorf("StorageAccountClient is nil")
+	}
+	result, rerr := d.cloud.StorageAccountClient.ListByResourceGroup(ctx, subsID, resourceGroup)
+	if rerr != nil {
+		return nil, rerr.Error()
+	}
+
+	accounts := []storage.Account{}
+	for _, acct := range result {
+		if acct.Name == nil || acct.Location == nil || acct.Sku == nil {
+			continue
+		}
+		if account != "" {
+			if strings.EqualFold(*acct.Name, account) {
+				accounts = append(accounts, acct)
+			}
+			continue
+		}
+		if !strings.EqualFold(string(acct.Sku.Name), sku) || !strings.EqualFold(string(acct.Kind), accountKind) || !strings.EqualFold(*acct.Location, location) {
+			continue
+		}
+		if _, ok := acct.Tags[azure.SkipMatchingTag]; ok {
+			continue
+		}
+		accounts = append(accounts, acct)
+	}
+	return accounts, nil
+}
+
+// getCachedAccountProvisionedGiB returns the sum of share quotas(in GiB) on the storage account,
+// which is cached for a while since GetCapacity is called periodically for every storage class
+func (d *Driver) getCachedAccountProvisionedGiB(ctx context.Context, subsID, resourceGroup, accountName string) (int64, error) {
+	key := strings.ToLower(fmt.Sprintf("%s/%s/%s", subsID, resourceGroup, accountName))
+	cache, err := d.accountUsageCache.Get(key, azcache.CacheReadTypeDefault)
+	if err != nil {
+		return 0, err
+	}
+	if cache != nil {
+		return cache.(int64), nil
+	}
+	_, provisionedGiB, err := d.getAccountUsage(ctx, subsID, resourceGroup, accountName)
+	if err != nil {
+		return 0, err
+	}
+	d.accountUsageCache.Set(key, provisionedGiB)
+	return provisionedGiB, nil
+}
+
+// getAccountUsage returns the number of file shares and the sum of share quotas(in GiB) on the storage account
+func (d *Driver) getAccountUsage(ctx context.Context, subsID, resourceGroup, accountName string) (int, int64, error) {
+	accountOptions := &azure.AccountOptions{
+		Name:           accountName,
+		SubscriptionID: subsID,
+		ResourceGroup:  resourceGroup,
+	}
+	accountKey, err := d.GetStorageAccesskey(ctx, accountOptions, nil, "", defaultNamespace, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	serviceURL, err := d.fileClient.getServiceURL(accountName, accountKey, d.cloud.Environment.StorageEndpointSuffix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var shareCount int
+	var provisionedGiB int64
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		listResp, err := serviceURL.ListSharesSegment(ctx, marker, azfile.ListSharesOptions{})
+		if err != nil {
+			return 0, 0, err
+		}
+		marker = listResp.NextMarker
+		shareCount += len(listResp.ShareItems)
+		for _, share := range listResp.ShareItems {
+			provisionedGiB += int64(share.Properties.Quota)
+		}
+	}
+	return shareCount, provisionedGiB, nil
+}
+
+// ListVolumes return all file shares in storage accounts created by this driver
+func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid list volumes request: %v", req)
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries(%d)", req.GetMaxEntries())
+	}
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	detail := azfile.ListSharesDetail{Metadata: true}
+	nextToken, err := d.listDriverFileShares(ctx, req.GetMaxEntries(), req.GetStartingToken(), detail, func(account storageAccountRef, accountKey string, share azfile.ShareItem) (bool, error) {
+		accountName := account.accountName
+		// only file share provisioned as one volume carries its volume ID
+		volumeID := share.Metadata[volumeIDMetadataKey]
+		if volumeID == "" {
+			return false, nil
+		}
+		if _, quarantined, _ := getQuarantineTime(share.Metadata); quarantined {
+			// volume of quarantined file share is already deleted
+			return false, nil
+		}
+		h, err := ParseVolumeHandle(volumeID)
+		if err != nil || !strings.EqualFold(h.AccountName, accountName) || h.FileShareName != share.Name {
+			klog.Warningf("skip file share(%s) on account(%s) with invalid volume ID(%s) in metadata, error: %v", share.Name, accountName, volumeID, err)
+			return false, nil
+		}
+		if h.ResourceGroup == "" {
+			h.ResourceGroup = account.resourceGroup
+		}
+		if h.SubscriptionID == "" {
+			h.SubscriptionID = account.subsID
+		}
+		// file share in list result exists and is not deleted, so its condition is not queried again
+		capacityBytes := volumehelper.GiBToBytes(int64(share.Properties.Quota))
+		capacityBytes, condition := d.getSubVolumeStatus(ctx, volumeID, h, accountKey, capacityBytes)
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      volumeID,
+				CapacityBytes: capacityBytes,
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: condition,
+			},
+		})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ListVolumesResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+// ControllerPublishVolume make a volume available on some required node
+func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
+	}
+
+	nodeID := req.GetNodeId()
+	if len(nodeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID not provided")
+	}
+
+	volContext := req.GetVolumeContext()
+	h, accountKey, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), volContext)
 	// always check diskName first since if it's not vhd disk attach, ControllerPublishVolume is not necessary
-	if !strings.HasSuffix(diskName, vhdSuffix) {
+	if !strings.HasSuffix(h.DiskName, vhdSuffix) {
 		klog.V(2).Infof("skip ControllerPublishVolume(%s) since it's not vhd disk attach", volumeID)
 		if useDataPlaneAPI(volContext) {
 			d.dataPlaneAPIVolCache.Set(volumeID, "")
-			d.dataPlaneAPIVolCache.Set(accountName, "")
+			d.dataPlaneAPIVolCache.Set(h.AccountName, "")
 		}
 		return &csi.ControllerPublishVolumeResponse{}, nil
 	}
@@ -724,26 +1515,51 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 	}
 	defer d.volumeLocks.Release(volumeID)
 
-	storageEndpointSuffix := d.cloud.Environment.StorageEndpointSuffix
-	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
+	storageEndpointSuffix := d.getStorageEndpointSuffix(h)
+	fileURL, err := d.fileClient.getFileURL(h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned with error: %v", accountName, storageEndpointSuffix, fileShareName, diskName, err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned with error: %v", h.AccountName, storageEndpointSuffix, h.FileShareName, h.DiskName, err))
 	}
 	if fileURL == nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned empty fileURL", h.AccountName, storageEndpointSuffix, h.FileShareName, h.DiskName))
 	}
 
 	properties, err := fileURL.GetProperties(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("GetProperties for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err))
+		return nil, azureStatusErrorf(err, "GetProperties for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err)
 	}
 
-	attachedNodeID, ok := properties.NewMetadata()[metaDataNode]
-	if ok && attachedNodeID != "" && !strings.EqualFold(attachedNodeID, nodeID) {
+	attachedNodeID := properties.NewMetadata()[metaDataNode]
+	if strings.EqualFold(attachedNodeID, nodeID) {
+		klog.V(2).Infof("ControllerPublishVolume: volume(%s) is already attached to node(%s)", volumeID, nodeID)
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	if attachedNodeID != "" {
+		pv := d.getForceDetachPV(ctx, volumeID, nodeID, attachedNodeID)
+		if pv == nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("volume(%s) cannot be attached to node(%s) since it's already attached to node(%s)", volumeID, nodeID, attachedNodeID))
+		}
+		klog.Warningf("force detach volume(%s) from node(%s) as requested by PV annotation", volumeID, attachedNodeID)
+		if err := d.forceDetachVHD(ctx, h, accountKey, storageEndpointSuffix); err != nil {
+			return nil, azureStatusErrorf(err, "failed to force detach volume(%s) from node(%s): %v", volumeID, attachedNodeID, err)
+		}
+		d.clearForceDetachAnnotation(ctx, pv)
+	}
+
+	// attached node is checked and set under lease, so that concurrent attach operations never attach vhd disk to two nodes
+	leaseID := getNodeLeaseID(nodeID)
+	if err := d.acquireVHDLease(ctx, volumeID, h, accountKey, storageEndpointSuffix, nodeID, attachedNodeID, leaseID); err != nil {
+		return nil, err
+	}
+	defer d.releaseVHDLease(ctx, h, accountKey, storageEndpointSuffix, leaseID)
+	if properties, err = fileURL.GetProperties(ctx); err != nil {
+		return nil, azureStatusErrorf(err, "GetProperties for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err)
+	}
+	if attachedNodeID = properties.NewMetadata()[metaDataNode]; attachedNodeID != "" && !strings.EqualFold(attachedNodeID, nodeID) {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("volume(%s) cannot be attached to node(%s) since it's already attached to node(%s)", volumeID, nodeID, attachedNodeID))
 	}
-	if _, err = fileURL.SetMetadata(ctx, azfile.Metadata{metaDataNode: nodeID}); err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("SetMetadata for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err))
+	if err := d.setFileMetadataWithLease(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName, map[string]string{metaDataNode: nodeID}, leaseID); err != nil {
+		return nil, azureStatusErrorf(err, "SetMetadata for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err)
 	}
 	klog.V(2).Infof("ControllerPublishVolume: volume(%s) attached to node(%s) successfully", volumeID, nodeID)
 	return &csi.ControllerPublishVolumeResponse{}, nil
@@ -761,9 +1577,9 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		return nil, status.Error(codes.InvalidArgument, "Node ID not provided")
 	}
 
-	_, accountName, accountKey, fileShareName, diskName, _, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), map[string]string{})
+	h, accountKey, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), map[string]string{})
 	// always check diskName first since if it's not vhd disk detach, ControllerUnpublishVolume is not necessary
-	if !strings.HasSuffix(diskName, vhdSuffix) {
+	if !strings.HasSuffix(h.DiskName, vhdSuffix) {
 		klog.V(2).Infof("skip ControllerUnpublishVolume(%s) since it's not vhd disk detach", volumeID)
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
@@ -776,17 +1592,34 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	}
 	defer d.volumeLocks.Release(volumeID)
 
-	storageEndpointSuffix := d.cloud.Environment.StorageEndpointSuffix
-	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
+	storageEndpointSuffix := d.getStorageEndpointSuffix(h)
+	fileURL, err := d.fileClient.getFileURL(h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned with error: %v", accountName, storageEndpointSuffix, fileShareName, diskName, err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned with error: %v", h.AccountName, storageEndpointSuffix, h.FileShareName, h.DiskName, err))
 	}
 	if fileURL == nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned empty fileURL", h.AccountName, storageEndpointSuffix, h.FileShareName, h.DiskName))
+	}
+
+	properties, err := fileURL.GetProperties(ctx)
+	if err != nil {
+		return nil, azureStatusErrorf(err, "GetProperties for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err)
+	}
+	leaseID := getNodeLeaseID(nodeID)
+	if attachedNodeID := properties.NewMetadata()[metaDataNode]; !strings.EqualFold(attachedNodeID, nodeID) {
+		// lease left by an interrupted attach operation of the node is released
+		d.releaseVHDLease(ctx, h, accountKey, storageEndpointSuffix, leaseID)
+		klog.V(2).Infof("ControllerUnpublishVolume: volume(%s) is not attached to node(%s), attached node: %q", volumeID, nodeID, attachedNodeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
-	if _, err = fileURL.SetMetadata(ctx, azfile.Metadata{metaDataNode: ""}); err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("SetMetadata for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err))
+	// lease held by a node which has gone away is broken if force detach is requested
+	if err := d.acquireVHDLease(ctx, volumeID, h, accountKey, storageEndpointSuffix, nodeID, nodeID, leaseID); err != nil {
+		return nil, err
+	}
+	defer d.releaseVHDLease(ctx, h, accountKey, storageEndpointSuffix, leaseID)
+	if err := d.setFileMetadataWithLease(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName, map[string]string{metaDataNode: ""}, leaseID); err != nil {
+		return nil, azureStatusErrorf(err, "SetMetadata for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err)
 	}
 	klog.V(2).Infof("ControllerUnpublishVolume: volume(%s) detached from node(%s) successfully", volumeID, nodeID)
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
@@ -803,10 +1636,14 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID must be provided")
 	}
 
-	rgName, _, _, _, _, subsID, err := GetFileShareInfo(sourceVolumeID) //nolint:dogsled
+	h, err := ParseVolumeHandle(sourceVolumeID)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("GetFileShareInfo(%s) failed with error: %v", sourceVolumeID, err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("ParseVolumeHandle(%s) failed with error: %v", sourceVolumeID, err))
+	}
+	if h.SubDir != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot of subdirectory volume(%s) is not supported since share snapshot covers the whole shared file share", sourceVolumeID)
 	}
+	rgName, subsID := h.ResourceGroup, h.SubscriptionID
 	if rgName == "" {
 		rgName = d.cloud.ResourceGroup
 	}
@@ -825,21 +1662,21 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 		if exists {
 			return nil, status.Errorf(codes.AlreadyExists, "%v", err)
 		}
-		return nil, status.Errorf(codes.Internal, "failed to check if snapshot(%v) exists: %v", snapshotName, err)
+		return nil, azureStatusErrorf(err, "failed to check if snapshot(%v) exists: %v", snapshotName, err)
 	}
 	if exists {
 		klog.V(2).Infof("snapshot(%s) already exists", snapshotName)
-		tp := timestamppb.New(item.Properties.LastModified)
-		if tp == nil {
-			return nil, status.Errorf(codes.Internal, "Failed to convert timestamp(%v)", item.Properties.LastModified)
-		}
 		if item.Snapshot == nil {
 			return nil, status.Errorf(codes.Internal, "Snapshot property of %s is nil", item.Name)
 		}
+		tp, err := getSnapshotCreationTime(*item.Snapshot)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to convert timestamp(%v): %v", *item.Snapshot, err)
+		}
 		return &csi.CreateSnapshotResponse{
 			Snapshot: &csi.Snapshot{
 				SizeBytes:      volumehelper.GiBToBytes(int64(item.Properties.Quota)),
-				SnapshotId:     sourceVolumeID + "#" + *item.Snapshot,
+				SnapshotId:     sourceVolumeID + separator + *item.Snapshot,
 				SourceVolumeId: sourceVolumeID,
 				CreationTime:   tp,
 				// Since the snapshot of azurefile has no field of ReadyToUse, here ReadyToUse is always set to true.
@@ -853,27 +1690,28 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 		return nil, status.Errorf(codes.Internal, "failed to get share url with (%s): %v", sourceVolumeID, err)
 	}
 
-	snapshotShare, err := shareURL.CreateSnapshot(ctx, azfile.Metadata{snapshotNameKey: snapshotName})
+	// source volume ID is kept in snapshot metadata since it could not be reconstructed from file share by ListSnapshots
+	snapshotShare, err := shareURL.CreateSnapshot(ctx, azfile.Metadata{snapshotNameKey: snapshotName, volumeIDMetadataKey: sourceVolumeID})
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "create snapshot from(%s) failed with %v, shareURL: %q", sourceVolumeID, err, shareURL)
+		return nil, azureStatusErrorf(err, "create snapshot from(%s) failed with %v, shareURL: %q", sourceVolumeID, err, shareURL)
 	}
 
 	klog.V(2).Infof("Created share snapshot: %s", snapshotShare.Snapshot())
 
 	properties, err := shareURL.GetProperties(ctx)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to get snapshot properties from (%s): %v", snapshotShare.Snapshot(), err)
+		return nil, azureStatusErrorf(err, "failed to get snapshot properties from (%s): %v", snapshotShare.Snapshot(), err)
 	}
 
-	tp := timestamppb.New(properties.LastModified())
-	if tp == nil {
-		return nil, status.Errorf(codes.Internal, "Failed to convert timestamp(%v)", properties.LastModified())
+	tp, err := getSnapshotCreationTime(snapshotShare.Snapshot())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to convert timestamp(%v): %v", snapshotShare.Snapshot(), err)
 	}
 
 	createResp := &csi.CreateSnapshotResponse{
 		Snapshot: &csi.Snapshot{
 			SizeBytes:      volumehelper.GiBToBytes(int64(properties.Quota())),
-			SnapshotId:     sourceVolumeID + "#" + snapshotShare.Snapshot(),
+			SnapshotId:     sourceVolumeID + separator + snapshotShare.Snapshot(),
 			SourceVolumeId: sourceVolumeID,
 			CreationTime:   tp,
 			// Since the snapshot of azurefile has no field of ReadyToUse, here ReadyToUse is always set to true.
@@ -890,25 +1728,26 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 		return nil, status.Error(codes.InvalidArgument, "Snapshot ID must be provided")
 	}
 
-	shareURL, err := d.getShareURL(ctx, req.SnapshotId, req.GetSecrets())
-	if err != nil {
-		// According to CSI Driver Sanity Tester, should succeed when an invalid snapshot id is used
-		klog.V(4).Infof("failed to get share url with (%s): %v, returning with success", req.SnapshotId, err)
-		return &csi.DeleteSnapshotResponse{}, nil
-	}
-
-	snapshot, err := getSnapshot(req.SnapshotId)
+	h, err := ParseSnapshotHandle(req.SnapshotId)
 	if err != nil {
+		if _, uerr := d.getShareURL(ctx, req.SnapshotId, req.GetSecrets()); uerr != nil {
+			// According to CSI Driver Sanity Tester, should succeed when an invalid snapshot id is used
+			klog.V(4).Infof("failed to get share url with (%s): %v, returning with success", req.SnapshotId, uerr)
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
 		return nil, status.Errorf(codes.Internal, "failed to get snapshot name with (%s): %v", req.SnapshotId, err)
 	}
-
-	// trim snapshotId from beginning to last #
-	volumeID := strings.TrimSuffix(req.SnapshotId, "#"+snapshot)
+	volumeID, snapshot := strings.TrimSuffix(req.SnapshotId, separator+h.Snapshot), h.Snapshot
 	klog.Infof("voumeID: %s, snapshot: %s", volumeID, snapshot)
-	rgName, _, _, _, _, subsID, err := GetFileShareInfo(volumeID) //nolint:dogsled
+
+	shareURL, err := d.getShareURL(ctx, volumeID, req.GetSecrets())
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("GetFileShareInfo(%s) failed with error: %v", volumeID, err))
+		// According to CSI Driver Sanity Tester, should succeed when an invalid snapshot id is used
+		klog.V(4).Infof("failed to get share url with (%s): %v, returning with success", req.SnapshotId, err)
+		return &csi.DeleteSnapshotResponse{}, nil
 	}
+
+	rgName, subsID := h.ResourceGroup, h.SubscriptionID
 	if rgName == "" {
 		rgName = d.cloud.ResourceGroup
 	}
@@ -923,21 +1762,244 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 	}()
 
 	if _, err := shareURL.WithSnapshot(snapshot).Delete(ctx, azfile.DeleteSnapshotsOptionNone); err != nil {
-		if strings.Contains(err.Error(), "ShareSnapshotNotFound") {
-			klog.Warningf("the specify snapshot(%s) was not found", snapshot)
-			return &csi.DeleteSnapshotResponse{}, nil
+		if !isNotFoundError(err) {
+			return nil, azureStatusErrorf(err, "failed to delete snapshot(%s): %v", snapshot, err)
 		}
-		return nil, status.Errorf(codes.Internal, "failed to delete snapshot(%s): %v", snapshot, err)
+		klog.Warningf("the specify snapshot(%s) was not found", snapshot)
+	} else {
+		klog.V(2).Infof("delete snapshot(%s) successfully", snapshot)
 	}
 
-	klog.V(2).Infof("delete snapshot(%s) successfully", snapshot)
+	// file share retained by DeleteVolume is deleted with its last snapshot
+	if err := d.deleteRetainedFileShare(ctx, volumeID, &h.VolumeHandle, req.GetSecrets()); err != nil {
+		return nil, azureStatusErrorf(err, "failed to delete retained file share(%s) under account(%s): %v", h.FileShareName, h.AccountName, err)
+	}
 	isOperationSucceeded = true
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-// ListSnapshots list all snapshots (todo)
+// ListSnapshots list all snapshots created by this driver
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid list snapshots request: %v", req)
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries(%d)", req.GetMaxEntries())
+	}
+
+	sourceVolumeID := req.GetSourceVolumeId()
+	var source *VolumeHandle
+	if sourceVolumeID != "" {
+		var err error
+		if source, err = ParseVolumeHandle(sourceVolumeID); err != nil {
+			klog.V(4).Infof("ParseVolumeHandle(%s) failed with error: %v, returning with empty list", sourceVolumeID, err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+	}
+	var snapshot string
+	if snapshotID := req.GetSnapshotId(); snapshotID != "" {
+		h, err := ParseSnapshotHandle(snapshotID)
+		if err != nil {
+			klog.V(4).Infof("failed to parse snapshot id(%s): %v, returning with empty list", snapshotID, err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		if source != nil && *source != h.VolumeHandle {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		snapshot = h.Snapshot
+		if source == nil {
+			sourceVolumeID = getSnapshotSourceVolumeID(snapshotID, h)
+		}
+	}
+
+	if sourceVolumeID != "" {
+		return d.listVolumeSnapshots(ctx, sourceVolumeID, snapshot, req.GetMaxEntries(), req.GetStartingToken(), req.GetSecrets())
+	}
+	return d.listAllSnapshots(ctx, req.GetMaxEntries(), req.GetStartingToken())
+}
+
+// listVolumeSnapshots lists snapshots of one file share, starting token is the list marker of the storage account
+func (d *Driver) listVolumeSnapshots(ctx context.Context, sourceVolumeID, snapshot string, maxEntries int32, startingToken string, secrets map[string]string) (*csi.ListSnapshotsResponse, error) {
+	serviceURL, fileShareName, err := d.getServiceURL(ctx, sourceVolumeID, secrets)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get service url with (%s): %v", sourceVolumeID, err)
+	}
+	if fileShareName == "" {
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+
+	marker := azfile.Marker{}
+	if startingToken != "" {
+		marker.Val = &startingToken
+	}
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for marker.NotDone() {
+		listResp, err := serviceURL.ListSharesSegment(ctx, marker, azfile.ListSharesOptions{
+			Prefix:     fileShareName,
+			MaxResults: maxEntries,
+			Detail:     azfile.ListSharesDetail{Metadata: true, Snapshots: true},
+		})
+		if err != nil {
+			if startingToken != "" && isStorageErrorWithServiceCode(err, azfile.ServiceCodeInvalidQueryParameterValue) {
+				return nil, status.Errorf(codes.Aborted, "invalid starting token(%s): %v", startingToken, err)
+			}
+			return nil, azureStatusErrorf(err, "failed to list snapshots of (%s): %v", sourceVolumeID, err)
+		}
+		marker = listResp.NextMarker
+		for _, share := range listResp.ShareItems {
+			if share.Name != fileShareName || (snapshot != "" && (share.Snapshot == nil || *share.Snapshot != snapshot)) {
+				continue
+			}
+			if id := share.Metadata[volumeIDMetadataKey]; id != "" && id != sourceVolumeID {
+				// snapshot of another volume on the same file share
+				continue
+			}
+			entry, err := newListSnapshotsEntry(sourceVolumeID, share)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "%v", err)
+			}
+			if entry != nil {
+				entries = append(entries, entry)
+			}
+		}
+		if maxEntries > 0 {
+			// return next page token to the caller
+			break
+		}
+	}
+
+	var nextToken string
+	if marker.Val != nil {
+		nextToken = *marker.Val
+	}
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+// listAllSnapshots lists snapshots of all file shares in storage accounts created by this driver
+func (d *Driver) listAllSnapshots(ctx context.Context, maxEntries int32, startingToken string) (*csi.ListSnapshotsResponse, error) {
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	detail := azfile.ListSharesDetail{Metadata: true, Snapshots: true}
+	nextToken, err := d.listDriverFileShares(ctx, maxEntries, startingToken, detail, func(account storageAccountRef, _ string, share azfile.ShareItem) (bool, error) {
+		// source volume ID is unknown if snapshot is created by previous driver version
+		sourceVolumeID := share.Metadata[volumeIDMetadataKey]
+		if sourceVolumeID == "" {
+			return false, nil
+		}
+		entry, err := newListSnapshotsEntry(sourceVolumeID, share)
+		if err != nil {
+			klog.Warningf("skip snapshot of file share(%s) on account(%s): %v", share.Name, account.accountName, err)
+			return false, nil
+		}
+		if entry == nil {
+			return false, nil
+		}
+		entries = append(entries, entry)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+// listDriverFileShares walks through file shares in storage accounts created by this driver and
+// calls visit on each of them with account key, visit returns true if the share is added as an entry.
+// it stops after maxEntries entries and returns next token in format of account#marker
+func (d *Driver) listDriverFileShares(ctx context.Context, maxEntries int32, startingToken string, detail azfile.ListSharesDetail,
+	visit func(account storageAccountRef, accountKey string, share azfile.ShareItem) (bool, error)) (string, error) {
+	accounts, err := d.getStorageAccountsCreatedByDriver(ctx)
+	if err != nil {
+		return "", azureStatusErrorf(err, "failed to list storage accounts: %v", err)
+	}
+
+	start := 0
+	marker := azfile.Marker{}
+	if startingToken != "" {
+		account, m, err := parseListToken(startingToken)
+		if err != nil {
+			return "", status.Errorf(codes.Aborted, "%v", err)
+		}
+		start = sort.Search(len(accounts), func(i int) bool { return accounts[i].accountName >= account })
+		if start == len(accounts) || accounts[start].accountName != account {
+			return "", status.Errorf(codes.Aborted, "invalid starting token(%s): account(%s) not found", startingToken, account)
+		}
+		if m != "" {
+			marker.Val = &m
+		}
+	}
+
+	var count int32
+	for i := start; i < len(accounts); i++ {
+		accountName := accounts[i].accountName
+		if maxEntries > 0 && count >= maxEntries {
+			return accountName + separator, nil
+		}
+		accountOptions := &azure.AccountOptions{
+			Name:           accountName,
+			SubscriptionID: accounts[i].subsID,
+			ResourceGroup:  accounts[i].resourceGroup,
+		}
+		accountKey, err := d.GetStorageAccesskey(ctx, accountOptions, nil, "", defaultNamespace, nil)
+		if err != nil {
+			klog.Warningf("skip listing file shares on account(%s) since GetStorageAccesskey failed with error: %v", accountName, err)
+			marker = azfile.Marker{}
+			continue
+		}
+		serviceURL, err := d.fileClient.getServiceURL(accountName, accountKey, d.cloud.Environment.StorageEndpointSuffix)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "%v", err)
+		}
+		for marker.NotDone() {
+			opts := azfile.ListSharesOptions{Detail: detail}
+			if maxEntries > 0 {
+				opts.MaxResults = maxEntries - count
+			}
+			listResp, err := serviceURL.ListSharesSegment(ctx, marker, opts)
+			if err != nil {
+				return "", azureStatusErrorf(err, "failed to list file shares on account(%s): %v", accountName, err)
+			}
+			marker = listResp.NextMarker
+			for _, share := range listResp.ShareItems {
+				added, err := visit(accounts[i], accountKey, share)
+				if err != nil {
+					return "", status.Errorf(codes.Internal, "%v", err)
+				}
+				if added {
+					count++
+				}
+			}
+			if maxEntries > 0 && count >= maxEntries && marker.NotDone() {
+				return accountName + separator + *marker.Val, nil
+			}
+		}
+		marker = azfile.Marker{}
+	}
+	return "", nil
+}
+
+// newListSnapshotsEntry returns nil if share is not a snapshot created by this driver,
+// snapshot ID is encoded in the same way as CreateSnapshot
+func newListSnapshotsEntry(sourceVolumeID string, share azfile.ShareItem) (*csi.ListSnapshotsResponse_Entry, error) {
+	if share.Snapshot == nil || share.Metadata[snapshotNameKey] == "" {
+		return nil, nil
+	}
+	if _, err := ParseVolumeHandle(sourceVolumeID); err != nil {
+		return nil, err
+	}
+	tp, err := getSnapshotCreationTime(*share.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SizeBytes:      volumehelper.GiBToBytes(int64(share.Properties.Quota)),
+			SnapshotId:     sourceVolumeID + separator + *share.Snapshot,
+			SourceVolumeId: sourceVolumeID,
+			CreationTime:   tp,
+			// Since the snapshot of azurefile has no field of ReadyToUse, here ReadyToUse is always set to true.
+			ReadyToUse: true,
+		},
+	}, nil
 }
 
 // ControllerExpandVolume controller expand volume
@@ -955,48 +2017,380 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 		return nil, status.Errorf(codes.InvalidArgument, "invalid expand volume request: %v", req)
 	}
 
-	resourceGroupName, accountName, fileShareName, diskName, secretNamespace, subsID, err := GetFileShareInfo(volumeID)
+	h, err := ParseVolumeHandle(volumeID)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetAccountInfo(%s) failed with error: %v", volumeID, err))
 	}
-	if strings.HasSuffix(diskName, vhdSuffix) {
-		// todo: figure out how to support vhd disk resize
-		return nil, status.Error(codes.Unimplemented, fmt.Sprintf("vhd disk volume(%s, diskName:%s) is not supported on ControllerExpandVolume", volumeID, diskName))
+	if h.SubDir != "" {
+		// quota is not enforced per subdirectory, capacity of subdirectory volume is only bounded by the shared file share
+		klog.V(2).Infof("ControllerExpandVolume(%s) on subdirectory(%s) of share(%s), skip resizing the shared file share", volumeID, h.SubDir, h.FileShareName)
+		reqContext := map[string]string{}
+		if h.SecretNamespace != "" {
+			setKeyValueInMap(reqContext, secretNamespaceField, h.SecretNamespace)
+		}
+		_, accountKey, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), reqContext)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
+		}
+		shareURL, err := d.fileClient.getShareURL(h.AccountName, accountKey, d.getStorageEndpointSuffix(h), h.FileShareName)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get share url of file share(%s) on account(%s): %v", h.FileShareName, h.AccountName, err)
+		}
+		if err := setSubDirMetadata(ctx, *shareURL, h.SubDir, map[string]string{requestedCapacityMetadataKey: strconv.FormatInt(capacityBytes, 10)}); err != nil {
+			return nil, azureStatusErrorf(err, "failed to set capacity of subdirectory(%s) on share(%s) account(%s), error: %v", h.SubDir, h.FileShareName, h.AccountName, err)
+		}
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
 	}
-	if resourceGroupName == "" {
-		resourceGroupName = d.cloud.ResourceGroup
+	isDiskVolume := strings.HasSuffix(h.DiskName, vhdSuffix)
+	if h.ResourceGroup == "" {
+		h.ResourceGroup = d.cloud.ResourceGroup
 	}
-	if subsID == "" {
-		subsID = d.cloud.SubscriptionID
+	if h.SubscriptionID == "" {
+		h.SubscriptionID = d.cloud.SubscriptionID
 	}
 
-	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_expand_volume", resourceGroupName, subsID, d.Name)
+	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_expand_volume", h.ResourceGroup, h.SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
 	}()
 
 	secrets := req.GetSecrets()
-	if len(secrets) == 0 && d.useDataPlaneAPI(volumeID, accountName) {
+	var accountKey string
+	useDataPlaneAPI := len(secrets) == 0 && d.useDataPlaneAPI(volumeID, h.AccountName)
+	// vhd disk is resized by data plane api, account key is also required
+	if useDataPlaneAPI || isDiskVolume {
 		reqContext := map[string]string{}
-		if secretNamespace != "" {
-			setKeyValueInMap(reqContext, secretNamespaceField, secretNamespace)
+		if h.SecretNamespace != "" {
+			setKeyValueInMap(reqContext, secretNamespaceField, h.SecretNamespace)
 		}
 		// use data plane api, get account key first
-		_, _, accountKey, _, _, _, err := d.GetAccountInfo(ctx, volumeID, secrets, reqContext)
+		_, accountKey, err = d.GetAccountInfo(ctx, volumeID, secrets, reqContext)
 		if err != nil {
 			return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
 		}
-		secrets = createStorageAccountSecret(accountName, accountKey)
+		if useDataPlaneAPI {
+			secrets = createStorageAccountSecret(h.AccountName, accountKey)
+		}
+	}
+
+	if err = d.ResizeFileShare(ctx, h.SubscriptionID, h.ResourceGroup, h.AccountName, d.getStorageEndpointSuffix(h), h.FileShareName, int(requestGiB), secrets); err != nil {
+		return nil, azureStatusErrorf(err, "expand volume error: %v", err)
 	}
 
-	if err = d.ResizeFileShare(subsID, resourceGroupName, accountName, fileShareName, int(requestGiB), secrets); err != nil {
-		return nil, status.Errorf(codes.Internal, "expand volume error: %v", err)
+	if isDiskVolume {
+		diskSizeBytes := volumehelper.GiBToBytes(requestGiB)
+		klog.V(2).Infof("begin to resize disk(%s) on share(%s) account(%s) to %d bytes", h.DiskName, h.FileShareName, h.AccountName, diskSizeBytes)
+		if err := d.resizeDisk(ctx, h.AccountName, accountKey, d.getStorageEndpointSuffix(h), h.FileShareName, h.DiskName, diskSizeBytes); err != nil {
+			return nil, azureStatusErrorf(err, "failed to resize disk(%s) on share(%s) account(%s), error: %v", h.DiskName, h.FileShareName, h.AccountName, err)
+		}
 	}
 
 	isOperationSucceeded = true
 	klog.V(2).Infof("ControllerExpandVolume(%s) successfully, currentQuota: %d Gi", volumeID, int(requestGiB))
-	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+	// file system on vhd disk should be expanded on the node
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes, NodeExpansionRequired: isDiskVolume}, nil
+}
+
+// getVHDDiskName returns the name of vhd disk created for volume, it's derived from volume name
+// so that retried CreateVolume keeps copying into the same vhd disk
+func getVHDDiskName(fileShareName, validFileShareName, volName string) string {
+	if fileShareName == "" {
+		// use pvc name as vhd disk name if file share not specified
+		return validFileShareName + vhdSuffix
+	}
+	// use volume name as vhd disk name if file share specified, since file share is shared by volumes
+	return volName + vhdSuffix
+}
+
+// copyVolume copies the content of volume content source into the file share(or vhd disk) of the new volume
+func (d *Driver) copyVolume(ctx context.Context, req *csi.CreateVolumeRequest, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName, protocol string) error {
+	vs := req.GetVolumeContentSource()
+	switch vs.Type.(type) {
+	case *csi.VolumeContentSource_Snapshot:
+		snapshotID := vs.GetSnapshot().GetSnapshotId()
+		h, err := ParseSnapshotHandle(snapshotID)
+		if err != nil {
+			return status.Errorf(codes.NotFound, "failed to get snapshot name with (%s): %v", snapshotID, err)
+		}
+		sourceVolumeID := getSnapshotSourceVolumeID(snapshotID, h)
+		return d.copyFileShare(ctx, req, sourceVolumeID, h.Snapshot, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName, protocol)
+	case *csi.VolumeContentSource_Volume:
+		sourceVolumeID := vs.GetVolume().GetVolumeId()
+		return d.copyFileShare(ctx, req, sourceVolumeID, "", accountName, accountKey, storageEndpointSuffix, fileShareName, diskName, protocol)
+	default:
+		return status.Errorf(codes.InvalidArgument, "%v is not a proper volume source", vs)
+	}
+}
+
+// copyFileShare copies all files and directories of the source file share(or its snapshot if snapshot is not empty)
+// into the new file share by server side copy, it's idempotent: completed copies are skipped and pending copies
+// are not restarted when CreateVolume is retried
+func (d *Driver) copyFileShare(ctx context.Context, req *csi.CreateVolumeRequest, sourceVolumeID, snapshot, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName, protocol string) error {
+	if protocol == nfs {
+		return status.Errorf(codes.InvalidArgument, "protocol nfs is not supported for volume cloning and snapshot restore")
+	}
+	if sourceVolumeID == "" {
+		return status.Error(codes.InvalidArgument, "source volume ID is empty")
+	}
+	srcHandle, err := ParseVolumeHandle(sourceVolumeID)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "error parsing source volume ID(%s): %v", sourceVolumeID, err)
+	}
+	// secrets of CreateVolume belong to the new volume, they are only used if source volume is on the same account
+	srcSecrets := req.GetSecrets()
+	if len(srcSecrets) > 0 {
+		if secretAccountName, _, err := getStorageAccount(srcSecrets); err != nil || !strings.EqualFold(secretAccountName, srcHandle.AccountName) {
+			srcSecrets = nil
+		}
+	}
+	src, srcAccountKey, err := d.GetAccountInfo(ctx, sourceVolumeID, srcSecrets, map[string]string{})
+	if err != nil {
+		return status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", sourceVolumeID, err)
+	}
+	if src.AccountName == "" || src.FileShareName == "" {
+		return status.Errorf(codes.NotFound, "failed to get source account name or file share name from(%s)", sourceVolumeID)
+	}
+	if src.SubDir != "" {
+		return status.Errorf(codes.InvalidArgument, "source volume(%s) is a subdirectory volume, volume cloning is not supported", sourceVolumeID)
+	}
+	if strings.HasSuffix(src.DiskName, vhdSuffix) != strings.HasSuffix(diskName, vhdSuffix) {
+		return status.Errorf(codes.InvalidArgument, "source volume(%s) and new volume should both be vhd disk volume or file share volume", sourceVolumeID)
+	}
+
+	srcShareURL, err := d.fileClient.getShareURL(src.AccountName, srcAccountKey, d.getStorageEndpointSuffix(src), src.FileShareName)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get share url of source volume(%s): %v", sourceVolumeID, err)
+	}
+	dstShareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get share url of file share(%s) on account(%s): %v", fileShareName, accountName, err)
+	}
+	sasToken, err := generateShareSASToken(src.AccountName, srcAccountKey, src.FileShareName, copySASTokenExpiry)
+	if err != nil {
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+
+	srcRootDir := srcShareURL.NewRootDirectoryURL()
+	if snapshot != "" {
+		srcRootDir = srcShareURL.WithSnapshot(snapshot).NewRootDirectoryURL()
+	}
+	copyFunc := func() (int, error) {
+		if strings.HasSuffix(diskName, vhdSuffix) {
+			return copyVHDDisk(ctx, srcRootDir.NewFileURL(src.DiskName), dstShareURL.NewRootDirectoryURL().NewFileURL(diskName), sasToken, req.GetCapacityRange().GetRequiredBytes())
+		}
+		return copyDirectory(ctx, srcRootDir, dstShareURL.NewRootDirectoryURL(), sasToken)
+	}
+
+	klog.V(2).Infof("begin to copy volume(%s) snapshot(%s) to file share(%s) on account(%s)", sourceVolumeID, snapshot, fileShareName, accountName)
+	var pending int
+	err = wait.PollImmediateWithContext(ctx, waitForCopyInterval, waitForCopyTimeout, func(context.Context) (bool, error) {
+		var err error
+		if pending, err = copyFunc(); err != nil {
+			return false, err
+		}
+		if pending > 0 {
+			klog.V(2).Infof("%d files are still being copied from volume(%s) to file share(%s)", pending, sourceVolumeID, fileShareName)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return status.Errorf(codes.Aborted, "copy from volume(%s) to file share(%s) on account(%s) is still in progress, %d files are pending", sourceVolumeID, fileShareName, accountName, pending)
+	}
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return azureStatusErrorf(err, "failed to copy volume(%s) to file share(%s) on account(%s): %v", sourceVolumeID, fileShareName, accountName, err)
+	}
+	klog.V(2).Infof("copy volume(%s) to file share(%s) on account(%s) successfully", sourceVolumeID, fileShareName, accountName)
+	return nil
+}
+
+// copyDirectory copies all files and sub directories under srcDir into dstDir recursively,
+// returns the number of files whose copy is still pending
+func copyDirectory(ctx context.Context, srcDir, dstDir azfile.DirectoryURL, sasToken string) (int, error) {
+	pending := 0
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		listResp, err := srcDir.ListFilesAndDirectoriesSegment(ctx, marker, azfile.ListFilesAndDirectoriesOptions{})
+		if err != nil {
+			return pending, fmt.Errorf("list files and directories under %s failed with %v", srcDir.String(), err)
+		}
+		marker = listResp.NextMarker
+
+		for _, dir := range listResp.DirectoryItems {
+			dstSubDir := dstDir.NewDirectoryURL(dir.Name)
+			if _, err := dstSubDir.Create(ctx, azfile.Metadata{}, azfile.SMBProperties{}); err != nil && !isStorageErrorWithServiceCode(err, azfile.ServiceCodeResourceAlreadyExists) {
+				return pending, fmt.Errorf("create directory %s failed with %v", dstSubDir.String(), err)
+			}
+			n, err := copyDirectory(ctx, srcDir.NewDirectoryURL(dir.Name), dstSubDir, sasToken)
+			pending += n
+			if err != nil {
+				return pending, err
+			}
+		}
+
+		for _, file := range listResp.FileItems {
+			isPending, err := startFileCopy(ctx, srcDir.NewFileURL(file.Name), dstDir.NewFileURL(file.Name), sasToken)
+			if err != nil {
+				return pending, err
+			}
+			if isPending {
+				pending++
+			}
+		}
+	}
+	return pending, nil
+}
+
+// copyVHDDisk copies vhd disk file, the size of new vhd disk is the same as source vhd disk
+func copyVHDDisk(ctx context.Context, srcFile, dstFile azfile.FileURL, sasToken string, requiredBytes int64) (int, error) {
+	properties, err := srcFile.GetProperties(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("GetProperties of vhd disk %s failed with %v", srcFile.String(), err)
+	}
+	if requiredBytes > properties.ContentLength() {
+		return 0, status.Errorf(codes.OutOfRange, "requested size(%d) is larger than source vhd disk size(%d), resizing vhd disk on clone is not supported", requiredBytes, properties.ContentLength())
+	}
+	isPending, err := startFileCopy(ctx, srcFile, dstFile, sasToken)
+	if isPending {
+		return 1, err
+	}
+	return 0, err
+}
+
+// startFileCopy starts server side copy from srcFile to dstFile if it's not copied yet,
+// returns true if the copy is still pending
+func startFileCopy(ctx context.Context, srcFile, dstFile azfile.FileURL, sasToken string) (bool, error) {
+	properties, err := dstFile.GetProperties(ctx)
+	if err == nil {
+		switch properties.CopyStatus() {
+		case azfile.CopyStatusSuccess:
+			return false, nil
+		case azfile.CopyStatusPending:
+			return true, nil
+		}
+		klog.V(2).Infof("copy status of %s is %q(%s), restart copy", dstFile.String(), properties.CopyStatus(), properties.CopyStatusDescription())
+	} else if !isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+		return false, fmt.Errorf("GetProperties of %s failed with %v", dstFile.String(), err)
+	}
+
+	srcURL := srcFile.URL()
+	if srcURL.RawQuery != "" {
+		// keep sharesnapshot query parameter of copy source
+		srcURL.RawQuery = srcURL.RawQuery + "&" + sasToken
+	} else {
+		srcURL.RawQuery = sasToken
+	}
+	copyResp, err := dstFile.StartCopy(ctx, srcURL, azfile.Metadata{})
+	if err != nil {
+		return false, fmt.Errorf("StartCopy from %s to %s failed with %v", path.Join(srcFile.URL().Host, srcFile.URL().Path), dstFile.String(), err)
+	}
+	return copyResp.CopyStatus() == azfile.CopyStatusPending, nil
+}
+
+// createSubDir creates subDir and all its parent directories inside file share, it's idempotent
+func createSubDir(ctx context.Context, shareURL azfile.ShareURL, subDir string) error {
+	dir := shareURL.NewRootDirectoryURL()
+	for _, name := range strings.Split(subDir, "/") {
+		dir = dir.NewDirectoryURL(name)
+		if _, err := dir.Create(ctx, azfile.Metadata{}, azfile.SMBProperties{}); err != nil && !isStorageErrorWithServiceCode(err, azfile.ServiceCodeResourceAlreadyExists) {
+			return fmt.Errorf("create directory %s failed with %v", dir.String(), err)
+		}
+	}
+	return nil
+}
+
+// setSubDirMetadata merges metadata into existing metadata of subDir, empty values are skipped
+func setSubDirMetadata(ctx context.Context, shareURL azfile.ShareURL, subDir string, values map[string]string) error {
+	dir := shareURL.NewRootDirectoryURL().NewDirectoryURL(subDir)
+	properties, err := dir.GetProperties(ctx)
+	if err != nil {
+		return fmt.Errorf("GetProperties of %s failed with %v", dir.String(), err)
+	}
+	metadata := properties.NewMetadata()
+	for k, v := range values {
+		if v != "" {
+			metadata[k] = v
+		}
+	}
+	if _, err := dir.SetMetadata(ctx, metadata); err != nil {
+		return fmt.Errorf("SetMetadata of %s failed with %v", dir.String(), err)
+	}
+	return nil
+}
+
+// deleteDirectory deletes dir with all files and directories under it, it's idempotent
+func deleteDirectory(ctx context.Context, dir azfile.DirectoryURL) error {
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		listResp, err := dir.ListFilesAndDirectoriesSegment(ctx, marker, azfile.ListFilesAndDirectoriesOptions{})
+		if err != nil {
+			if isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+				return nil
+			}
+			return fmt.Errorf("list files and directories under %s failed with %v", dir.String(), err)
+		}
+		marker = listResp.NextMarker
+
+		for _, subDir := range listResp.DirectoryItems {
+			if err := deleteDirectory(ctx, dir.NewDirectoryURL(subDir.Name)); err != nil {
+				return err
+			}
+		}
+		for _, file := range listResp.FileItems {
+			fileURL := dir.NewFileURL(file.Name)
+			if _, err := fileURL.Delete(ctx); err != nil && !isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+				return fmt.Errorf("delete file %s failed with %v", fileURL.String(), err)
+			}
+		}
+	}
+	if _, err := dir.Delete(ctx); err != nil && !isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+		return fmt.Errorf("delete directory %s failed with %v", dir.String(), err)
+	}
+	return nil
+}
+
+// deleteSubDir removes, archives or retains subDir inside file share according to onDelete action in its metadata,
+// archived subDir is copied into a sibling directory with archivedSubDirPrefix before it's removed
+func (d *Driver) deleteSubDir(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, subDir string) error {
+	shareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return err
+	}
+	srcDir := shareURL.NewRootDirectoryURL().NewDirectoryURL(subDir)
+	properties, err := srcDir.GetProperties(ctx)
+	if err != nil {
+		if isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+			klog.Warningf("subdirectory(%s) on share(%s) account(%s) does not exist, return as success", subDir, fileShareName, accountName)
+			return nil
+		}
+		return fmt.Errorf("GetProperties of %s failed with %v", srcDir.String(), err)
+	}
+	onDelete := properties.NewMetadata()[subDirOnDeleteMetadataKey]
+	if strings.EqualFold(onDelete, subDirOnDeleteRetain) {
+		klog.V(2).Infof("subdirectory(%s) on share(%s) account(%s) is retained since subDirOnDelete is %s", subDir, fileShareName, accountName, subDirOnDeleteRetain)
+		return nil
+	}
+	if strings.EqualFold(onDelete, subDirOnDeleteArchive) {
+		archivedSubDir := path.Join(path.Dir(subDir), archivedSubDirPrefix+path.Base(subDir))
+		if err := createSubDir(ctx, *shareURL, archivedSubDir); err != nil {
+			return err
+		}
+		sasToken, err := generateShareSASToken(accountName, accountKey, fileShareName, copySASTokenExpiry)
+		if err != nil {
+			return err
+		}
+		pending, err := copyDirectory(ctx, srcDir, shareURL.NewRootDirectoryURL().NewDirectoryURL(archivedSubDir), sasToken)
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			return status.Errorf(codes.Aborted, "archiving subdirectory(%s) into %s on share(%s) is in progress, %d files pending", subDir, archivedSubDir, fileShareName, pending)
+		}
+		klog.V(2).Infof("subdirectory(%s) on share(%s) account(%s) is archived into %s", subDir, fileShareName, accountName, archivedSubDir)
+	}
+	return deleteDirectory(ctx, srcDir)
 }
 
 // getShareURL: sourceVolumeID is the id of source file share, returns a ShareURL of source file share.
@@ -1015,29 +2409,17 @@ func (d *Driver) getShareURL(ctx context.Context, sourceVolumeID string, secrets
 }
 
 func (d *Driver) getServiceURL(ctx context.Context, sourceVolumeID string, secrets map[string]string) (azfile.ServiceURL, string, error) {
-	_, accountName, accountKey, fileShareName, _, _, err := d.GetAccountInfo(ctx, sourceVolumeID, secrets, map[string]string{}) //nolint:dogsled
-	if err != nil {
-		return azfile.ServiceURL{}, "", err
-	}
-
-	credential, err := azfile.NewSharedKeyCredential(accountName, accountKey)
+	h, accountKey, err := d.GetAccountInfo(ctx, sourceVolumeID, secrets, map[string]string{})
 	if err != nil {
-		klog.Errorf("NewSharedKeyCredential(%s) in CreateSnapshot failed with error: %v", accountName, err)
 		return azfile.ServiceURL{}, "", err
 	}
-
-	u, err := url.Parse(fmt.Sprintf(serviceURLTemplate, accountName, d.cloud.Environment.StorageEndpointSuffix))
+	serviceURL, err := d.fileClient.getServiceURL(h.AccountName, accountKey, d.getStorageEndpointSuffix(h))
 	if err != nil {
-		klog.Errorf("parse serviceURLTemplate error: %v", err)
+		klog.Errorf("getServiceURL(%s) failed with error: %v", h.AccountName, err)
 		return azfile.ServiceURL{}, "", err
 	}
-	if u == nil {
-		return azfile.ServiceURL{}, "", fmt.Errorf("url is nil")
-	}
-
-	serviceURL := azfile.NewServiceURL(*u, azfile.NewPipeline(credential, azfile.PipelineOptions{}))
 
-	return serviceURL, fileShareName, nil
+	return *serviceURL, h.FileShareName, nil
 }
 
 // snapshotExists: sourceVolumeID is the id of source file share, returns the existence of snapshot and its detail info.
@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -34,6 +35,7 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2021-07-01/compute"
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/azure-storage-file-go/azfile"
 	azure2 "github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -41,11 +43,18 @@ import (
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 	cloudprovider "k8s.io/cloud-provider"
 
+	volumehelper "sigs.k8s.io/azurefile-csi-driver/pkg/util"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmclient/mockvmclient"
@@ -421,19 +430,10 @@ func TestCreateVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "invalid tags format to convert to map",
+			name: "Invalid accountSelectionPolicy",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					skuNameField:               "premium",
-					resourceGroupField:         "rg",
-					tagsField:                  "tags",
-					createAccountField:         "true",
-					useSecretCacheField:        "true",
-					enableLargeFileSharesField: "true",
-					pvcNameKey:                 "pvc",
-					pvNameKey:                  "pv",
-					shareNamePrefixField:       "pre",
-					storageEndpointSuffixField: ".core",
+					accountSelectionPolicyField: "random",
 				}
 
 				req := &csi.CreateVolumeRequest{
@@ -451,7 +451,7 @@ func TestCreateVolume(t *testing.T) {
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				expectedErr := status.Errorf(codes.InvalidArgument, fmt.Errorf("Tags 'tags' are invalid, the format should like: 'key1=value1,key2=value2'").Error())
+				expectedErr := status.Errorf(codes.InvalidArgument, "accountSelectionPolicy(random) is not supported, supported accountSelectionPolicy list: [leastshares mostfreecapacity roundrobin pernamespace]")
 				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
@@ -459,21 +459,11 @@ func TestCreateVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "failed to GetStorageAccesskey",
+			name: "accountSelectionPolicy with storageAccount",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					protocolField:            "nfs",
-					networkEndpointTypeField: "privateendpoint",
-					useDataPlaneAPIField:     "true",
-					vnetResourceGroupField:   "",
-					vnetNameField:            "",
-					subnetNameField:          "",
-				}
-				fakeCloud := &azure.Cloud{
-					Config: azure.Config{},
-					Environment: azure2.Environment{
-						StorageEndpointSuffix: "core.windows.net",
-					},
+					accountSelectionPolicyField: "leastShares",
+					storageAccountField:         "account",
 				}
 
 				req := &csi.CreateVolumeRequest{
@@ -485,17 +475,13 @@ func TestCreateVolume(t *testing.T) {
 
 				ctx := context.Background()
 				d := NewFakeDriver()
-				d.cloud = fakeCloud
-				d.volMap = sync.Map{}
-				d.volMap.Store("random-vol-name-vol-cap-invalid", "account")
-				d.fileClient = &azureFileClient{}
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				expectedErr := status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(account) rg(), error: StorageAccountClient is nil")
+				expectedErr := status.Errorf(codes.InvalidArgument, "accountSelectionPolicy(leastshares) could not be used with storageAccount or createAccount")
 				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
@@ -503,11 +489,10 @@ func TestCreateVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "Invalid protocol & fsType combination",
+			name: "perNamespace accountSelectionPolicy without pvc namespace",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					protocolField: "nfs",
-					fsTypeField:   "ext4",
+					accountSelectionPolicyField: "perNamespace",
 				}
 
 				req := &csi.CreateVolumeRequest{
@@ -518,20 +503,14 @@ func TestCreateVolume(t *testing.T) {
 				}
 
 				ctx := context.Background()
-
-				driverOptions := DriverOptions{
-					NodeID:               fakeNodeID,
-					DriverName:           DefaultDriverName,
-					EnableVHDDiskFeature: true,
-				}
-				d := NewFakeDriverCustomOptions(driverOptions)
+				d := NewFakeDriver()
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				expectedErr := status.Errorf(codes.InvalidArgument, "fsType(ext4) is not supported with protocol(nfs)")
+				expectedErr := status.Errorf(codes.InvalidArgument, "accountSelectionPolicy(pernamespace) requires pvc namespace in parameters, enable --extra-create-metadata on csi-provisioner")
 				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
@@ -539,11 +518,10 @@ func TestCreateVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "storeAccountKey must set as true in cross subscription",
+			name: "keyName without keyVaultURI",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					subscriptionIDField:  "abc",
-					storeAccountKeyField: "false",
+					keyNameField: "key",
 				}
 
 				req := &csi.CreateVolumeRequest{
@@ -553,29 +531,29 @@ func TestCreateVolume(t *testing.T) {
 					Parameters:         allParam,
 				}
 
+				ctx := context.Background()
 				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{
-					Config: azure.Config{},
-				}
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				expectedErr := status.Errorf(codes.InvalidArgument, "resourceGroup must be provided in cross subscription(abc)")
-				_, err := d.CreateVolume(context.Background(), req)
+				expectedErr := status.Errorf(codes.InvalidArgument, "keyName, keyVersion and userAssignedIdentity could only be used with keyVaultURI")
+				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
 				}
 			},
 		},
 		{
-			name: "storageAccount and matchTags conflict",
+			name: "keyVaultURI with storageAccount",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					storageAccountField: "abc",
-					matchTagsField:      "true",
+					storageAccountField:       "account",
+					keyVaultURIField:          "https://vault.vault.azure.net/",
+					keyNameField:              "key",
+					userAssignedIdentityField: "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/identity",
 				}
 
 				req := &csi.CreateVolumeRequest{
@@ -585,71 +563,57 @@ func TestCreateVolume(t *testing.T) {
 					Parameters:         allParam,
 				}
 
+				ctx := context.Background()
 				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{
-					Config: azure.Config{},
-				}
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				expectedErr := status.Errorf(codes.InvalidArgument, "matchTags must set as false when storageAccount(abc) is provided")
-				_, err := d.CreateVolume(context.Background(), req)
+				expectedErr := status.Errorf(codes.InvalidArgument, "keyVaultURI could not be used with storageAccount(account), customer-managed key is only configured on storage account created by driver")
+				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
 				}
 			},
 		},
 		{
-			name: "disableDeleteRetentionPolicy is not supported with Standard account type",
+			name: "Invalid provisioningMode",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					storageAccountTypeField:           "standard",
-					disableDeleteRetentionPolicyField: "true",
+					provisioningModeField: "invalid",
 				}
 
 				req := &csi.CreateVolumeRequest{
-					Name:               "random-vol-name",
+					Name:               "random-vol-name-vol-cap-invalid",
 					CapacityRange:      stdCapRange,
 					VolumeCapabilities: stdVolCap,
 					Parameters:         allParam,
 				}
 
+				ctx := context.Background()
 				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{
-					Config: azure.Config{},
-				}
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				expectedErr := status.Errorf(codes.InvalidArgument, "disableDeleteRetentionPolicy is not supported with Standard account type(standard)")
-				_, err := d.CreateVolume(context.Background(), req)
+				expectedErr := status.Errorf(codes.InvalidArgument, "provisioningMode(invalid) is not supported, supported provisioningMode list: [subdirectory]")
+				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
 				}
 			},
 		},
 		{
-			name: "Failed to update subnet service endpoints",
+			name: "Invalid subDirOnDelete",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					protocolField: "nfs",
-				}
-
-				fakeCloud := &azure.Cloud{
-					Config: azure.Config{
-						ResourceGroup: "rg",
-						Location:      "loc",
-						VnetName:      "fake-vnet",
-						SubnetName:    "fake-subnet",
-					},
+					provisioningModeField: subDirProvisioningMode,
+					subDirOnDeleteField:   "invalid",
 				}
-				retErr := retry.NewError(false, fmt.Errorf("the subnet does not exist"))
 
 				req := &csi.CreateVolumeRequest{
 					Name:               "random-vol-name-vol-cap-invalid",
@@ -657,23 +621,16 @@ func TestCreateVolume(t *testing.T) {
 					VolumeCapabilities: stdVolCap,
 					Parameters:         allParam,
 				}
+
 				ctx := context.Background()
 				d := NewFakeDriver()
 
-				d.cloud = fakeCloud
-				ctrl := gomock.NewController(t)
-				defer ctrl.Finish()
-				mockSubnetClient := mocksubnetclient.NewMockInterface(ctrl)
-				fakeCloud.SubnetsClient = mockSubnetClient
-
-				mockSubnetClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(network.Subnet{}, retErr).Times(1)
-
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				expectedErr := status.Errorf(codes.Internal, "update service endpoints failed with error: failed to get the subnet fake-subnet under vnet fake-vnet: &{false 0 0001-01-01 00:00:00 +0000 UTC the subnet does not exist}")
+				expectedErr := status.Errorf(codes.InvalidArgument, "subDirOnDelete(invalid) is not supported, supported subDirOnDelete list: [delete archive retain]")
 				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
@@ -681,217 +638,778 @@ func TestCreateVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "No valid key with zero request gib",
+			name: "Invalid shareOnDelete",
 			testFunc: func(t *testing.T) {
-				name := "baz"
-				sku := "sku"
-				kind := "StorageV2"
-				location := "centralus"
-				value := ""
-				account := storage.Account{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location}
-				accounts := []storage.Account{account}
-				keys := storage.AccountListKeysResult{
-					Keys: &[]storage.AccountKey{
-						{Value: &value},
-					},
-				}
-
 				allParam := map[string]string{
-					skuNameField:                      "premium",
-					locationField:                     "loc",
-					storageAccountField:               "",
-					resourceGroupField:                "rg",
-					shareNameField:                    "",
-					diskNameField:                     "diskname.vhd",
-					fsTypeField:                       "",
-					storeAccountKeyField:              "storeaccountkey",
-					secretNamespaceField:              "secretnamespace",
-					disableDeleteRetentionPolicyField: "true",
+					shareOnDeleteField: "invalid",
 				}
 
 				req := &csi.CreateVolumeRequest{
-					Name:               "random-vol-name-no-valid-key",
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
 					VolumeCapabilities: stdVolCap,
-					CapacityRange:      zeroCapRange,
 					Parameters:         allParam,
 				}
 
+				ctx := context.Background()
 				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-
-				ctrl := gomock.NewController(t)
-				defer ctrl.Finish()
-
-				mockFileClient := mockfileclient.NewMockInterface(ctrl)
-				d.cloud.FileClient = mockFileClient
-
-				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
-				d.cloud.StorageAccountClient = mockStorageAccountsClient
-
-				fileServiceProperties := storage.FileServiceProperties{
-					FileServicePropertiesProperties: &storage.FileServicePropertiesProperties{},
-				}
-
-				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
-				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockFileClient.EXPECT().GetServiceProperties(gomock.Any(), gomock.Any()).Return(fileServiceProperties, nil).AnyTimes()
-				mockFileClient.EXPECT().SetServiceProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(fileServiceProperties, nil).AnyTimes()
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				ctx := context.Background()
-				expectedErr := fmt.Errorf("no valid keys")
-
+				expectedErr := status.Errorf(codes.InvalidArgument, "shareOnDelete(invalid) is not supported, supported shareOnDelete list: [delete quarantine]")
 				_, err := d.CreateVolume(ctx, req)
-				if !strings.Contains(err.Error(), expectedErr.Error()) {
+				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
 				}
 			},
 		},
 		{
-			name: "No valid key, check all params, with less than min premium volume",
+			name: "shareOnDelete in subdirectory provisioning mode",
 			testFunc: func(t *testing.T) {
-				name := "baz"
-				sku := "sku"
-				kind := "StorageV2"
-				location := "centralus"
-				value := ""
-				accounts := []storage.Account{
-					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
-				}
-				keys := storage.AccountListKeysResult{
-					Keys: &[]storage.AccountKey{
-						{Value: &value},
-					},
-				}
-
 				allParam := map[string]string{
-					skuNameField:         "premium",
-					locationField:        "loc",
-					storageAccountField:  "",
-					resourceGroupField:   "rg",
-					shareNameField:       "",
-					diskNameField:        "diskname.vhd",
-					fsTypeField:          "",
-					storeAccountKeyField: "storeaccountkey",
-					secretNamespaceField: "secretnamespace",
+					provisioningModeField: subDirProvisioningMode,
+					shareOnDeleteField:    shareOnDeleteQuarantine,
 				}
 
 				req := &csi.CreateVolumeRequest{
-					Name:               "random-vol-name-no-valid-key-check-all-params",
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
 					VolumeCapabilities: stdVolCap,
-					CapacityRange:      lessThanPremCapRange,
 					Parameters:         allParam,
 				}
 
+				ctx := context.Background()
 				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-
-				ctrl := gomock.NewController(t)
-				defer ctrl.Finish()
-
-				mockFileClient := mockfileclient.NewMockInterface(ctrl)
-				d.cloud.FileClient = mockFileClient
-
-				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
-				d.cloud.StorageAccountClient = mockStorageAccountsClient
-
-				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
-				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				ctx := context.Background()
-				expectedErr := fmt.Errorf("no valid keys")
-
+				expectedErr := status.Errorf(codes.InvalidArgument, "shareOnDelete is not supported in subdirectory provisioning mode, use subDirOnDelete instead")
 				_, err := d.CreateVolume(ctx, req)
-				if !strings.Contains(err.Error(), expectedErr.Error()) {
+				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
 				}
 			},
 		},
 		{
-			name: "Get file share returns error",
+			name: "Invalid softDeletedShareAction",
 			testFunc: func(t *testing.T) {
-				name := "baz"
-				sku := "sku"
-				kind := "StorageV2"
-				location := "centralus"
-				value := "foo bar"
-				accounts := []storage.Account{
-					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location, AccountProperties: &storage.AccountProperties{}},
-				}
-				keys := storage.AccountListKeysResult{
-					Keys: &[]storage.AccountKey{
-						{Value: &value},
-					},
+				allParam := map[string]string{
+					softDeletedShareActionField: "invalid",
 				}
 
 				req := &csi.CreateVolumeRequest{
-					Name:               "random-vol-name-get-file-error",
-					VolumeCapabilities: stdVolCap,
+					Name:               "random-vol-name-vol-cap-invalid",
 					CapacityRange:      stdCapRange,
-					Parameters:         nil,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
 				}
 
+				ctx := context.Background()
 				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-
-				ctrl := gomock.NewController(t)
-				defer ctrl.Finish()
-
-				mockFileClient := mockfileclient.NewMockInterface(ctrl)
-				d.cloud.FileClient = mockFileClient
-
-				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
-				d.cloud.StorageAccountClient = mockStorageAccountsClient
-
-				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
-				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: nil}}, fmt.Errorf("test error")).AnyTimes()
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				ctx := context.Background()
-				expectedErr := status.Errorf(codes.Internal, "test error")
-
+				expectedErr := status.Errorf(codes.InvalidArgument, "softDeletedShareAction(invalid) is not supported, supported softDeletedShareAction list: [wait restore rename]")
 				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
-					t.Errorf("test name: %s, Unexpected error: %v, expected error: %v", name, err, expectedErr)
+					t.Errorf("Unexpected error: %v", err)
 				}
 			},
 		},
 		{
-			name: "Create file share error tests",
+			name: "softDeletedShareAction in subdirectory provisioning mode",
 			testFunc: func(t *testing.T) {
-				name := "baz"
-				sku := "sku"
-				kind := "StorageV2"
-				location := "centralus"
-				value := "foo bar"
-				accounts := []storage.Account{
-					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
+				allParam := map[string]string{
+					provisioningModeField:       subDirProvisioningMode,
+					softDeletedShareActionField: softDeletedShareRestore,
 				}
-				keys := storage.AccountListKeysResult{
-					Keys: &[]storage.AccountKey{
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "softDeletedShareAction is not supported in subdirectory provisioning mode")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Invalid snapshotOnDelete",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					snapshotOnDeleteField: "invalid",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "snapshotOnDelete(invalid) is not supported, supported snapshotOnDelete list: [refuse delete retain]")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "snapshotOnDelete with quarantine shareOnDelete",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					shareOnDeleteField:    shareOnDeleteQuarantine,
+					snapshotOnDeleteField: snapshotOnDeleteRetain,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "snapshotOnDelete could not be used with quarantine shareOnDelete")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "subDirOnDelete without subdirectory provisioning mode",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					subDirOnDeleteField: subDirOnDeleteRetain,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "subDirOnDelete is only supported in subdirectory provisioning mode")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "nfs protocol in subdirectory provisioning mode",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					provisioningModeField: subDirProvisioningMode,
+					protocolField:         nfs,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "protocol(nfs) is not supported in subdirectory provisioning mode")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Invalid folderName in subdirectory provisioning mode",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					provisioningModeField: subDirProvisioningMode,
+					folderNameField:       "data/${pvc.metadata.name}?",
+					pvcNameKey:            "pvc",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "folderName(data/pvc?) is not a valid directory name")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "invalid tags format to convert to map",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					skuNameField:               "premium",
+					resourceGroupField:         "rg",
+					tagsField:                  "tags",
+					createAccountField:         "true",
+					useSecretCacheField:        "true",
+					enableLargeFileSharesField: "true",
+					pvcNameKey:                 "pvc",
+					pvNameKey:                  "pv",
+					shareNamePrefixField:       "pre",
+					storageEndpointSuffixField: ".core",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, fmt.Errorf("Tags 'tags' are invalid, the format should like: 'key1=value1,key2=value2'").Error())
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "failed to GetStorageAccesskey",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					protocolField:            "nfs",
+					networkEndpointTypeField: "privateendpoint",
+					useDataPlaneAPIField:     "true",
+					vnetResourceGroupField:   "",
+					vnetNameField:            "",
+					subnetNameField:          "",
+				}
+				fakeCloud := &azure.Cloud{
+					Config: azure.Config{},
+					Environment: azure2.Environment{
+						StorageEndpointSuffix: "core.windows.net",
+					},
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.cloud = fakeCloud
+				d.volMap = sync.Map{}
+				d.volMap.Store("random-vol-name-vol-cap-invalid", "account")
+				d.fileClient = &azureFileClient{}
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(account) rg(), error: StorageAccountClient is nil")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Invalid protocol & fsType combination",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					protocolField: "nfs",
+					fsTypeField:   "ext4",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				ctx := context.Background()
+
+				driverOptions := DriverOptions{
+					NodeID:               fakeNodeID,
+					DriverName:           DefaultDriverName,
+					EnableVHDDiskFeature: true,
+				}
+				d := NewFakeDriverCustomOptions(driverOptions)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "fsType(ext4) is not supported with protocol(nfs)")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "storeAccountKey must set as true in cross subscription",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					subscriptionIDField:  "abc",
+					storeAccountKeyField: "false",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{
+					Config: azure.Config{},
+				}
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "resourceGroup must be provided in cross subscription(abc)")
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "storageAccount and matchTags conflict",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField: "abc",
+					matchTagsField:      "true",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{
+					Config: azure.Config{},
+				}
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "matchTags must set as false when storageAccount(abc) is provided")
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "location does not match requested topology",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					locationField: "westus",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+					AccessibilityRequirements: &csi.TopologyRequirement{
+						Requisite: []*csi.Topology{{Segments: map[string]string{topologyRegionKey: "eastus"}}},
+					},
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{
+					Config: azure.Config{},
+				}
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "location(westus) in storage class does not match region(eastus) of requested topology")
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "disableDeleteRetentionPolicy is not supported with Standard account type",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountTypeField:           "standard",
+					disableDeleteRetentionPolicyField: "true",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{
+					Config: azure.Config{},
+				}
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "disableDeleteRetentionPolicy is not supported with Standard account type(standard)")
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Failed to update subnet service endpoints",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					protocolField: "nfs",
+				}
+
+				fakeCloud := &azure.Cloud{
+					Config: azure.Config{
+						ResourceGroup: "rg",
+						Location:      "loc",
+						VnetName:      "fake-vnet",
+						SubnetName:    "fake-subnet",
+					},
+				}
+				retErr := retry.NewError(false, fmt.Errorf("the subnet does not exist"))
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+				ctx := context.Background()
+				d := NewFakeDriver()
+
+				d.cloud = fakeCloud
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				mockSubnetClient := mocksubnetclient.NewMockInterface(ctrl)
+				fakeCloud.SubnetsClient = mockSubnetClient
+
+				mockSubnetClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(network.Subnet{}, retErr).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.Internal, "update service endpoints failed with error: failed to get the subnet fake-subnet under vnet fake-vnet: &{false 0 0001-01-01 00:00:00 +0000 UTC the subnet does not exist}")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "No valid key with zero request gib",
+			testFunc: func(t *testing.T) {
+				name := "baz"
+				sku := "sku"
+				kind := "StorageV2"
+				location := "centralus"
+				value := ""
+				account := storage.Account{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location}
+				accounts := []storage.Account{account}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:                      "premium",
+					locationField:                     "loc",
+					storageAccountField:               "",
+					resourceGroupField:                "rg",
+					shareNameField:                    "",
+					diskNameField:                     "diskname.vhd",
+					fsTypeField:                       "",
+					storeAccountKeyField:              "storeaccountkey",
+					secretNamespaceField:              "secretnamespace",
+					disableDeleteRetentionPolicyField: "true",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-no-valid-key",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      zeroCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				fileServiceProperties := storage.FileServiceProperties{
+					FileServicePropertiesProperties: &storage.FileServicePropertiesProperties{},
+				}
+
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockFileClient.EXPECT().GetServiceProperties(gomock.Any(), gomock.Any()).Return(fileServiceProperties, nil).AnyTimes()
+				mockFileClient.EXPECT().SetServiceProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(fileServiceProperties, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+				expectedErr := fmt.Errorf("no valid keys")
+
+				_, err := d.CreateVolume(ctx, req)
+				if !strings.Contains(err.Error(), expectedErr.Error()) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "No valid key, check all params, with less than min premium volume",
+			testFunc: func(t *testing.T) {
+				name := "baz"
+				sku := "sku"
+				kind := "StorageV2"
+				location := "centralus"
+				value := ""
+				accounts := []storage.Account{
+					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
+				}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         "premium",
+					locationField:        "loc",
+					storageAccountField:  "",
+					resourceGroupField:   "rg",
+					shareNameField:       "",
+					diskNameField:        "diskname.vhd",
+					fsTypeField:          "",
+					storeAccountKeyField: "storeaccountkey",
+					secretNamespaceField: "secretnamespace",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-no-valid-key-check-all-params",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+				expectedErr := fmt.Errorf("no valid keys")
+
+				_, err := d.CreateVolume(ctx, req)
+				if !strings.Contains(err.Error(), expectedErr.Error()) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Get file share returns error",
+			testFunc: func(t *testing.T) {
+				name := "baz"
+				sku := "sku"
+				kind := "StorageV2"
+				location := "centralus"
+				value := "foo bar"
+				accounts := []storage.Account{
+					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location, AccountProperties: &storage.AccountProperties{}},
+				}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-get-file-error",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         nil,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: nil}}, fmt.Errorf("test error")).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+				expectedErr := status.Errorf(codes.Internal, "test error")
+
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("test name: %s, Unexpected error: %v, expected error: %v", name, err, expectedErr)
+				}
+			},
+		},
+		{
+			name: "Create file share error tests",
+			testFunc: func(t *testing.T) {
+				name := "baz"
+				sku := "sku"
+				kind := "StorageV2"
+				location := "centralus"
+				value := "foo bar"
+				accounts := []storage.Account{
+					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
+				}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
 						{Value: &value},
 					},
 				}
@@ -1335,7 +1853,6 @@ func TestCreateVolume(t *testing.T) {
 					skuNameField:            "premium",
 					storageAccountTypeField: "stoacctype",
 					locationField:           "loc",
-					storageAccountField:     "stoacc",
 					resourceGroupField:      "rg",
 					shareNameField:          "",
 					diskNameField:           "diskname.vhd",
@@ -1348,7 +1865,57 @@ func TestCreateVolume(t *testing.T) {
 					Name:               "random-vol-name-valid-request",
 					VolumeCapabilities: stdVolCap,
 					CapacityRange:      lessThanPremCapRange,
-					Parameters:         allParam,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+				tagValue := "TestTagValue"
+
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				first := mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Code=\"%s\"", accountLimitExceedManagementAPI))
+				second := mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+				gomock.InOrder(first, second)
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Tags: map[string]*string{"TestKey": &tagValue}}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Account limit exceeded on specified account",
+			testFunc: func(t *testing.T) {
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-valid-request",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters: map[string]string{
+						storageAccountField: "stoacc",
+						resourceGroupField:  "rg",
+					},
 				}
 
 				d := NewFakeDriver()
@@ -1359,31 +1926,24 @@ func TestCreateVolume(t *testing.T) {
 
 				mockFileClient := mockfileclient.NewMockInterface(ctrl)
 				d.cloud.FileClient = mockFileClient
-
+				value := "foo bar"
+				keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
 				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
 				d.cloud.StorageAccountClient = mockStorageAccountsClient
-				tagValue := "TestTagValue"
 
 				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
-				first := mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf(accountLimitExceedManagementAPI))
-				second := mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
-				gomock.InOrder(first, second)
+				// file share is created only once on the account specified by user
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Code=\"%s\"", accountLimitExceedManagementAPI)).Times(1)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("Code=\"ShareNotFound\"")).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Tags: map[string]*string{"TestKey": &tagValue}}, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
 
 				d.AddControllerServiceCapabilities(
 					[]csi.ControllerServiceCapability_RPC_Type{
 						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 					})
 
-				ctx := context.Background()
-
-				_, err := d.CreateVolume(ctx, req)
-				if !reflect.DeepEqual(err, nil) {
+				_, err := d.CreateVolume(context.Background(), req)
+				if status.Code(err) != codes.ResourceExhausted {
 					t.Errorf("Unexpected error: %v", err)
 				}
 			},
@@ -1395,6 +1955,104 @@ func TestCreateVolume(t *testing.T) {
 	}
 }
 
+func TestCreateVolumeWithAccountSelectionPersisted(t *testing.T) {
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	fakeShareQuota := int32(100)
+	lessThanPremCapRange := &csi.CapacityRange{RequiredBytes: int64(fakeShareQuota * 1024 * 1024 * 1024)}
+	name := "baz"
+	sku := "sku"
+	kind := "StorageV2"
+	location := "centralus"
+	value := "foo bar"
+	accounts := []storage.Account{
+		{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
+	}
+	keys := storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{Value: &value},
+		},
+	}
+	tests := []struct {
+		desc           string
+		configMapError error
+	}{
+		{
+			desc: "account selection is removed after volume is created",
+		},
+		{
+			desc:           "failure of persisting account selection is ignored",
+			configMapError: fmt.Errorf("test error"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.accountSelectionConfigMapName = "account-selection"
+		d.accountSelectionConfigMapNamespace = "kube-system"
+		clientSet := fake.NewSimpleClientset()
+		persisted := false
+		clientSet.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if test.configMapError != nil {
+				return true, nil, test.configMapError
+			}
+			if create, ok := action.(k8stesting.CreateAction); ok {
+				persisted = persisted || len(create.GetObject().(*v1.ConfigMap).Data) > 0
+			}
+			return false, nil, nil
+		})
+		d.cloud.KubeClient = clientSet
+		ctrl := gomock.NewController(t)
+
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		d.AddControllerServiceCapabilities(
+			[]csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			})
+
+		req := &csi.CreateVolumeRequest{
+			Name:               "random-vol-name",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      lessThanPremCapRange,
+			Parameters: map[string]string{
+				skuNameField:       "premium",
+				locationField:      "loc",
+				resourceGroupField: "rg",
+			},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.NoError(t, err, test.desc)
+		if test.configMapError == nil {
+			assert.True(t, persisted, test.desc)
+			cm, err := clientSet.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "account-selection", metav1.GetOptions{})
+			assert.NoError(t, err, test.desc)
+			assert.Empty(t, cm.Data, test.desc)
+		}
+		ctrl.Finish()
+	}
+}
+
 func TestDeleteVolume(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -1459,6 +2117,44 @@ func TestDeleteVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "Retain subdirectory",
+			testFunc: func(t *testing.T) {
+				req := &csi.DeleteVolumeRequest{
+					VolumeId: "rg#f5713de20cde511e8ba4900#pool#####v3###pvc-subdir",
+					Secrets:  map[string]string{},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.Cap = []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+						},
+					},
+				}
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				// the shared file share should never be deleted
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud = &azure.Cloud{}
+				d.cloud.FileClient = mockFileClient
+				d.accountCacheMap.Set("f5713de20cde511e8ba4900", base64.StdEncoding.EncodeToString([]byte("key")))
+				// subdirectory is retained according to subDirOnDelete in its metadata
+				d.fileClient = newFakeFileClient(func(req *http.Request) *http.Response {
+					if req.Method != http.MethodGet {
+						t.Errorf("unexpected request: %s %s", req.Method, req.URL)
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"x-ms-meta-" + subDirOnDeleteMetadataKey: []string{subDirOnDeleteRetain}}}
+				})
+
+				_, err := d.DeleteVolume(ctx, req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
 		{
 			name: "failed to get account info",
 			testFunc: func(t *testing.T) {
@@ -1510,6 +2206,7 @@ func TestDeleteVolume(t *testing.T) {
 				d.cloud = &azure.Cloud{}
 				d.cloud.FileClient = mockFileClient
 				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, nil).Times(1)
 				mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("test error")).Times(1)
 
 				expectedErr := status.Errorf(codes.Internal, "DeleteFileShare fileshare under account(f5713de20cde511e8ba4900) rg() failed with error: test error")
@@ -1520,50 +2217,325 @@ func TestDeleteVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "Valid request",
-			testFunc: func(t *testing.T) {
-				req := &csi.DeleteVolumeRequest{
-					VolumeId: "vol_1#f5713de20cde511e8ba4900#fileshare#diskname.vhd#",
-					Secrets:  map[string]string{},
-				}
-
-				ctx := context.Background()
-				d := NewFakeDriver()
-				d.Cap = []*csi.ControllerServiceCapability{
-					{
-						Type: &csi.ControllerServiceCapability_Rpc{
-							Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
-						},
-					},
-				}
-				ctrl := gomock.NewController(t)
-				defer ctrl.Finish()
-				mockFileClient := mockfileclient.NewMockInterface(ctrl)
-				d.cloud = &azure.Cloud{}
-				d.cloud.FileClient = mockFileClient
-				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
-				mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(1)
-
-				expectedResp := &csi.DeleteSnapshotResponse{}
-				resp, err := d.DeleteVolume(ctx, req)
-				if !(reflect.DeepEqual(err, nil) || reflect.DeepEqual(resp, expectedResp)) {
-					t.Errorf("Unexpected error: %v", err)
-				}
+			name: "Quarantine file share without account key",
+			testFunc: func(t *testing.T) {
+				req := &csi.DeleteVolumeRequest{
+					VolumeId: "rg#f5713de20cde511e8ba4900#fileshare###secret",
+					Secrets:  map[string]string{},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.Cap = []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+						},
+					},
+				}
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				// file share should never be deleted in quarantine mode
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud = &azure.Cloud{}
+				d.cloud.FileClient = mockFileClient
+				fileShare := storage.FileShare{FileShareProperties: &storage.FileShareProperties{
+					Metadata: map[string]*string{shareOnDeleteMetadataKey: to.StringPtr(shareOnDeleteQuarantine)},
+				}}
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fileShare, nil).Times(1)
+
+				expectedErr := status.Errorf(codes.NotFound, "get account info from(rg#f5713de20cde511e8ba4900#fileshare###secret) failed with error: could not get account key from secret(azure-storage-account-f5713de20cde511e8ba4900-secret): KubeClient is nil")
+				_, err := d.DeleteVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Refuse snapshotOnDelete without account key",
+			testFunc: func(t *testing.T) {
+				req := &csi.DeleteVolumeRequest{
+					VolumeId: "rg#f5713de20cde511e8ba4900#fileshare###secret",
+					Secrets:  map[string]string{},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.Cap = []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+						},
+					},
+				}
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				// file share should not be deleted before its snapshots are checked
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud = &azure.Cloud{}
+				d.cloud.FileClient = mockFileClient
+				fileShare := storage.FileShare{FileShareProperties: &storage.FileShareProperties{
+					Metadata: map[string]*string{snapshotOnDeleteMetadataKey: to.StringPtr(snapshotOnDeleteRefuse)},
+				}}
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fileShare, nil).Times(1)
+
+				expectedErr := status.Errorf(codes.NotFound, "get account info from(rg#f5713de20cde511e8ba4900#fileshare###secret) failed with error: could not get account key from secret(azure-storage-account-f5713de20cde511e8ba4900-secret): KubeClient is nil")
+				_, err := d.DeleteVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "File share belongs to another cluster",
+			testFunc: func(t *testing.T) {
+				req := &csi.DeleteVolumeRequest{
+					VolumeId: "rg#f5713de20cde511e8ba4900#fileshare#diskname.vhd#",
+					Secrets:  map[string]string{},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.Cap = []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+						},
+					},
+				}
+				d.clusterName = "cluster1"
+				d.enableShareOwnershipCheck = true
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud = &azure.Cloud{}
+				d.cloud.FileClient = mockFileClient
+				fileShare := storage.FileShare{FileShareProperties: &storage.FileShareProperties{
+					Metadata: map[string]*string{createdByMetadataKey: to.StringPtr(d.Name), clusterNameMetadataKey: to.StringPtr("cluster2")},
+				}}
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fileShare, nil).Times(1)
+				mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+				expectedErr := status.Errorf(codes.FailedPrecondition, "refuse to delete volume(rg#f5713de20cde511e8ba4900#fileshare#diskname.vhd#): file share(fileshare) belongs to cluster(cluster2) instead of cluster(cluster1)")
+				_, err := d.DeleteVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Valid request",
+			testFunc: func(t *testing.T) {
+				req := &csi.DeleteVolumeRequest{
+					VolumeId: "vol_1#f5713de20cde511e8ba4900#fileshare#diskname.vhd#",
+					Secrets:  map[string]string{},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.Cap = []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+						},
+					},
+				}
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud = &azure.Cloud{}
+				d.cloud.FileClient = mockFileClient
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, nil).Times(1)
+				mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+				expectedResp := &csi.DeleteSnapshotResponse{}
+				resp, err := d.DeleteVolume(ctx, req)
+				if !(reflect.DeepEqual(err, nil) || reflect.DeepEqual(resp, expectedResp)) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, tc.testFunc)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	shareQuota := int32(10)
+	deleted := true
+	volumeID := "rg#f123#testshare##uuid#default#subsID"
+	diskVolumeID := "rg#f123#testshare#diskname.vhd#uuid#default#subsID"
+	subDirVolumeID := "rg#f123#testshare#####v3###pvc-subdir"
+	testCases := []struct {
+		name               string
+		req                *csi.ControllerGetVolumeRequest
+		mockedFileShare    storage.FileShare
+		mockedFileShareErr error
+		fileHandler        func(req *http.Request) *http.Response
+		expectedResp       *csi.ControllerGetVolumeResponse
+		expectedErr        error
+	}{
+		{
+			name:        "Volume ID missing",
+			req:         &csi.ControllerGetVolumeRequest{},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+		},
+		{
+			name:        "Invalid volume ID",
+			req:         &csi.ControllerGetVolumeRequest{VolumeId: "vol_1"},
+			expectedErr: status.Errorf(codes.NotFound, "error parsing volume id: %q: %v", "vol_1", fmt.Errorf("error parsing volume id: %q, should at least contain two #", "vol_1")),
+		},
+		{
+			name:            "Healthy volume",
+			req:             &csi.ControllerGetVolumeRequest{VolumeId: volumeID},
+			mockedFileShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}},
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: volumeID, CapacityBytes: volumehelper.GiBToBytes(int64(shareQuota))},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: volumeHealthyMessage},
+				},
+			},
+		},
+		{
+			name:            "Healthy vhd disk volume",
+			req:             &csi.ControllerGetVolumeRequest{VolumeId: diskVolumeID},
+			mockedFileShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}},
+			fileHandler: func(req *http.Request) *http.Response {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Length": []string{"1073741824"}}}
+			},
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: diskVolumeID, CapacityBytes: volumehelper.GiBToBytes(1)},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: volumeHealthyMessage},
+				},
+			},
+		},
+		{
+			name:            "Vhd disk not found",
+			req:             &csi.ControllerGetVolumeRequest{VolumeId: diskVolumeID},
+			mockedFileShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}},
+			fileHandler: func(req *http.Request) *http.Response {
+				return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{errorCodeHeader: []string{"ResourceNotFound"}}}
+			},
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: diskVolumeID},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: "vhd disk(diskname.vhd) not found on share(testshare)"},
+				},
+			},
+		},
+		{
+			name:            "Healthy subdirectory volume",
+			req:             &csi.ControllerGetVolumeRequest{VolumeId: subDirVolumeID},
+			mockedFileShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}},
+			fileHandler: func(req *http.Request) *http.Response {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"x-ms-meta-" + requestedCapacityMetadataKey: []string{"5368709120"}}}
+			},
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: subDirVolumeID, CapacityBytes: volumehelper.GiBToBytes(5)},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: volumeHealthyMessage},
+				},
+			},
+		},
+		{
+			name:            "Subdirectory not found",
+			req:             &csi.ControllerGetVolumeRequest{VolumeId: subDirVolumeID},
+			mockedFileShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}},
+			fileHandler: func(req *http.Request) *http.Response {
+				return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{errorCodeHeader: []string{"ResourceNotFound"}}}
+			},
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: subDirVolumeID},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: "subdirectory(pvc-subdir) not found on share(testshare)"},
+				},
+			},
+		},
+		{
+			name:               "File share not found",
+			req:                &csi.ControllerGetVolumeRequest{VolumeId: volumeID},
+			mockedFileShareErr: fmt.Errorf("Code=\"ShareNotFound\" Message=\"The specified share does not exist.\""),
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: volumeID},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: "file share(testshare) not found on account(f123)"},
+				},
+			},
+		},
+		{
+			name:               "File share being deleted",
+			req:                &csi.ControllerGetVolumeRequest{VolumeId: volumeID},
+			mockedFileShareErr: fmt.Errorf("Code=\"ShareBeingDeleted\" Message=\"The specified share is being deleted. Try operation later.\""),
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: volumeID},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: "file share(testshare) on account(f123) is being deleted"},
+				},
+			},
+		},
+		{
+			name:            "File share soft deleted",
+			req:             &csi.ControllerGetVolumeRequest{VolumeId: volumeID},
+			mockedFileShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota, Deleted: &deleted}},
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: volumeID},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: "file share(testshare) on account(f123) is being deleted"},
+				},
+			},
+		},
+		{
+			name:               "Storage account unreachable",
+			req:                &csi.ControllerGetVolumeRequest{VolumeId: volumeID},
+			mockedFileShareErr: fmt.Errorf("Code=\"StorageAccountNotFound\""),
+			expectedResp: &csi.ControllerGetVolumeResponse{
+				Volume: &csi.Volume{VolumeId: volumeID},
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: "failed to get file share(testshare) on account(f123): Code=\"StorageAccountNotFound\""},
+				},
 			},
 		},
 	}
+
 	for _, tc := range testCases {
-		t.Run(tc.name, tc.testFunc)
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewFakeDriver()
+			d.AddControllerServiceCapabilities(
+				[]csi.ControllerServiceCapability_RPC_Type{
+					csi.ControllerServiceCapability_RPC_GET_VOLUME,
+				})
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockFileClient := mockfileclient.NewMockInterface(ctrl)
+			d.cloud.FileClient = mockFileClient
+			mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(tc.mockedFileShare, tc.mockedFileShareErr).AnyTimes()
+			if tc.fileHandler != nil {
+				d.fileClient = newFakeFileClient(tc.fileHandler)
+				d.accountCacheMap.Set("f123", "dW5pdHRlc3Q=")
+			}
+
+			resp, err := d.ControllerGetVolume(context.Background(), tc.req)
+			if !reflect.DeepEqual(err, tc.expectedErr) {
+				t.Errorf("Unexpected error: %v, expected: %v", err, tc.expectedErr)
+			}
+			if !reflect.DeepEqual(resp, tc.expectedResp) {
+				t.Errorf("Unexpected response: %v, expected: %v", resp, tc.expectedResp)
+			}
+		})
 	}
-}
 
-func TestControllerGetVolume(t *testing.T) {
 	d := NewFakeDriver()
-	req := csi.ControllerGetVolumeRequest{}
-	resp, err := d.ControllerGetVolume(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	_, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error without GET_VOLUME capability: %v", err)
 	}
 }
 
@@ -1661,7 +2633,7 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 				VolumeCapabilities: stdVolCap,
 			},
 			expectedErr:        status.Errorf(codes.NotFound, "the requested volume(vol_1#f5713de20cde511e8ba4900#fileshare#) does not exist."),
-			mockedFileShareErr: fmt.Errorf("ShareNotFound"),
+			mockedFileShareErr: fmt.Errorf("Code=\"ShareNotFound\""),
 		},
 		{
 			desc: "Valid request disk name is empty",
@@ -1969,7 +2941,15 @@ func TestCreateSnapshot(t *testing.T) {
 				SourceVolumeId: "vol_1",
 				Name:           "snapname",
 			},
-			expectedErr: status.Errorf(codes.Internal, `GetFileShareInfo(vol_1) failed with error: error parsing volume id: "vol_1", should at least contain two #`),
+			expectedErr: status.Errorf(codes.Internal, `ParseVolumeHandle(vol_1) failed with error: error parsing volume id: "vol_1", should at least contain two #`),
+		},
+		{
+			desc: "Subdirectory volume",
+			req: &csi.CreateSnapshotRequest{
+				SourceVolumeId: "rg#f5713de20cde511e8ba4900#pool#####v3###pvc-subdir",
+				Name:           "snapname",
+			},
+			expectedErr: status.Errorf(codes.InvalidArgument, "snapshot of subdirectory volume(rg#f5713de20cde511e8ba4900#pool#####v3###pvc-subdir) is not supported since share snapshot covers the whole shared file share"),
 		},
 	}
 
@@ -1981,6 +2961,166 @@ func TestCreateSnapshot(t *testing.T) {
 	}
 }
 
+func TestCopyVolume(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+
+	validSecret := map[string]string{
+		"accountname": "accountname",
+		"accountkey":  base64.StdEncoding.EncodeToString([]byte("accountkey")),
+	}
+
+	tests := []struct {
+		desc        string
+		req         *csi.CreateVolumeRequest
+		diskName    string
+		protocol    string
+		expectedErr error
+	}{
+		{
+			desc: "invalid snapshot ID",
+			req: &csi.CreateVolumeRequest{
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "rg#f123#share"},
+					},
+				},
+			},
+			expectedErr: status.Errorf(codes.NotFound, `failed to get snapshot name with (rg#f123#share): error parsing volume id: "rg#f123#share", should at least contain four #`),
+		},
+		{
+			desc: "restore vhd disk snapshot into file share volume",
+			req: &csi.CreateVolumeRequest{
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "rg#accountname#share#diskname.vhd#2019-08-22T07:17:53.0000000Z"},
+					},
+				},
+				Secrets: validSecret,
+			},
+			expectedErr: status.Errorf(codes.InvalidArgument, "source volume(rg#accountname#share#diskname.vhd) and new volume should both be vhd disk volume or file share volume"),
+		},
+		{
+			desc: "unknown volume content source",
+			req: &csi.CreateVolumeRequest{
+				VolumeContentSource: &csi.VolumeContentSource{},
+			},
+			expectedErr: status.Errorf(codes.InvalidArgument, "%v is not a proper volume source", &csi.VolumeContentSource{}),
+		},
+		{
+			desc: "nfs protocol is not supported",
+			req: &csi.CreateVolumeRequest{
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "rg#accountname#share"},
+					},
+				},
+			},
+			protocol:    nfs,
+			expectedErr: status.Errorf(codes.InvalidArgument, "protocol nfs is not supported for volume cloning and snapshot restore"),
+		},
+		{
+			desc: "invalid source volume ID",
+			req: &csi.CreateVolumeRequest{
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "vol_1"},
+					},
+				},
+			},
+			expectedErr: status.Errorf(codes.NotFound, `error parsing source volume ID(vol_1): error parsing volume id: "vol_1", should at least contain two #`),
+		},
+		{
+			desc: "source volume is vhd disk while new volume is not",
+			req: &csi.CreateVolumeRequest{
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "rg#accountname#share#diskname.vhd"},
+					},
+				},
+				Secrets: validSecret,
+			},
+			expectedErr: status.Errorf(codes.InvalidArgument, "source volume(rg#accountname#share#diskname.vhd) and new volume should both be vhd disk volume or file share volume"),
+		},
+		{
+			desc: "new volume is vhd disk while source volume is not",
+			req: &csi.CreateVolumeRequest{
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "rg#accountname#share"},
+					},
+				},
+				Secrets: validSecret,
+			},
+			diskName:    "pvcd-disk.vhd",
+			expectedErr: status.Errorf(codes.InvalidArgument, "source volume(rg#accountname#share) and new volume should both be vhd disk volume or file share volume"),
+		},
+		{
+			desc: "secrets of new volume are not used on source volume in another account",
+			req: &csi.CreateVolumeRequest{
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "rg#f123#share"},
+					},
+				},
+				Secrets: validSecret,
+			},
+			expectedErr: status.Errorf(codes.NotFound, "get account info from(rg#f123#share) failed with error: could not get account key from secret(azure-storage-account-f123-secret): KubeClient is nil"),
+		},
+	}
+
+	for _, test := range tests {
+		err := d.copyVolume(context.Background(), test.req, "accountname", "YWNjb3VudGtleQ==", "core.windows.net", "dstshare", test.diskName, test.protocol)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+
+	// retried CreateVolume converges on the vhd disk whose copy is started by previous call, instead of starting another copy
+	diskName := getVHDDiskName("dstshare", "dstshare", "pvc-clone")
+	assert.Equal(t, "pvc-clone.vhd", diskName)
+	var copyStarted, copyCompleted int
+	d.fileClient = newFakeFileClient(func(req *http.Request) *http.Response {
+		header := http.Header{}
+		switch {
+		case req.Method == http.MethodPut && req.Header.Get("x-ms-copy-source") != "":
+			assert.Equal(t, "/dstshare/"+diskName, req.URL.Path)
+			copyStarted++
+			// copy is started while its response is lost
+			header.Set(errorCodeHeader, "InternalError")
+			return &http.Response{StatusCode: http.StatusInternalServerError, Header: header}
+		case req.Method == http.MethodHead && strings.HasPrefix(req.URL.Path, "/dstshare/"):
+			if req.URL.Path != "/dstshare/"+diskName || copyStarted == 0 {
+				header.Set(errorCodeHeader, "ResourceNotFound")
+				return &http.Response{StatusCode: http.StatusNotFound, Header: header}
+			}
+			header.Set("x-ms-copy-status", string(azfile.CopyStatusPending))
+			if copyCompleted > 0 {
+				header.Set("x-ms-copy-status", string(azfile.CopyStatusSuccess))
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: header}
+		case req.Method == http.MethodHead:
+			header.Set("Content-Length", "1073741824")
+			return &http.Response{StatusCode: http.StatusOK, Header: header}
+		}
+		return &http.Response{StatusCode: http.StatusBadRequest, Header: header}
+	})
+	req := &csi.CreateVolumeRequest{
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "rg#accountname#srcshare#disk.vhd"},
+			},
+		},
+		Secrets: validSecret,
+	}
+	err := d.copyVolume(context.Background(), req, "accountname", "YWNjb3VudGtleQ==", "core.windows.net", "dstshare", diskName, "")
+	assert.Error(t, err)
+	copyCompleted++
+	err = d.copyVolume(context.Background(), req, "accountname", "YWNjb3VudGtleQ==", "core.windows.net", "dstshare", getVHDDiskName("dstshare", "dstshare", "pvc-clone"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, copyStarted)
+}
+
 func TestDeleteSnapshot(t *testing.T) {
 	d := NewFakeDriver()
 	d.cloud = &azure.Cloud{}
@@ -2125,6 +3265,49 @@ func TestControllerExpandVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "Subdirectory volume",
+			testFunc: func(t *testing.T) {
+				req := &csi.ControllerExpandVolumeRequest{
+					VolumeId:      "rg#f5713de20cde511e8ba4900#pool#####v3###pvc-subdir",
+					CapacityRange: stdCapRange,
+					Secrets:       map[string]string{defaultSecretAccountName: "f5713de20cde511e8ba4900", defaultSecretAccountKey: "dW5pdHRlc3Q="},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+					})
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				// the shared file share should never be resized
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud = &azure.Cloud{}
+				d.cloud.FileClient = mockFileClient
+				// requested capacity is recorded in metadata of subdirectory
+				var requestedCapacity string
+				d.fileClient = newFakeFileClient(func(req *http.Request) *http.Response {
+					if req.URL.Query().Get("comp") == "metadata" {
+						requestedCapacity = req.Header.Get("x-ms-meta-" + requestedCapacityMetadataKey)
+					}
+					return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+				})
+
+				expectedResp := &csi.ControllerExpandVolumeResponse{CapacityBytes: stdVolSize}
+				resp, err := d.ControllerExpandVolume(ctx, req)
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if !reflect.DeepEqual(resp, expectedResp) {
+					t.Errorf("Unexpected response: %v, expected response: %v", resp, expectedResp)
+				}
+				if requestedCapacity != strconv.FormatInt(stdVolSize, 10) {
+					t.Errorf("Unexpected requested capacity in metadata: %s", requestedCapacity)
+				}
+			},
+		},
 		{
 			name: "Disk name not empty",
 			testFunc: func(t *testing.T) {
@@ -2155,8 +3338,12 @@ func TestControllerExpandVolume(t *testing.T) {
 				d.cloud.KubeClient = clientSet
 				d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "vol_1", gomock.Any()).Return(key, nil).AnyTimes()
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("test error")).AnyTimes()
+				d.cloud.FileClient = mockFileClient
 
-				expectErr := status.Error(codes.Unimplemented, "vhd disk volume(vol_1#f5713de20cde511e8ba4900#filename#diskname.vhd#, diskName:diskname.vhd) is not supported on ControllerExpandVolume")
+				expectErr := status.Errorf(codes.Internal, "expand volume error: test error")
 				_, err := d.ControllerExpandVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectErr) {
 					t.Errorf("Unexpected error: %v, expected error: %v", err, expectErr)
@@ -2391,7 +3578,7 @@ func TestGetServiceURL(t *testing.T) {
 			desc:           "Invalid URL",
 			sourceVolumeID: "vol_1#^f5713de20cde511e8ba4900#",
 			key:            validKey,
-			expectedErr:    &url.Error{Op: "parse", URL: "https://^f5713de20cde511e8ba4900.file.abc", Err: url.InvalidHostError("^")},
+			expectedErr:    fmt.Errorf("parse serviceURLTemplate error: %v", &url.Error{Op: "parse", URL: "https://^f5713de20cde511e8ba4900.file.abc", Err: url.InvalidHostError("^")}),
 		},
 		{
 			desc:           "Valid call",
@@ -2460,32 +3647,416 @@ func TestSnapshotExists(t *testing.T) {
 }
 
 func TestGetCapacity(t *testing.T) {
+	standardAccount, premiumAccount, skippedAccount, privateEndpointAccount := "standardaccount", "premiumaccount", "skippedaccount", "privateendpointaccount"
+	location := "westus"
+	accounts := []storage.Account{
+		{Name: &standardAccount, Sku: &storage.Sku{Name: storage.SkuNameStandardLRS}, Kind: storage.KindStorageV2, Location: &location},
+		{Name: &premiumAccount, Sku: &storage.Sku{Name: storage.SkuNamePremiumLRS}, Kind: storage.KindFileStorage, Location: &location},
+		{Name: &skippedAccount, Sku: &storage.Sku{Name: storage.SkuNamePremiumZRS}, Kind: storage.KindFileStorage, Location: &location,
+			Tags: map[string]*string{azure.SkipMatchingTag: to.StringPtr("")}},
+		{Name: &privateEndpointAccount, Sku: &storage.Sku{Name: storage.SkuNameStandardZRS}, Kind: storage.KindStorageV2, Location: &location,
+			AccountProperties: &storage.AccountProperties{PrivateEndpointConnections: &[]storage.PrivateEndpointConnection{{}}}},
+	}
+
+	testCases := []struct {
+		name         string
+		parameters   map[string]string
+		listErr      *retry.Error
+		cachedUsage  map[string]int64
+		expectedResp *csi.GetCapacityResponse
+		expectedErr  error
+	}{
+		{
+			name:       "No matched standard account",
+			parameters: map[string]string{skuNameField: "Standard_GRS"},
+			expectedResp: &csi.GetCapacityResponse{
+				AvailableCapacity: volumehelper.GiBToBytes(standardAccountCapacityLimit),
+				MaximumVolumeSize: wrapperspb.Int64(volumehelper.GiBToBytes(maximumFileShareSize)),
+			},
+		},
+		{
+			name:       "No matched standard account with large file shares enabled",
+			parameters: map[string]string{skuNameField: "Standard_GRS", enableLargeFileSharesField: trueValue},
+			expectedResp: &csi.GetCapacityResponse{
+				AvailableCapacity: volumehelper.GiBToBytes(standardAccountCapacityLimit),
+				MaximumVolumeSize: wrapperspb.Int64(volumehelper.GiBToBytes(maximumLargeFileShareSize)),
+			},
+		},
+		{
+			name:       "No matched premium account in other location",
+			parameters: map[string]string{skuNameField: "Premium_LRS", locationField: "eastus"},
+			expectedResp: &csi.GetCapacityResponse{
+				AvailableCapacity: volumehelper.GiBToBytes(premiumAccountCapacityLimit),
+				MaximumVolumeSize: wrapperspb.Int64(volumehelper.GiBToBytes(maximumLargeFileShareSize)),
+			},
+		},
+		{
+			name:       "Account tagged with skip-matching is excluded",
+			parameters: map[string]string{skuNameField: "Premium_ZRS", locationField: location},
+			expectedResp: &csi.GetCapacityResponse{
+				AvailableCapacity: volumehelper.GiBToBytes(premiumAccountCapacityLimit),
+				MaximumVolumeSize: wrapperspb.Int64(volumehelper.GiBToBytes(maximumLargeFileShareSize)),
+			},
+		},
+		{
+			name:        "Provisioned capacity of account is cached",
+			parameters:  map[string]string{skuNameField: "Standard_LRS"},
+			cachedUsage: map[string]int64{"subsid/rg/standardaccount": 100},
+			expectedResp: &csi.GetCapacityResponse{
+				AvailableCapacity: volumehelper.GiBToBytes(standardAccountCapacityLimit - 100),
+				MaximumVolumeSize: wrapperspb.Int64(volumehelper.GiBToBytes(maximumFileShareSize)),
+			},
+		},
+		{
+			name:       "Account failed to get provisioned capacity is skipped",
+			parameters: map[string]string{skuNameField: "Premium_LRS"},
+			expectedResp: &csi.GetCapacityResponse{
+				MaximumVolumeSize: wrapperspb.Int64(0),
+			},
+		},
+		{
+			name:        "Account with private endpoint is excluded without networkEndpointType",
+			parameters:  map[string]string{skuNameField: "Standard_ZRS"},
+			cachedUsage: map[string]int64{"subsid/rg/privateendpointaccount": 100},
+			expectedResp: &csi.GetCapacityResponse{
+				MaximumVolumeSize: wrapperspb.Int64(0),
+			},
+		},
+		{
+			name:        "Account with private endpoint is matched with networkEndpointType privateEndpoint",
+			parameters:  map[string]string{skuNameField: "Standard_ZRS", networkEndpointTypeField: privateEndpoint},
+			cachedUsage: map[string]int64{"subsid/rg/privateendpointaccount": 100},
+			expectedResp: &csi.GetCapacityResponse{
+				AvailableCapacity: volumehelper.GiBToBytes(standardAccountCapacityLimit - 100),
+				MaximumVolumeSize: wrapperspb.Int64(volumehelper.GiBToBytes(maximumFileShareSize)),
+			},
+		},
+		{
+			name:       "Specified storage account not found",
+			parameters: map[string]string{storageAccountField: "notexist"},
+			expectedResp: &csi.GetCapacityResponse{
+				MaximumVolumeSize: wrapperspb.Int64(0),
+			},
+		},
+		{
+			name:        "ListByResourceGroup failed",
+			parameters:  map[string]string{},
+			listErr:     &retry.Error{HTTPStatusCode: http.StatusBadGateway, RawError: fmt.Errorf("test error")},
+			expectedErr: status.Errorf(codes.Internal, "failed to list storage accounts in subsID(%s) rg(%s): %v", "subsID", "rg", (&retry.Error{HTTPStatusCode: http.StatusBadGateway, RawError: fmt.Errorf("test error")}).Error()),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewFakeDriver()
+			d.cloud.SubscriptionID = "subsID"
+			d.cloud.ResourceGroup = "rg"
+			d.cloud.Location = location
+			d.AddControllerServiceCapabilities(
+				[]csi.ControllerServiceCapability_RPC_Type{
+					csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+				})
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+			d.cloud.StorageAccountClient = mockStorageAccountsClient
+			mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), "subsID", "rg").Return(accounts, tc.listErr).AnyTimes()
+			mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), "subsID", "rg", gomock.Any()).Return(storage.AccountListKeysResult{}, &retry.Error{RawError: fmt.Errorf("test error")}).AnyTimes()
+			for key, provisionedGiB := range tc.cachedUsage {
+				d.accountUsageCache.Set(key, provisionedGiB)
+			}
+
+			resp, err := d.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: tc.parameters})
+			if !reflect.DeepEqual(err, tc.expectedErr) {
+				t.Errorf("Unexpected error: %v, expected: %v", err, tc.expectedErr)
+			}
+			if !reflect.DeepEqual(resp, tc.expectedResp) {
+				t.Errorf("Unexpected response: %v, expected: %v", resp, tc.expectedResp)
+			}
+		})
+	}
+
 	d := NewFakeDriver()
-	req := csi.GetCapacityRequest{}
-	resp, err := d.GetCapacity(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	_, err := d.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error without GET_CAPACITY capability: %v", err)
 	}
 }
 
+func TestGetStorageAccountPool(t *testing.T) {
+	name1, name2 := "account1", "account2"
+	location := "westus"
+	accounts := []storage.Account{
+		{Name: &name1, Sku: &storage.Sku{Name: storage.SkuNamePremiumLRS}, Kind: storage.KindFileStorage, Location: &location},
+		{Name: &name2, Sku: &storage.Sku{Name: storage.SkuNamePremiumLRS}, Kind: storage.KindFileStorage, Location: &location},
+		{Name: nil},
+	}
+
+	d := NewFakeDriver()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+
+	result, err := d.getStorageAccountPool(context.Background(), "subsID", "rg", "WestUS", "premium_lrs", string(storage.KindFileStorage), "")
+	assert.NoError(t, err)
+	assert.Equal(t, accounts[:2], result)
+
+	result, err = d.getStorageAccountPool(context.Background(), "subsID", "rg", location, "Premium_LRS", string(storage.KindFileStorage), name2)
+	assert.NoError(t, err)
+	assert.Equal(t, accounts[1:2], result)
+
+	result, err = d.getStorageAccountPool(context.Background(), "subsID", "rg", location, "Standard_LRS", string(storage.KindStorageV2), "")
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+
+	d.cloud.StorageAccountClient = nil
+	_, err = d.getStorageAccountPool(context.Background(), "subsID", "rg", location, "Standard_LRS", string(storage.KindStorageV2), "")
+	assert.Equal(t, fmt.Errorf("StorageAccountClient is nil"), err)
+}
+
+func TestGetSubVolumeStatus(t *testing.T) {
+	d := NewFakeDriver()
+	// file share volume is healthy without querying file share again
+	capacityBytes, condition := d.getSubVolumeStatus(context.Background(), "rg#account#share", &VolumeHandle{ResourceGroup: "rg", AccountName: "account", FileShareName: "share"}, "", volumehelper.GiBToBytes(100))
+	assert.Equal(t, volumehelper.GiBToBytes(100), capacityBytes)
+	assert.Equal(t, &csi.VolumeCondition{Abnormal: false, Message: volumeHealthyMessage}, condition)
+
+	// account key of subdirectory volume could not be got
+	h := &VolumeHandle{ResourceGroup: "rg", AccountName: "account", FileShareName: "share", SubDir: "subdir"}
+	capacityBytes, condition = d.getSubVolumeStatus(context.Background(), "rg#account#share", h, "", volumehelper.GiBToBytes(100))
+	assert.Equal(t, int64(0), capacityBytes)
+	assert.True(t, condition.Abnormal)
+}
+
 func TestListVolumes(t *testing.T) {
+	testCases := []struct {
+		name         string
+		req          *csi.ListVolumesRequest
+		expectedResp *csi.ListVolumesResponse
+		expectedErr  error
+	}{
+		{
+			name:        "Invalid max entries",
+			req:         &csi.ListVolumesRequest{MaxEntries: -1},
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid max entries(%d)", -1),
+		},
+		{
+			name:        "Invalid starting token",
+			req:         &csi.ListVolumesRequest{StartingToken: "invalidtoken"},
+			expectedErr: status.Errorf(codes.Aborted, "error parsing list token: %q, should be in format of account#marker", "invalidtoken"),
+		},
+		{
+			name:        "Starting token refers to unknown account",
+			req:         &csi.ListVolumesRequest{StartingToken: "unknown#"},
+			expectedErr: status.Errorf(codes.Aborted, "invalid starting token(%s): account(%s) not found", "unknown#", "unknown"),
+		},
+		{
+			name:         "No storage account created by driver",
+			req:          &csi.ListVolumesRequest{},
+			expectedResp: &csi.ListVolumesResponse{Entries: []*csi.ListVolumesResponse_Entry{}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewFakeDriver()
+			d.AddControllerServiceCapabilities(
+				[]csi.ControllerServiceCapability_RPC_Type{
+					csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				})
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+			d.cloud.StorageAccountClient = mockStorageAccountsClient
+			name := "notcreatedbydriver"
+			accounts := []storage.Account{
+				{Name: &name},
+			}
+			mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+
+			resp, err := d.ListVolumes(context.Background(), tc.req)
+			if !reflect.DeepEqual(err, tc.expectedErr) {
+				t.Errorf("Unexpected error: %v, expected: %v", err, tc.expectedErr)
+			}
+			if !reflect.DeepEqual(resp, tc.expectedResp) {
+				t.Errorf("Unexpected response: %v, expected: %v", resp, tc.expectedResp)
+			}
+		})
+	}
+
 	d := NewFakeDriver()
-	req := csi.ListVolumesRequest{}
-	resp, err := d.ListVolumes(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	_, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error without LIST_VOLUMES capability: %v", err)
 	}
 }
 
 func TestListSnapshots(t *testing.T) {
+	testCases := []struct {
+		name         string
+		req          *csi.ListSnapshotsRequest
+		expectedResp *csi.ListSnapshotsResponse
+		expectedErr  error
+	}{
+		{
+			name:        "Invalid max entries",
+			req:         &csi.ListSnapshotsRequest{MaxEntries: -1},
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid max entries(%d)", -1),
+		},
+		{
+			name:         "Invalid snapshot ID",
+			req:          &csi.ListSnapshotsRequest{SnapshotId: "rg#f123#csivolumename"},
+			expectedResp: &csi.ListSnapshotsResponse{},
+		},
+		{
+			name: "Snapshot ID does not belong to source volume ID",
+			req: &csi.ListSnapshotsRequest{
+				SnapshotId:     "rg#f123#csivolumename#diskname#2019-08-22T07:17:53.0000000Z",
+				SourceVolumeId: "rg#f123#othervolume#diskname",
+			},
+			expectedResp: &csi.ListSnapshotsResponse{},
+		},
+		{
+			name:         "Invalid source volume ID",
+			req:          &csi.ListSnapshotsRequest{SourceVolumeId: "rg#f123"},
+			expectedResp: &csi.ListSnapshotsResponse{},
+		},
+		{
+			name:        "Invalid starting token",
+			req:         &csi.ListSnapshotsRequest{StartingToken: "invalidtoken"},
+			expectedErr: status.Errorf(codes.Aborted, "error parsing list token: %q, should be in format of account#marker", "invalidtoken"),
+		},
+		{
+			name:        "Starting token refers to unknown account",
+			req:         &csi.ListSnapshotsRequest{StartingToken: "unknown#marker"},
+			expectedErr: status.Errorf(codes.Aborted, "invalid starting token(%s): account(%s) not found", "unknown#marker", "unknown"),
+		},
+		{
+			name:         "No storage account created by driver",
+			req:          &csi.ListSnapshotsRequest{},
+			expectedResp: &csi.ListSnapshotsResponse{Entries: []*csi.ListSnapshotsResponse_Entry{}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewFakeDriver()
+			d.AddControllerServiceCapabilities(
+				[]csi.ControllerServiceCapability_RPC_Type{
+					csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				})
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+			d.cloud.StorageAccountClient = mockStorageAccountsClient
+			name := "notcreatedbydriver"
+			accounts := []storage.Account{
+				{Name: &name},
+			}
+			mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+
+			resp, err := d.ListSnapshots(context.Background(), tc.req)
+			if !reflect.DeepEqual(err, tc.expectedErr) {
+				t.Errorf("Unexpected error: %v, expected: %v", err, tc.expectedErr)
+			}
+			if !reflect.DeepEqual(resp, tc.expectedResp) {
+				t.Errorf("Unexpected response: %v, expected: %v", resp, tc.expectedResp)
+			}
+		})
+	}
+
 	d := NewFakeDriver()
-	req := csi.ListSnapshotsRequest{}
-	resp, err := d.ListSnapshots(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	_, err := d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	if err == nil || status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error without LIST_SNAPSHOTS capability: %v", err)
+	}
+}
+
+func TestNewListSnapshotsEntry(t *testing.T) {
+	snapshot := "2019-08-22T07:17:53.0000000Z"
+	sourceVolumeID := "rg#f123#csivolumename#diskname.vhd#uuid#default#subsID"
+	tests := []struct {
+		desc           string
+		sourceVolumeID string
+		share          azfile.ShareItem
+		expectedEntry  *csi.ListSnapshotsResponse_Entry
+		expectedErr    bool
+	}{
+		{
+			desc:           "not a snapshot",
+			sourceVolumeID: sourceVolumeID,
+			share:          azfile.ShareItem{Name: "csivolumename", Metadata: azfile.Metadata{snapshotNameKey: "snapshot"}},
+		},
+		{
+			desc:           "snapshot not created by driver",
+			sourceVolumeID: sourceVolumeID,
+			share:          azfile.ShareItem{Name: "csivolumename", Snapshot: &snapshot},
+		},
+		{
+			desc:           "invalid source volume ID",
+			sourceVolumeID: "rg#f123",
+			share:          azfile.ShareItem{Name: "csivolumename", Snapshot: &snapshot, Metadata: azfile.Metadata{snapshotNameKey: "snapshot"}},
+			expectedErr:    true,
+		},
+		{
+			desc:           "snapshot created by driver",
+			sourceVolumeID: sourceVolumeID,
+			share: azfile.ShareItem{
+				Name:       "csivolumename",
+				Snapshot:   &snapshot,
+				Metadata:   azfile.Metadata{snapshotNameKey: "snapshot", volumeIDMetadataKey: sourceVolumeID},
+				Properties: azfile.ShareProperties{Quota: 10},
+			},
+			expectedEntry: &csi.ListSnapshotsResponse_Entry{
+				Snapshot: &csi.Snapshot{
+					SizeBytes:      volumehelper.GiBToBytes(10),
+					SnapshotId:     sourceVolumeID + "#" + snapshot,
+					SourceVolumeId: sourceVolumeID,
+					CreationTime:   timestamppb.New(time.Date(2019, 8, 22, 7, 17, 53, 0, time.UTC)),
+					ReadyToUse:     true,
+				},
+			},
+		},
+	}
+
+	// legacy volume IDs with 3 to 5 segments are kept as is in snapshot ID
+	for _, id := range []string{"rg#f123#csivolumename", "rg#f123#csivolumename#diskname.vhd", "rg#f123#csivolumename#diskname.vhd#uuid"} {
+		tests = append(tests, struct {
+			desc           string
+			sourceVolumeID string
+			share          azfile.ShareItem
+			expectedEntry  *csi.ListSnapshotsResponse_Entry
+			expectedErr    bool
+		}{
+			desc:           "legacy source volume ID " + id,
+			sourceVolumeID: id,
+			share: azfile.ShareItem{
+				Name:       "csivolumename",
+				Snapshot:   &snapshot,
+				Metadata:   azfile.Metadata{snapshotNameKey: "snapshot", volumeIDMetadataKey: id},
+				Properties: azfile.ShareProperties{Quota: 10},
+			},
+			expectedEntry: &csi.ListSnapshotsResponse_Entry{
+				Snapshot: &csi.Snapshot{
+					SizeBytes:      volumehelper.GiBToBytes(10),
+					SnapshotId:     id + "#" + snapshot,
+					SourceVolumeId: id,
+					CreationTime:   timestamppb.New(time.Date(2019, 8, 22, 7, 17, 53, 0, time.UTC)),
+					ReadyToUse:     true,
+				},
+			},
+		})
+	}
+
+	for _, test := range tests {
+		entry, err := newListSnapshotsEntry(test.sourceVolumeID, test.share)
+		assert.Equal(t, test.expectedErr, err != nil, test.desc)
+		assert.Equal(t, test.expectedEntry, entry, test.desc)
 	}
 }
 
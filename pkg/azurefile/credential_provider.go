@@ -0,0 +1,171 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// names of credential providers in credentialProviders parameter
+	credentialProviderSecret   = "secret"
+	credentialProviderFile     = "file"
+	credentialProviderIdentity = "identity"
+
+	// placeholders in credential file path template
+	accountNameMetadata = "${account.name}"
+	namespaceMetadata   = "${namespace}"
+)
+
+// account key is read from k8s secret first, and then with cluster identity by default
+var defaultCredentialProviders = []string{credentialProviderSecret, credentialProviderIdentity}
+
+// credentialRequest describes the storage account whose key is looked up by credential providers
+type credentialRequest struct {
+	subsID          string
+	resourceGroup   string
+	accountName     string
+	secretName      string
+	secretNamespace string
+}
+
+// credentialProvider looks up key of storage account, account name is also returned if it's stored along with the key,
+// empty account key without error is returned if the provider is not applicable to the request
+type credentialProvider interface {
+	GetAccountKey(ctx context.Context, req *credentialRequest) (string, string, error)
+}
+
+// secretCredentialProvider reads account key from k8s secret
+type secretCredentialProvider struct {
+	d *Driver
+}
+
+func (p *secretCredentialProvider) GetAccountKey(ctx context.Context, req *credentialRequest) (string, string, error) {
+	if req.secretName == "" {
+		return "", "", nil
+	}
+	return p.d.GetStorageAccountFromSecret(ctx, req.secretName, req.secretNamespace)
+}
+
+// identityCredentialProvider lists account keys with cluster identity
+type identityCredentialProvider struct {
+	d *Driver
+}
+
+func (p *identityCredentialProvider) GetAccountKey(ctx context.Context, req *credentialRequest) (string, string, error) {
+	if req.accountName == "" {
+		return "", "", nil
+	}
+	klog.V(2).Infof("use cluster identity to get account key from (%s, %s, %s)", req.subsID, req.resourceGroup, req.accountName)
+	accountKey, err := p.d.getStorageAccesskeyWithIdentity(ctx, req.subsID, req.accountName, req.resourceGroup)
+	return "", accountKey, err
+}
+
+// fileCredentialProvider reads account key from a file, e.g. synced from external vault by Secrets Store CSI driver,
+// path of the file is templated by account name and secret namespace
+type fileCredentialProvider struct {
+	pathTemplate string
+}
+
+func (p *fileCredentialProvider) GetAccountKey(ctx context.Context, req *credentialRequest) (string, string, error) {
+	if p.pathTemplate == "" {
+		return "", "", fmt.Errorf("credential file path template is not set")
+	}
+	if req.accountName == "" {
+		return "", "", nil
+	}
+	for _, v := range []string{req.accountName, req.secretNamespace} {
+		if strings.ContainsAny(v, `/\`) || v == "." || v == ".." {
+			return "", "", fmt.Errorf("invalid path element(%s) in credential file path", v)
+		}
+	}
+	path := replaceWithMap(p.pathTemplate, map[string]string{
+		accountNameMetadata: req.accountName,
+		namespaceMetadata:   req.secretNamespace,
+	})
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("could not read account key from file(%s): %v", path, err)
+	}
+	return "", strings.TrimSpace(string(content)), nil
+}
+
+// newCredentialProviders returns the credential providers supported by driver by name
+func newCredentialProviders(d *Driver, credentialFilePathTemplate string) map[string]credentialProvider {
+	return map[string]credentialProvider{
+		credentialProviderSecret:   &secretCredentialProvider{d: d},
+		credentialProviderIdentity: &identityCredentialProvider{d: d},
+		credentialProviderFile:     &fileCredentialProvider{pathTemplate: credentialFilePathTemplate},
+	}
+}
+
+// parseCredentialProviders parses comma separated credential provider names in lookup order, default order is returned if empty
+func (d *Driver) parseCredentialProviders(value string) ([]string, error) {
+	var providers []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := d.credentialProviders[name]; !ok {
+			return nil, fmt.Errorf("credential provider(%s) is not supported", name)
+		}
+		providers = append(providers, name)
+	}
+	if len(providers) == 0 {
+		return defaultCredentialProviders, nil
+	}
+	return providers, nil
+}
+
+// getAccountKeyFromProviders looks up account key with credential providers in order, the first key found is returned,
+// error of the last failed provider is returned if no key is found
+func (d *Driver) getAccountKeyFromProviders(ctx context.Context, providers []string, req *credentialRequest) (string, string, error) {
+	var lastErr error
+	for _, name := range providers {
+		p, ok := d.credentialProviders[name]
+		if !ok {
+			lastErr = fmt.Errorf("credential provider(%s) is not supported", name)
+			continue
+		}
+		accountName, accountKey, err := p.GetAccountKey(ctx, req)
+		if err != nil {
+			klog.Warningf("could not get key of account(%s) from %s credential provider: %v", req.accountName, name, err)
+			lastErr = err
+			continue
+		}
+		if accountKey != "" {
+			klog.V(4).Infof("get key of account(%s) from %s credential provider", req.accountName, name)
+			return accountName, accountKey, nil
+		}
+	}
+	return "", "", lastErr
+}
+
+func containsCredentialProvider(providers []string, name string) bool {
+	for _, v := range providers {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCredentialProvider struct {
+	accountName string
+	accountKey  string
+	err         error
+}
+
+func (p *fakeCredentialProvider) GetAccountKey(ctx context.Context, req *credentialRequest) (string, string, error) {
+	return p.accountName, p.accountKey, p.err
+}
+
+func TestParseCredentialProviders(t *testing.T) {
+	d := NewFakeDriver()
+	tests := []struct {
+		desc        string
+		value       string
+		expected    []string
+		expectedErr error
+	}{
+		{
+			desc:     "default order",
+			value:    "",
+			expected: defaultCredentialProviders,
+		},
+		{
+			desc:     "custom order",
+			value:    "File, secret,,identity",
+			expected: []string{credentialProviderFile, credentialProviderSecret, credentialProviderIdentity},
+		},
+		{
+			desc:        "unsupported provider",
+			value:       "file,vault",
+			expectedErr: fmt.Errorf("credential provider(vault) is not supported"),
+		},
+	}
+
+	for _, test := range tests {
+		providers, err := d.parseCredentialProviders(test.value)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expected, providers, test.desc)
+	}
+}
+
+func TestFileCredentialProvider(t *testing.T) {
+	dir, err := os.MkdirTemp("", "credentials")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "ns"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "ns", "account"), []byte("key\n"), 0600))
+	template := filepath.Join(dir, namespaceMetadata, accountNameMetadata)
+
+	tests := []struct {
+		desc          string
+		pathTemplate  string
+		req           *credentialRequest
+		expectedKey   string
+		expectedError bool
+	}{
+		{
+			desc:          "path template not set",
+			req:           &credentialRequest{accountName: "account", secretNamespace: "ns"},
+			expectedError: true,
+		},
+		{
+			desc:         "no account name",
+			pathTemplate: template,
+			req:          &credentialRequest{secretNamespace: "ns"},
+		},
+		{
+			desc:          "path traversal in namespace",
+			pathTemplate:  template,
+			req:           &credentialRequest{accountName: "account", secretNamespace: ".."},
+			expectedError: true,
+		},
+		{
+			desc:          "path separator in account name",
+			pathTemplate:  template,
+			req:           &credentialRequest{accountName: "../ns/account", secretNamespace: "ns"},
+			expectedError: true,
+		},
+		{
+			desc:          "file not found",
+			pathTemplate:  template,
+			req:           &credentialRequest{accountName: "account2", secretNamespace: "ns"},
+			expectedError: true,
+		},
+		{
+			desc:         "account key read from file",
+			pathTemplate: template,
+			req:          &credentialRequest{accountName: "account", secretNamespace: "ns"},
+			expectedKey:  "key",
+		},
+	}
+
+	for _, test := range tests {
+		p := &fileCredentialProvider{pathTemplate: test.pathTemplate}
+		_, accountKey, err := p.GetAccountKey(context.Background(), test.req)
+		assert.Equal(t, test.expectedError, err != nil, test.desc)
+		assert.Equal(t, test.expectedKey, accountKey, test.desc)
+	}
+}
+
+func TestGetAccountKeyFromProviders(t *testing.T) {
+	d := NewFakeDriver()
+	d.credentialProviders = map[string]credentialProvider{
+		"failed":   &fakeCredentialProvider{err: fmt.Errorf("test error")},
+		"empty":    &fakeCredentialProvider{},
+		"found":    &fakeCredentialProvider{accountName: "account", accountKey: "key"},
+		"found2":   &fakeCredentialProvider{accountKey: "key2"},
+		"failed2":  &fakeCredentialProvider{err: fmt.Errorf("test error2")},
+		"notfound": &fakeCredentialProvider{},
+	}
+	tests := []struct {
+		desc                string
+		providers           []string
+		expectedAccountName string
+		expectedAccountKey  string
+		expectedErr         error
+	}{
+		{
+			desc:                "fall back to next provider on error",
+			providers:           []string{"failed", "empty", "found", "found2"},
+			expectedAccountName: "account",
+			expectedAccountKey:  "key",
+		},
+		{
+			desc:               "first provider wins",
+			providers:          []string{"found2", "found"},
+			expectedAccountKey: "key2",
+		},
+		{
+			desc:        "error of last failed provider",
+			providers:   []string{"failed", "failed2", "notfound"},
+			expectedErr: fmt.Errorf("test error2"),
+		},
+		{
+			desc:      "no provider is applicable",
+			providers: []string{"empty", "notfound"},
+		},
+		{
+			desc:        "unsupported provider",
+			providers:   []string{"empty", "vault"},
+			expectedErr: fmt.Errorf("credential provider(vault) is not supported"),
+		},
+	}
+
+	for _, test := range tests {
+		accountName, accountKey, err := d.getAccountKeyFromProviders(context.Background(), test.providers, &credentialRequest{accountName: "account"})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedAccountName, accountName, test.desc)
+		assert.Equal(t, test.expectedAccountKey, accountKey, test.desc)
+	}
+}
+
+func TestGetAccountInfoWithCredentialProviders(t *testing.T) {
+	d := NewFakeDriver()
+	d.credentialProviders[credentialProviderFile] = &fakeCredentialProvider{accountKey: "filekey"}
+
+	// secret provider fails without KubeClient, file provider is used then
+	h, accountKey, err := d.GetAccountInfo(context.Background(), "rg#account#share", nil, map[string]string{credentialProvidersField: "secret,file"})
+	assert.NoError(t, err)
+	assert.Equal(t, "account", h.AccountName)
+	assert.Equal(t, "filekey", accountKey)
+
+	_, _, err = d.GetAccountInfo(context.Background(), "rg#account2#share", nil, map[string]string{credentialProvidersField: "secret,vault"})
+	assert.Equal(t, fmt.Errorf("credential provider(vault) is not supported"), err)
+}
@@ -32,6 +32,7 @@ import (
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume"
 	"k8s.io/kubernetes/pkg/volume/util"
+	mount "k8s.io/mount-utils"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -133,6 +134,10 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 	if err := CleanupSMBMountPoint(d.mounter, targetPath, true /*extensiveMountPointCheck*/); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount target %s: %v", targetPath, err)
 	}
+	if m, ok := d.stagedMounts.Load(volumeID); ok && m.(*stagedMount).mountPath == targetPath {
+		// ephemeral volume is staged on target path in NodePublishVolume
+		d.stagedMounts.Delete(volumeID)
+	}
 	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -158,17 +163,22 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	volumeMountGroup := req.GetVolumeCapability().GetMount().GetVolumeMountGroup()
 	gidPresent := checkGidPresentInMountFlags(mountFlags)
 
-	_, accountName, accountKey, fileShareName, diskName, _, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), context)
+	h, accountKey, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), context)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetAccountInfo(%s) failed with error: %v", volumeID, err))
 	}
-	if fileShareName == "" {
+	if h.FileShareName == "" {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("failed to get file share name from %s", volumeID))
 	}
+	accountName, fileShareName, diskName := h.AccountName, h.FileShareName, h.DiskName
+	// subdirectory in volume handle could be overridden by folderName in volume context
+	folderName := h.SubDir
+	// protocol and storage endpoint suffix carried in volume handle could be overridden by volume context
+	protocol, storageEndpointSuffix := h.Protocol, h.StorageEndpointSuffix
 	// don't respect fsType from req.GetVolumeCapability().GetMount().GetFsType()
 	// since it's ext4 by default on Linux
-	var fsType, server, protocol, ephemeralVolMountOptions, storageEndpointSuffix, folderName string
-	var ephemeralVol bool
+	var fsType, server, ephemeralVolMountOptions string
+	var ephemeralVol, unquarantine, restoreSoftDeletedShare bool
 	fileShareNameReplaceMap := map[string]string{}
 
 	mountPermissions := d.mountPermissions
@@ -189,6 +199,10 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 			server = v
 		case ephemeralField:
 			ephemeralVol = strings.EqualFold(v, trueValue)
+		case unquarantineField:
+			unquarantine = strings.EqualFold(v, trueValue)
+		case restoreSoftDeletedShareField:
+			restoreSoftDeletedShare = strings.EqualFold(v, trueValue)
 		case mountOptionsField:
 			ephemeralVolMountOptions = v
 		case storageEndpointSuffixField:
@@ -249,6 +263,33 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	// replace pv/pvc name namespace metadata in fileShareName
 	fileShareName = replaceWithMap(fileShareName, fileShareNameReplaceMap)
 
+	if restoreSoftDeletedShare {
+		// static pv could recover a soft-deleted file share
+		if accountKey == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "account key is required to restore soft-deleted file share(%s)", fileShareName)
+		}
+		if _, err := d.restoreSoftDeletedFileShare(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName); err != nil {
+			return nil, azureStatusErrorf(err, "failed to restore soft-deleted file share(%s) on account(%s): %v", fileShareName, accountName, err)
+		}
+	}
+
+	if unquarantine {
+		// static pv could take over a quarantined file share
+		if accountKey == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "account key is required to unquarantine file share(%s)", fileShareName)
+		}
+		if err := d.unquarantineFileShare(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName); err != nil {
+			return nil, azureStatusErrorf(err, "failed to unquarantine file share(%s) on account(%s): %v", fileShareName, accountName, err)
+		}
+	} else if d.enableQuarantinedShareMountCheck && accountKey != "" {
+		quarantined, err := d.isFileShareQuarantined(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName)
+		if err != nil {
+			klog.Warningf("failed to check whether file share(%s) on account(%s) is quarantined: %v", fileShareName, accountName, err)
+		} else if quarantined {
+			return nil, status.Errorf(codes.FailedPrecondition, "file share(%s) on account(%s) is quarantined, set %s as true in volume attributes to take it over", fileShareName, accountName, unquarantineField)
+		}
+	}
+
 	osSeparator := string(os.PathSeparator)
 	if strings.TrimSpace(server) == "" {
 		// server address is "accountname.file.core.windows.net" by default
@@ -331,6 +372,18 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		}
 		klog.V(2).Infof("volume(%s) mount %s on %s succeeded", volumeID, source, cifsMountPath)
 	}
+	if protocol != nfs && d.stagedMountCheckInterval > 0 {
+		d.stagedMounts.Store(volumeID, &stagedMount{
+			volumeID:      volumeID,
+			source:        source,
+			mountPath:     cifsMountPath,
+			mountOptions:  mountOptions,
+			accountName:   accountName,
+			accountKey:    accountKey,
+			secrets:       req.GetSecrets(),
+			volumeContext: context,
+		})
+	}
 
 	if isDiskMount {
 		mnt, err := d.ensureMountPoint(targetPath, os.FileMode(mountPermissions))
@@ -394,6 +447,7 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	if err := CleanupMountPoint(d.mounter, targetPath, false); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %s: %v", targetPath, err)
 	}
+	d.stagedMounts.Delete(volumeID)
 	klog.V(2).Infof("NodeUnstageVolume: unmount volume %s on %s successfully", volumeID, stagingTargetPath)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
@@ -408,8 +462,15 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 
 // NodeGetInfo return info of the node on which this plugin is running
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	region, zone := d.getNodeTopology(ctx)
+	klog.V(2).Infof("NodeGetInfo: node(%s) region(%s) zone(%s)", d.NodeID, region, zone)
+	segments := map[string]string{topologyRegionKey: region}
+	if zone != "" {
+		segments[topologyZoneKey] = zone
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId: d.NodeID,
+		NodeId:             d.NodeID,
+		AccessibleTopology: &csi.Topology{Segments: segments},
 	}, nil
 }
 
@@ -479,9 +540,58 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 }
 
 // NodeExpandVolume node expand volume
-// N/A for azure file
+// only the file system of vhd disk volume is expanded on the node, file share quota is expanded in ControllerExpandVolume
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume path must be provided")
+	}
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+
+	h, err := ParseVolumeHandle(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "error parsing volume id: %q: %v", volumeID, err)
+	}
+	if !strings.HasSuffix(h.DiskName, vhdSuffix) {
+		// file share quota is already expanded in ControllerExpandVolume
+		klog.V(2).Infof("NodeExpandVolume: volume(%s) is not a vhd disk volume, skip expanding on node", volumeID)
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+	}
+
+	// file system of vhd disk is mounted on staging path
+	mountPath := req.GetStagingTargetPath()
+	if mountPath == "" {
+		mountPath = volumePath
+	}
+
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	devicePath, refCount, err := mount.GetDeviceNameFromMount(d.mounter, mountPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get device of mount path %s: %v", mountPath, err)
+	}
+	if devicePath == "" || refCount == 0 {
+		return nil, status.Errorf(codes.NotFound, "volume(%s) is not mounted on %s", volumeID, mountPath)
+	}
+
+	klog.V(2).Infof("NodeExpandVolume: refreshing capacity of loop device %s of volume(%s)", devicePath, volumeID)
+	if output, err := d.mounter.Exec.Command("losetup", "-c", devicePath).CombinedOutput(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to refresh capacity of loop device %s: %v, output: %s", devicePath, err, string(output))
+	}
+
+	klog.V(2).Infof("NodeExpandVolume: resizing file system on %s mounted at %s", devicePath, mountPath)
+	if _, err := mount.NewResizeFs(d.mounter.Exec).Resize(devicePath, mountPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "could not resize volume(%s) on %s: %v", volumeID, devicePath, err)
+	}
+	klog.V(2).Infof("NodeExpandVolume: volume(%s) on %s expanded successfully", volumeID, mountPath)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
 }
 
 // ensureMountPoint: create mount point if not exists
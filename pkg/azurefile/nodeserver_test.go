@@ -35,6 +35,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 	mount "k8s.io/mount-utils"
 	"k8s.io/utils/exec"
 	testingexec "k8s.io/utils/exec/testing"
@@ -73,6 +76,33 @@ func TestNodeGetInfo(t *testing.T) {
 	resp, err := d.NodeGetInfo(context.Background(), &req)
 	assert.NoError(t, err)
 	assert.Equal(t, resp.GetNodeId(), fakeNodeID)
+	assert.Equal(t, map[string]string{topologyRegionKey: ""}, resp.GetAccessibleTopology().GetSegments())
+
+	// Test node in availability zone
+	d.cloud.Location = "eastus"
+	d.cloud.KubeClient = fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fakeNodeID,
+			Labels: map[string]string{
+				v1.LabelTopologyRegion: "eastus",
+				v1.LabelTopologyZone:   "eastus-1",
+			},
+		},
+	})
+	resp, err = d.NodeGetInfo(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{topologyRegionKey: "eastus", topologyZoneKey: "eastus-1"}, resp.GetAccessibleTopology().GetSegments())
+
+	// Test node in fault domain
+	d.cloud.KubeClient = fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   fakeNodeID,
+			Labels: map[string]string{v1.LabelTopologyZone: "0"},
+		},
+	})
+	resp, err = d.NodeGetInfo(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{topologyRegionKey: "eastus"}, resp.GetAccessibleTopology().GetSegments())
 }
 
 func TestNodeGetCapabilities(t *testing.T) {
@@ -243,7 +273,7 @@ func TestNodePublishVolume(t *testing.T) {
 	_ = makeDir(alreadyMountedTarget, 0755)
 	mounter, err := NewFakeMounter()
 	if err != nil {
-		t.Fatalf(fmt.Sprintf("failed to get fake mounter: %v", err))
+		t.Fatalf("failed to get fake mounter: %v", err)
 	}
 	if runtime.GOOS != "windows" {
 		mounter.Exec = &testingexec.FakeExec{ExactOrder: true}
@@ -316,7 +346,7 @@ func TestNodeUnpublishVolume(t *testing.T) {
 	_ = makeDir(errorTarget, 0755)
 	mounter, err := NewFakeMounter()
 	if err != nil {
-		t.Fatalf(fmt.Sprintf("failed to get fake mounter: %v", err))
+		t.Fatalf("failed to get fake mounter: %v", err)
 	}
 	if runtime.GOOS != "windows" {
 		mounter.Exec = &testingexec.FakeExec{ExactOrder: true}
@@ -707,7 +737,7 @@ func TestNodeStageVolume(t *testing.T) {
 		}
 		mounter, err := NewFakeMounter()
 		if err != nil {
-			t.Fatalf(fmt.Sprintf("failed to get fake mounter: %v", err))
+			t.Fatalf("failed to get fake mounter: %v", err)
 		}
 
 		if runtime.GOOS != "windows" {
@@ -813,7 +843,7 @@ func TestNodeUnstageVolume(t *testing.T) {
 	_ = makeDir(errorTarget, 0755)
 	mounter, err := NewFakeMounter()
 	if err != nil {
-		t.Fatalf(fmt.Sprintf("failed to get fake mounter: %v", err))
+		t.Fatalf("failed to get fake mounter: %v", err)
 	}
 	if runtime.GOOS != "windows" {
 		mounter.Exec = &testingexec.FakeExec{ExactOrder: true}
@@ -969,12 +999,62 @@ func TestMakeDir(t *testing.T) {
 }
 
 func TestNodeExpandVolume(t *testing.T) {
+	tests := []struct {
+		desc         string
+		req          csi.NodeExpandVolumeRequest
+		expectedResp *csi.NodeExpandVolumeResponse
+		expectedErr  error
+	}{
+		{
+			desc:        "[Error] Volume ID missing",
+			req:         csi.NodeExpandVolumeRequest{},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+		},
+		{
+			desc:        "[Error] Volume path missing",
+			req:         csi.NodeExpandVolumeRequest{VolumeId: "vol_1"},
+			expectedErr: status.Error(codes.InvalidArgument, "volume path must be provided"),
+		},
+		{
+			desc:        "[Error] Invalid volume ID",
+			req:         csi.NodeExpandVolumeRequest{VolumeId: "vol_1", VolumePath: targetTest},
+			expectedErr: status.Errorf(codes.NotFound, "error parsing volume id: %q: %v", "vol_1", fmt.Errorf("error parsing volume id: \"vol_1\", should at least contain two #")),
+		},
+		{
+			desc: "[Success] File share volume is skipped",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId:      "rg#acc#share",
+				VolumePath:    targetTest,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 10},
+			},
+			expectedResp: &csi.NodeExpandVolumeResponse{CapacityBytes: 10},
+		},
+		{
+			desc: "[Error] Vhd disk volume not mounted",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId:          "rg#acc#share#disk.vhd",
+				VolumePath:        targetTest,
+				StagingTargetPath: sourceTest,
+			},
+			expectedErr: status.Errorf(codes.NotFound, "volume(%s) is not mounted on %s", "rg#acc#share#disk.vhd", sourceTest),
+		},
+	}
+
 	d := NewFakeDriver()
-	req := csi.NodeExpandVolumeRequest{}
-	resp, err := d.NodeExpandVolume(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	fakeMounter, err := NewFakeMounter()
+	if err != nil {
+		t.Fatalf("failed to get fake mounter: %v", err)
+	}
+	d.mounter = fakeMounter
+
+	for _, test := range tests {
+		resp, err := d.NodeExpandVolume(context.Background(), &test.req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("desc: %v, expected error: %v, actual error: %v", test.desc, test.expectedErr, err)
+		}
+		if !reflect.DeepEqual(resp, test.expectedResp) {
+			t.Errorf("desc: %v, expected response: %v, actual response: %v", test.desc, test.expectedResp, resp)
+		}
 	}
 }
 
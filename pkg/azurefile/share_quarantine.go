@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// actions taken on file share when volume is deleted
+	shareOnDeleteDelete     = "delete"
+	shareOnDeleteQuarantine = "quarantine"
+
+	// key of quarantine time in metadata of quarantined file share
+	quarantinedAtMetadataKey = "quarantinedat"
+
+	// interval of deleting quarantined file shares after grace period
+	quarantineReaperInterval = time.Hour
+)
+
+var supportedShareOnDeleteList = []string{shareOnDeleteDelete, shareOnDeleteQuarantine}
+
+func isSupportedShareOnDelete(onDelete string) bool {
+	if onDelete == "" {
+		return true
+	}
+	for _, v := range supportedShareOnDeleteList {
+		if strings.EqualFold(onDelete, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// isQuarantineOnDelete returns true if file share should be quarantined instead of deleted in DeleteVolume,
+// shareOnDelete of the volume is kept in file share metadata
+func (d *Driver) isQuarantineOnDelete(metadata map[string]string) bool {
+	return d.quarantineDeletedShares || strings.EqualFold(metadata[shareOnDeleteMetadataKey], shareOnDeleteQuarantine)
+}
+
+// getQuarantineTime returns the quarantine time in file share metadata, false is returned if file share is not quarantined
+func getQuarantineTime(metadata map[string]string) (time.Time, bool, error) {
+	v, ok := metadata[quarantinedAtMetadataKey]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("error parsing quarantine time(%s): %v", v, err)
+	}
+	return t, true, nil
+}
+
+// quarantineFileShare tags file share with quarantine time, quarantine time of already quarantined file share is kept
+func (d *Driver) quarantineFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName string, now time.Time) error {
+	shareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return err
+	}
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		if isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+			klog.Warningf("file share(%s) on account(%s) not found, skip quarantine", fileShareName, accountName)
+			return nil
+		}
+		return err
+	}
+	metadata := properties.NewMetadata()
+	if _, ok := metadata[quarantinedAtMetadataKey]; ok {
+		klog.V(2).Infof("file share(%s) on account(%s) is already quarantined at %s", fileShareName, accountName, metadata[quarantinedAtMetadataKey])
+		return nil
+	}
+	metadata[quarantinedAtMetadataKey] = now.UTC().Format(time.RFC3339)
+	_, err = shareURL.SetMetadata(ctx, metadata)
+	return err
+}
+
+// unquarantineFileShare removes quarantine time from file share metadata so that file share could be mounted again
+func (d *Driver) unquarantineFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName string) error {
+	shareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return err
+	}
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		return err
+	}
+	metadata := properties.NewMetadata()
+	if _, ok := metadata[quarantinedAtMetadataKey]; !ok {
+		return nil
+	}
+	delete(metadata, quarantinedAtMetadataKey)
+	if _, err = shareURL.SetMetadata(ctx, metadata); err != nil {
+		return err
+	}
+	klog.V(2).Infof("file share(%s) on account(%s) is unquarantined", fileShareName, accountName)
+	return nil
+}
+
+// isFileShareQuarantined returns true if file share is tagged with quarantine time
+func (d *Driver) isFileShareQuarantined(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName string) (bool, error) {
+	shareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return false, err
+	}
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, ok := properties.NewMetadata()[quarantinedAtMetadataKey]
+	return ok, nil
+}
+
+// reapQuarantinedFileShares deletes file shares quarantined by this cluster longer than grace period
+func (d *Driver) reapQuarantinedFileShares(ctx context.Context, now time.Time) error {
+	_, err := d.listDriverFileShares(ctx, 0, "", azfile.ListSharesDetail{Metadata: true}, func(account storageAccountRef, _ string, share azfile.ShareItem) (bool, error) {
+		accountName := account.accountName
+		quarantinedAt, quarantined, err := getQuarantineTime(share.Metadata)
+		if !quarantined {
+			return false, nil
+		}
+		if err != nil {
+			klog.Warningf("skip quarantined file share(%s) on account(%s): %v", share.Name, accountName, err)
+			return false, nil
+		}
+		if share.Metadata[clusterNameMetadataKey] != d.clusterName || now.Sub(quarantinedAt) < d.quarantineGracePeriod {
+			return false, nil
+		}
+		if err := d.DeleteFileShare(ctx, account.subsID, account.resourceGroup, accountName, "", share.Name, nil); err != nil {
+			klog.Errorf("failed to delete quarantined file share(%s) on account(%s): %v", share.Name, accountName, err)
+			return false, nil
+		}
+		klog.V(2).Infof("file share(%s) on account(%s) quarantined at %s is deleted", share.Name, accountName, quarantinedAt)
+		return true, nil
+	})
+	return err
+}
+
+// runQuarantineReaper deletes quarantined file shares periodically until stopCh is closed
+func (d *Driver) runQuarantineReaper(stopCh <-chan struct{}) {
+	klog.V(2).Infof("starting quarantine reaper with grace period(%v)", d.quarantineGracePeriod)
+	wait.Until(func() {
+		if err := d.reapQuarantinedFileShares(context.Background(), time.Now()); err != nil {
+			klog.Errorf("failed to reap quarantined file shares: %v", err)
+		}
+	}, quarantineReaperInterval, stopCh)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+func TestIsSupportedShareOnDelete(t *testing.T) {
+	assert.True(t, isSupportedShareOnDelete(""))
+	assert.True(t, isSupportedShareOnDelete("Quarantine"))
+	assert.True(t, isSupportedShareOnDelete(shareOnDeleteDelete))
+	assert.False(t, isSupportedShareOnDelete("retain"))
+}
+
+func TestIsQuarantineOnDelete(t *testing.T) {
+	d := NewFakeDriver()
+	assert.False(t, d.isQuarantineOnDelete(nil))
+	assert.False(t, d.isQuarantineOnDelete(map[string]string{shareOnDeleteMetadataKey: shareOnDeleteDelete}))
+	assert.True(t, d.isQuarantineOnDelete(map[string]string{shareOnDeleteMetadataKey: "Quarantine"}))
+	d.quarantineDeletedShares = true
+	assert.True(t, d.isQuarantineOnDelete(nil))
+}
+
+func TestGetQuarantineTime(t *testing.T) {
+	quarantinedAt := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc                string
+		metadata            map[string]string
+		expectedTime        time.Time
+		expectedQuarantined bool
+		expectedErr         bool
+	}{
+		{
+			desc:     "not quarantined",
+			metadata: map[string]string{createdByMetadataKey: "driver"},
+		},
+		{
+			desc:                "quarantined",
+			metadata:            map[string]string{quarantinedAtMetadataKey: "2022-05-01T10:00:00Z"},
+			expectedTime:        quarantinedAt,
+			expectedQuarantined: true,
+		},
+		{
+			desc:                "invalid quarantine time",
+			metadata:            map[string]string{quarantinedAtMetadataKey: "invalid"},
+			expectedQuarantined: true,
+			expectedErr:         true,
+		},
+	}
+
+	for _, test := range tests {
+		result, quarantined, err := getQuarantineTime(test.metadata)
+		if !result.Equal(test.expectedTime) || quarantined != test.expectedQuarantined || (err != nil) != test.expectedErr {
+			t.Errorf("test[%s]: getQuarantineTime returned with: %v, %v, %v", test.desc, result, quarantined, err)
+		}
+	}
+}
+
+func TestQuarantineFileShare(t *testing.T) {
+	d := NewFakeDriver()
+	err := d.quarantineFileShare(context.Background(), "account", "invalid key", "core.windows.net", "share", time.Now())
+	assert.Error(t, err)
+	err = d.unquarantineFileShare(context.Background(), "account", "invalid key", "core.windows.net", "share")
+	assert.Error(t, err)
+	_, err = d.isFileShareQuarantined(context.Background(), "account", "invalid key", "core.windows.net", "share")
+	assert.Error(t, err)
+}
+
+func TestReapQuarantinedFileShares(t *testing.T) {
+	name := "account"
+	tests := []struct {
+		desc        string
+		accounts    []storage.Account
+		rerr        *retry.Error
+		expectedErr error
+	}{
+		{
+			desc:        "failed to list storage accounts",
+			rerr:        &retry.Error{HTTPStatusCode: http.StatusInternalServerError, RawError: fmt.Errorf("test error")},
+			expectedErr: status.Errorf(codes.Internal, "failed to list storage accounts: Retriable: false, RetryAfter: 0s, HTTPStatusCode: 500, RawError: test error"),
+		},
+		{
+			desc:     "no storage account created by driver",
+			accounts: []storage.Account{{Name: &name}},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		ctrl := gomock.NewController(t)
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(test.accounts, test.rerr).Times(1)
+
+		err := d.reapQuarantinedFileShares(context.Background(), time.Now())
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		ctrl.Finish()
+	}
+}
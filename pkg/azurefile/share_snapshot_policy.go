@@ -0,0 +1,212 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// actions taken on file share with snapshots when volume is deleted
+	snapshotOnDeleteRefuse = "refuse"
+	snapshotOnDeleteDelete = "delete"
+	snapshotOnDeleteRetain = "retain"
+
+	// key of the time when volume is deleted in metadata of file share retained for its snapshots
+	retainedAtMetadataKey = "retainedat"
+
+	// Lease Share is not supported by azfile
+	// See https://docs.microsoft.com/en-us/rest/api/storageservices/lease-share
+	leaseActionAcquire  = "acquire"
+	leaseActionBreak    = "break"
+	leaseAlreadyPresent = "LeaseAlreadyPresent"
+	leaseNotPresent     = "LeaseNotPresentWithLeaseOperation"
+)
+
+var supportedSnapshotOnDeleteList = []string{snapshotOnDeleteRefuse, snapshotOnDeleteDelete, snapshotOnDeleteRetain}
+
+func isSupportedSnapshotOnDelete(onDelete string) bool {
+	if onDelete == "" {
+		return true
+	}
+	for _, v := range supportedSnapshotOnDeleteList {
+		if strings.EqualFold(onDelete, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// countShareSnapshots returns the number of snapshots of file share
+func countShareSnapshots(ctx context.Context, serviceURL *azfile.ServiceURL, fileShareName string) (int, error) {
+	var count int
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		listResp, err := serviceURL.ListSharesSegment(ctx, marker, azfile.ListSharesOptions{Prefix: fileShareName, Detail: azfile.ListSharesDetail{Snapshots: true}})
+		if err != nil {
+			return 0, err
+		}
+		marker = listResp.NextMarker
+		for _, share := range listResp.ShareItems {
+			if share.Name == fileShareName && share.Snapshot != nil {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// leaseFileShare acquires an infinite lease on file share or breaks it immediately,
+// it's idempotent that acquiring an existing lease or breaking a non-existing lease also succeeds
+func (d *Driver) leaseFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, action string) error {
+	headers := map[string]string{"x-ms-lease-action": action}
+	expectedStatusCode, ignoredErrorCode := http.StatusCreated, leaseAlreadyPresent
+	if action == leaseActionBreak {
+		headers["x-ms-lease-break-period"] = "0"
+		expectedStatusCode, ignoredErrorCode = http.StatusAccepted, leaseNotPresent
+	} else {
+		headers["x-ms-lease-duration"] = "-1"
+	}
+	query := url.Values{"comp": {"lease"}, "restype": {"share"}}
+	resp, err := d.fileClient.sendFileServiceRequest(ctx, accountName, accountKey, storageEndpointSuffix, http.MethodPut, fileShareName, query, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	errorCode := resp.Header.Get("x-ms-error-code")
+	if resp.StatusCode != expectedStatusCode && errorCode != ignoredErrorCode {
+		return fmt.Errorf("lease action(%s) on file share(%s) returned with status code(%d), error code(%s)", action, fileShareName, resp.StatusCode, errorCode)
+	}
+	return nil
+}
+
+// retainFileShare tags file share with the time when volume is deleted and leases it,
+// so that file share and its snapshots could not be deleted until all snapshots are deleted by DeleteSnapshot
+func (d *Driver) retainFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName string, now time.Time) error {
+	shareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return err
+	}
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		return err
+	}
+	metadata := properties.NewMetadata()
+	if _, ok := metadata[retainedAtMetadataKey]; !ok {
+		metadata[retainedAtMetadataKey] = now.UTC().Format(time.RFC3339)
+		if _, err := shareURL.SetMetadata(ctx, metadata); err != nil {
+			return err
+		}
+	}
+	return d.leaseFileShare(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName, leaseActionAcquire)
+}
+
+// applySnapshotOnDelete handles file share with snapshots according to snapshotOnDelete kept in file share metadata in DeleteVolume,
+// true is returned if file share is already deleted or retained, otherwise file share should be deleted as usual
+func (d *Driver) applySnapshotOnDelete(ctx context.Context, volumeID string, h *VolumeHandle, onDelete string, secrets map[string]string) (bool, error) {
+	reqContext := map[string]string{}
+	if h.SecretNamespace != "" {
+		setKeyValueInMap(reqContext, secretNamespaceField, h.SecretNamespace)
+	}
+	_, accountKey, err := d.GetAccountInfo(ctx, volumeID, secrets, reqContext)
+	if err != nil {
+		return false, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
+	}
+	storageEndpointSuffix := d.getStorageEndpointSuffix(h)
+	serviceURL, err := d.fileClient.getServiceURL(h.AccountName, accountKey, storageEndpointSuffix)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	onDelete = strings.ToLower(onDelete)
+	if onDelete == snapshotOnDeleteDelete {
+		if _, err := serviceURL.NewShareURL(h.FileShareName).Delete(ctx, azfile.DeleteSnapshotsOptionInclude); err != nil && !isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+			return false, status.Errorf(codes.Internal, "failed to delete file share(%s) with its snapshots under account(%s): %v", h.FileShareName, h.AccountName, err)
+		}
+		klog.V(2).Infof("file share(%s) under account(%s) is deleted with its snapshots", h.FileShareName, h.AccountName)
+		return true, nil
+	}
+
+	count, err := countShareSnapshots(ctx, serviceURL, h.FileShareName)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "failed to list snapshots of file share(%s) under account(%s): %v", h.FileShareName, h.AccountName, err)
+	}
+	if count == 0 {
+		return false, nil
+	}
+	switch onDelete {
+	case snapshotOnDeleteRefuse:
+		return false, status.Errorf(codes.FailedPrecondition, "file share(%s) under account(%s) has %d snapshots, delete its VolumeSnapshots first", h.FileShareName, h.AccountName, count)
+	case snapshotOnDeleteRetain:
+		if err := d.retainFileShare(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, time.Now()); err != nil {
+			return false, status.Errorf(codes.Internal, "failed to retain file share(%s) under account(%s): %v", h.FileShareName, h.AccountName, err)
+		}
+		klog.V(2).Infof("file share(%s) under account(%s) is retained with its %d snapshots", h.FileShareName, h.AccountName, count)
+		return true, nil
+	}
+	return false, nil
+}
+
+// deleteRetainedFileShare deletes file share retained by DeleteVolume after its last snapshot is deleted
+func (d *Driver) deleteRetainedFileShare(ctx context.Context, volumeID string, h *VolumeHandle, secrets map[string]string) error {
+	reqContext := map[string]string{}
+	if h.SecretNamespace != "" {
+		setKeyValueInMap(reqContext, secretNamespaceField, h.SecretNamespace)
+	}
+	_, accountKey, err := d.GetAccountInfo(ctx, volumeID, secrets, reqContext)
+	if err != nil {
+		return err
+	}
+	storageEndpointSuffix := d.getStorageEndpointSuffix(h)
+	serviceURL, err := d.fileClient.getServiceURL(h.AccountName, accountKey, storageEndpointSuffix)
+	if err != nil {
+		return err
+	}
+	shareURL := serviceURL.NewShareURL(h.FileShareName)
+	properties, err := shareURL.GetProperties(ctx)
+	if err != nil {
+		if isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := properties.NewMetadata()[retainedAtMetadataKey]; !ok {
+		// volume is not deleted yet
+		return nil
+	}
+	count, err := countShareSnapshots(ctx, serviceURL, h.FileShareName)
+	if err != nil || count > 0 {
+		return err
+	}
+	if err := d.leaseFileShare(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, leaseActionBreak); err != nil {
+		return err
+	}
+	if _, err := shareURL.Delete(ctx, azfile.DeleteSnapshotsOptionNone); err != nil && !isStorageErrorWithStatusCode(err, http.StatusNotFound) {
+		return err
+	}
+	klog.V(2).Infof("retained file share(%s) under account(%s) is deleted after its last snapshot is deleted", h.FileShareName, h.AccountName)
+	return nil
+}
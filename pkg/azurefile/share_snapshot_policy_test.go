@@ -0,0 +1,47 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSupportedSnapshotOnDelete(t *testing.T) {
+	assert.True(t, isSupportedSnapshotOnDelete(""))
+	assert.True(t, isSupportedSnapshotOnDelete("Refuse"))
+	assert.True(t, isSupportedSnapshotOnDelete(snapshotOnDeleteDelete))
+	assert.True(t, isSupportedSnapshotOnDelete(snapshotOnDeleteRetain))
+	assert.False(t, isSupportedSnapshotOnDelete("quarantine"))
+}
+
+func TestLeaseFileShare(t *testing.T) {
+	d := NewFakeDriver()
+	err := d.leaseFileShare(context.Background(), "account", "invalid key", "core.windows.net", "share", leaseActionAcquire)
+	assert.Error(t, err)
+	err = d.leaseFileShare(context.Background(), "account", "invalid key", "core.windows.net", "share", leaseActionBreak)
+	assert.Error(t, err)
+}
+
+func TestRetainFileShare(t *testing.T) {
+	d := NewFakeDriver()
+	err := d.retainFileShare(context.Background(), "account", "invalid key", "core.windows.net", "share", time.Now())
+	assert.Error(t, err)
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// actions taken in CreateVolume when a soft-deleted file share with the same name exists
+	softDeletedShareWait    = "wait"
+	softDeletedShareRestore = "restore"
+	softDeletedShareRename  = "rename"
+)
+
+var supportedSoftDeletedShareActionList = []string{softDeletedShareWait, softDeletedShareRestore, softDeletedShareRename}
+
+// deletedShare is a soft-deleted version of file share
+type deletedShare struct {
+	Name        string
+	Version     string
+	DeletedTime time.Time
+}
+
+// listSharesResult is the response of List Shares with deleted file shares
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/list-shares
+type listSharesResult struct {
+	Shares []struct {
+		Name       string `xml:"Name"`
+		Snapshot   string `xml:"Snapshot"`
+		Deleted    bool   `xml:"Deleted"`
+		Version    string `xml:"Version"`
+		Properties struct {
+			DeletedTime string `xml:"DeletedTime"`
+		} `xml:"Properties"`
+	} `xml:"Shares>Share"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// deletedShares returns soft-deleted versions of file share in the result
+func (r *listSharesResult) deletedShares(fileShareName string) []deletedShare {
+	deleted := []deletedShare{}
+	for _, share := range r.Shares {
+		if share.Name != fileShareName || !share.Deleted || share.Snapshot != "" {
+			continue
+		}
+		// deleted time is only used for ordering, it's zero if not parsable
+		deletedTime, _ := time.Parse(time.RFC1123, share.Properties.DeletedTime)
+		deleted = append(deleted, deletedShare{Name: share.Name, Version: share.Version, DeletedTime: deletedTime})
+	}
+	return deleted
+}
+
+func isSupportedSoftDeletedShareAction(action string) bool {
+	if action == "" {
+		return true
+	}
+	for _, v := range supportedSoftDeletedShareActionList {
+		if strings.EqualFold(action, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// listDeletedFileShares returns soft-deleted versions of file share, the latest deleted version is the first one
+func (d *Driver) listDeletedFileShares(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName string) ([]deletedShare, error) {
+	deleted := []deletedShare{}
+	for marker := ""; ; {
+		query := url.Values{"comp": {"list"}, "include": {"deleted"}, "prefix": {fileShareName}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := d.fileClient.sendFileServiceRequest(ctx, accountName, accountKey, storageEndpointSuffix, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listSharesResult
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("list deleted file shares returned with status code(%d), error code(%s)", resp.StatusCode, resp.Header.Get("x-ms-error-code"))
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, result.deletedShares(fileShareName)...)
+		if marker = result.NextMarker; marker == "" {
+			break
+		}
+	}
+	sort.SliceStable(deleted, func(i, j int) bool {
+		return deleted[i].DeletedTime.After(deleted[j].DeletedTime)
+	})
+	return deleted, nil
+}
+
+// undeleteFileShare restores a soft-deleted version of file share, false is returned if a file share with the same name already exists
+func (d *Driver) undeleteFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix string, share deletedShare) (bool, error) {
+	query := url.Values{"comp": {"undelete"}, "restype": {"share"}}
+	headers := map[string]string{
+		"x-ms-deleted-share-name":    share.Name,
+		"x-ms-deleted-share-version": share.Version,
+	}
+	resp, err := d.fileClient.sendFileServiceRequest(ctx, accountName, accountKey, storageEndpointSuffix, http.MethodPut, share.Name, query, headers)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	errorCode := resp.Header.Get(errorCodeHeader)
+	switch {
+	case resp.StatusCode == http.StatusCreated:
+		return true, nil
+	case errorCode == shareAlreadyExists:
+		return false, nil
+	}
+	return false, fmt.Errorf("undelete file share(%s) version(%s) returned with status code(%d), error code(%s)", share.Name, share.Version, resp.StatusCode, errorCode)
+}
+
+// restoreSoftDeletedFileShare restores the latest soft-deleted version of file share,
+// false is returned if there is no soft-deleted version or a file share with the same name already exists
+func (d *Driver) restoreSoftDeletedFileShare(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName string) (bool, error) {
+	deleted, err := d.listDeletedFileShares(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return false, fmt.Errorf("failed to list soft-deleted file share(%s) on account(%s): %v", fileShareName, accountName, err)
+	}
+	if len(deleted) == 0 {
+		return false, nil
+	}
+	restored, err := d.undeleteFileShare(ctx, accountName, accountKey, storageEndpointSuffix, deleted[0])
+	if err != nil {
+		return false, err
+	}
+	if restored {
+		klog.V(2).Infof("soft-deleted file share(%s) version(%s) on account(%s) is restored", fileShareName, deleted[0].Version, accountName)
+	}
+	return restored, nil
+}
+
+// getRenamedFileShareName returns a new file share name to avoid the soft-deleted file share with the same name,
+// the new name is derived from the deleted version so that retried CreateVolume gets the same name
+func getRenamedFileShareName(fileShareName string, share deletedShare) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(share.Version))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	if len(fileShareName)+len(suffix) > fileShareNameMaxLength {
+		fileShareName = strings.TrimSuffix(fileShareName[:fileShareNameMaxLength-len(suffix)], "-")
+	}
+	return fileShareName + suffix
+}
+
+// handleSoftDeletedFileShare applies action on the soft-deleted file share with the same name in CreateVolume,
+// the file share name to be created and whether the file share is restored are returned
+func (d *Driver) handleSoftDeletedFileShare(ctx context.Context, action, accountName, accountKey, storageEndpointSuffix, fileShareName string) (string, bool, error) {
+	if action == "" || strings.EqualFold(action, softDeletedShareWait) {
+		return fileShareName, false, nil
+	}
+	shareURL, err := d.fileClient.getShareURL(accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := shareURL.GetProperties(ctx); err == nil {
+		// soft-deleted versions are not relevant if file share already exists
+		return fileShareName, false, nil
+	}
+	if strings.EqualFold(action, softDeletedShareRestore) {
+		restored, err := d.restoreSoftDeletedFileShare(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName)
+		return fileShareName, restored, err
+	}
+	deleted, err := d.listDeletedFileShares(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to list soft-deleted file share(%s) on account(%s): %v", fileShareName, accountName, err)
+	}
+	if len(deleted) == 0 {
+		return fileShareName, false, nil
+	}
+	newName := getRenamedFileShareName(fileShareName, deleted[0])
+	klog.V(2).Infof("file share(%s) on account(%s) is soft-deleted, use new name(%s) instead", fileShareName, accountName, newName)
+	return newName, false, nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSupportedSoftDeletedShareAction(t *testing.T) {
+	assert.True(t, isSupportedSoftDeletedShareAction(""))
+	assert.True(t, isSupportedSoftDeletedShareAction("Restore"))
+	assert.True(t, isSupportedSoftDeletedShareAction(softDeletedShareWait))
+	assert.True(t, isSupportedSoftDeletedShareAction(softDeletedShareRename))
+	assert.False(t, isSupportedSoftDeletedShareAction("delete"))
+}
+
+func TestListSharesResultDeletedShares(t *testing.T) {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ServiceEndpoint="https://account.file.core.windows.net/">
+  <Prefix>pvc-share</Prefix>
+  <Shares>
+    <Share>
+      <Name>pvc-share</Name>
+      <Properties><Quota>100</Quota></Properties>
+    </Share>
+    <Share>
+      <Name>pvc-share</Name>
+      <Deleted>true</Deleted>
+      <Version>01D8F6C6A0E4F4F1</Version>
+      <Properties><DeletedTime>Mon, 02 May 2022 10:00:00 GMT</DeletedTime><RemainingRetentionDays>6</RemainingRetentionDays></Properties>
+    </Share>
+    <Share>
+      <Name>pvc-share</Name>
+      <Snapshot>2022-05-01T10:00:00.0000000Z</Snapshot>
+      <Deleted>true</Deleted>
+      <Version>01D8F6C6A0E4F4F2</Version>
+    </Share>
+    <Share>
+      <Name>pvc-share-2</Name>
+      <Deleted>true</Deleted>
+      <Version>01D8F6C6A0E4F4F3</Version>
+    </Share>
+  </Shares>
+  <NextMarker />
+</EnumerationResults>`
+	var result listSharesResult
+	if err := xml.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatalf("failed to unmarshal list shares result: %v", err)
+	}
+	expected := []deletedShare{
+		{Name: "pvc-share", Version: "01D8F6C6A0E4F4F1", DeletedTime: time.Date(2022, 5, 2, 10, 0, 0, 0, time.UTC)},
+	}
+	deleted := result.deletedShares("pvc-share")
+	if len(deleted) != 1 || deleted[0].Name != expected[0].Name || deleted[0].Version != expected[0].Version || !deleted[0].DeletedTime.Equal(expected[0].DeletedTime) {
+		t.Errorf("deletedShares returned with: %+v, expected: %+v", deleted, expected)
+	}
+	assert.Equal(t, "", result.NextMarker)
+}
+
+func TestGetRenamedFileShareName(t *testing.T) {
+	share := deletedShare{Name: "pvc-share", Version: "01D8F6C6A0E4F4F1"}
+	name := getRenamedFileShareName("pvc-share", share)
+	assert.True(t, strings.HasPrefix(name, "pvc-share-"))
+	assert.Equal(t, name, getRenamedFileShareName("pvc-share", share))
+	assert.NotEqual(t, name, getRenamedFileShareName("pvc-share", deletedShare{Name: "pvc-share", Version: "01D8F6C6A0E4F4F2"}))
+
+	// trailing hyphen of the truncated name is trimmed
+	name = getRenamedFileShareName(strings.Repeat("a", 53)+"-"+strings.Repeat("b", 9), share)
+	assert.Equal(t, 62, len(name))
+	assert.False(t, strings.Contains(name, "--"))
+}
+
+func TestHandleSoftDeletedFileShare(t *testing.T) {
+	d := NewFakeDriver()
+	tests := []struct {
+		desc             string
+		action           string
+		expectedName     string
+		expectedRestored bool
+		expectedErr      bool
+	}{
+		{
+			desc:         "no action",
+			expectedName: "share",
+		},
+		{
+			desc:         "wait",
+			action:       softDeletedShareWait,
+			expectedName: "share",
+		},
+		{
+			desc:        "restore with invalid account key",
+			action:      softDeletedShareRestore,
+			expectedErr: true,
+		},
+		{
+			desc:        "rename with invalid account key",
+			action:      softDeletedShareRename,
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		name, restored, err := d.handleSoftDeletedFileShare(context.Background(), test.action, "account", "invalid key", "core.windows.net", "share")
+		if !reflect.DeepEqual(name, test.expectedName) || restored != test.expectedRestored || (err != nil) != test.expectedErr {
+			t.Errorf("test[%s]: handleSoftDeletedFileShare returned with: %s, %v, %v", test.desc, name, restored, err)
+		}
+	}
+}
+
+func TestRestoreSoftDeletedFileShare(t *testing.T) {
+	d := NewFakeDriver()
+	_, err := d.restoreSoftDeletedFileShare(context.Background(), "account", "invalid key", "core.windows.net", "share")
+	assert.Error(t, err)
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// timeout of checking whether staged mount is accessible, stat on a broken cifs mount may hang
+	stagedMountCheckTimeout = 10 * time.Second
+
+	// last element of staging path created by kubelet
+	stagingPathBase = "globalmount"
+)
+
+// errStatPending is returned if previous stat on the path is not returned yet
+var errStatPending = errors.New("previous stat is still pending")
+
+// stagedMount is a cifs mount of file share staged by NodeStageVolume,
+// it's remounted with refreshed account key if authentication fails after account key rotation
+type stagedMount struct {
+	volumeID     string
+	source       string
+	mountPath    string
+	mountOptions []string
+	accountName  string
+	accountKey   string
+	// secrets of NodeStageVolume request, which are read from nodeStageSecretRef of pv
+	secrets       map[string]string
+	volumeContext map[string]string
+}
+
+// sensitiveMountOptions returns the cifs mount options with credentials of staged mount
+func (m *stagedMount) sensitiveMountOptions() []string {
+	return []string{fmt.Sprintf("username=%s,password=%s", m.accountName, m.accountKey)}
+}
+
+// checkStagedMounts remounts staged mounts which fail with authentication error using refreshed account key
+func (d *Driver) checkStagedMounts(ctx context.Context) {
+	d.stagedMounts.Range(func(key, value interface{}) bool {
+		m := value.(*stagedMount)
+		err := statWithTimeout(m.mountPath, stagedMountCheckTimeout, &d.pendingStagedMountStats)
+		if errors.Is(err, errStatPending) {
+			klog.V(4).Infof("skip checking staged mount(%s) of volume(%s): %v", m.mountPath, m.volumeID, err)
+			return true
+		}
+		if err == nil || !isSMBAuthError(err) {
+			return true
+		}
+		klog.Warningf("staged mount(%s) of volume(%s) failed with error(%v), refresh account key and remount", m.mountPath, m.volumeID, err)
+		if err := d.remountStagedMount(ctx, m); err != nil {
+			klog.Errorf("failed to remount staged mount(%s) of volume(%s): %v", m.mountPath, m.volumeID, err)
+		}
+		return true
+	})
+}
+
+// remountStagedMount remounts staged mount in place with refreshed account key, so that pods using
+// the volume don't need to be restarted, nothing is done if account key is not changed
+func (d *Driver) remountStagedMount(ctx context.Context, m *stagedMount) error {
+	if acquired := d.volumeLocks.TryAcquire(m.volumeID); !acquired {
+		// stage or unstage is in progress, check in next round
+		return nil
+	}
+	defer d.volumeLocks.Release(m.volumeID)
+
+	accountKey, err := d.refreshAccountKey(ctx, m)
+	if err != nil {
+		return err
+	}
+	// account key of staged mount restored after driver restart is unknown, which is always remounted
+	if accountKey == m.accountKey {
+		klog.V(2).Infof("account key of volume(%s) is not changed, skip remounting %s", m.volumeID, m.mountPath)
+		return nil
+	}
+	remounted := *m
+	remounted.accountKey = accountKey
+	if err := SMBRemount(d.mounter, m.source, m.mountPath, m.mountOptions, remounted.sensitiveMountOptions()); err != nil {
+		return err
+	}
+	klog.V(2).Infof("volume(%s) is remounted on %s with refreshed account key", m.volumeID, m.mountPath)
+	d.stagedMounts.Store(m.volumeID, &remounted)
+	return nil
+}
+
+// refreshAccountKey reads account key of staged mount from k8s secret or with cluster identity again, bypassing key cache
+func (d *Driver) refreshAccountKey(ctx context.Context, m *stagedMount) (string, error) {
+	if err := d.accountCacheMap.Delete(m.accountName); err != nil {
+		return "", err
+	}
+	secrets := m.secrets
+	if len(secrets) > 0 {
+		var err error
+		if secrets, err = d.getNodeStageSecrets(ctx, m.volumeID); err != nil {
+			return "", err
+		}
+	}
+	_, accountKey, err := d.GetAccountInfo(ctx, m.volumeID, secrets, m.volumeContext)
+	if err != nil {
+		return "", err
+	}
+	if accountKey == "" {
+		return "", fmt.Errorf("account key of volume(%s) is empty", m.volumeID)
+	}
+	return accountKey, nil
+}
+
+// getNodeStageSecrets returns the secret referenced by nodeStageSecretRef of pv with volumeID
+func (d *Driver) getNodeStageSecrets(ctx context.Context, volumeID string) (map[string]string, error) {
+	if d.cloud.KubeClient == nil {
+		return nil, fmt.Errorf("could not get node stage secret of volume(%s): KubeClient is nil", volumeID)
+	}
+	pvList, err := d.cloud.KubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	for _, pv := range pvList.Items {
+		source := pv.Spec.CSI
+		if source == nil || source.Driver != d.Name || source.VolumeHandle != volumeID || source.NodeStageSecretRef == nil {
+			continue
+		}
+		return d.getSecretData(ctx, source.NodeStageSecretRef)
+	}
+	return nil, fmt.Errorf("node stage secret of volume(%s) is not found", volumeID)
+}
+
+// getSecretData returns data of the secret referenced by ref
+func (d *Driver) getSecretData(ctx context.Context, ref *v1.SecretReference) (map[string]string, error) {
+	secret, err := d.cloud.KubeClient.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get secret(%s/%s): %v", ref.Namespace, ref.Name, err)
+	}
+	secrets := map[string]string{}
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	return secrets, nil
+}
+
+// restoreStagedMounts restores staged mounts of pvs after driver restart, cifs mounts in mount table are matched with
+// staging path of pvs created by kubelet, which is {kubelet dir}/plugins/kubernetes.io/csi/{driver name}/{sha256 of volume handle}/globalmount
+// since k8s 1.24 and {kubelet dir}/plugins/kubernetes.io/csi/pv/{pv name}/globalmount before, proxy-mount is used instead of globalmount
+// for vhd disk
+func (d *Driver) restoreStagedMounts(ctx context.Context) error {
+	if d.cloud.KubeClient == nil {
+		return fmt.Errorf("KubeClient is nil")
+	}
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return fmt.Errorf("failed to list mount points: %v", err)
+	}
+	pvList, err := d.cloud.KubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	// pvs by the last two elements of staging directory
+	pvs := map[string]*v1.PersistentVolume{}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != d.Name {
+			continue
+		}
+		pvs[filepath.Join(d.Name, fmt.Sprintf("%x", sha256.Sum256([]byte(pv.Spec.CSI.VolumeHandle))))] = pv
+		pvs[filepath.Join("pv", pv.Name)] = pv
+	}
+
+	for _, mp := range mountPoints {
+		if mp.Type != cifs {
+			continue
+		}
+		if base := filepath.Base(mp.Path); base != stagingPathBase && base != proxyMount {
+			continue
+		}
+		stagingDir := filepath.Dir(mp.Path)
+		pv, ok := pvs[filepath.Join(filepath.Base(filepath.Dir(stagingDir)), filepath.Base(stagingDir))]
+		if !ok {
+			continue
+		}
+		if err := d.restoreStagedMount(ctx, pv, mp); err != nil {
+			klog.Warningf("failed to restore staged mount(%s) of volume(%s): %v", mp.Path, pv.Spec.CSI.VolumeHandle, err)
+		}
+	}
+	return nil
+}
+
+// restoreStagedMount restores staged mount of pv from mount point, the mount point is skipped if volume is staged again
+// or stage or unstage is in progress
+func (d *Driver) restoreStagedMount(ctx context.Context, pv *v1.PersistentVolume, mp mount.MountPoint) error {
+	volumeID := pv.Spec.CSI.VolumeHandle
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	var secrets map[string]string
+	if ref := pv.Spec.CSI.NodeStageSecretRef; ref != nil {
+		var err error
+		if secrets, err = d.getSecretData(ctx, ref); err != nil {
+			return err
+		}
+	}
+	m := &stagedMount{
+		volumeID:  volumeID,
+		source:    mp.Device,
+		mountPath: mp.Path,
+		// account name is the first element of host name in source, e.g. //account.file.core.windows.net/share
+		accountName:   strings.SplitN(strings.TrimPrefix(mp.Device, "//"), ".", 2)[0],
+		secrets:       secrets,
+		volumeContext: pv.Spec.CSI.VolumeAttributes,
+	}
+	// options of current mount are kept on remount, credentials are passed by sensitive mount options
+	for _, opt := range mp.Opts {
+		if !strings.HasPrefix(opt, "username=") && !strings.HasPrefix(opt, "password=") {
+			m.mountOptions = append(m.mountOptions, opt)
+		}
+	}
+	if _, loaded := d.stagedMounts.LoadOrStore(volumeID, m); !loaded {
+		klog.V(2).Infof("staged mount(%s) of volume(%s) is restored", mp.Path, volumeID)
+	}
+	return nil
+}
+
+// statWithTimeout returns error of os.Stat on path, or error if it does not return within timeout,
+// stat is not started again on path whose previous stat is still pending, so that goroutines blocked
+// on a hung mount are not accumulated
+func statWithTimeout(path string, timeout time.Duration, pending *sync.Map) error {
+	if _, loaded := pending.LoadOrStore(path, struct{}{}); loaded {
+		return errStatPending
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(path)
+		pending.Delete(path)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("stat %s timed out after %v", path, timeout)
+	}
+}
+
+// runStagedMountChecker checks staged mounts periodically until stopCh is closed
+func (d *Driver) runStagedMountChecker(interval time.Duration, stopCh <-chan struct{}) {
+	klog.V(2).Infof("starting staged mount checker with interval(%v)", interval)
+	if err := d.restoreStagedMounts(context.Background()); err != nil {
+		klog.Errorf("failed to restore staged mounts: %v", err)
+	}
+	wait.Until(func() {
+		d.checkStagedMounts(context.Background())
+	}, interval, stopCh)
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	mount "k8s.io/mount-utils"
+)
+
+func TestGetNodeStageSecrets(t *testing.T) {
+	d := NewFakeDriver()
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:             d.Name,
+					VolumeHandle:       "rg#account#share",
+					NodeStageSecretRef: &v1.SecretReference{Name: "secret", Namespace: "ns"},
+				},
+			},
+		},
+	}
+	_, err := clientSet.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	_, err = d.getNodeStageSecrets(context.TODO(), "rg#account#share")
+	assert.Equal(t, fmt.Errorf("could not get secret(ns/secret): secrets \"secret\" not found"), err)
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "ns"},
+		Data:       map[string][]byte{defaultSecretAccountName: []byte("account"), defaultSecretAccountKey: []byte("key")},
+	}
+	_, err = clientSet.CoreV1().Secrets("ns").Create(context.TODO(), secret, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	secrets, err := d.getNodeStageSecrets(context.TODO(), "rg#account#share")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{defaultSecretAccountName: "account", defaultSecretAccountKey: "key"}, secrets)
+
+	_, err = d.getNodeStageSecrets(context.TODO(), "rg#account#share2")
+	assert.Equal(t, fmt.Errorf("node stage secret of volume(rg#account#share2) is not found"), err)
+}
+
+func TestRemountStagedMount(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("remount is only supported on linux")
+	}
+	d := NewFakeDriver()
+	fakeMounter := mount.NewFakeMounter(nil)
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+	volumeID := "rg#account#share"
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:             d.Name,
+					VolumeHandle:       volumeID,
+					NodeStageSecretRef: &v1.SecretReference{Name: "secret", Namespace: "ns"},
+				},
+			},
+		},
+	}
+	_, err := clientSet.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "ns"},
+		Data:       map[string][]byte{defaultSecretAccountName: []byte("account"), defaultSecretAccountKey: []byte("key")},
+	}
+	_, err = clientSet.CoreV1().Secrets("ns").Create(context.TODO(), secret, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	m := &stagedMount{
+		volumeID:    volumeID,
+		source:      "//account.file.core.windows.net/share",
+		mountPath:   "/staging",
+		accountName: "account",
+		accountKey:  "key",
+		secrets:     map[string]string{defaultSecretAccountName: "account", defaultSecretAccountKey: "key"},
+	}
+	d.stagedMounts.Store(volumeID, m)
+
+	// account key is not changed
+	assert.NoError(t, d.remountStagedMount(context.TODO(), m))
+	assert.Empty(t, fakeMounter.GetLog())
+
+	// stage or unstage is in progress
+	secret.Data[defaultSecretAccountKey] = []byte("newkey")
+	_, err = clientSet.CoreV1().Secrets("ns").Update(context.TODO(), secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	d.volumeLocks.TryAcquire(volumeID)
+	assert.NoError(t, d.remountStagedMount(context.TODO(), m))
+	assert.Empty(t, fakeMounter.GetLog())
+	d.volumeLocks.Release(volumeID)
+
+	// remounted with refreshed account key
+	assert.NoError(t, d.remountStagedMount(context.TODO(), m))
+	assert.Equal(t, []mount.FakeAction{{Action: mount.FakeActionMount, Target: "/staging", Source: m.source, FSType: cifs}}, fakeMounter.GetLog())
+	value, ok := d.stagedMounts.Load(volumeID)
+	assert.True(t, ok)
+	assert.Equal(t, "newkey", value.(*stagedMount).accountKey)
+}
+
+func TestStatWithTimeout(t *testing.T) {
+	dir := t.TempDir()
+	pending := &sync.Map{}
+
+	assert.NoError(t, statWithTimeout(dir, time.Second, pending))
+	_, ok := pending.Load(dir)
+	assert.False(t, ok)
+
+	// stat is not started again on path whose previous stat is pending
+	pending.Store(dir, struct{}{})
+	assert.Equal(t, errStatPending, statWithTimeout(dir, time.Second, pending))
+}
+
+func TestRestoreStagedMounts(t *testing.T) {
+	d := NewFakeDriver()
+	stagingDir := "/var/lib/kubelet/plugins/kubernetes.io/csi"
+	newPV := func(name, volumeHandle string, secretRef *v1.SecretReference) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{
+						Driver:             d.Name,
+						VolumeHandle:       volumeHandle,
+						VolumeAttributes:   map[string]string{shareNameField: "share"},
+						NodeStageSecretRef: secretRef,
+					},
+				},
+			},
+		}
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "ns"},
+		Data:       map[string][]byte{defaultSecretAccountName: []byte("account2"), defaultSecretAccountKey: []byte("key")},
+	}
+	d.cloud.KubeClient = fake.NewSimpleClientset(
+		newPV("pv1", "rg#account1#share1", nil),
+		newPV("pv2", "rg#account2#share2", &v1.SecretReference{Name: "secret", Namespace: "ns"}),
+		newPV("pv3", "rg#account3#share3", &v1.SecretReference{Name: "notfound", Namespace: "ns"}),
+		newPV("pv4", "rg#account4#share4", nil),
+		secret,
+	)
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{
+		// staging path since k8s 1.24
+		{
+			Device: "//account1.file.core.windows.net/share1",
+			Path:   filepath.Join(stagingDir, d.Name, fmt.Sprintf("%x", sha256.Sum256([]byte("rg#account1#share1"))), stagingPathBase),
+			Type:   cifs,
+			Opts:   []string{"rw", "vers=3.0", "username=account1"},
+		},
+		// staging path before k8s 1.24 with vhd disk
+		{
+			Device: "//account2.file.core.windows.net/share2",
+			Path:   filepath.Join(stagingDir, "pv", "pv2", proxyMount),
+			Type:   cifs,
+		},
+		// secret not found
+		{
+			Device: "//account3.file.core.windows.net/share3",
+			Path:   filepath.Join(stagingDir, "pv", "pv3", stagingPathBase),
+			Type:   cifs,
+		},
+		// not cifs mount
+		{
+			Device: "account4.file.core.windows.net:/account4/share4",
+			Path:   filepath.Join(stagingDir, "pv", "pv4", stagingPathBase),
+			Type:   "nfs",
+		},
+		// not staging path of any pv
+		{
+			Device: "//account5.file.core.windows.net/share5",
+			Path:   filepath.Join(stagingDir, "pv", "pv5", stagingPathBase),
+			Type:   cifs,
+		},
+	})}
+	// volume staged again is not overwritten
+	staged := &stagedMount{volumeID: "rg#account4#share4", accountKey: "key"}
+	d.stagedMounts.Store(staged.volumeID, staged)
+
+	assert.NoError(t, d.restoreStagedMounts(context.TODO()))
+	restored := map[string]*stagedMount{}
+	d.stagedMounts.Range(func(key, value interface{}) bool {
+		restored[key.(string)] = value.(*stagedMount)
+		return true
+	})
+	assert.Equal(t, map[string]*stagedMount{
+		"rg#account1#share1": {
+			volumeID:      "rg#account1#share1",
+			source:        "//account1.file.core.windows.net/share1",
+			mountPath:     filepath.Join(stagingDir, d.Name, fmt.Sprintf("%x", sha256.Sum256([]byte("rg#account1#share1"))), stagingPathBase),
+			mountOptions:  []string{"rw", "vers=3.0"},
+			accountName:   "account1",
+			volumeContext: map[string]string{shareNameField: "share"},
+		},
+		"rg#account2#share2": {
+			volumeID:      "rg#account2#share2",
+			source:        "//account2.file.core.windows.net/share2",
+			mountPath:     filepath.Join(stagingDir, "pv", "pv2", proxyMount),
+			accountName:   "account2",
+			secrets:       map[string]string{defaultSecretAccountName: "account2", defaultSecretAccountKey: "key"},
+			volumeContext: map[string]string{shareNameField: "share"},
+		},
+		"rg#account4#share4": staged,
+	}, restored)
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// scopes of throttle limiters, management API is throttled per subscription and data plane API per storage account
+	throttleScopeSubscription = "subscription"
+	throttleScopeAccount      = "account"
+
+	// storage data plane API returns ServerBusy when it's throttled
+	serverBusy = "ServerBusy"
+)
+
+var (
+	// RetryAfter in error message of cloud provider, e.g. "Retriable: true, RetryAfter: 16s, HTTPStatusCode: 429"
+	retryAfterRegex = regexp.MustCompile(`RetryAfter: (\d+)s`)
+
+	throttleQueueDepth = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      "azurefile_csi_driver",
+			Name:           "throttle_queue_depth",
+			Help:           "Number of azure API calls waiting for a token of throttle limiter.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"scope"},
+	)
+	throttleRejectedTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      "azurefile_csi_driver",
+			Name:           "throttle_rejected_total",
+			Help:           "Number of azure API calls rejected with ResourceExhausted by throttle limiter.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"scope"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(throttleQueueDepth, throttleRejectedTotal)
+}
+
+// throttleLimiter is a driver-wide token bucket limiter of azure API calls in one scope, keyed by subscription ID or
+// account name. Calls are rejected with ResourceExhausted instead of blocking gRPC threads if they could not be issued
+// within maxWait, or the key is throttled by Azure and Retry-After is not over yet
+type throttleLimiter struct {
+	scope   string
+	limit   rate.Limit
+	burst   int
+	maxWait time.Duration
+
+	mu           sync.Mutex
+	limiters     map[string]*rate.Limiter
+	blockedUntil map[string]time.Time
+	// for unit test
+	now func() time.Time
+}
+
+// newThrottleLimiter returns a throttle limiter of scope, qps <= 0 means calls are not limited by driver,
+// while Retry-After returned by Azure is still honoured
+func newThrottleLimiter(scope string, qps float64, burst int, maxWait time.Duration) *throttleLimiter {
+	limit := rate.Inf
+	if qps > 0 {
+		limit = rate.Limit(qps)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &throttleLimiter{
+		scope:        scope,
+		limit:        limit,
+		burst:        burst,
+		maxWait:      maxWait,
+		limiters:     map[string]*rate.Limiter{},
+		blockedUntil: map[string]time.Time{},
+		now:          time.Now,
+	}
+}
+
+// wait waits until an API call on key could be issued, ResourceExhausted error is returned if it could not be issued within maxWait
+func (l *throttleLimiter) wait(ctx context.Context, key string) error {
+	if l == nil || key == "" {
+		return nil
+	}
+	key = strings.ToLower(key)
+	l.mu.Lock()
+	now := l.now()
+	if until, ok := l.blockedUntil[key]; ok {
+		if retryAfter := until.Sub(now); retryAfter > 0 {
+			l.mu.Unlock()
+			throttleRejectedTotal.WithLabelValues(l.scope).Inc()
+			return status.Errorf(codes.ResourceExhausted, "%s(%s) is throttled by Azure, retry after %v", l.scope, key, retryAfter.Round(time.Second))
+		}
+		delete(l.blockedUntil, key)
+	}
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[key] = limiter
+	}
+	r := limiter.ReserveN(now, 1)
+	l.mu.Unlock()
+
+	delay := r.DelayFrom(now)
+	if !r.OK() || delay > l.maxWait {
+		r.CancelAt(now)
+		throttleRejectedTotal.WithLabelValues(l.scope).Inc()
+		return status.Errorf(codes.ResourceExhausted, "too many requests on %s(%s), retry after %v", l.scope, key, delay.Round(time.Second))
+	}
+	if delay == 0 {
+		return nil
+	}
+	throttleQueueDepth.WithLabelValues(l.scope).Inc()
+	defer throttleQueueDepth.WithLabelValues(l.scope).Dec()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttled blocks API calls on key until Retry-After is over if err is a throttling error,
+// defaultRetryAfter is used if Retry-After is not found in err, true is returned if err is a throttling error
+func (l *throttleLimiter) throttled(key string, err error, defaultRetryAfter time.Duration) bool {
+	retryAfter, ok := getRetryAfter(err, defaultRetryAfter)
+	if !ok {
+		return false
+	}
+	l.block(key, retryAfter)
+	return true
+}
+
+// throttledError returns ResourceExhausted error if err is a throttling error, err is returned as is otherwise
+func (l *throttleLimiter) throttledError(key string, err error, defaultRetryAfter time.Duration) error {
+	if l == nil || !l.throttled(key, err, defaultRetryAfter) {
+		return err
+	}
+	return status.Errorf(codes.ResourceExhausted, "%s(%s) is throttled by Azure: %v", l.scope, key, err)
+}
+
+func (l *throttleLimiter) block(key string, retryAfter time.Duration) {
+	if l == nil || key == "" {
+		return
+	}
+	key = strings.ToLower(key)
+	klog.Warningf("%s(%s) is throttled, block API calls on it for %v", l.scope, key, retryAfter)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := l.now().Add(retryAfter)
+	if until.After(l.blockedUntil[key]) {
+		l.blockedUntil[key] = until
+	}
+}
+
+// getRetryAfter returns Retry-After of throttling error, false is returned if err is not a throttling error,
+// or if err is returned by driver, e.g. the API call is rejected by throttle limiter
+func getRetryAfter(err error, defaultRetryAfter time.Duration) (time.Duration, bool) {
+	if _, ok := getStatus(err); ok {
+		return 0, false
+	}
+	if err == nil || classifyError(err) != errorCategoryThrottled {
+		return 0, false
+	}
+	if retryAfter := getAzureErrorDetail(err).RetryAfter; retryAfter > 0 {
+		return retryAfter, true
+	}
+	return defaultRetryAfter, true
+}
+
+// getRetryAfterFromHeader returns Retry-After in seconds or http date in header, defaultRetryAfter is returned if not found
+func getRetryAfterFromHeader(header http.Header, defaultRetryAfter time.Duration) time.Duration {
+	v := header.Get("Retry-After")
+	if v == "" {
+		return defaultRetryAfter
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return defaultRetryAfter
+}
+
+// getSubscriptionThrottleKey returns the key of management API calls in subscription, default subscription is used if subsID is empty
+func (d *Driver) getSubscriptionThrottleKey(subsID string) string {
+	if subsID == "" && d.cloud != nil {
+		return d.cloud.SubscriptionID
+	}
+	return subsID
+}
+
+// getStorageAccesskeyWithIdentity gets storage account key with cluster identity under throttle limiter of subscription
+func (d *Driver) getStorageAccesskeyWithIdentity(ctx context.Context, subsID, accountName, resourceGroup string) (string, error) {
+	key := d.getSubscriptionThrottleKey(subsID)
+	if err := d.subscriptionLimiter.wait(ctx, key); err != nil {
+		return "", err
+	}
+	accountKey, err := d.cloud.GetStorageAccesskey(ctx, subsID, accountName, resourceGroup)
+	return accountKey, d.subscriptionLimiter.throttledError(key, err, accountOpThrottlingRetryAfter)
+}
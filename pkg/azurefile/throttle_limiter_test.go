@@ -0,0 +1,120 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestThrottleLimiterWait(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	l := newThrottleLimiter(throttleScopeAccount, 1, 2, 0)
+	l.now = func() time.Time { return now }
+
+	// burst is issued without waiting, keys are case-insensitive
+	assert.NoError(t, l.wait(ctx, "account1"))
+	assert.NoError(t, l.wait(ctx, "Account1"))
+	err := l.wait(ctx, "account1")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	// other keys are not affected
+	assert.NoError(t, l.wait(ctx, "account2"))
+	// token is refilled
+	now = now.Add(time.Second)
+	assert.NoError(t, l.wait(ctx, "account1"))
+
+	// Retry-After is honoured
+	assert.True(t, l.throttled("account2", fmt.Errorf("Retriable: true, RetryAfter: 10s, HTTPStatusCode: 429, RawError: TooManyRequests"), time.Minute))
+	err = l.wait(ctx, "account2")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	now = now.Add(11 * time.Second)
+	assert.NoError(t, l.wait(ctx, "account2"))
+
+	// nil limiter and empty key are not limited
+	var nilLimiter *throttleLimiter
+	assert.NoError(t, nilLimiter.wait(ctx, "account1"))
+	assert.NoError(t, l.wait(ctx, ""))
+}
+
+func TestThrottleLimiterWaitWithDelay(t *testing.T) {
+	l := newThrottleLimiter(throttleScopeSubscription, 100, 1, time.Second)
+	assert.NoError(t, l.wait(context.Background(), "subs"))
+	assert.NoError(t, l.wait(context.Background(), "subs"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = newThrottleLimiter(throttleScopeSubscription, 1, 1, time.Minute)
+	assert.NoError(t, l.wait(ctx, "subs"))
+	assert.Equal(t, context.Canceled, l.wait(ctx, "subs"))
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	tests := []struct {
+		desc       string
+		err        error
+		retryAfter time.Duration
+		throttled  bool
+	}{
+		{
+			desc: "nil error",
+		},
+		{
+			desc: "not throttled",
+			err:  fmt.Errorf("ShareNotFound"),
+		},
+		{
+			desc:       "throttled with RetryAfter",
+			err:        fmt.Errorf("Retriable: true, RetryAfter: 30s, HTTPStatusCode: 429, RawError: TooManyRequests"),
+			retryAfter: 30 * time.Second,
+			throttled:  true,
+		},
+		{
+			desc:       "client throttled without RetryAfter",
+			err:        fmt.Errorf("azure cloud provider rate limited(write) for operation CreateFileShare, client throttled"),
+			retryAfter: time.Minute,
+			throttled:  true,
+		},
+		{
+			desc:       "data plane server busy",
+			err:        fmt.Errorf("storage: service returned error: StatusCode=503, ErrorCode=ServerBusy"),
+			retryAfter: time.Minute,
+			throttled:  true,
+		},
+	}
+
+	for _, test := range tests {
+		retryAfter, throttled := getRetryAfter(test.err, time.Minute)
+		assert.Equal(t, test.retryAfter, retryAfter, test.desc)
+		assert.Equal(t, test.throttled, throttled, test.desc)
+	}
+}
+
+func TestGetRetryAfterFromHeader(t *testing.T) {
+	assert.Equal(t, time.Minute, getRetryAfterFromHeader(http.Header{}, time.Minute))
+	assert.Equal(t, 5*time.Second, getRetryAfterFromHeader(http.Header{"Retry-After": {"5"}}, time.Minute))
+	assert.Equal(t, time.Minute, getRetryAfterFromHeader(http.Header{"Retry-After": {"invalid"}}, time.Minute))
+	retryAfter := getRetryAfterFromHeader(http.Header{"Retry-After": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Minute)
+	assert.True(t, retryAfter > 59*time.Minute && retryAfter <= time.Hour)
+}
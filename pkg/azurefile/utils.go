@@ -22,8 +22,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
+	"github.com/Azure/azure-storage-file-go/azfile"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume"
@@ -123,22 +123,33 @@ func isSupportedFsType(fsType string) bool {
 	return false
 }
 
+// isRetriableError returns true if err is transient, e.g. throttled, share being deleted or account being provisioned
 func isRetriableError(err error) bool {
-	if err != nil {
-		for _, v := range retriableErrors {
-			if strings.Contains(strings.ToLower(err.Error()), strings.ToLower(v)) {
-				return true
-			}
-		}
+	if _, ok := getStatus(err); ok {
+		// e.g. API call rejected by throttle limiter
+		return false
+	}
+	switch classifyError(err) {
+	case errorCategoryThrottled, errorCategoryBeingDeleted, errorCategoryNotReady:
+		return true
 	}
 	return false
 }
 
-func sleepIfThrottled(err error, sleepSec int) {
-	if strings.Contains(strings.ToLower(err.Error()), strings.ToLower(tooManyRequests)) || strings.Contains(strings.ToLower(err.Error()), clientThrottled) {
-		klog.Warningf("sleep %d more seconds, waiting for throttling complete", sleepSec)
-		time.Sleep(time.Duration(sleepSec) * time.Second)
+// isStorageErrorWithServiceCode checks whether err is a data plane storage error with specified service code
+func isStorageErrorWithServiceCode(err error, code azfile.ServiceCodeType) bool {
+	if stgErr, ok := err.(azfile.StorageError); ok {
+		return stgErr.ServiceCode() == code
 	}
+	return false
+}
+
+// isStorageErrorWithStatusCode checks whether err is a data plane storage error with specified http status code
+func isStorageErrorWithStatusCode(err error, statusCode int) bool {
+	if stgErr, ok := err.(azfile.StorageError); ok {
+		return stgErr.Response() != nil && stgErr.Response().StatusCode == statusCode
+	}
+	return false
 }
 
 func useDataPlaneAPI(volContext map[string]string) bool {
@@ -19,12 +19,14 @@ package azurefile
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-storage-file-go/azfile"
 	utiltesting "k8s.io/client-go/util/testing"
 )
 
@@ -318,16 +320,6 @@ func TestIsRetriableError(t *testing.T) {
 	}
 }
 
-func TestSleepIfThrottled(t *testing.T) {
-	start := time.Now()
-	sleepIfThrottled(errors.New("tooManyRequests"), 10)
-	elapsed := time.Since(start)
-	if elapsed.Seconds() < 10 {
-		t.Errorf("Expected sleep time(%d), Actual sleep time(%f)", 10, elapsed.Seconds())
-	}
-
-}
-
 func TestUseDataPlaneAPI(t *testing.T) {
 	volumeContext := map[string]string{"usedataplaneapi": "true"}
 	result := useDataPlaneAPI(volumeContext)
@@ -589,3 +581,33 @@ func TestReplaceWithMap(t *testing.T) {
 		}
 	}
 }
+
+func TestIsStorageErrorWithServiceCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		code     azfile.ServiceCodeType
+		expected bool
+	}{
+		{
+			err:      nil,
+			code:     azfile.ServiceCodeResourceNotFound,
+			expected: false,
+		},
+		{
+			err:      fmt.Errorf("ResourceNotFound"),
+			code:     azfile.ServiceCodeResourceNotFound,
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isStorageErrorWithServiceCode(test.err, test.code)
+		if result != test.expected {
+			t.Errorf("isStorageErrorWithServiceCode(%v, %s) returned with %v, not equal to %v", test.err, test.code, result, test.expected)
+		}
+		result = isStorageErrorWithStatusCode(test.err, http.StatusNotFound)
+		if result != test.expected {
+			t.Errorf("isStorageErrorWithStatusCode(%v) returned with %v, not equal to %v", test.err, result, test.expected)
+		}
+	}
+}
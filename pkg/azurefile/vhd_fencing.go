@@ -0,0 +1,216 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pborman/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annotation on PV to force detach its vhd disk from the node in annotation value, e.g. a node which has gone away,
+	// "*" forces detaching from any node
+	forceDetachAnnotation = "file.csi.azure.com/force-detach-from"
+	forceDetachAnyNode    = "*"
+
+	// Lease File is not supported by azfile, file lease is always infinite
+	// See https://docs.microsoft.com/en-us/rest/api/storageservices/lease-file
+	leaseActionRelease = "release"
+)
+
+// getNodeLeaseID returns the lease ID on vhd disk used by attach and detach operations of the node,
+// it's derived from node ID so that the lease could be released by any controller on behalf of the node
+func getNodeLeaseID(nodeID string) string {
+	return uuid.NewMD5(uuid.NameSpace_OID, []byte(strings.ToLower(nodeID))).String()
+}
+
+// leaseFile acquires lease with leaseID, releases lease with leaseID or breaks any lease on file,
+// error code of file service is returned if lease operation fails
+func (d *Driver) leaseFile(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, fileName, action, leaseID string) (string, error) {
+	headers := map[string]string{"x-ms-lease-action": action}
+	expectedStatusCode := http.StatusOK
+	switch action {
+	case leaseActionAcquire:
+		headers["x-ms-lease-duration"] = "-1"
+		headers["x-ms-proposed-lease-id"] = leaseID
+		expectedStatusCode = http.StatusCreated
+	case leaseActionRelease:
+		headers["x-ms-lease-id"] = leaseID
+	case leaseActionBreak:
+		expectedStatusCode = http.StatusAccepted
+	}
+	query := url.Values{"comp": {"lease"}}
+	resp, err := d.fileClient.sendFileServiceRequest(ctx, accountName, accountKey, storageEndpointSuffix, http.MethodPut, fileShareName+"/"+fileName, query, headers)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatusCode {
+		errorCode := resp.Header.Get("x-ms-error-code")
+		return errorCode, fmt.Errorf("lease action(%s) on file(%s/%s) returned with status code(%d), error code(%s)", action, fileShareName, fileName, resp.StatusCode, errorCode)
+	}
+	return "", nil
+}
+
+// setFileMetadataWithLease replaces metadata of file, leaseID is required if file is leased
+func (d *Driver) setFileMetadataWithLease(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, fileName string, metadata map[string]string, leaseID string) error {
+	headers := map[string]string{}
+	for k, v := range metadata {
+		headers["x-ms-meta-"+k] = v
+	}
+	if leaseID != "" {
+		headers["x-ms-lease-id"] = leaseID
+	}
+	query := url.Values{"comp": {"metadata"}}
+	resp, err := d.fileClient.sendFileServiceRequest(ctx, accountName, accountKey, storageEndpointSuffix, http.MethodPut, fileShareName+"/"+fileName, query, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("set metadata of file(%s/%s) returned with status code(%d), error code(%s)", fileShareName, fileName, resp.StatusCode, resp.Header.Get("x-ms-error-code"))
+	}
+	return nil
+}
+
+// forceCloseFileHandles closes all SMB handles opened on file, e.g. handles left by a node which has gone away
+func (d *Driver) forceCloseFileHandles(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, fileName string) error {
+	for marker := ""; ; {
+		query := url.Values{"comp": {"forceclosehandles"}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := d.fileClient.sendFileServiceRequest(ctx, accountName, accountKey, storageEndpointSuffix, http.MethodPut, fileShareName+"/"+fileName, query, map[string]string{"x-ms-handle-id": "*"})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("force close handles of file(%s/%s) returned with status code(%d), error code(%s)", fileShareName, fileName, resp.StatusCode, resp.Header.Get("x-ms-error-code"))
+		}
+		if marker = resp.Header.Get("x-ms-marker"); marker == "" {
+			return nil
+		}
+	}
+}
+
+// getVolumeAttachmentName returns name of the VolumeAttachment created by attach detach controller,
+// it's derived from volume handle, driver name and node name
+func getVolumeAttachmentName(volumeID, driverName, nodeID string) string {
+	return fmt.Sprintf("csi-%x", sha256.Sum256([]byte(volumeID+driverName+nodeID)))
+}
+
+// getVolumeAttachmentPV returns PV of the volume attached to the node, it's got by name from the VolumeAttachment of the volume
+func (d *Driver) getVolumeAttachmentPV(ctx context.Context, volumeID, nodeID string) (*v1.PersistentVolume, error) {
+	attachmentName := getVolumeAttachmentName(volumeID, d.Name, nodeID)
+	attachment, err := d.cloud.KubeClient.StorageV1().VolumeAttachments().Get(ctx, attachmentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get VolumeAttachment(%s) of volume(%s) on node(%s): %v", attachmentName, volumeID, nodeID, err)
+	}
+	pvName := attachment.Spec.Source.PersistentVolumeName
+	if pvName == nil || *pvName == "" {
+		return nil, fmt.Errorf("VolumeAttachment(%s) of volume(%s) has no persistent volume", attachmentName, volumeID)
+	}
+	return d.cloud.KubeClient.CoreV1().PersistentVolumes().Get(ctx, *pvName, metav1.GetOptions{})
+}
+
+// getForceDetachPV returns PV of the volume if it's annotated to force detach its vhd disk from attachedNodeID,
+// nodeID is the node of attach or detach operation
+func (d *Driver) getForceDetachPV(ctx context.Context, volumeID, nodeID, attachedNodeID string) *v1.PersistentVolume {
+	if d.cloud.KubeClient == nil {
+		return nil
+	}
+	pv, err := d.getVolumeAttachmentPV(ctx, volumeID, nodeID)
+	if err != nil {
+		klog.Warningf("failed to get persistent volume to check force detach of volume(%s): %v", volumeID, err)
+		return nil
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle != volumeID {
+		return nil
+	}
+	v, ok := pv.Annotations[forceDetachAnnotation]
+	if ok && (v == forceDetachAnyNode || (attachedNodeID != "" && strings.EqualFold(v, attachedNodeID))) {
+		return pv
+	}
+	return nil
+}
+
+// clearForceDetachAnnotation removes force detach annotation from PV once force detach succeeds,
+// so that vhd disk attached later is not force detached by the same annotation
+func (d *Driver) clearForceDetachAnnotation(ctx context.Context, pv *v1.PersistentVolume) {
+	pv = pv.DeepCopy()
+	delete(pv.Annotations, forceDetachAnnotation)
+	if _, err := d.cloud.KubeClient.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		klog.Warningf("failed to remove annotation %s from persistent volume(%s): %v", forceDetachAnnotation, pv.Name, err)
+		return
+	}
+	klog.V(2).Infof("annotation %s is removed from persistent volume(%s)", forceDetachAnnotation, pv.Name)
+}
+
+// forceDetachVHD breaks lease on vhd disk, closes its SMB handles and clears its attached node
+func (d *Driver) forceDetachVHD(ctx context.Context, h *VolumeHandle, accountKey, storageEndpointSuffix string) error {
+	if _, err := d.leaseFile(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName, leaseActionBreak, ""); err != nil {
+		return err
+	}
+	if err := d.forceCloseFileHandles(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName); err != nil {
+		return err
+	}
+	return d.setFileMetadataWithLease(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName, map[string]string{metaDataNode: ""}, "")
+}
+
+// acquireVHDLease acquires lease of the node on vhd disk, lease held by another attach or detach operation
+// is only broken if force detach is requested
+func (d *Driver) acquireVHDLease(ctx context.Context, volumeID string, h *VolumeHandle, accountKey, storageEndpointSuffix, nodeID, attachedNodeID, leaseID string) error {
+	code, err := d.leaseFile(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName, leaseActionAcquire, leaseID)
+	if err == nil {
+		return nil
+	}
+	pv := d.getForceDetachPV(ctx, volumeID, nodeID, attachedNodeID)
+	if pv == nil {
+		if code == leaseAlreadyPresent {
+			return status.Errorf(codes.Aborted, "vhd disk of volume(%s) is locked by another attach or detach operation, annotate PV with %s to force detach: %v", volumeID, forceDetachAnnotation, err)
+		}
+		return status.Errorf(codes.Internal, "failed to acquire lease on vhd disk of volume(%s): %v", volumeID, err)
+	}
+	klog.Warningf("force detach vhd disk of volume(%s) from node(%s) as requested by PV annotation", volumeID, attachedNodeID)
+	if err := d.forceDetachVHD(ctx, h, accountKey, storageEndpointSuffix); err != nil {
+		return status.Errorf(codes.Internal, "failed to force detach vhd disk of volume(%s): %v", volumeID, err)
+	}
+	d.clearForceDetachAnnotation(ctx, pv)
+	if _, err := d.leaseFile(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName, leaseActionAcquire, leaseID); err != nil {
+		return status.Errorf(codes.Aborted, "failed to acquire lease on vhd disk of volume(%s) after force detach: %v", volumeID, err)
+	}
+	return nil
+}
+
+// releaseVHDLease releases lease of the node on vhd disk, it's a no-op if the lease is not held by the node
+func (d *Driver) releaseVHDLease(ctx context.Context, h *VolumeHandle, accountKey, storageEndpointSuffix, leaseID string) {
+	if _, err := d.leaseFile(ctx, h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName, leaseActionRelease, leaseID); err != nil {
+		klog.V(4).Infof("release lease(%s) on vhd disk(%s/%s) on account(%s): %v", leaseID, h.FileShareName, h.DiskName, h.AccountName, err)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetNodeLeaseID(t *testing.T) {
+	leaseID := getNodeLeaseID("node1")
+	assert.NotNil(t, uuid.Parse(leaseID))
+	assert.Equal(t, leaseID, getNodeLeaseID("Node1"))
+	assert.NotEqual(t, leaseID, getNodeLeaseID("node2"))
+}
+
+func TestLeaseFile(t *testing.T) {
+	d := NewFakeDriver()
+	for _, action := range []string{leaseActionAcquire, leaseActionRelease, leaseActionBreak} {
+		_, err := d.leaseFile(context.Background(), "account", "invalid key", "core.windows.net", "share", "disk.vhd", action, getNodeLeaseID("node1"))
+		assert.Error(t, err)
+	}
+	err := d.setFileMetadataWithLease(context.Background(), "account", "invalid key", "core.windows.net", "share", "disk.vhd", map[string]string{metaDataNode: "node1"}, getNodeLeaseID("node1"))
+	assert.Error(t, err)
+	err = d.forceCloseFileHandles(context.Background(), "account", "invalid key", "core.windows.net", "share", "disk.vhd")
+	assert.Error(t, err)
+}
+
+func TestGetForceDetachPV(t *testing.T) {
+	volumeID := "rg#account#share#disk.vhd#uuid#namespace"
+	nodeID := "node3"
+	newPV := func(name, volumeHandle, annotation string) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: DefaultDriverName, VolumeHandle: volumeHandle},
+				},
+			},
+		}
+		if annotation != "" {
+			pv.Annotations = map[string]string{forceDetachAnnotation: annotation}
+		}
+		return pv
+	}
+	tests := []struct {
+		desc           string
+		pv             *v1.PersistentVolume
+		noAttachment   bool
+		attachedNodeID string
+		expected       bool
+	}{
+		{
+			desc:           "no kube client",
+			attachedNodeID: "node1",
+		},
+		{
+			desc:           "no volume attachment",
+			pv:             newPV("pv1", volumeID, "node1"),
+			noAttachment:   true,
+			attachedNodeID: "node1",
+		},
+		{
+			desc:           "pv without annotation",
+			pv:             newPV("pv1", volumeID, ""),
+			attachedNodeID: "node1",
+		},
+		{
+			desc:           "annotation of another volume",
+			pv:             newPV("pv1", "rg#account#share#other.vhd#uuid#namespace", "node1"),
+			attachedNodeID: "node1",
+		},
+		{
+			desc:           "annotation matches attached node",
+			pv:             newPV("pv1", volumeID, "Node1"),
+			attachedNodeID: "node1",
+			expected:       true,
+		},
+		{
+			desc:           "annotation does not match attached node",
+			pv:             newPV("pv1", volumeID, "node2"),
+			attachedNodeID: "node1",
+		},
+		{
+			desc:     "annotation of node without attached node",
+			pv:       newPV("pv1", volumeID, "node1"),
+			expected: false,
+		},
+		{
+			desc:     "annotation of any node",
+			pv:       newPV("pv1", volumeID, forceDetachAnyNode),
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		if test.pv != nil {
+			clientSet := fake.NewSimpleClientset(test.pv)
+			if !test.noAttachment {
+				_, err := clientSet.StorageV1().VolumeAttachments().Create(context.Background(), newVolumeAttachment(d, volumeID, nodeID, test.pv.Name), metav1.CreateOptions{})
+				assert.NoError(t, err, test.desc)
+			}
+			d.cloud.KubeClient = clientSet
+		}
+		pv := d.getForceDetachPV(context.Background(), volumeID, nodeID, test.attachedNodeID)
+		assert.Equal(t, test.expected, pv != nil, test.desc)
+	}
+}
+
+func TestClearForceDetachAnnotation(t *testing.T) {
+	d := NewFakeDriver()
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv1", Annotations: map[string]string{forceDetachAnnotation: "node1", "key": "value"}}}
+	clientSet := fake.NewSimpleClientset(pv)
+	d.cloud.KubeClient = clientSet
+
+	d.clearForceDetachAnnotation(context.Background(), pv)
+	result, err := clientSet.CoreV1().PersistentVolumes().Get(context.Background(), "pv1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "value"}, result.Annotations)
+	// annotation of the object passed in is not changed
+	assert.Equal(t, "node1", pv.Annotations[forceDetachAnnotation])
+}
+
+func TestVHDLeaseOfControllerPublishAndUnpublish(t *testing.T) {
+	volumeID := "rg#account#share#disk.vhd#uuid#namespace"
+	secrets := map[string]string{defaultSecretAccountName: "account", defaultSecretAccountKey: "dW5pdHRlc3Q="}
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	otherLeaseID := uuid.NewUUID().String()
+
+	tests := []struct {
+		desc                 string
+		unpublish            bool
+		nodeID               string
+		attachedNodeID       string
+		leaseID              string
+		annotation           string
+		expectedCode         codes.Code
+		expectedNodeID       string
+		expectedHandleClosed bool
+		expectedAnnotation   string
+	}{
+		{
+			desc:           "attach acquires and releases lease",
+			nodeID:         "node1",
+			expectedNodeID: "node1",
+		},
+		{
+			desc:         "attach conflicts with lease of another operation",
+			nodeID:       "node1",
+			leaseID:      otherLeaseID,
+			expectedCode: codes.Aborted,
+		},
+		{
+			desc:           "attach conflicts with attached node",
+			nodeID:         "node1",
+			attachedNodeID: "node2",
+			leaseID:        getNodeLeaseID("node2"),
+			expectedCode:   codes.Internal,
+			expectedNodeID: "node2",
+		},
+		{
+			desc:                 "attach breaks lease of attached node if force detach is requested",
+			nodeID:               "node1",
+			attachedNodeID:       "node2",
+			leaseID:              getNodeLeaseID("node2"),
+			annotation:           "node2",
+			expectedNodeID:       "node1",
+			expectedHandleClosed: true,
+		},
+		{
+			desc:           "attach is not forced by annotation of another node",
+			nodeID:         "node1",
+			attachedNodeID: "node2",
+			annotation:     "node3",
+			expectedCode:   codes.Internal,
+			expectedNodeID: "node2",
+		},
+		{
+			desc:           "detach acquires and releases lease",
+			unpublish:      true,
+			nodeID:         "node1",
+			attachedNodeID: "node1",
+		},
+		{
+			desc:           "detach conflicts with lease of another operation",
+			unpublish:      true,
+			nodeID:         "node1",
+			attachedNodeID: "node1",
+			leaseID:        otherLeaseID,
+			expectedCode:   codes.Aborted,
+			expectedNodeID: "node1",
+		},
+		{
+			desc:                 "detach breaks lease of another operation if force detach is requested",
+			unpublish:            true,
+			nodeID:               "node1",
+			attachedNodeID:       "node1",
+			leaseID:              otherLeaseID,
+			annotation:           forceDetachAnyNode,
+			expectedHandleClosed: true,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		disk := &fakeLeasedFile{node: test.attachedNodeID, leaseID: test.leaseID}
+		d.fileClient = newFakeFileClient(disk.serve)
+		pv := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv1"},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: d.Name, VolumeHandle: volumeID},
+				},
+			},
+		}
+		if test.annotation != "" {
+			pv.Annotations = map[string]string{forceDetachAnnotation: test.annotation}
+		}
+		clientSet := fake.NewSimpleClientset(pv, newVolumeAttachment(d, volumeID, test.nodeID, pv.Name))
+		d.cloud.KubeClient = clientSet
+
+		var err error
+		if test.unpublish {
+			_, err = d.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: test.nodeID, Secrets: secrets})
+		} else {
+			_, err = d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volumeID, NodeId: test.nodeID, VolumeCapability: volCap, Secrets: secrets})
+		}
+		assert.Equal(t, test.expectedCode, status.Code(err), "%s: %v", test.desc, err)
+		assert.Equal(t, test.expectedNodeID, disk.node, test.desc)
+		assert.Equal(t, test.expectedHandleClosed, disk.handleClosed, test.desc)
+		if test.expectedCode == codes.OK {
+			// lease of the node is always released
+			assert.Empty(t, disk.leaseID, test.desc)
+		}
+		result, err := clientSet.CoreV1().PersistentVolumes().Get(context.Background(), pv.Name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		expectedAnnotation := test.annotation
+		if test.expectedHandleClosed {
+			// annotation is removed once force detach succeeds
+			expectedAnnotation = ""
+		}
+		assert.Equal(t, expectedAnnotation, result.Annotations[forceDetachAnnotation], test.desc)
+	}
+}
+
+func newVolumeAttachment(d *Driver, volumeID, nodeID, pvName string) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: getVolumeAttachmentName(volumeID, d.Name, nodeID)},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: d.Name,
+			NodeName: nodeID,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+	}
+}
+
+// fakeLeasedFile serves properties, metadata, lease and handle requests of file service on a single vhd disk
+type fakeLeasedFile struct {
+	node         string
+	leaseID      string
+	handleClosed bool
+}
+
+func (f *fakeLeasedFile) serve(req *http.Request) *http.Response {
+	response := func(statusCode int, errorCode string) *http.Response {
+		header := http.Header{}
+		if errorCode != "" {
+			header.Set(errorCodeHeader, errorCode)
+		}
+		return &http.Response{StatusCode: statusCode, Header: header}
+	}
+	if req.Method == http.MethodHead {
+		resp := response(http.StatusOK, "")
+		if f.node != "" {
+			resp.Header.Set("x-ms-meta-"+metaDataNode, f.node)
+		}
+		return resp
+	}
+	leaseID := req.Header.Get("x-ms-lease-id")
+	switch req.URL.Query().Get("comp") {
+	case "lease":
+		switch req.Header.Get("x-ms-lease-action") {
+		case leaseActionAcquire:
+			proposedLeaseID := req.Header.Get("x-ms-proposed-lease-id")
+			if f.leaseID != "" && f.leaseID != proposedLeaseID {
+				return response(http.StatusConflict, leaseAlreadyPresent)
+			}
+			f.leaseID = proposedLeaseID
+			return response(http.StatusCreated, "")
+		case leaseActionRelease:
+			if f.leaseID != leaseID {
+				return response(http.StatusConflict, "LeaseIdMismatchWithLeaseOperation")
+			}
+			f.leaseID = ""
+			return response(http.StatusOK, "")
+		case leaseActionBreak:
+			f.leaseID = ""
+			return response(http.StatusAccepted, "")
+		}
+	case "metadata":
+		if f.leaseID != "" && f.leaseID != leaseID {
+			return response(http.StatusPreconditionFailed, "LeaseIdMismatchWithFileOperation")
+		}
+		f.node = req.Header.Get("x-ms-meta-" + metaDataNode)
+		return response(http.StatusOK, "")
+	case "forceclosehandles":
+		f.handleClosed = true
+		return response(http.StatusOK, "")
+	}
+	return response(http.StatusBadRequest, "InvalidQueryParameterValue")
+}
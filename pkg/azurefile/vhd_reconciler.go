@@ -0,0 +1,190 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// reason of event emitted on PV when attachment of its vhd disk to a deleted node is cleared
+	staleAttachmentClearedReason = "StaleAttachmentCleared"
+	staleAttachmentFailedReason  = "StaleAttachmentClearFailed"
+
+	// minimum interval between reconciliations triggered by node deletion or volume attachment failure
+	staleAttachmentMinInterval = time.Minute
+)
+
+// reconcileStaleVHDAttachments clears attached node of vhd disks which is recorded in vhd file metadata
+// but does not exist any more, so that the vhd disks could be attached to other nodes
+func (d *Driver) reconcileStaleVHDAttachments(ctx context.Context, recorder record.EventRecorder) error {
+	kubeClient := d.cloud.KubeClient
+	nodeList, err := kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+	if len(nodeList.Items) == 0 {
+		// never treat all attachments as stale
+		klog.V(2).Infof("skip reconciling stale vhd attachments since there is no node")
+		return nil
+	}
+	nodes := map[string]bool{}
+	for _, node := range nodeList.Items {
+		nodes[strings.ToLower(node.Name)] = true
+	}
+
+	pvList, err := kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != d.Name || !isVHDVolume(pv.Spec.CSI) {
+			continue
+		}
+		volumeID := pv.Spec.CSI.VolumeHandle
+		h, accountKey, err := d.GetAccountInfo(ctx, volumeID, nil, pv.Spec.CSI.VolumeAttributes)
+		if err != nil {
+			klog.Warningf("skip reconciling vhd attachment of volume(%s): %v", volumeID, err)
+			continue
+		}
+		if err := d.reconcileStaleVHDAttachment(ctx, recorder, pv, h, accountKey, nodes); err != nil {
+			klog.Errorf("failed to reconcile vhd attachment of volume(%s): %v", volumeID, err)
+		}
+	}
+	return nil
+}
+
+// isVHDVolume returns true if the disk name in volume handle or volume attributes is a vhd disk
+func isVHDVolume(source *v1.CSIPersistentVolumeSource) bool {
+	var diskName string
+	if h, err := ParseVolumeHandle(source.VolumeHandle); err == nil {
+		diskName = h.DiskName
+	}
+	for k, v := range source.VolumeAttributes {
+		if strings.EqualFold(k, diskNameField) {
+			diskName = v
+		}
+	}
+	return strings.HasSuffix(diskName, vhdSuffix)
+}
+
+// reconcileStaleVHDAttachment clears attached node of vhd disk of pv if the node is not in nodes
+func (d *Driver) reconcileStaleVHDAttachment(ctx context.Context, recorder record.EventRecorder, pv *v1.PersistentVolume, h *VolumeHandle, accountKey string, nodes map[string]bool) error {
+	volumeID := pv.Spec.CSI.VolumeHandle
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		// attach or detach is in progress, reconcile in next round
+		return nil
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	storageEndpointSuffix := d.getStorageEndpointSuffix(h)
+	fileURL, err := d.fileClient.getFileURL(h.AccountName, accountKey, storageEndpointSuffix, h.FileShareName, h.DiskName)
+	if err != nil {
+		return err
+	}
+	properties, err := fileURL.GetProperties(ctx)
+	if err != nil {
+		return err
+	}
+	attachedNodeID := properties.NewMetadata()[metaDataNode]
+	if attachedNodeID == "" || nodes[strings.ToLower(attachedNodeID)] {
+		return nil
+	}
+
+	// node list may be stale, e.g. node is recreated with the same name, so clear the attachment only if the node is confirmed to be deleted
+	if _, err := d.cloud.KubeClient.CoreV1().Nodes().Get(ctx, attachedNodeID, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		if err != nil {
+			return fmt.Errorf("failed to get attached node(%s) of volume(%s): %v", attachedNodeID, volumeID, err)
+		}
+		klog.V(2).Infof("attached node(%s) of volume(%s) exists, skip clearing the attachment", attachedNodeID, volumeID)
+		return nil
+	}
+	klog.Warningf("vhd disk of volume(%s) is attached to deleted node(%s), clear the attachment", volumeID, attachedNodeID)
+	if err := d.forceDetachVHD(ctx, h, accountKey, storageEndpointSuffix); err != nil {
+		recorder.Eventf(pv, v1.EventTypeWarning, staleAttachmentFailedReason, "failed to clear attachment of vhd disk(%s) to deleted node(%s): %v", h.DiskName, attachedNodeID, err)
+		return err
+	}
+	recorder.Eventf(pv, v1.EventTypeNormal, staleAttachmentClearedReason, "attachment of vhd disk(%s) to deleted node(%s) is cleared", h.DiskName, attachedNodeID)
+	return nil
+}
+
+// runStaleVHDAttachmentReconciler reconciles stale vhd attachments periodically and whenever a node is deleted
+// or a volume attachment fails, until stopCh is closed
+func (d *Driver) runStaleVHDAttachmentReconciler(interval time.Duration, stopCh <-chan struct{}) {
+	kubeClient := d.cloud.KubeClient
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	defer broadcaster.Shutdown()
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: d.Name})
+
+	trigger := make(chan struct{}, 1)
+	enqueue := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	factory := informers.NewSharedInformerFactory(kubeClient, 0)
+	factory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) { enqueue() },
+	})
+	factory.Storage().V1().VolumeAttachments().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if va, ok := newObj.(*storagev1.VolumeAttachment); ok && va.Spec.Attacher == d.Name && va.Status.AttachError != nil {
+				enqueue()
+			}
+		},
+	})
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	klog.V(2).Infof("starting stale vhd attachment reconciler with interval(%v)", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.reconcileStaleVHDAttachments(context.Background(), recorder); err != nil {
+			klog.Errorf("failed to reconcile stale vhd attachments: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-trigger:
+			// throttle reconciliations triggered by frequent events
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(staleAttachmentMinInterval):
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestIsVHDVolume(t *testing.T) {
+	tests := []struct {
+		desc     string
+		source   *v1.CSIPersistentVolumeSource
+		expected bool
+	}{
+		{
+			desc:     "vhd disk in volume handle",
+			source:   &v1.CSIPersistentVolumeSource{VolumeHandle: "rg#account#share#disk.vhd"},
+			expected: true,
+		},
+		{
+			desc:   "no disk in volume handle",
+			source: &v1.CSIPersistentVolumeSource{VolumeHandle: "rg#account#share"},
+		},
+		{
+			desc: "vhd disk in volume attributes",
+			source: &v1.CSIPersistentVolumeSource{
+				VolumeHandle:     "unique-volume-id",
+				VolumeAttributes: map[string]string{"diskName": "disk.vhd"},
+			},
+			expected: true,
+		},
+		{
+			desc: "non vhd disk in volume attributes",
+			source: &v1.CSIPersistentVolumeSource{
+				VolumeHandle:     "unique-volume-id",
+				VolumeAttributes: map[string]string{diskNameField: "disk"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isVHDVolume(test.source), test.desc)
+	}
+}
+
+func TestReconcileStaleVHDAttachments(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	newPV := func(name, driver, volumeHandle string, attributes map[string]string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeHandle, VolumeAttributes: attributes},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		desc    string
+		objects []runtime.Object
+	}{
+		{
+			desc:    "no node",
+			objects: []runtime.Object{newPV("pv1", DefaultDriverName, "rg#account#share#disk.vhd", nil)},
+		},
+		{
+			desc:    "pv of another driver",
+			objects: []runtime.Object{node, newPV("pv1", "disk.csi.azure.com", "rg#account#share#disk.vhd", nil)},
+		},
+		{
+			desc:    "pv without vhd disk",
+			objects: []runtime.Object{node, newPV("pv1", DefaultDriverName, "rg#account#share", nil)},
+		},
+		{
+			desc: "account key secret not found",
+			objects: []runtime.Object{node, newPV("pv1", DefaultDriverName, "unique-volume-id", map[string]string{
+				storageAccountField:          "account",
+				shareNameField:               "share",
+				diskNameField:                "disk.vhd",
+				getAccountKeyFromSecretField: trueValue,
+			})},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud.KubeClient = fake.NewSimpleClientset(test.objects...)
+		recorder := record.NewFakeRecorder(10)
+		err := d.reconcileStaleVHDAttachments(context.Background(), recorder)
+		assert.NoError(t, err, test.desc)
+		assert.Empty(t, recorder.Events, test.desc)
+	}
+}
+
+func TestReconcileStaleVHDAttachment(t *testing.T) {
+	volumeID := "rg#account#share#disk.vhd"
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv1"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: DefaultDriverName, VolumeHandle: volumeID},
+			},
+		},
+	}
+	h := &VolumeHandle{ResourceGroup: "rg", AccountName: "account", FileShareName: "share", DiskName: "disk.vhd"}
+	tests := []struct {
+		desc           string
+		objects        []runtime.Object
+		nodes          map[string]bool
+		getNodeErr     error
+		expectedErr    bool
+		expectedNodeID string
+		expectedEvent  bool
+	}{
+		{
+			desc:           "attached node is in node list",
+			nodes:          map[string]bool{"node1": true},
+			expectedNodeID: "node1",
+		},
+		{
+			desc:           "attached node is created after node list",
+			objects:        []runtime.Object{&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}},
+			nodes:          map[string]bool{"node2": true},
+			expectedNodeID: "node1",
+		},
+		{
+			desc:           "failed to get attached node",
+			nodes:          map[string]bool{"node2": true},
+			getNodeErr:     fmt.Errorf("test error"),
+			expectedErr:    true,
+			expectedNodeID: "node1",
+		},
+		{
+			desc:          "attached node is deleted",
+			nodes:         map[string]bool{"node2": true},
+			expectedEvent: true,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		disk := &fakeLeasedFile{node: "node1"}
+		d.fileClient = newFakeFileClient(disk.serve)
+		clientSet := fake.NewSimpleClientset(test.objects...)
+		if test.getNodeErr != nil {
+			clientSet.PrependReactor("get", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, test.getNodeErr
+			})
+		}
+		d.cloud.KubeClient = clientSet
+		recorder := record.NewFakeRecorder(10)
+		err := d.reconcileStaleVHDAttachment(context.Background(), recorder, pv, h, "dW5pdHRlc3Q=", test.nodes)
+		assert.Equal(t, test.expectedErr, err != nil, "%s: %v", test.desc, err)
+		assert.Equal(t, test.expectedNodeID, disk.node, test.desc)
+		assert.Equal(t, test.expectedEvent, len(recorder.Events) == 1, test.desc)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// volumeHandleV2 is the version marker of volume ID which carries protocol and storage endpoint suffix after subscription ID
+	volumeHandleV2 = "v2"
+	// volumeHandleV3 is the version marker of volume ID which carries subdirectory after the fields of v2 format
+	volumeHandleV3 = "v3"
+
+	// positions of fields in volume ID
+	rgIndex              = 0
+	accountNameIndex     = 1
+	fileShareNameIndex   = 2
+	diskNameIndex        = 3
+	uuidIndex            = 4
+	secretNamespaceIndex = 5
+	subsIDIndex          = 6
+	versionIndex         = 7
+	protocolIndex        = 8
+	endpointSuffixIndex  = 9
+	subDirIndex          = 10
+)
+
+// VolumeHandle is the typed form of volume ID, e.g.
+// legacy: {rg}#{account}#{fileShareName}#{diskName}#{uuid}#{secretNamespace}#{subsID}
+// v2:     {rg}#{account}#{fileShareName}#{diskName}#{uuid}#{secretNamespace}#{subsID}#v2#{protocol}#{storageEndpointSuffix}
+// v3:     {rg}#{account}#{fileShareName}#{diskName}#{uuid}#{secretNamespace}#{subsID}#v3#{protocol}#{storageEndpointSuffix}#{subDir}
+// fields of versioned format keep the same positions as legacy format, so that it could still be parsed by legacy driver.
+// version is bumped whenever a field is appended, and actions taken when volume is deleted are kept in metadata of
+// file share or subdirectory instead of volume ID
+type VolumeHandle struct {
+	ResourceGroup         string
+	AccountName           string
+	FileShareName         string
+	DiskName              string
+	UUID                  string
+	SecretNamespace       string
+	SubscriptionID        string
+	Protocol              string
+	StorageEndpointSuffix string
+	// SubDir is the directory inside file share which is provisioned as volume in subdirectory provisioning mode
+	SubDir string
+}
+
+// SnapshotHandle is the typed form of snapshot ID, which is source volume ID with share snapshot time as the last segment, e.g.
+// rg#f5713de20cde511e8ba4900#csivolumename#diskname#2019-08-22T07:17:53.0000000Z
+type SnapshotHandle struct {
+	VolumeHandle
+	Snapshot string
+}
+
+// ParseVolumeHandle decodes volume ID into VolumeHandle, all existing volume ID formats are supported
+func ParseVolumeHandle(id string) (*VolumeHandle, error) {
+	segments := strings.Split(id, separator)
+	if len(segments) < 3 {
+		return nil, fmt.Errorf("error parsing volume id: %q, should at least contain two #", id)
+	}
+	segment := func(i int) string {
+		if i < len(segments) {
+			return segments[i]
+		}
+		return ""
+	}
+
+	h := &VolumeHandle{
+		ResourceGroup: segment(rgIndex),
+		AccountName:   segment(accountNameIndex),
+		FileShareName: segment(fileShareNameIndex),
+		DiskName:      segment(diskNameIndex),
+		UUID:          segment(uuidIndex),
+	}
+	switch version := segment(versionIndex); version {
+	case volumeHandleV2, volumeHandleV3:
+		lastIndex := endpointSuffixIndex
+		if version == volumeHandleV3 {
+			lastIndex = subDirIndex
+		}
+		if len(segments) > lastIndex+1 {
+			return nil, fmt.Errorf("error parsing volume id: %q, should at most contain %d #", id, lastIndex)
+		}
+		h.SecretNamespace = segment(secretNamespaceIndex)
+		h.SubscriptionID = segment(subsIDIndex)
+		h.Protocol = segment(protocolIndex)
+		h.StorageEndpointSuffix = segment(endpointSuffixIndex)
+		h.SubDir = segment(subDirIndex)
+	default:
+		if h.ResourceGroup != "" {
+			h.SecretNamespace = segment(secretNamespaceIndex)
+			h.SubscriptionID = segment(subsIDIndex)
+			break
+		}
+		// in csi migration, rg could be empty, then the 5th element is namespace
+		// https://github.com/kubernetes/kubernetes/blob/v1.23.5/staging/src/k8s.io/csi-translation-lib/plugins/azure_file.go#L137
+		h.UUID = ""
+		h.SecretNamespace = segment(uuidIndex)
+	}
+	return h, nil
+}
+
+// String encodes VolumeHandle into volume ID,
+// versioned format is only used when optional fields are set or legacy format could not be parsed back
+func (h *VolumeHandle) String() string {
+	if h.isVersioned() {
+		segments := []string{h.ResourceGroup, h.AccountName, h.FileShareName, h.DiskName, h.UUID, h.SecretNamespace,
+			h.SubscriptionID, volumeHandleV2, h.Protocol, h.StorageEndpointSuffix}
+		if h.SubDir != "" {
+			segments[versionIndex] = volumeHandleV3
+			segments = append(segments, h.SubDir)
+		}
+		return strings.Join(segments, separator)
+	}
+	if h.ResourceGroup == "" && h.SecretNamespace != "" {
+		// csi migration format, the 5th element is namespace
+		return strings.Join([]string{h.ResourceGroup, h.AccountName, h.FileShareName, h.DiskName, h.SecretNamespace}, separator)
+	}
+	segments := []string{h.ResourceGroup, h.AccountName, h.FileShareName, h.DiskName, h.UUID, h.SecretNamespace}
+	if h.SubscriptionID != "" {
+		segments = append(segments, h.SubscriptionID)
+	}
+	return strings.Join(segments, separator)
+}
+
+// isVersioned returns true if VolumeHandle could not be encoded in legacy format
+func (h *VolumeHandle) isVersioned() bool {
+	if h.Protocol != "" || h.StorageEndpointSuffix != "" || h.SubDir != "" {
+		return true
+	}
+	// legacy format with empty resource group could only carry namespace
+	return h.ResourceGroup == "" && (h.UUID != "" || h.SubscriptionID != "")
+}
+
+// ParseSnapshotHandle decodes snapshot ID into SnapshotHandle
+func ParseSnapshotHandle(id string) (*SnapshotHandle, error) {
+	segments := strings.Split(id, separator)
+	if len(segments) < 5 {
+		return nil, fmt.Errorf("error parsing volume id: %q, should at least contain four #", id)
+	}
+	snapshot := segments[len(segments)-1]
+	if snapshot == "" {
+		return nil, fmt.Errorf("error parsing snapshot id: %q, snapshot is empty", id)
+	}
+	h, err := ParseVolumeHandle(strings.Join(segments[:len(segments)-1], separator))
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotHandle{VolumeHandle: *h, Snapshot: snapshot}, nil
+}
+
+// getSnapshotSourceVolumeID returns source volume ID in snapshot ID as is, which may differ from the one encoded by
+// VolumeHandle, e.g. legacy volume ID without trailing empty fields
+func getSnapshotSourceVolumeID(snapshotID string, h *SnapshotHandle) string {
+	return strings.TrimSuffix(snapshotID, separator+h.Snapshot)
+}
+
+// String encodes SnapshotHandle into snapshot ID
+func (h *SnapshotHandle) String() string {
+	return h.VolumeHandle.String() + separator + h.Snapshot
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseVolumeHandle(t *testing.T) {
+	tests := []struct {
+		id            string
+		expected      *VolumeHandle
+		expectedError error
+	}{
+		{
+			id: "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname1.vhd#1620118846",
+			expected: &VolumeHandle{
+				ResourceGroup: "rg",
+				AccountName:   "f5713de20cde511e8ba4900",
+				FileShareName: "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
+				DiskName:      "diskname1.vhd",
+				UUID:          "1620118846",
+			},
+		},
+		{
+			id: "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname1.vhd#1620118846#namespace",
+			expected: &VolumeHandle{
+				ResourceGroup:   "rg",
+				AccountName:     "f5713de20cde511e8ba4900",
+				FileShareName:   "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
+				DiskName:        "diskname1.vhd",
+				UUID:            "1620118846",
+				SecretNamespace: "namespace",
+			},
+		},
+		{
+			id: "#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname1.vhd#namespace",
+			expected: &VolumeHandle{
+				AccountName:     "f5713de20cde511e8ba4900",
+				FileShareName:   "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
+				DiskName:        "diskname1.vhd",
+				SecretNamespace: "namespace",
+			},
+		},
+		{
+			id: "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41#diskname2.vhd#",
+			expected: &VolumeHandle{
+				ResourceGroup: "rg",
+				AccountName:   "f5713de20cde511e8ba4900",
+				FileShareName: "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
+				DiskName:      "diskname2.vhd",
+			},
+		},
+		{
+			id: "rg#f5713de20cde511e8ba4900#pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
+			expected: &VolumeHandle{
+				ResourceGroup: "rg",
+				AccountName:   "f5713de20cde511e8ba4900",
+				FileShareName: "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
+			},
+		},
+		{
+			id:            "rg#f5713de20cde511e8ba4900",
+			expectedError: fmt.Errorf("error parsing volume id: \"rg#f5713de20cde511e8ba4900\", should at least contain two #"),
+		},
+		{
+			id:            "rg",
+			expectedError: fmt.Errorf("error parsing volume id: \"rg\", should at least contain two #"),
+		},
+		{
+			id:            "",
+			expectedError: fmt.Errorf("error parsing volume id: \"\", should at least contain two #"),
+		},
+		{
+			id: "rg#f5713de20cde511e8ba4900#fileShareName#diskname.vhd#uuid#namespace#subsID",
+			expected: &VolumeHandle{
+				ResourceGroup:   "rg",
+				AccountName:     "f5713de20cde511e8ba4900",
+				FileShareName:   "fileShareName",
+				DiskName:        "diskname.vhd",
+				UUID:            "uuid",
+				SecretNamespace: "namespace",
+				SubscriptionID:  "subsID",
+			},
+		},
+		{
+			id: "rg#f5713de20cde511e8ba4900#fileShareName###namespace##v2#nfs#core.chinacloudapi.cn",
+			expected: &VolumeHandle{
+				ResourceGroup:         "rg",
+				AccountName:           "f5713de20cde511e8ba4900",
+				FileShareName:         "fileShareName",
+				SecretNamespace:       "namespace",
+				Protocol:              "nfs",
+				StorageEndpointSuffix: "core.chinacloudapi.cn",
+			},
+		},
+		{
+			id: "#f5713de20cde511e8ba4900#fileShareName##uuid#namespace#subsID#v2##",
+			expected: &VolumeHandle{
+				AccountName:     "f5713de20cde511e8ba4900",
+				FileShareName:   "fileShareName",
+				UUID:            "uuid",
+				SecretNamespace: "namespace",
+				SubscriptionID:  "subsID",
+			},
+		},
+		{
+			id: "rg#f5713de20cde511e8ba4900#pool###namespace##v3###pvc-subdir",
+			expected: &VolumeHandle{
+				ResourceGroup:   "rg",
+				AccountName:     "f5713de20cde511e8ba4900",
+				FileShareName:   "pool",
+				SecretNamespace: "namespace",
+				SubDir:          "pvc-subdir",
+			},
+		},
+		{
+			id:            "rg#f5713de20cde511e8ba4900#fileShareName#####v2#nfs#suffix#subdir",
+			expectedError: fmt.Errorf("error parsing volume id: \"rg#f5713de20cde511e8ba4900#fileShareName#####v2#nfs#suffix#subdir\", should at most contain 9 #"),
+		},
+		{
+			id:            "rg#f5713de20cde511e8ba4900#fileShareName#####v3#nfs#suffix#subdir#extra",
+			expectedError: fmt.Errorf("error parsing volume id: \"rg#f5713de20cde511e8ba4900#fileShareName#####v3#nfs#suffix#subdir#extra\", should at most contain 10 #"),
+		},
+	}
+
+	for _, test := range tests {
+		h, err := ParseVolumeHandle(test.id)
+		if !reflect.DeepEqual(err, test.expectedError) {
+			t.Errorf("ParseVolumeHandle(%q) returned with error: %v, expected: %v", test.id, err, test.expectedError)
+		}
+		if !reflect.DeepEqual(h, test.expected) {
+			t.Errorf("ParseVolumeHandle(%q) returned with: %+v, expected: %+v", test.id, h, test.expected)
+		}
+	}
+}
+
+func TestVolumeHandleString(t *testing.T) {
+	tests := []struct {
+		handle   VolumeHandle
+		expected string
+	}{
+		{
+			handle:   VolumeHandle{ResourceGroup: "rg", AccountName: "account", FileShareName: "share"},
+			expected: "rg#account#share###",
+		},
+		{
+			handle:   VolumeHandle{ResourceGroup: "rg", AccountName: "account", FileShareName: "share", DiskName: "disk.vhd", UUID: "uuid", SecretNamespace: "namespace"},
+			expected: "rg#account#share#disk.vhd#uuid#namespace",
+		},
+		{
+			handle:   VolumeHandle{ResourceGroup: "rg", AccountName: "account", FileShareName: "share", SecretNamespace: "namespace", SubscriptionID: "subsID"},
+			expected: "rg#account#share###namespace#subsID",
+		},
+		{
+			handle:   VolumeHandle{AccountName: "account", FileShareName: "share", SecretNamespace: "namespace"},
+			expected: "#account#share##namespace",
+		},
+		{
+			handle:   VolumeHandle{AccountName: "account", FileShareName: "share", UUID: "uuid", SecretNamespace: "namespace"},
+			expected: "#account#share##uuid#namespace##v2##",
+		},
+		{
+			handle:   VolumeHandle{ResourceGroup: "rg", AccountName: "account", FileShareName: "share", SecretNamespace: "namespace", Protocol: "nfs"},
+			expected: "rg#account#share###namespace##v2#nfs#",
+		},
+		{
+			handle:   VolumeHandle{ResourceGroup: "rg", AccountName: "account", FileShareName: "pool", SecretNamespace: "namespace", SubDir: "pvc-subdir"},
+			expected: "rg#account#pool###namespace##v3###pvc-subdir",
+		},
+	}
+
+	for _, test := range tests {
+		id := test.handle.String()
+		if id != test.expected {
+			t.Errorf("String() of %+v returned with: %q, expected: %q", test.handle, id, test.expected)
+		}
+		h, err := ParseVolumeHandle(id)
+		if err != nil {
+			t.Errorf("ParseVolumeHandle(%q) returned with error: %v", id, err)
+		} else if *h != test.handle {
+			t.Errorf("ParseVolumeHandle(%q) returned with: %+v, expected: %+v", id, *h, test.handle)
+		}
+	}
+}
+
+func TestParseSnapshotHandle(t *testing.T) {
+	tests := []struct {
+		id            string
+		expected      *SnapshotHandle
+		expectedError error
+	}{
+		{
+			id: "rg#f123#csivolumename#diskname#2019-08-22T07:17:53.0000000Z",
+			expected: &SnapshotHandle{
+				VolumeHandle: VolumeHandle{ResourceGroup: "rg", AccountName: "f123", FileShareName: "csivolumename", DiskName: "diskname"},
+				Snapshot:     "2019-08-22T07:17:53.0000000Z",
+			},
+		},
+		{
+			id: "rg#f123#csivolumename#diskname#uuid#default#2021-08-22T07:17:53.0000000Z",
+			expected: &SnapshotHandle{
+				VolumeHandle: VolumeHandle{ResourceGroup: "rg", AccountName: "f123", FileShareName: "csivolumename", DiskName: "diskname", UUID: "uuid", SecretNamespace: "default"},
+				Snapshot:     "2021-08-22T07:17:53.0000000Z",
+			},
+		},
+		{
+			id: "rg#f123#csivolumename#diskname#uuid#default#subsID#2021-08-22T07:17:53.0000000Z",
+			expected: &SnapshotHandle{
+				VolumeHandle: VolumeHandle{ResourceGroup: "rg", AccountName: "f123", FileShareName: "csivolumename", DiskName: "diskname", UUID: "uuid", SecretNamespace: "default", SubscriptionID: "subsID"},
+				Snapshot:     "2021-08-22T07:17:53.0000000Z",
+			},
+		},
+		{
+			id: "rg#f123#csivolumename#####v2##core.chinacloudapi.cn#2021-08-22T07:17:53.0000000Z",
+			expected: &SnapshotHandle{
+				VolumeHandle: VolumeHandle{ResourceGroup: "rg", AccountName: "f123", FileShareName: "csivolumename", StorageEndpointSuffix: "core.chinacloudapi.cn"},
+				Snapshot:     "2021-08-22T07:17:53.0000000Z",
+			},
+		},
+		{
+			id:            "rg#f123#csivolumename#diskname#",
+			expectedError: fmt.Errorf("error parsing snapshot id: \"rg#f123#csivolumename#diskname#\", snapshot is empty"),
+		},
+		{
+			id:            "rg#f123#csivolumename",
+			expectedError: fmt.Errorf("error parsing volume id: \"rg#f123#csivolumename\", should at least contain four #"),
+		},
+		{
+			id:            "",
+			expectedError: fmt.Errorf("error parsing volume id: \"\", should at least contain four #"),
+		},
+	}
+
+	for _, test := range tests {
+		h, err := ParseSnapshotHandle(test.id)
+		if !reflect.DeepEqual(err, test.expectedError) {
+			t.Errorf("ParseSnapshotHandle(%q) returned with error: %v, expected: %v", test.id, err, test.expectedError)
+		}
+		if !reflect.DeepEqual(h, test.expected) {
+			t.Errorf("ParseSnapshotHandle(%q) returned with: %+v, expected: %+v", test.id, h, test.expected)
+		}
+	}
+}
+
+func TestGetSnapshotSourceVolumeID(t *testing.T) {
+	snapshot := "2019-08-22T07:17:53.0000000Z"
+	// legacy volume IDs without trailing empty fields are not re-encoded into snapshot ID
+	for _, sourceVolumeID := range []string{
+		"rg#f123#csivolumename#diskname",
+		"rg#f123#csivolumename#diskname#uuid",
+		"rg#f123#csivolumename###",
+		"rg#f123#csivolumename#####v2##core.chinacloudapi.cn",
+	} {
+		snapshotID := sourceVolumeID + separator + snapshot
+		h, err := ParseSnapshotHandle(snapshotID)
+		if err != nil {
+			t.Errorf("ParseSnapshotHandle(%q) returned with error: %v", snapshotID, err)
+			continue
+		}
+		if id := getSnapshotSourceVolumeID(snapshotID, h); id != sourceVolumeID {
+			t.Errorf("getSnapshotSourceVolumeID(%q) returned with: %q, expected: %q", snapshotID, id, sourceVolumeID)
+		}
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"sigs.k8s.io/azurefile-csi-driver/pkg/azurefile"
 
@@ -52,6 +53,31 @@ var (
 	allowInlineVolumeKeyAccessWithIdentity = flag.Bool("allow-inline-volume-key-access-with-identity", false, "allow accessing storage account key using cluster identity for inline volume")
 	fsGroupChangePolicy                    = flag.String("fsgroup-change-policy", "", "indicates how the volume's ownership will be changed by the driver, OnRootMismatch is the default value")
 	enableVHDDiskFeature                   = flag.Bool("enable-vhd", true, "enable VHD disk feature (experimental)")
+	clusterName                            = flag.String("cluster-name", "", "name of the cluster which is set in metadata of file share created by driver")
+	enableShareOwnershipCheck              = flag.Bool("enable-share-ownership-check", false, "refuse to delete file share which was not created by driver in this cluster according to its metadata")
+	quarantineDeletedShares                = flag.Bool("quarantine-deleted-shares", false, "quarantine file share instead of deleting it when volume is deleted")
+	quarantineGracePeriod                  = flag.Duration("quarantine-grace-period", 72*time.Hour, "grace period after which quarantined file shares are deleted by controller, 0 means quarantined file shares are never deleted")
+	enableQuarantinedShareMountCheck       = flag.Bool("enable-quarantined-share-mount-check", true, "refuse to mount quarantined file share on agent node")
+	accountSelectionConfigMapName          = flag.String("account-selection-configmap-name", "azurefile-csi-account-selection", "name of ConfigMap in which storage account selected for volume is persisted across controller restarts, empty string disables it")
+	accountSelectionConfigMapNamespace     = flag.String("account-selection-configmap-namespace", "kube-system", "namespace of ConfigMap in which storage account selected for volume is persisted")
+	subscriptionAPIQPS                     = flag.Float64("subscription-api-qps", 0, "QPS of management API calls per subscription issued by driver, 0 means no limit")
+	subscriptionAPIBurst                   = flag.Int("subscription-api-burst", 10, "burst of management API calls per subscription issued by driver")
+	accountAPIQPS                          = flag.Float64("account-api-qps", 0, "QPS of data plane API calls per storage account issued by driver, 0 means no limit")
+	accountAPIBurst                        = flag.Int("account-api-burst", 50, "burst of data plane API calls per storage account issued by driver")
+	throttleMaxWait                        = flag.Duration("throttle-max-wait", 5*time.Second, "max time an API call waits for throttle limiter, the request fails with ResourceExhausted if it could not be issued in time")
+	dataPlaneMaxTries                      = flag.Int("data-plane-max-tries", 3, "max number of tries of a data plane API call, 1 means no retry")
+	dataPlaneTryTimeout                    = flag.Duration("data-plane-try-timeout", 30*time.Second, "timeout of each try of a data plane API call")
+	dataPlaneRetryDelay                    = flag.Duration("data-plane-retry-delay", time.Second, "initial delay before retrying a data plane API call, the delay increases exponentially")
+	dataPlaneMaxRetryDelay                 = flag.Duration("data-plane-max-retry-delay", 10*time.Second, "max delay before retrying a data plane API call")
+	dataPlaneProxyURL                      = flag.String("data-plane-proxy-url", "", "proxy of data plane API calls, proxy in HTTPS_PROXY environment variable is used if empty")
+	dataPlaneCACertFile                    = flag.String("data-plane-ca-cert-file", "", "PEM file of CA certificates trusted by data plane API calls in addition to system CA certificates")
+	staleVHDAttachmentReconcileInterval    = flag.Duration("stale-vhd-attachment-reconcile-interval", 10*time.Minute, "interval of clearing attachments of vhd disks to deleted nodes by controller, 0 disables it")
+	accountKeySyncInterval                 = flag.Duration("account-key-sync-interval", 10*time.Minute, "interval of syncing storage account keys into account key secrets created by driver, 0 disables it")
+	accountKeyRotationInterval             = flag.Duration("account-key-rotation-interval", 0, "interval of regenerating storage account keys used by account key secrets created by driver, 0 disables it")
+	stagedMountCheckInterval               = flag.Duration("staged-mount-check-interval", time.Minute, "interval of checking staged smb mounts and remounting them with refreshed account key on authentication failure, 0 disables it")
+	credentialFilePathTemplate             = flag.String("credential-file-path-template", "", "path template of files storing account keys read by file credential provider, ${account.name} and ${namespace} are replaced by storage account name and secret namespace")
+	accountKeySecretGCInterval             = flag.Duration("account-key-secret-gc-interval", 0, "interval of deleting account key secrets created by driver which are not referenced by any pv in the namespace, 0 disables it")
+	leaderElectionNamespace                = flag.String("leader-election-namespace", "kube-system", "namespace of the lease which makes sure only one controller replica runs background tasks")
 )
 
 func main() {
@@ -89,6 +115,31 @@ func handle() {
 		AllowInlineVolumeKeyAccessWithIdentity: *allowInlineVolumeKeyAccessWithIdentity,
 		FSGroupChangePolicy:                    *fsGroupChangePolicy,
 		EnableVHDDiskFeature:                   *enableVHDDiskFeature,
+		ClusterName:                            *clusterName,
+		EnableShareOwnershipCheck:              *enableShareOwnershipCheck,
+		QuarantineDeletedShares:                *quarantineDeletedShares,
+		QuarantineGracePeriod:                  *quarantineGracePeriod,
+		EnableQuarantinedShareMountCheck:       *enableQuarantinedShareMountCheck,
+		StaleVHDAttachmentReconcileInterval:    *staleVHDAttachmentReconcileInterval,
+		AccountSelectionConfigMapName:          *accountSelectionConfigMapName,
+		AccountSelectionConfigMapNamespace:     *accountSelectionConfigMapNamespace,
+		SubscriptionAPIQPS:                     *subscriptionAPIQPS,
+		SubscriptionAPIBurst:                   *subscriptionAPIBurst,
+		AccountAPIQPS:                          *accountAPIQPS,
+		AccountAPIBurst:                        *accountAPIBurst,
+		ThrottleMaxWait:                        *throttleMaxWait,
+		DataPlaneMaxTries:                      *dataPlaneMaxTries,
+		DataPlaneTryTimeout:                    *dataPlaneTryTimeout,
+		DataPlaneRetryDelay:                    *dataPlaneRetryDelay,
+		DataPlaneMaxRetryDelay:                 *dataPlaneMaxRetryDelay,
+		DataPlaneProxyURL:                      *dataPlaneProxyURL,
+		DataPlaneCACertFile:                    *dataPlaneCACertFile,
+		AccountKeySyncInterval:                 *accountKeySyncInterval,
+		AccountKeyRotationInterval:             *accountKeyRotationInterval,
+		StagedMountCheckInterval:               *stagedMountCheckInterval,
+		CredentialFilePathTemplate:             *credentialFilePathTemplate,
+		AccountKeySecretGCInterval:             *accountKeySecretGCInterval,
+		LeaderElectionNamespace:                *leaderElectionNamespace,
 	}
 	driver := azurefile.NewDriver(&driverOptions)
 	if driver == nil {
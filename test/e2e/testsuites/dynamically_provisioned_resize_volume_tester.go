@@ -124,8 +124,9 @@ func (t *DynamicallyProvisionedResizeVolumeTest) Run(client clientset.Interface,
 		var accountName string
 		var shareName string
 		if newPv.Spec.PersistentVolumeSource.CSI != nil {
-			resourceGroup, accountName, shareName, _, _, _, err = azurefile.GetFileShareInfo(newPv.Spec.PersistentVolumeSource.CSI.VolumeHandle)
+			h, err := azurefile.ParseVolumeHandle(newPv.Spec.PersistentVolumeSource.CSI.VolumeHandle)
 			framework.ExpectNoError(err, fmt.Sprintf("Error getting filesource for azurefile %v", err))
+			resourceGroup, accountName, shareName = h.ResourceGroup, h.AccountName, h.FileShareName
 		} else if newPv.Spec.PersistentVolumeSource.AzureFile != nil {
 			resourceGroup = creds.ResourceGroup
 			azureSource := newPv.Spec.PersistentVolumeSource.AzureFile
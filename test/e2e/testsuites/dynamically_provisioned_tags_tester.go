@@ -55,8 +55,9 @@ func (t *DynamicallyProvisionedAccountWithTags) Run(client clientset.Interface,
 		framework.ExpectNoError(err, fmt.Sprintf("failed to get pv(%s): %v", pvName, err))
 
 		volumeID := pv.Spec.PersistentVolumeSource.CSI.VolumeHandle
-		resourceGroupName, accountName, _, _, _, _, err := azurefile.GetFileShareInfo(volumeID)
+		h, err := azurefile.ParseVolumeHandle(volumeID)
 		framework.ExpectNoError(err, fmt.Sprintf("failed to get fileShare(%s) info: %v", volumeID, err))
+		resourceGroupName, accountName := h.ResourceGroup, h.AccountName
 
 		creds, err := credentials.CreateAzureCredentialFile(false)
 		gomega.Expect(err).NotTo(gomega.HaveOccurred())
@@ -41,17 +41,17 @@ type PreProvisionedProvidedCredentiasTest struct {
 func (t *PreProvisionedProvidedCredentiasTest) Run(client clientset.Interface, namespace *v1.Namespace) {
 	for _, pod := range t.Pods {
 		for n, volume := range pod.Volumes {
-			_, accountName, accountKey, fileShareName, _, _, err := t.Azurefile.GetAccountInfo(context.Background(), volume.VolumeID, nil, nil)
+			h, accountKey, err := t.Azurefile.GetAccountInfo(context.Background(), volume.VolumeID, nil, nil)
 			framework.ExpectNoError(err, fmt.Sprintf("Error GetAccountInfo from volumeID(%s): %v", volume.VolumeID, err))
 
 			ginkgo.By("creating the secret")
-			secreteData := map[string]string{"azurestorageaccountname": accountName}
+			secreteData := map[string]string{"azurestorageaccountname": h.AccountName}
 			secreteData["azurestorageaccountkey"] = accountKey
 			tsecret := NewTestSecret(client, namespace, volume.NodeStageSecretRef, secreteData)
 			tsecret.Create()
 			defer tsecret.Cleanup()
 
-			pod.Volumes[n].ShareName = fileShareName
+			pod.Volumes[n].ShareName = h.FileShareName
 			tpod, cleanup := pod.SetupWithPreProvisionedVolumes(client, namespace, t.CSIDriver)
 			// defer must be called here for resources not get removed before using them
 			for i := range cleanup {